@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/viper"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+// Settings for connecting to Sync Gateway, shared by every command.  Each
+// can be a flag, an environment variable (eg SG_USERNAME) or a key in the
+// config file (eg sg_username).
+var connectionFlags = []struct {
+	name  string
+	key   string
+	usage string
+}{
+	{"sg-username", "sg_username", "Sync Gateway user, sent with basic auth"},
+	{"sg-password", "sg_password", "Password for --sg-username"},
+	{"sg-session", "sg_session", "Sync Gateway session id, instead of a username and password"},
+	{"sg-ca-cert", "sg_ca_cert", "PEM bundle of CAs to trust for Sync Gateway, instead of the system ones"},
+	{"sg-client-cert", "sg_client_cert", "PEM client certificate for mutual TLS with Sync Gateway"},
+	{"sg-client-key", "sg_client_key", "PEM key for --sg-client-cert"},
+}
+
+func init() {
+
+	flags := RootCmd.PersistentFlags()
+	for _, connectionFlag := range connectionFlags {
+		flags.String(connectionFlag.name, "", connectionFlag.usage)
+		viper.BindPFlag(connectionFlag.key, flags.Lookup(connectionFlag.name))
+	}
+
+	flags.Bool("sg-insecure-skip-verify", false, "Don't verify Sync Gateway's TLS certificate (test servers only)")
+	viper.BindPFlag("sg_insecure_skip_verify", flags.Lookup("sg-insecure-skip-verify"))
+
+	flags.String("db-flavor", deepstylelib.FlavorSyncGateway, "What --url points at: sync_gw, or couchdb for Apache CouchDB 2.x/3.x")
+	viper.BindPFlag("db_flavor", flags.Lookup("db-flavor"))
+
+	flags.Duration("sg-timeout", deepstylelib.DefaultHTTPTimeout, "Timeout for uploads and other requests to Sync Gateway (not the changes feed)")
+	viper.BindPFlag("sg_timeout", flags.Lookup("sg-timeout"))
+
+}
+
+// configureConnection applies the connection settings, once flags and the
+// config file have been read
+func configureConnection() {
+
+	config := deepstylelib.ConnectionConfig{
+		Timeout:            viper.GetDuration("sg_timeout"),
+		Flavor:             viper.GetString("db_flavor"),
+		Username:           viper.GetString("sg_username"),
+		Password:           viper.GetString("sg_password"),
+		SessionId:          viper.GetString("sg_session"),
+		CACertFile:         viper.GetString("sg_ca_cert"),
+		ClientCertFile:     viper.GetString("sg_client_cert"),
+		ClientKeyFile:      viper.GetString("sg_client_key"),
+		InsecureSkipVerify: viper.GetBool("sg_insecure_skip_verify"),
+	}
+	if config.InsecureSkipVerify {
+		log.Printf("WARNING: not verifying Sync Gateway's TLS certificate")
+	}
+
+	if err := deepstylelib.ConfigureConnection(config); err != nil {
+		log.Panicf("Invalid Sync Gateway connection settings: %v", err)
+	}
+
+}
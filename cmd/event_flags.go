@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+// eventFlags configure the webhooks that get job state transitions
+type eventFlags struct {
+	webhooks  []string
+	secret    string
+	outboxDir string
+}
+
+// addEventFlags adds the flags for job event webhooks.  Workers and the
+// reaper both need them, since both move jobs between states.
+func addEventFlags(flags *pflag.FlagSet, events *eventFlags) {
+
+	flags.StringSliceVar(&events.webhooks, "event-webhooks", []string{}, "URLs to POST a signed event to on every job state transition")
+
+	flags.StringVar(&events.secret, "event-webhook-secret", "", "Secret to sign events with (or EVENT_WEBHOOK_SECRET / event_webhook_secret in the config file)")
+
+	flags.StringVar(&events.outboxDir, "event-outbox", deepstylelib.DefaultEventOutboxDir, "Directory where events wait to be delivered.  Each worker needs its own")
+
+}
+
+// newEventOutbox returns the outbox for the configured webhooks, or nil if
+// there aren't any
+func (events eventFlags) newEventOutbox() *deepstylelib.EventOutbox {
+
+	if len(events.webhooks) == 0 {
+		return nil
+	}
+
+	secret := events.secret
+	if secret == "" {
+		secret = viper.GetString("event_webhook_secret")
+	}
+
+	subscriptions := []deepstylelib.WebhookSubscription{}
+	for _, webhook := range events.webhooks {
+		subscriptions = append(subscriptions, deepstylelib.WebhookSubscription{
+			URL:    webhook,
+			Secret: secret,
+		})
+	}
+
+	outbox, err := deepstylelib.NewEventOutbox(events.outboxDir, subscriptions)
+	if err != nil {
+		log.Panicf("%v", err)
+	}
+	return outbox
+
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spf13/pflag"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+// executorFlags configure the style transfer backend that processes jobs
+type executorFlags struct {
+	name   string
+	config deepstylelib.ExecutorConfig
+}
+
+// addExecutorFlags adds the flags that choose and configure the executor
+func addExecutorFlags(flags *pflag.FlagSet, executor *executorFlags) {
+
+	flags.StringVar(&executor.name, "executor", deepstylelib.ExecutorNeuralStyle, fmt.Sprintf("Style transfer backend, one of %v", deepstylelib.ExecutorNames()))
+
+	flags.StringVar(&executor.config.Command, "executor-command", "", "Binary for the command executor (or override th for neural_style)")
+
+	flags.StringSliceVar(&executor.config.Args, "executor-args", []string{}, "Templated args for the command executor, eg: -in,{{.SourceImagePath}},-style,{{.StyleImagePath}},-out,{{.OutputFilePath}}")
+
+	flags.StringVar(&executor.config.WorkDir, "executor-workdir", "", "Working directory for the executor (defaults to /home/ubuntu/neural-style for neural_style)")
+
+	flags.DurationVar(&executor.config.Timeout, "executor-timeout", 0, "Kill jobs that run longer than this, keeping the newest intermediate result (0 for no limit)")
+
+}
+
+// newExecutor returns the configured executor
+func (executor executorFlags) newExecutor() deepstylelib.Executor {
+	newExecutor, err := deepstylelib.NewExecutor(executor.name, executor.config)
+	if err != nil {
+		log.Panicf("%v", err)
+	}
+	return newExecutor
+}
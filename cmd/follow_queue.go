@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+var (
+	brokerRedisAddr        *string
+	brokerStream           *string
+	brokerGroup            *string
+	brokerConsumer         *string
+	brokerDeadLetterStream *string
+	brokerClaimIdle        *time.Duration
+	brokerBlobURL          *string
+	brokerWorkerId         *string
+	brokerLeaseDuration    *time.Duration
+	brokerProgressInterval *time.Duration
+	brokerSnapshotInterval *time.Duration
+	brokerExecutor         executorFlags
+	brokerRetryPolicy      = deepstylelib.DefaultRetryPolicy()
+	brokerDeliveryPolicy   = deepstylelib.DefaultDeliveryPolicy()
+	brokerEvents           eventFlags
+	brokerMetrics          metricsFlags
+)
+
+// follow_queueCmd runs jobs published to a Redis stream
+var follow_queueCmd = &cobra.Command{
+	Use:   "follow_queue",
+	Short: "Run jobs that other services publish to a Redis stream",
+	Long:  `Reads job messages from --stream with the consumer group --group, eg XADD deepstyle_jobs * job '{"job_id": "cat", "source_image": "https://example.com/cat.jpg", "style_image": "styles/starry_night.jpg"}', where images are urls or keys under --blob-url.  Each becomes a job in the database at --url, with the result as its result_image attachment, and the message is acked once the job succeeds.  Jobs that fail are dead-lettered to --dead-letter-stream`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if err := cmd.ParseFlags(args); err != nil {
+			log.Printf("err: %v", err)
+			return
+		}
+
+		urlFlag := cmd.Flag("url")
+		urlVal := urlFlag.Value.String()
+		if urlVal == "" {
+			log.Printf("ERROR: Missing: --url.\n  %v", cmd.UsageString())
+			return
+		}
+
+		// the consumer name has to survive restarts, so the messages we
+		// were running when we died come back to us
+		consumer := *brokerConsumer
+		if consumer == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				log.Panicf("Unable to get hostname for --consumer: %v", err)
+			}
+			consumer = hostname
+		}
+		queue := deepstylelib.NewRedisStreamQueue(*brokerRedisAddr, *brokerStream, *brokerGroup, consumer)
+		queue.Password = viper.GetString("redis_password")
+		if *brokerDeadLetterStream != "" {
+			queue.DeadLetterStream = *brokerDeadLetterStream
+		}
+		queue.ClaimIdle = *brokerClaimIdle
+		defer queue.Close()
+
+		source, err := deepstylelib.NewQueueJobSource(queue, urlVal)
+		if err != nil {
+			log.Panicf("%v", err)
+		}
+
+		source.Executor = brokerExecutor.newExecutor()
+		source.ExecutorName = brokerExecutor.name
+		if *brokerWorkerId != "" {
+			source.WorkerId = *brokerWorkerId
+		}
+		source.LeaseDuration = *brokerLeaseDuration
+		source.RetryPolicy = brokerRetryPolicy
+		source.DeliveryPolicy = brokerDeliveryPolicy
+		source.ProgressInterval = *brokerProgressInterval
+		source.SnapshotInterval = *brokerSnapshotInterval
+		source.BlobURL = *brokerBlobURL
+		source.Events = brokerEvents.newEventOutbox()
+		source.Metrics = brokerMetrics.newMetricsSink()
+		if source.Metrics != nil {
+			stopFlushing := deepstylelib.StartFlushing(source.Metrics, brokerMetrics.flushInterval)
+			defer stopFlushing()
+		}
+
+		log.Printf("Following %v on redis %v as %v/%v", *brokerStream, *brokerRedisAddr, *brokerGroup, consumer)
+		source.Follow()
+
+	},
+}
+
+func init() {
+
+	RootCmd.AddCommand(follow_queueCmd)
+
+	flags := follow_queueCmd.PersistentFlags()
+
+	flags.String("url", "", "Sync Gateway URL, where the jobs are kept")
+
+	brokerRedisAddr = flags.String("redis-addr", "localhost:6379", "Redis host:port")
+
+	flags.String("redis-password", "", "Redis password, if it needs AUTH")
+	viper.BindPFlag("redis_password", flags.Lookup("redis-password"))
+
+	brokerStream = flags.String("stream", "deepstyle_jobs", "Redis stream jobs are published to")
+
+	brokerGroup = flags.String("group", "deepstyle_workers", "Consumer group shared by the workers, created if needed")
+
+	brokerConsumer = flags.String("consumer", "", "This worker's name in the group, must be the same across restarts (defaults to the hostname)")
+
+	brokerDeadLetterStream = flags.String("dead-letter-stream", "", "Where messages whose jobs failed go (defaults to <stream>:dead)")
+
+	brokerClaimIdle = flags.Duration("claim-idle", deepstylelib.DefaultRedisClaimIdle, "How long a message can be pending with another consumer, eg one that died, before this one takes it over (should be longer than --lease-duration)")
+
+	brokerBlobURL = flags.String("blob-url", "", "Base url images given as keys are downloaded from, eg https://bucket.s3.amazonaws.com")
+
+	brokerWorkerId = flags.String("worker-id", "", "Worker id recorded on claimed jobs (defaults to hostname:pid)")
+
+	brokerLeaseDuration = flags.Duration("lease-duration", deepstylelib.DefaultLeaseDuration, "How long a claim on a job lasts, renewed every third of this while the job runs")
+
+	brokerProgressInterval = flags.Duration("progress-interval", deepstylelib.DefaultProgressInterval, "How often running jobs save their progress on the job doc (0 to never)")
+
+	brokerSnapshotInterval = flags.Duration("snapshot-interval", deepstylelib.DefaultSnapshotInterval, "How often jobs with timelapse enabled upload their newest snapshot")
+
+	flags.IntVar(&brokerDeliveryPolicy.MaxAttempts, "max-deliveries", deepstylelib.DefaultMaxMessageDeliveries, "How many times a message that can't be turned into a job, eg because an image won't download, is tried before it's dead-lettered")
+
+	addExecutorFlags(flags, &brokerExecutor)
+
+	addRetryPolicyFlags(flags, &brokerRetryPolicy)
+
+	addEventFlags(flags, &brokerEvents)
+
+	addMetricsFlags(flags, &brokerMetrics, deepstylelib.MetricsSinkNone)
+
+}
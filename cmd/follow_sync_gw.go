@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"log"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/tleyden/deepstyle/deepstylelib"
@@ -11,6 +12,20 @@ var (
 	processJobs       *bool
 	sendNotifications *bool
 	since             *string
+	checkpointBackend *string
+	checkpointPath    *string
+	workerExecutor    executorFlags
+	workerPool        *bool
+	numJobWorkers     *int
+	numNotifyWorkers  *int
+	workerId          *string
+	leaseDuration     *time.Duration
+	progressInterval  *time.Duration
+	notifyProgress    *bool
+	snapshotInterval  *time.Duration
+	retryPolicy       = deepstylelib.DefaultRetryPolicy()
+	workerEvents      eventFlags
+	workerMetrics     metricsFlags
 )
 
 var follow_sync_gwCmd = &cobra.Command{
@@ -35,11 +50,6 @@ var follow_sync_gwCmd = &cobra.Command{
 			return
 		}
 
-		// Uniqush URL
-		uniqushUrlFlag := cmd.Flag("uniqush-url")
-		uniqushUrlVal := uniqushUrlFlag.Value.String()
-		log.Printf("uniqush url val: %v", uniqushUrlVal)
-
 		shouldProcessJobs := *processJobs
 		shouldSendNotifications := *sendNotifications
 
@@ -47,22 +57,55 @@ var follow_sync_gwCmd = &cobra.Command{
 			log.Panicf("You need to either set the --process-jobs or --send-notifications flag, otherwise there is nothing to do!")
 		}
 
-		if shouldSendNotifications && uniqushUrlVal == "" {
-			log.Panicf("You must pass a --uniqush-url to send notifications")
-		}
-
 		// Create Changes follower
 		changesFollower, err := deepstylelib.NewChangesFeedFollower(*since, urlVal)
 		if err != nil {
 			log.Panicf("%v", err)
 		}
 
+		// Where to record the last processed sequence
+		checkpoint, err := deepstylelib.NewCheckpointStore(
+			*checkpointBackend,
+			*checkpointPath,
+			changesFollower.Database,
+		)
+		if err != nil {
+			log.Panicf("%v", err)
+		}
+		changesFollower.Checkpoint = checkpoint
+
+		// Style transfer backend used to process jobs
+		if shouldProcessJobs {
+			changesFollower.Executor = workerExecutor.newExecutor()
+			changesFollower.ExecutorName = workerExecutor.name
+		}
+
+		if *workerId != "" {
+			changesFollower.WorkerId = *workerId
+		}
+
+		changesFollower.LeaseDuration = *leaseDuration
+		changesFollower.RetryPolicy = retryPolicy
+		changesFollower.ProgressInterval = *progressInterval
+		changesFollower.NotifyProgress = *notifyProgress
+		changesFollower.SnapshotInterval = *snapshotInterval
+		changesFollower.Events = workerEvents.newEventOutbox()
+		changesFollower.Metrics = workerMetrics.newMetricsSink()
+		if changesFollower.Metrics != nil {
+			stopFlushing := deepstylelib.StartFlushing(changesFollower.Metrics, workerMetrics.flushInterval)
+			defer stopFlushing()
+		}
+
+		changesFollower.WorkerPool = *workerPool
+		changesFollower.NumJobWorkers = *numJobWorkers
+		changesFollower.NumNotificationWorkers = *numNotifyWorkers
+
 		changesFollower.ProcessJobs = shouldProcessJobs
 		changesFollower.SendNotifications = shouldSendNotifications
 
-		// Set uniqush url if one was passed in
-		if uniqushUrlVal != "" {
-			changesFollower.UniqushURL = uniqushUrlVal
+		// Where to send notifications
+		if shouldSendNotifications {
+			changesFollower.Notifier = newNotifier()
 		}
 
 		// Start following changes
@@ -81,13 +124,40 @@ func init() {
 	follow_sync_gwCmd.PersistentFlags().String("url", "", "Sync Gateway URL")
 	follow_sync_gwCmd.MarkPersistentFlagRequired("url")
 
-	follow_sync_gwCmd.PersistentFlags().String("uniqush-url", "", "Uniqush URL (push notifications)")
-
 	processJobs = follow_sync_gwCmd.PersistentFlags().BoolP("process-jobs", "p", false, "Process DeepStyle jobs (requires deps + GPU)")
 
-	sendNotifications = follow_sync_gwCmd.Flags().BoolP("send-notifications", "s", false, "Send push notifications (requires Uniqush url)")
+	sendNotifications = follow_sync_gwCmd.Flags().BoolP("send-notifications", "s", false, "Notify job owners when jobs are done (see --notifiers)")
+	addNotifierFlags(follow_sync_gwCmd.PersistentFlags())
+
+	since = follow_sync_gwCmd.PersistentFlags().String("since", "", "Since value to start changes feed at (defaults to saved checkpoint, then last sequence)")
+
+	checkpointBackend = follow_sync_gwCmd.PersistentFlags().String("checkpoint-backend", deepstylelib.CheckpointBackendFile, "Where to save the last processed sequence: file or sync_gw (a _local doc)")
+
+	checkpointPath = follow_sync_gwCmd.PersistentFlags().String("checkpoint-location", "", "Checkpoint file path, or _local doc id for sync_gw (defaults to lastprocessed.db / deepstyle_checkpoint)")
+
+	addExecutorFlags(follow_sync_gwCmd.PersistentFlags(), &workerExecutor)
+
+	workerPool = follow_sync_gwCmd.PersistentFlags().BoolP("worker-pool", "w", false, "Process jobs and notifications concurrently on pools of workers")
+
+	numJobWorkers = follow_sync_gwCmd.PersistentFlags().Int("job-workers", 0, "Number of job workers in --worker-pool mode (defaults to one per GPU)")
+
+	numNotifyWorkers = follow_sync_gwCmd.PersistentFlags().Int("notification-workers", deepstylelib.DefaultNumNotificationWorkers, "Number of notification workers in --worker-pool mode")
+
+	workerId = follow_sync_gwCmd.PersistentFlags().String("worker-id", "", "Worker id recorded on claimed jobs (defaults to hostname:pid)")
+
+	leaseDuration = follow_sync_gwCmd.PersistentFlags().Duration("lease-duration", deepstylelib.DefaultLeaseDuration, "How long a claim on a job lasts, renewed every third of this while the job runs")
+
+	addRetryPolicyFlags(follow_sync_gwCmd.PersistentFlags(), &retryPolicy)
+
+	addEventFlags(follow_sync_gwCmd.PersistentFlags(), &workerEvents)
+
+	addMetricsFlags(follow_sync_gwCmd.PersistentFlags(), &workerMetrics, deepstylelib.MetricsSinkNone)
+
+	progressInterval = follow_sync_gwCmd.PersistentFlags().Duration("progress-interval", deepstylelib.DefaultProgressInterval, "How often running jobs save their progress on the job doc (0 to never)")
+
+	notifyProgress = follow_sync_gwCmd.PersistentFlags().Bool("notify-progress", false, "Also notify owners as jobs progress, not just when they finish")
 
-	since = follow_sync_gwCmd.PersistentFlags().String("since", "", "Since value to start changes feed at (defaults to last sequence)")
+	snapshotInterval = follow_sync_gwCmd.PersistentFlags().Duration("snapshot-interval", deepstylelib.DefaultSnapshotInterval, "How often jobs with timelapse enabled upload their newest snapshot")
 
 	// Cobra supports local flags which will only run when this command is called directly
 	// follow_sync_gwCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle" )
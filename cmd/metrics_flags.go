@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+// metricsFlags configure where metrics are sent
+type metricsFlags struct {
+	sink          string
+	config        deepstylelib.MetricsConfig
+	flushInterval time.Duration
+	dimensions    []string // Name=Value
+}
+
+// addMetricsFlags adds the flags for the metrics sink, defaulting to
+// defaultSink
+func addMetricsFlags(flags *pflag.FlagSet, metrics *metricsFlags, defaultSink string) {
+
+	sinks := []string{deepstylelib.MetricsSinkNone, deepstylelib.MetricsSinkCloudWatch, deepstylelib.MetricsSinkPrometheus}
+	flags.StringVar(&metrics.sink, "metrics-sink", defaultSink, fmt.Sprintf("Where to send metrics, one of %v", sinks))
+
+	flags.StringVar(&metrics.config.PrometheusAddr, "metrics-addr", ":9102", "Address to serve /metrics on for the prometheus sink")
+
+	flags.DurationVar(&metrics.flushInterval, "metrics-flush-interval", deepstylelib.DefaultMetricsFlushInterval, "How often to push metrics, for the cloudwatch sink")
+
+	flags.StringVar(&metrics.config.CloudWatch.Region, "cloudwatch-region", deepstylelib.DefaultCloudWatchRegion, "AWS region to send CloudWatch metrics to")
+
+	flags.StringVar(&metrics.config.CloudWatch.Namespace, "cloudwatch-namespace", deepstylelib.DefaultCloudWatchNamespace, "CloudWatch namespace for the metrics")
+
+	flags.StringVar(&metrics.config.CloudWatch.Endpoint, "cloudwatch-endpoint", "", "Override the CloudWatch endpoint, eg http://localhost:4582 for a local CloudWatch")
+
+	flags.StringSliceVar(&metrics.dimensions, "cloudwatch-dimensions", []string{}, "Dimensions added to every CloudWatch metric, eg Database=deepstyle,WorkerPool=gpu")
+
+}
+
+// newMetricsSink returns the configured sink, or nil for none
+func (metrics metricsFlags) newMetricsSink() deepstylelib.MetricsSink {
+	metrics.config.CloudWatch.Dimensions = map[string]string{}
+	for _, dimension := range metrics.dimensions {
+		nameValue := strings.SplitN(dimension, "=", 2)
+		if len(nameValue) != 2 || nameValue[0] == "" {
+			log.Panicf("Invalid CloudWatch dimension: %q.  Expected Name=Value", dimension)
+		}
+		metrics.config.CloudWatch.Dimensions[nameValue[0]] = nameValue[1]
+	}
+	sink, err := deepstylelib.NewMetricsSink(metrics.sink, metrics.config)
+	if err != nil {
+		log.Panicf("%v", err)
+	}
+	return sink
+}
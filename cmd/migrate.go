@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+var migrateDryRun *bool
+
+// migrateCmd upgrades the design docs and job docs of an existing database
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Upgrade the views and job docs written by older versions of deepstyle",
+	Long:  `Installs or updates the design docs this version of deepstyle needs (waiting until their views can be queried), then upgrades every job doc, eg renaming the legacy photo attachment to source_image.  Safe to run more than once, and while workers are running`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if err := cmd.ParseFlags(args); err != nil {
+			log.Printf("err: %v", err)
+			return
+		}
+
+		urlFlag := cmd.Flag("admin_url")
+
+		urlVal := urlFlag.Value.String()
+		if urlVal == "" {
+			log.Printf("ERROR: Missing: --admin_url.\n  %v", cmd.UsageString())
+			return
+		}
+
+		report, err := deepstylelib.Migrate(urlVal, *migrateDryRun)
+		if err != nil {
+			log.Panicf("%v", err)
+		}
+
+		if *migrateDryRun {
+			log.Printf("Dry run, nothing was changed")
+		}
+		log.Printf("Design docs installed: %v", report.DesignDocsInstalled)
+		log.Printf("Jobs checked: %v", report.JobsChecked)
+		for _, migration := range deepstylelib.Migrations {
+			log.Printf("%v: %v jobs", migration.Description, report.JobsMigrated[migration.Name])
+		}
+		if report.JobsFailed > 0 || report.DocsUnreadable > 0 {
+			log.Panicf("%v jobs failed to migrate and %v docs couldn't be read, see the errors above", report.JobsFailed, report.DocsUnreadable)
+		}
+
+	},
+}
+
+func init() {
+
+	RootCmd.AddCommand(migrateCmd)
+
+	migrateCmd.PersistentFlags().String("admin_url", "", "Sync Gateway Admin URL")
+
+	migrateDryRun = migrateCmd.PersistentFlags().Bool("dry-run", false, "Only report which jobs would be migrated")
+
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+// addNotifierFlags adds the flags that pick and configure the notifiers used
+// to tell owners their jobs are done.  Like the connection settings, each
+// can also be set with an environment variable (eg SMTP_PASSWORD) or in the
+// config file (eg smtp_password).
+func addNotifierFlags(flags *pflag.FlagSet) {
+
+	flags.StringSlice("notifiers", []string{deepstylelib.NotifierUniqush}, fmt.Sprintf("Where to send notifications, any of %v", deepstylelib.NotifierNames()))
+	viper.BindPFlag("notifiers", flags.Lookup("notifiers"))
+
+	flags.Duration("notifier-timeout", deepstylelib.DefaultNotifierTimeout, "How long sending a notification may take")
+	viper.BindPFlag("notifier_timeout", flags.Lookup("notifier-timeout"))
+
+	notifierFlags := []struct {
+		name  string
+		key   string
+		value string
+		usage string
+	}{
+		{"uniqush-url", "uniqush_url", "", "Uniqush URL (push notifications)"},
+		{"uniqush-service", "uniqush_service", "deepstyle", "Uniqush service to push through"},
+		{"webhook-url", "webhook_url", "", "URL the webhook notifier POSTs notifications to"},
+		{"smtp-addr", "smtp_addr", "", "SMTP server for the smtp notifier, host:port"},
+		{"smtp-username", "smtp_username", "", "SMTP user, if the server needs auth"},
+		{"smtp-password", "smtp_password", "", "Password for --smtp-username"},
+		{"smtp-from", "smtp_from", "", "From address for notification emails"},
+	}
+	for _, notifierFlag := range notifierFlags {
+		flags.String(notifierFlag.name, notifierFlag.value, notifierFlag.usage)
+		viper.BindPFlag(notifierFlag.key, flags.Lookup(notifierFlag.name))
+	}
+
+}
+
+// newNotifier builds the notifiers named by --notifiers
+func newNotifier() deepstylelib.Notifier {
+
+	config := deepstylelib.NotifierConfig{
+		Timeout:        viper.GetDuration("notifier_timeout"),
+		UniqushURL:     viper.GetString("uniqush_url"),
+		UniqushService: viper.GetString("uniqush_service"),
+		WebhookURL:     viper.GetString("webhook_url"),
+		SMTPAddr:       viper.GetString("smtp_addr"),
+		SMTPUsername:   viper.GetString("smtp_username"),
+		SMTPPassword:   viper.GetString("smtp_password"),
+		SMTPFrom:       viper.GetString("smtp_from"),
+	}
+
+	notifier, err := deepstylelib.NewNotifiers(viper.GetStringSlice("notifiers"), config)
+	if err != nil {
+		log.Panicf("%v", err)
+	}
+	return notifier
+
+}
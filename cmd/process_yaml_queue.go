@@ -1,14 +1,15 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"os/exec"
 	"path"
 	"strings"
 
 	"github.com/BurntSushi/toml"
 	"github.com/spf13/cobra"
+	"github.com/tleyden/deepstyle/deepstylelib"
 )
 
 // process_yaml_queueCmd respresents the process_yaml_queue command
@@ -27,6 +28,21 @@ var process_yaml_queueCmd = &cobra.Command{
 			fmt.Println(err)
 			return
 		}
+
+		if config.Executor == "" {
+			config.Executor = deepstylelib.ExecutorNeuralStyle
+		}
+		// run in the current directory, which the relative paths in the
+		// toml file are relative to, rather than the executor's default
+		if config.ExecutorConfig.WorkDir == "" {
+			config.ExecutorConfig.WorkDir = "."
+		}
+		executor, err := deepstylelib.NewExecutor(config.Executor, config.ExecutorConfig)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
 		for _, itemToProcess := range config.Items {
 
 			log.Printf(
@@ -36,16 +52,11 @@ var process_yaml_queueCmd = &cobra.Command{
 				itemToProcess.OutputImagePath(config.OutputPath),
 			)
 
-			out, err := exec.Command(
-				"th",
-				"neural_style.lua",
-				"-style_image",
-				itemToProcess.Painting,
-				"-content_image",
-				itemToProcess.Photo,
-				"-output_image",
-				itemToProcess.OutputImagePath(config.OutputPath),
-			).CombinedOutput()
+			out, err := executor.Execute(context.Background(), deepstylelib.StyleTransferRequest{
+				SourceImagePath: itemToProcess.Photo,
+				StyleImagePath:  itemToProcess.Painting,
+				OutputFilePath:  itemToProcess.OutputImagePath(config.OutputPath),
+			})
 
 			log.Printf("Command output: %v Command err: %v", string(out), err)
 		}
@@ -54,8 +65,10 @@ var process_yaml_queueCmd = &cobra.Command{
 }
 
 type tomlConfig struct {
-	Items      []item
-	OutputPath string
+	Items          []item
+	OutputPath     string
+	Executor       string                      // Style transfer backend, defaults to neural_style
+	ExecutorConfig deepstylelib.ExecutorConfig `toml:"executor_config"`
 }
 
 type item struct {
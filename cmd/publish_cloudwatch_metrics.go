@@ -7,11 +7,18 @@ import (
 	"github.com/tleyden/deepstyle/deepstylelib"
 )
 
+var (
+	metricsReaperConfig = deepstylelib.DefaultReaperConfig()
+	metricsEvents       eventFlags
+	queueMetrics        metricsFlags
+	queueMetricsConfig  = deepstylelib.DefaultQueueMetricsConfig()
+)
+
 // publish_cloudwatch_metricsCmd respresents the publish_cloudwatch_metrics command
 var publish_cloudwatch_metricsCmd = &cobra.Command{
 	Use:   "publish_cloudwatch_metrics",
 	Short: "Publish queue metrics to CloudWatch in order to trigger auto-scale alarms",
-	Long:  `Publish queue metrics to CloudWatch in order to trigger auto-scale alarms.  AWS keys will be taken from environment variables or ~/.aws/.  See github.com/aws/aws-sdk-go`,
+	Long:  `Publish queue metrics to CloudWatch in order to trigger auto-scale alarms.  AWS keys will be taken from environment variables or ~/.aws/.  See github.com/aws/aws-sdk-go.  Use --metrics-sink prometheus to serve them on /metrics instead`,
 	Run: func(cmd *cobra.Command, args []string) {
 
 		if err := cmd.ParseFlags(args); err != nil {
@@ -27,7 +34,19 @@ var publish_cloudwatch_metricsCmd = &cobra.Command{
 			return
 		}
 
-		err := deepstylelib.AddCloudWatchMetrics(urlVal)
+		metricsReaperConfig.Events = metricsEvents.newEventOutbox()
+		if metricsReaperConfig.Events != nil {
+			stopDelivery := metricsReaperConfig.Events.Start()
+			defer stopDelivery()
+		}
+
+		sink := queueMetrics.newMetricsSink()
+		if sink == nil {
+			log.Printf("ERROR: --metrics-sink %v, there is nowhere to publish to", queueMetrics.sink)
+			return
+		}
+
+		err := deepstylelib.PublishMetrics(urlVal, metricsReaperConfig, queueMetricsConfig, sink)
 		if err != nil {
 			log.Printf("ERROR: %v", err)
 			return
@@ -45,6 +64,20 @@ func init() {
 
 	publish_cloudwatch_metricsCmd.PersistentFlags().String("admin_url", "", "Sync Gateway Admin URL")
 
+	publish_cloudwatch_metricsCmd.PersistentFlags().DurationVar(&metricsReaperConfig.GracePeriod, "grace-period", deepstylelib.DefaultLeaseGracePeriod, "How long past lease expiry to wait before requeueing a stuck job")
+
+	addRetryPolicyFlags(publish_cloudwatch_metricsCmd.PersistentFlags(), &metricsReaperConfig.RetryPolicy)
+
+	addEventFlags(publish_cloudwatch_metricsCmd.PersistentFlags(), &metricsEvents)
+
+	addMetricsFlags(publish_cloudwatch_metricsCmd.PersistentFlags(), &queueMetrics, deepstylelib.MetricsSinkCloudWatch)
+
+	publish_cloudwatch_metricsCmd.PersistentFlags().StringVar(&queueMetricsConfig.Executor, "executor", queueMetricsConfig.Executor, "Style transfer backend the workers run, whose recorded job durations are used to estimate the backlog")
+
+	publish_cloudwatch_metricsCmd.PersistentFlags().DurationVar(&queueMetricsConfig.TargetDrainTime, "target-drain-time", queueMetricsConfig.TargetDrainTime, "How soon the recommended number of workers should get through the backlog")
+
+	publish_cloudwatch_metricsCmd.PersistentFlags().IntVar(&queueMetricsConfig.MaxWorkers, "max-workers", 0, "Upper limit on the recommended number of workers (0 for none)")
+
 	// Cobra supports local flags which will only run when this command is called directly
 	// publish_cloudwatch_metricsCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle" )
 
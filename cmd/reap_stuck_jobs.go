@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+var (
+	reaperConfig = deepstylelib.DefaultReaperConfig()
+	reapInterval *time.Duration
+	reaperEvents eventFlags
+)
+
+// reap_stuck_jobsCmd respresents the reap_stuck_jobs command
+var reap_stuck_jobsCmd = &cobra.Command{
+	Use:   "reap_stuck_jobs",
+	Short: "Requeue jobs whose worker stopped renewing its lease",
+	Long:  `Requeue jobs that are BEING_PROCESSED but whose lease has expired, which means the worker processing them has died, or abandon them once they are out of attempts.  Also releases failed jobs for retry once their backoff is over.  Runs once, or forever with --interval`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if err := cmd.ParseFlags(args); err != nil {
+			log.Printf("err: %v", err)
+			return
+		}
+
+		urlFlag := cmd.Flag("admin_url")
+
+		urlVal := urlFlag.Value.String()
+		if urlVal == "" {
+			log.Printf("ERROR: Missing: --admin_url.\n  %v", cmd.UsageString())
+			return
+		}
+
+		reaperConfig.Events = reaperEvents.newEventOutbox()
+		if reaperConfig.Events != nil && *reapInterval > 0 {
+			stopDelivery := reaperConfig.Events.Start()
+			defer stopDelivery()
+		}
+
+		for {
+
+			if err := deepstylelib.ReapStuckJobs(urlVal, reaperConfig); err != nil {
+				log.Printf("ERROR: %v", err)
+			}
+
+			if *reapInterval <= 0 {
+				// anything that can't be delivered now waits for the next run
+				if reaperConfig.Events != nil {
+					reaperConfig.Events.Deliver()
+				}
+				return
+			}
+
+			log.Printf("Sleeping %v", *reapInterval)
+			<-time.After(*reapInterval)
+
+		}
+
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(reap_stuck_jobsCmd)
+
+	reap_stuck_jobsCmd.PersistentFlags().String("admin_url", "", "Sync Gateway Admin URL")
+
+	reap_stuck_jobsCmd.PersistentFlags().DurationVar(&reaperConfig.GracePeriod, "grace-period", deepstylelib.DefaultLeaseGracePeriod, "How long past lease expiry to wait before requeueing a job")
+
+	addRetryPolicyFlags(reap_stuck_jobsCmd.PersistentFlags(), &reaperConfig.RetryPolicy)
+
+	addEventFlags(reap_stuck_jobsCmd.PersistentFlags(), &reaperEvents)
+
+	reapInterval = reap_stuck_jobsCmd.PersistentFlags().Duration("interval", 0, "Keep running, checking for stuck jobs this often (eg 1m).  Runs once if not set")
+
+}
@@ -0,0 +1,19 @@
+package cmd
+
+import (
+	"github.com/spf13/pflag"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+// addRetryPolicyFlags adds the flags that control how failing jobs are
+// retried.  Workers and the reaper both need them, since either one can be
+// the one that decides a job has failed.
+func addRetryPolicyFlags(flags *pflag.FlagSet, retryPolicy *deepstylelib.RetryPolicy) {
+
+	flags.IntVar(&retryPolicy.MaxAttempts, "max-attempts", deepstylelib.DefaultMaxAttempts, "Attempts before a failing job is PROCESSING_ABANDONED (0 to retry forever)")
+
+	flags.DurationVar(&retryPolicy.InitialBackoff, "retry-backoff", deepstylelib.DefaultRetryBackoff, "How long to wait before retrying a failed job, doubled after each attempt")
+
+	flags.DurationVar(&retryPolicy.MaxBackoff, "max-retry-backoff", deepstylelib.DefaultMaxRetryBackoff, "Upper limit on the retry backoff")
+
+}
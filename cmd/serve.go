@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+var (
+	serveDataDir       *string
+	serveListen        *string
+	serveToken         *string
+	servePublicUrl     *string
+	serveReapInterval  *time.Duration
+	serveLeaseDuration *time.Duration
+	serveExecutor      executorFlags
+	serveRetryPolicy   = deepstylelib.DefaultRetryPolicy()
+	serveEvents        eventFlags
+	serveMetrics       metricsFlags
+)
+
+// serveCmd runs everything on one box, with jobs kept in a local directory
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Accept and process jobs on this box, without Sync Gateway",
+	Long:  `Keeps jobs in a file-backed store under --data-dir, accepts them over a small HTTP API (POST /jobs with source_image and style_image files, GET /jobs/{id}, GET /jobs/{id}/result_image, POST /jobs/{id}/cancel), processes them with the executor and requeues jobs whose worker died.  Only one serve may use a data dir at a time`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if err := cmd.ParseFlags(args); err != nil {
+			log.Printf("err: %v", err)
+			return
+		}
+
+		// the API can run jobs and read everyone's images, so anything
+		// that isn't only reachable from this box needs a token
+		token := *serveToken
+		if token == "" {
+			token = viper.GetString("api_token")
+		}
+		if token == "" && !isLoopbackAddr(*serveListen) {
+			log.Panicf("Refusing to serve the job API on %v without --api-token", *serveListen)
+		}
+
+		store, err := deepstylelib.OpenFileStore(*serveDataDir)
+		if err != nil {
+			log.Panicf("%v", err)
+		}
+		defer store.Close()
+
+		publicUrl := *servePublicUrl
+		if publicUrl == "" {
+			_, port, err := net.SplitHostPort(*serveListen)
+			if err != nil {
+				log.Panicf("Invalid --listen: %v", err)
+			}
+			publicUrl = "http://localhost:" + port
+		}
+		store.AttachmentBaseURL = strings.TrimSuffix(publicUrl, "/") + "/jobs"
+
+		events := serveEvents.newEventOutbox()
+		metrics := serveMetrics.newMetricsSink()
+		if metrics != nil {
+			stopFlushing := deepstylelib.StartFlushing(metrics, serveMetrics.flushInterval)
+			defer stopFlushing()
+		}
+
+		changesFollower := deepstylelib.ChangesFeedFollower{
+			Database:         store,
+			ProcessJobs:      true,
+			Checkpoint:       deepstylelib.FileCheckpointStore{Path: filepath.Join(*serveDataDir, deepstylelib.DefaultCheckpointFile)},
+			Executor:         serveExecutor.newExecutor(),
+			ExecutorName:     serveExecutor.name,
+			WorkerId:         deepstylelib.DefaultWorkerId(),
+			LeaseDuration:    *serveLeaseDuration,
+			RetryPolicy:      serveRetryPolicy,
+			ProgressInterval: deepstylelib.DefaultProgressInterval,
+			SnapshotInterval: deepstylelib.DefaultSnapshotInterval,
+			Events:           events,
+			Metrics:          metrics,
+		}
+
+		// the first time, process every job in the store rather than
+		// starting at the end of the feed
+		since, err := changesFollower.Checkpoint.Load()
+		if err != nil {
+			log.Panicf("%v", err)
+		}
+		if since == "" {
+			changesFollower.StartingSince = "0"
+		}
+
+		// requeue jobs whose worker died, eg a previous serve that crashed
+		reaperConfig := deepstylelib.DefaultReaperConfig()
+		reaperConfig.RetryPolicy = serveRetryPolicy
+		reaperConfig.Events = events
+		go func() {
+			for {
+				if err := deepstylelib.ReapStuckJobsIn(store, reaperConfig); err != nil {
+					log.Printf("ERROR: %v", err)
+				}
+				<-time.After(*serveReapInterval)
+			}
+		}()
+
+		api := deepstylelib.JobAPI{Store: store, Token: token}
+		mux := http.NewServeMux()
+		mux.Handle("/jobs", api)
+		mux.Handle("/jobs/", api)
+		go func() {
+			log.Printf("Serving the job API on %v", *serveListen)
+			log.Panicf("%v", http.ListenAndServe(*serveListen, mux))
+		}()
+
+		changesFollower.Follow()
+
+	},
+}
+
+func init() {
+
+	RootCmd.AddCommand(serveCmd)
+
+	serveDataDir = serveCmd.PersistentFlags().String("data-dir", "deepstyle_data", "Directory to keep jobs, their images and the checkpoint in")
+
+	serveListen = serveCmd.PersistentFlags().String("listen", "127.0.0.1:8080", "Address to serve the job API on, which needs --api-token unless it's a loopback address")
+
+	serveToken = serveCmd.PersistentFlags().String("api-token", "", "Bearer token every job API request must carry (or API_TOKEN)")
+
+	servePublicUrl = serveCmd.PersistentFlags().String("public-url", "", "URL the job API is reachable at, used in result urls (defaults to http://localhost and the --listen port)")
+
+	serveReapInterval = serveCmd.PersistentFlags().Duration("reap-interval", time.Minute, "How often to check for jobs whose worker stopped renewing its lease")
+
+	serveLeaseDuration = serveCmd.PersistentFlags().Duration("lease-duration", deepstylelib.DefaultLeaseDuration, "How long a claim on a job lasts, renewed every third of this while the job runs")
+
+	addExecutorFlags(serveCmd.PersistentFlags(), &serveExecutor)
+
+	addRetryPolicyFlags(serveCmd.PersistentFlags(), &serveRetryPolicy)
+
+	addEventFlags(serveCmd.PersistentFlags(), &serveEvents)
+
+	addMetricsFlags(serveCmd.PersistentFlags(), &serveMetrics, deepstylelib.MetricsSinkNone)
+
+}
+
+// isLoopbackAddr returns true if a host:port only listens on this box
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
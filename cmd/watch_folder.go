@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+var (
+	watchInbox        *string
+	watchOutbox       *string
+	watchErrorDir     *string
+	watchStateDir     *string
+	watchPollInterval *time.Duration
+	watchSettleTime   *time.Duration
+	watchImageTimeout *time.Duration
+	watchExecutor     executorFlags
+	watchRetryPolicy  = deepstylelib.DefaultRetryPolicy()
+	watchMetrics      metricsFlags
+)
+
+// watch_folderCmd runs jobs dropped into a directory
+var watch_folderCmd = &cobra.Command{
+	Use:   "watch_folder",
+	Short: "Run jobs dropped into a directory, without Sync Gateway or the app",
+	Long:  `Watches --inbox for jobs: a pair of files like cat.source.jpg and cat.style.png, or a manifest like cat.json ({"source_image": "cat.jpg", "style_image": "starry_night.png", "parameters": {...}}).  Each job is run with the executor, then its files are moved to a directory named after it: in --outbox with result_image and job.log, or in --error-dir with job.log and error.txt`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if err := cmd.ParseFlags(args); err != nil {
+			log.Printf("err: %v", err)
+			return
+		}
+
+		if *watchInbox == "" {
+			log.Printf("ERROR: Missing: --inbox.\n  %v", cmd.UsageString())
+			return
+		}
+
+		hotFolder := deepstylelib.NewHotFolder(*watchInbox)
+		if *watchOutbox != "" {
+			hotFolder.Outbox = *watchOutbox
+		}
+		if *watchErrorDir != "" {
+			hotFolder.ErrorDir = *watchErrorDir
+		}
+		if *watchStateDir != "" {
+			hotFolder.StateDir = *watchStateDir
+		}
+		hotFolder.PollInterval = *watchPollInterval
+		hotFolder.SettleTime = *watchSettleTime
+		hotFolder.ImageTimeout = *watchImageTimeout
+		hotFolder.Executor = watchExecutor.newExecutor()
+		hotFolder.ExecutorName = watchExecutor.name
+		hotFolder.RetryPolicy = watchRetryPolicy
+
+		hotFolder.Metrics = watchMetrics.newMetricsSink()
+		if hotFolder.Metrics != nil {
+			stopFlushing := deepstylelib.StartFlushing(hotFolder.Metrics, watchMetrics.flushInterval)
+			defer stopFlushing()
+		}
+
+		if err := hotFolder.Watch(make(chan struct{})); err != nil {
+			log.Panicf("%v", err)
+		}
+
+	},
+}
+
+func init() {
+
+	RootCmd.AddCommand(watch_folderCmd)
+
+	watchInbox = watch_folderCmd.PersistentFlags().String("inbox", "", "Directory to watch for jobs")
+
+	watchOutbox = watch_folderCmd.PersistentFlags().String("outbox", "", "Where finished jobs go (defaults to outbox in the inbox)")
+
+	watchErrorDir = watch_folderCmd.PersistentFlags().String("error-dir", "", "Where failed jobs go (defaults to errors in the inbox)")
+
+	watchStateDir = watch_folderCmd.PersistentFlags().String("state-dir", "", "Where jobs are kept while they run (defaults to .deepstyle in the inbox)")
+
+	watchPollInterval = watch_folderCmd.PersistentFlags().Duration("poll-interval", deepstylelib.DefaultHotFolderPollInterval, "How often to look for new files")
+
+	watchSettleTime = watch_folderCmd.PersistentFlags().Duration("settle-time", deepstylelib.DefaultHotFolderSettleTime, "How long files must go unchanged before they're picked up, so half-copied ones aren't")
+
+	watchImageTimeout = watch_folderCmd.PersistentFlags().Duration("image-timeout", deepstylelib.DefaultHotFolderImageTimeout, "How long after a manifest is written to wait for the images it names before giving up on it")
+
+	addExecutorFlags(watch_folderCmd.PersistentFlags(), &watchExecutor)
+
+	addRetryPolicyFlags(watch_folderCmd.PersistentFlags(), &watchRetryPolicy)
+
+	addMetricsFlags(watch_folderCmd.PersistentFlags(), &watchMetrics, deepstylelib.MetricsSinkNone)
+
+}
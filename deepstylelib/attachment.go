@@ -0,0 +1,132 @@
+package deepstylelib
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// AddAttachment uploads the file as an attachment on the job, on top of the
+// latest revision of the doc.  On a conflict it retries, re-reading the file
+// from the start each time.  The content type is sniffed from the file
+// itself, and once the upload succeeds the length and digest the store
+// recorded are checked against the file.
+func (doc *JobDocument) AddAttachment(attachmentName, filepath string) (err error) {
+
+	f, err := os.Open(filepath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fileInfo.Size()
+
+	contentType, err := detectContentType(f, filepath)
+	if err != nil {
+		return err
+	}
+
+	for i := 1; i <= 10; i++ {
+
+		// get latest revision of doc so we are updating the current rev
+		if err := doc.RefreshFromDB(); err != nil {
+			return err
+		}
+
+		// a fresh reader over the whole file for every attempt
+		body := io.NewSectionReader(f, 0, size)
+		err := doc.config.Database.PutAttachment(doc.Id, doc.Revision, attachmentName, contentType, body, size)
+		if err != nil && isConflict(err) {
+			log.Printf("409 conflict adding attachment %v to %v, retrying attempt #%v", attachmentName, doc.Id, i+1)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to upload attachment: %v from %v: %v", attachmentName, filepath, err)
+		}
+		doc.config.metrics().AddCounter(MetricAttachmentBytes, Labels{"direction": "upload"}, float64(size))
+
+		if err := doc.verifyAttachment(attachmentName, f, size); err != nil {
+			log.Printf("Attachment %v on %v doesn't match %v: %v.  Retrying attempt #%v", attachmentName, doc.Id, filepath, err, i+1)
+			continue
+		}
+
+		return nil
+
+	}
+
+	return fmt.Errorf("Tried to add attachment %v to %v 10 times, giving up", attachmentName, doc.Id)
+
+}
+
+// verifyAttachment re-reads the doc and checks the stored attachment has the
+// same length and digest as the file.  Digests are md5 (CouchDB) or sha1
+// (Sync Gateway), base64 encoded; any other kind is skipped.
+func (doc *JobDocument) verifyAttachment(attachmentName string, f *os.File, size int64) error {
+
+	if err := doc.RefreshFromDB(); err != nil {
+		return err
+	}
+
+	stub, ok := doc.Attachments[attachmentName].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Attachment missing from doc")
+	}
+
+	if length, ok := stub["length"].(float64); ok && int64(length) != size {
+		return fmt.Errorf("Stored length %v, expected %v", int64(length), size)
+	}
+
+	digest, _ := stub["digest"].(string)
+	var hasher hash.Hash
+	switch {
+	case strings.HasPrefix(digest, "md5-"):
+		hasher = md5.New()
+	case strings.HasPrefix(digest, "sha1-"):
+		hasher = sha1.New()
+	default:
+		return nil
+	}
+	if _, err := io.Copy(hasher, io.NewSectionReader(f, 0, size)); err != nil {
+		return err
+	}
+	algorithm := strings.SplitN(digest, "-", 2)[0]
+	expected := algorithm + "-" + base64.StdEncoding.EncodeToString(hasher.Sum(nil))
+	if digest != expected {
+		return fmt.Errorf("Stored digest %v, expected %v", digest, expected)
+	}
+	return nil
+
+}
+
+// detectContentType sniffs the content type from the start of the file,
+// falling back to its extension
+func detectContentType(f *os.File, filepath string) (string, error) {
+
+	head := make([]byte, 512)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	contentType := http.DetectContentType(head[:n])
+	if contentType == "application/octet-stream" || strings.HasPrefix(contentType, "text/plain") {
+		if byExtension := mime.TypeByExtension(path.Ext(filepath)); byExtension != "" {
+			contentType = byExtension
+		}
+	}
+	return contentType, nil
+
+}
@@ -0,0 +1,171 @@
+package deepstylelib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// runningJobs keeps the cancel func for each job running on this worker, so
+// that a change seen on the feed can stop it.
+type runningJobs struct {
+	mutex   sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+func newRunningJobs() *runningJobs {
+	return &runningJobs{
+		cancels: map[string]context.CancelFunc{},
+	}
+}
+
+func (r *runningJobs) add(jobId string, cancel context.CancelFunc) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cancels[jobId] = cancel
+}
+
+func (r *runningJobs) remove(jobId string) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.cancels, jobId)
+}
+
+func (r *runningJobs) isRunning(jobId string) bool {
+	if r == nil {
+		return false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, ok := r.cancels[jobId]
+	return ok
+}
+
+// cancel stops the job if it is running on this worker, and returns whether
+// it was.
+func (r *runningJobs) cancel(jobId string) bool {
+	if r == nil {
+		return false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	cancel, ok := r.cancels[jobId]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+func (doc JobDocument) IsCancelRequested() bool {
+	return doc.State == StateCancelRequested
+}
+
+// MarkCancelled moves a job from CANCEL_REQUESTED to CANCELLED.  Only the
+// worker holding the job may do this, or any worker if nobody holds it.
+func (doc *JobDocument) MarkCancelled(workerId string) (updated bool, err error) {
+
+	isCancellable := func() bool {
+		return doc.IsCancelRequested() && (doc.WorkerId == "" || doc.WorkerId == workerId)
+	}
+
+	cancelUpdater := func() {
+		if doc.WorkerId != "" {
+			doc.finishAttempt(StateCancelled, nil, noExitStatus)
+		}
+		doc.State = StateCancelled
+		doc.clearClaim()
+	}
+
+	return doc.editIf(isCancellable, cancelUpdater)
+
+}
+
+// CancelExpiredLease cancels a CANCEL_REQUESTED job whose worker stopped
+// renewing its lease more than gracePeriod ago, eg because it died before
+// it could record the cancel itself.  Like ReleaseExpiredLease, the update
+// is conditional on the revision it checked.
+func (doc *JobDocument) CancelExpiredLease(gracePeriod time.Duration) (cancelled bool, err error) {
+
+	isExpired := func() bool {
+		if !doc.IsCancelRequested() || doc.WorkerId == "" {
+			return false
+		}
+		expiry, ok := doc.LeaseExpiry()
+		return ok && !time.Now().Before(expiry.Add(gracePeriod))
+	}
+
+	cancelUpdater := func() {
+		log.Printf("Lease on cancelled job %v held by %v expired at %v", doc.Id, doc.WorkerId, doc.LeaseExpiresAt)
+		leaseErr := fmt.Errorf("Worker %v stopped renewing its lease, which expired at %v", doc.WorkerId, doc.LeaseExpiresAt)
+		doc.finishAttempt(AttemptOutcomeLeaseExpired, leaseErr, noExitStatus)
+		doc.State = StateCancelled
+		doc.clearClaim()
+	}
+
+	return doc.editIf(isExpired, cancelUpdater)
+
+}
+
+// finishCancelledJob cleans up after a job whose context was cancelled
+// while it was running, and records why it stopped.
+func finishCancelledJob(jobDoc JobDocument, deepStyleJob *DeepStyleJob, workerId string) {
+
+	deepStyleJob.RemoveTempFiles()
+
+	if err := jobDoc.RefreshFromDB(); err != nil {
+		if isNotFound(err) {
+			log.Printf("Job %v was deleted while running, stopped it", jobDoc.Id)
+			return
+		}
+		log.Printf("Unable to refresh cancelled job %v: %v", jobDoc.Id, err)
+		return
+	}
+
+	if !jobDoc.IsCancelRequested() {
+		log.Printf("Job %v is %v and no longer held by %v, stopped it", jobDoc.Id, jobDoc.State, workerId)
+		return
+	}
+
+	if _, err := jobDoc.MarkCancelled(workerId); err != nil {
+		log.Printf("Unable to mark job %v cancelled: %v", jobDoc.Id, err)
+		return
+	}
+	log.Printf("Job %v cancelled", jobDoc.Id)
+
+}
+
+// cancelJob handles a CANCEL_REQUESTED job seen on the changes feed.  A job
+// running here is stopped, and the job itself records CANCELLED once its
+// process is dead.  A job nobody is running is cancelled right away.  A job
+// running on another worker is left for that worker.
+func (f ChangesFeedFollower) cancelJob(jobDoc JobDocument) error {
+
+	if f.running.cancel(jobDoc.Id) {
+		log.Printf("Cancelling job %v running on this worker", jobDoc.Id)
+		return nil
+	}
+
+	if jobDoc.WorkerId != "" {
+		return nil
+	}
+
+	jobDoc.SetConfiguration(configuration{Database: f.Database, Events: f.Events})
+	_, err := jobDoc.MarkCancelled(f.WorkerId)
+	return err
+
+}
+
+// cancelDeletedJob stops a job that was deleted while running here
+func (f ChangesFeedFollower) cancelDeletedJob(jobId string) {
+	if f.running.cancel(jobId) {
+		log.Printf("Job %v was deleted, cancelling it", jobId)
+	}
+}
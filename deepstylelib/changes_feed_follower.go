@@ -1,17 +1,16 @@
 package deepstylelib
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
-	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/couchbaselabs/logg"
 	"github.com/tleyden/go-couch"
-	"github.com/tleyden/uqclient/libuqclient"
 )
 
 /*
@@ -26,23 +25,56 @@ import (
 */
 
 type ChangesFeedFollower struct {
-	Database          couch.Database
-	UniqushURL        string
-	ProcessJobs       bool // Run NeuralStyle (typically only on AWS+GPU)
-	SendNotifications bool // Send push notifications when jobs done
+	Database          JobStore
+	ProcessJobs       bool     // Run NeuralStyle (typically only on AWS+GPU)
+	SendNotifications bool     // Notify job owners when jobs are done
+	Notifier          Notifier // How to reach job owners
 	StartingSince     string
+	Checkpoint        CheckpointStore // Where to record the last processed sequence
+	Executor          Executor        // Runs the style transfer for each job
+	ExecutorName      string          // Which backend Executor is, for duration stats
+	WorkerId          string          // Recorded on jobs claimed by this worker
+	LeaseDuration     time.Duration   // How long a claim lasts between heartbeats
+	RetryPolicy       RetryPolicy     // How often to retry failing jobs
+	ProgressInterval  time.Duration   // How often running jobs save progress, 0 to never
+	NotifyProgress    bool            // Also notify owners as jobs progress
+	SnapshotInterval  time.Duration   // How often timelapse jobs upload a snapshot
+	Events            *EventOutbox    // Webhooks for job state transitions, may be nil
+	Metrics           MetricsSink     // Job and feed metrics, may be nil
+
+	// Worker pool mode: jobs and notifications are handed off to their own
+	// pools of workers, so the feed never waits on a running job.
+	WorkerPool             bool
+	NumJobWorkers          int // Defaults to one per GPU
+	NumNotificationWorkers int // Defaults to DefaultNumNotificationWorkers
+	pool                   *followerPool
+	running                *runningJobs
 }
 
 func NewChangesFeedFollower(startingSince, syncGatewayUrl string) (*ChangesFeedFollower, error) {
 
-	db, err := GetDbConnection(syncGatewayUrl)
+	db, err := OpenJobStore(syncGatewayUrl)
 	if err != nil {
 		return nil, fmt.Errorf("Error connecting to db: %v.  Err: %v", syncGatewayUrl, err)
 	}
 
+	executor, err := NewExecutor(ExecutorNeuralStyle, ExecutorConfig{})
+	if err != nil {
+		return nil, err
+	}
+
 	return &ChangesFeedFollower{
-		Database:      db,
-		StartingSince: startingSince,
+		Database:         db,
+		StartingSince:    startingSince,
+		Checkpoint:       FileCheckpointStore{Path: DefaultCheckpointFile},
+		Executor:         executor,
+		ExecutorName:     ExecutorNeuralStyle,
+		WorkerId:         DefaultWorkerId(),
+		LeaseDuration:    DefaultLeaseDuration,
+		RetryPolicy:      DefaultRetryPolicy(),
+		ProgressInterval: DefaultProgressInterval,
+		SnapshotInterval: DefaultSnapshotInterval,
+		running:          newRunningJobs(),
 	}, nil
 }
 
@@ -60,14 +92,34 @@ func (f ChangesFeedFollower) Follow() {
 			return since
 		}
 
-		f.processChanges(changes)
+		if f.pool != nil {
+			f.pool.dispatchChanges(changes)
+		} else {
+			f.processChanges(changes)
+		}
 
-		since = changes.LastSequence
+		lastSequence := sequenceString(changes.LastSequence)
+		f.recordFeedLag(lastSequence)
+		since = lastSequence
 
 		return since
 
 	}
 
+	if f.running == nil {
+		f.running = newRunningJobs()
+	}
+
+	if f.Events != nil {
+		stopDelivery := f.Events.Start()
+		defer stopDelivery()
+	}
+
+	if f.WorkerPool {
+		f.pool = newFollowerPool(f)
+		f.pool.start()
+	}
+
 	options := map[string]interface{}{}
 	options["feed"] = "longpoll"
 	since = f.determineStartingSince(f.StartingSince)
@@ -77,24 +129,6 @@ func (f ChangesFeedFollower) Follow() {
 
 }
 
-func (f ChangesFeedFollower) lastProcessedSeq() (string, error) {
-
-	infile, err := os.Open("lastprocessed.db")
-	if err != nil {
-		log.Printf("could not open lastprocessed.db file for reading")
-		return "", err
-	}
-	defer infile.Close()
-	reader := bufio.NewReader(infile)
-	line, err := reader.ReadString('\n')
-	if err != nil {
-		log.Printf("could not read from lastprocessed.db file")
-		return "", err
-	}
-	return strings.TrimSpace(line), nil
-
-}
-
 func (f ChangesFeedFollower) determineStartingSince(startingSince string) interface{} {
 
 	if startingSince != "" {
@@ -103,12 +137,17 @@ func (f ChangesFeedFollower) determineStartingSince(startingSince string) interf
 		return startingSince
 	} else {
 		// otherwise try to get the stored last processed sequence
-		lastProcessedSeq, err := f.lastProcessedSeq()
-		if err == nil {
+		lastProcessedSeq, err := f.Checkpoint.Load()
+		if err != nil {
+			// don't fall back to the end of the feed, since that would
+			// silently skip any jobs queued while we were down.
+			logg.LogPanic("Error loading checkpoint: %v", err)
+		}
+		if lastProcessedSeq != "" {
 			log.Printf("Using saved last seq: %v", lastProcessedSeq)
 			return lastProcessedSeq
 		} else {
-			log.Printf("Error getting stored last seq: %v", err)
+			log.Printf("No saved last seq found")
 
 			// if that's empty, find the sequence of most recent change
 			lastSequence, err := f.Database.LastSequence()
@@ -133,31 +172,87 @@ func (f ChangesFeedFollower) processChanges(changes couch.Changes) {
 
 	}
 
+	// every change in the batch has been handled, so record how far we got
+	lastSequence := sequenceString(changes.LastSequence)
+	if lastSequence == "" {
+		return
+	}
+	if err := f.Checkpoint.Save(lastSequence); err != nil {
+		errMsg := fmt.Errorf("Error %v saving checkpoint %v", err, lastSequence)
+		logg.LogError(errMsg)
+	}
+
 }
 
 func (f ChangesFeedFollower) processChange(change couch.Change) error {
 
+	if change.Deleted {
+		f.cancelDeletedJob(change.Id)
+		return nil
+	}
+
+	jobDoc, err := f.retrieveJobDoc(change)
+	if err != nil || jobDoc == nil {
+		return err
+	}
+
+	if jobDoc.IsCancelRequested() {
+		return f.cancelJob(*jobDoc)
+	}
+
+	if f.ProcessJobs {
+
+		// skip any jobs that aren't ready to process
+		if !jobDoc.IsReadyToProcess() {
+			return nil
+		}
+
+		// Run the job (call neural style).  This feed waits for the job,
+		// so watch for it being cancelled on a feed of its own.
+		stopWatching := f.watchForCancel(sequenceString(change.Sequence))
+		err := f.processJob(*jobDoc, 0)
+		stopWatching()
+		if err != nil {
+			return err
+		}
+	}
+
+	if f.SendNotifications {
+
+		if err := f.sendNotifications(*jobDoc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// retrieveJobDoc returns the job doc for a change, or nil if the change
+// isn't for a job.
+func (f ChangesFeedFollower) retrieveJobDoc(change couch.Change) (*JobDocument, error) {
+
 	docId := change.Id
 	log.Printf("processChange: %v", docId)
 
 	if change.Deleted {
-		return nil
+		return nil, nil
 	}
 
 	// ignore any doc ids that start with "_user"
 	if strings.HasPrefix(docId, "_user") {
-		return nil
+		return nil, nil
 	}
 
 	doc := TypedDocument{}
 	err := f.Database.Retrieve(docId, &doc)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// skip any docs that aren't jobs
 	if !doc.IsJob() {
-		return nil
+		return nil, nil
 	}
 	log.Printf("doc: %+v. isJob: %v", doc, doc.IsJob())
 
@@ -165,69 +260,188 @@ func (f ChangesFeedFollower) processChange(change couch.Change) error {
 	jobDoc := JobDocument{}
 	err = f.Database.Retrieve(docId, &jobDoc)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	log.Printf("jobdoc: %+v", jobDoc)
 
-	if f.ProcessJobs {
+	return &jobDoc, nil
 
-		// skip any jobs that aren't ready to process
-		if !jobDoc.IsReadyToProcess() {
-			return nil
-		}
+}
 
-		// Run the job (call neural style)
-		config := configuration{
-			Database: f.Database,
-			TempDir:  "/tmp",
+// watchForCancel follows the changes feed from since on its own goroutine,
+// stopping any job running on this worker that is cancelled or deleted, until
+// the returned stop func is called.
+func (f ChangesFeedFollower) watchForCancel(since string) (stop func()) {
+
+	done := make(chan struct{})
+	isStopped := func() bool {
+		select {
+		case <-done:
+			return true
+		default:
+			return false
 		}
+	}
 
-		if err := executeDeepStyleJob(config, jobDoc); err != nil {
-			return err
+	handleChange := func(reader io.Reader) interface{} {
+		if isStopped() {
+			return nil
+		}
+		changes, err := decodeChanges(reader)
+		if err != nil {
+			return since
 		}
+		for _, change := range changes.Results {
+			if err := f.cancelIfRequested(change); err != nil {
+				logg.LogError(fmt.Errorf("Error %v checking change %v for a cancel", err, change))
+			}
+		}
+		if lastSequence := sequenceString(changes.LastSequence); lastSequence != "" {
+			since = lastSequence
+		}
+		return since
 	}
 
-	if f.SendNotifications {
+	options := map[string]interface{}{}
+	options["feed"] = "longpoll"
+	options["since"] = since
+	go f.Database.Changes(handleChange, options)
 
-		if err := f.sendNotifications(jobDoc); err != nil {
-			return err
-		}
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+
+}
+
+// cancelIfRequested stops the job a change is for if it's running on this
+// worker and was cancelled or deleted
+func (f ChangesFeedFollower) cancelIfRequested(change couch.Change) error {
+
+	if change.Deleted {
+		f.cancelDeletedJob(change.Id)
+		return nil
+	}
+	if !f.running.isRunning(change.Id) {
+		return nil
 	}
 
+	jobDoc := JobDocument{}
+	if err := f.Database.Retrieve(change.Id, &jobDoc); err != nil {
+		return err
+	}
+	if jobDoc.IsCancelRequested() {
+		return f.cancelJob(jobDoc)
+	}
 	return nil
 
 }
 
-func (f ChangesFeedFollower) sendNotifications(jobDoc JobDocument) error {
+// processJob runs the job on the given GPU (ignored if there is no GPU)
+func (f ChangesFeedFollower) processJob(jobDoc JobDocument, gpuIndex int) error {
+
+	config := configuration{
+		Database:         f.Database,
+		TempDir:          "/tmp",
+		Executor:         f.Executor,
+		ExecutorName:     f.ExecutorName,
+		GpuIndex:         gpuIndex,
+		WorkerId:         f.WorkerId,
+		LeaseDuration:    f.LeaseDuration,
+		RetryPolicy:      f.RetryPolicy,
+		RunningJobs:      f.running,
+		ProgressInterval: f.ProgressInterval,
+		SnapshotInterval: f.SnapshotInterval,
+		Events:           f.Events,
+		Metrics:          f.Metrics,
+	}
+
+	return executeDeepStyleJob(config, jobDoc)
+
+}
+
+// recordFeedLag records how far the sequence we've read up to is behind the
+// latest sequence in the database
+func (f ChangesFeedFollower) recordFeedLag(since string) {
 
-	log.Printf("Sending notification for %v@%v", jobDoc.Id, jobDoc.Revision)
+	if f.Metrics == nil || since == "" {
+		return
+	}
+	lastSequence, err := f.Database.LastSequence()
+	if err != nil {
+		log.Printf("Unable to get last sequence for feed lag: %v", err)
+		return
+	}
+	latest, ok := sequenceNumber(lastSequence)
+	current, ok2 := sequenceNumber(since)
+	if !ok || !ok2 {
+		return
+	}
+	lag := float64(0)
+	if latest > current {
+		lag = float64(latest - current)
+	}
+	f.Metrics.SetGauge(MetricFeedLag, nil, lag)
+
+}
+
+// shouldNotify returns true if the owner of the job should get a push
+// notification about the change
+func (f ChangesFeedFollower) shouldNotify(jobDoc JobDocument) bool {
+	if jobDoc.State == StateBeingProcessed {
+		return f.NotifyProgress && jobDoc.Progress != nil
+	}
+	return jobDoc.IsFinished()
+}
+
+// sendNotifications notifies the owner of the job over each channel that
+// hasn't already been told about the job's current state.  What was sent is
+// recorded on the job doc, so later changes to the doc, restarts and other
+// workers don't send it again.
+func (f ChangesFeedFollower) sendNotifications(jobDoc JobDocument) error {
 
-	message := ""
-	switch jobDoc.State {
-	case StateProcessingSuccessful:
-		message = "Your DeepStyle work of art is ready!"
-	case StateProcessingFailed:
-		message = "Oops, something went wrong making your DeepStyle work of art!"
-	default:
-		// Job isn't finished, don't send any notification
+	if _, ok := newNotification(jobDoc, f.NotifyProgress); !ok {
 		return nil
 	}
+	if f.Notifier == nil {
+		return fmt.Errorf("No notifier configured, can't notify about %v", jobDoc.Id)
+	}
 
-	// create subscriber in uniqush
-	uniqushClient := libuqclient.NewUniqushClient(f.UniqushURL)
-	uniqushService := uniqushClient.NewService("deepstyle", libuqclient.APNS)
-	subscriber := uniqushService.NewSubscriber(jobDoc.Owner, jobDoc.OwnerDeviceToken)
-	_, err := subscriber.Create()
-	if err != nil {
+	jobDoc.SetConfiguration(configuration{Database: f.Database})
+
+	errs := []string{}
+	for _, notifier := range notifierChannels(f.Notifier) {
+		if err := f.notifyOnce(jobDoc, notifier); err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", notifier.Name(), err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Notifiers failed: %v", strings.Join(errs, "; "))
+	}
+	return nil
+
+}
+
+// notifyOnce claims the notification for the channel on the job doc, sends
+// it, and records the outcome
+func (f ChangesFeedFollower) notifyOnce(jobDoc JobDocument, notifier Notifier) error {
+
+	notification, claim, claimed, err := jobDoc.claimNotification(notifier.Name(), f.WorkerId, f.NotifyProgress)
+	if err != nil || !claimed {
 		return err
 	}
 
-	_, err = subscriber.Push(message)
-	if err != nil {
+	log.Printf("Sending %v notification for %v@%v", notifier.Name(), jobDoc.Id, jobDoc.Revision)
+
+	sendErr := notifier.Notify(notification)
+	if _, err := jobDoc.finishNotification(claim, sendErr == nil); err != nil && sendErr == nil {
 		return err
 	}
+	if sendErr != nil {
+		return sendErr
+	}
 
-	log.Printf("Sent notification for %v@%v", jobDoc.Id, jobDoc.Revision)
+	log.Printf("Sent %v notification for %v@%v", notifier.Name(), jobDoc.Id, jobDoc.Revision)
 
 	return nil
 
@@ -237,6 +451,10 @@ func decodeChanges(reader io.Reader) (couch.Changes, error) {
 
 	changes := couch.Changes{}
 	decoder := json.NewDecoder(reader)
+
+	// keep numeric sequences intact rather than turning them into float64
+	decoder.UseNumber()
+
 	err := decoder.Decode(&changes)
 	return changes, err
 
@@ -0,0 +1,229 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tleyden/deepstyle/deepstylelib/fakesyncgw"
+)
+
+// newTestFollower returns a follower for the fake Sync Gateway that runs
+// jobs with executor, and checkpoints to a file in dir
+func newTestFollower(t *testing.T, syncGw *fakesyncgw.Server, executor Executor, dir string) *ChangesFeedFollower {
+	follower, err := NewChangesFeedFollower("0", syncGw.DBURL())
+	assert.NoError(t, err)
+	follower.Executor = executor
+	follower.Checkpoint = FileCheckpointStore{Path: filepath.Join(dir, "lastprocessed.db")}
+	follower.ProcessJobs = true
+	return follower
+}
+
+func TestChangesFeedFollower(t *testing.T) {
+
+	for _, workerPool := range []bool{false, true} {
+
+		syncGw := fakesyncgw.NewServer("deepstyle")
+
+		dir, err := ioutil.TempDir("", "deepstyle_follower")
+		assert.NoError(t, err)
+
+		follower := newTestFollower(t, syncGw, FakeExecutor{}, dir)
+		follower.WorkerPool = workerPool
+		follower.NumJobWorkers = 1
+		go follower.Follow()
+
+		for _, jobId := range []string{"job1", "job2"} {
+			newTestJob(t, follower.Database, jobId, nil)
+		}
+		for _, jobId := range []string{"job1", "job2"} {
+			waitForState(t, syncGw, jobId, StateProcessingSuccessful)
+			assert.NotEqual(t, 0, len(syncGw.Attachment(jobId, ResultImageAttachment)))
+		}
+
+		// once everything is done, the checkpoint catches up
+		lastSequence, err := follower.Database.LastSequence()
+		assert.NoError(t, err)
+		waitForCheckpoint(t, follower.Checkpoint, lastSequence)
+
+		syncGw.Close()
+		os.RemoveAll(dir)
+
+	}
+
+}
+
+func TestChangesFeedFollowerCancelsJobs(t *testing.T) {
+
+	// the lease is far too long for the heartbeat to notice the cancel, so
+	// it has to be seen on the feed, in either mode
+	for _, workerPool := range []bool{false, true} {
+
+		syncGw := fakesyncgw.NewServer("deepstyle")
+
+		dir, err := ioutil.TempDir("", "deepstyle_follower")
+		assert.NoError(t, err)
+
+		executor, err := NewExecutor(ExecutorCommand, ExecutorConfig{Command: "sleep", Args: []string{"30"}})
+		assert.NoError(t, err)
+
+		follower := newTestFollower(t, syncGw, executor, dir)
+		follower.WorkerPool = workerPool
+		follower.NumJobWorkers = 1
+		go follower.Follow()
+
+		jobDoc := newTestJob(t, follower.Database, "job1", nil)
+		if waitForState(t, syncGw, "job1", StateBeingProcessed) {
+
+			assert.NoError(t, jobDoc.RefreshFromDB())
+			updated, err := jobDoc.UpdateState(StateCancelRequested)
+			assert.NoError(t, err)
+			assert.True(t, updated)
+
+			if waitForState(t, syncGw, "job1", StateCancelled) {
+				attempts := syncGw.Doc("job1")["attempt_history"].([]interface{})
+				assert.Equal(t, StateCancelled, attempts[0].(map[string]interface{})["outcome"])
+			}
+
+		}
+
+		syncGw.Close()
+		os.RemoveAll(dir)
+
+	}
+
+}
+
+func waitForCheckpoint(t *testing.T, checkpoint CheckpointStore, sequence string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if since, _ := checkpoint.Load(); since == sequence {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	since, _ := checkpoint.Load()
+	t.Errorf("Checkpoint never reached %v, is %v", sequence, since)
+}
+
+// countingNotifier counts the notifications it is sent, failing the first
+// failures of them
+type countingNotifier struct {
+	name     string
+	mutex    sync.Mutex
+	sent     []Notification
+	failures int
+}
+
+func (n *countingNotifier) Name() string {
+	return n.name
+}
+
+func (n *countingNotifier) Notify(notification Notification) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.failures > 0 {
+		n.failures -= 1
+		return fmt.Errorf("%v is down", n.name)
+	}
+	n.sent = append(n.sent, notification)
+	return nil
+}
+
+func (n *countingNotifier) count() int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return len(n.sent)
+}
+
+func TestNotificationsSentOnce(t *testing.T) {
+
+	syncGw := fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+
+	push := &countingNotifier{name: "push"}
+	flaky := &countingNotifier{name: "flaky", failures: 1000}
+
+	followers := []*ChangesFeedFollower{}
+	for _, workerId := range []string{"worker1", "worker2"} {
+		follower, err := NewChangesFeedFollower("0", syncGw.DBURL())
+		assert.NoError(t, err)
+		follower.WorkerId = workerId
+		follower.SendNotifications = true
+		follower.Notifier = MultiNotifier{push, flaky}
+		followers = append(followers, follower)
+	}
+	db := followers[0].Database
+
+	_, _, err := db.InsertWith(map[string]interface{}{
+		"type":     Job,
+		"state":    StateProcessingSuccessful,
+		"attempts": 1,
+		"owner":    "alice",
+	}, "job1")
+	assert.NoError(t, err)
+
+	retrieve := func() JobDocument {
+		jobDoc := JobDocument{}
+		assert.NoError(t, db.Retrieve("job1", &jobDoc))
+		return jobDoc
+	}
+
+	// both workers see the change, several times over
+	jobDoc := retrieve()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		for _, follower := range followers {
+			wg.Add(1)
+			go func(follower *ChangesFeedFollower) {
+				defer wg.Done()
+				follower.sendNotifications(jobDoc)
+			}(follower)
+		}
+	}
+	wg.Wait()
+	assert.Equal(t, 1, push.count())
+
+	// the failing channel wasn't recorded, so it's retried on the next change
+	assert.Equal(t, 0, flaky.count())
+	notified := retrieve().Notified
+	assert.NotEqual(t, "", notified["push"].NotifiedAt)
+	assert.Equal(t, "", notified["push"].SendingBy)
+	_, ok := notified["flaky"]
+	assert.False(t, ok)
+
+	flaky.mutex.Lock()
+	flaky.failures = 0
+	flaky.mutex.Unlock()
+	assert.NoError(t, followers[1].sendNotifications(retrieve()))
+	assert.Equal(t, 1, push.count())
+	assert.Equal(t, 1, flaky.count())
+
+	// later edits to the doc, or a restart, don't notify again
+	edited := retrieve()
+	edited.StdOutAndErr = "more output"
+	_, err = db.Edit(edited)
+	assert.NoError(t, err)
+	restarted, err := NewChangesFeedFollower("0", syncGw.DBURL())
+	assert.NoError(t, err)
+	restarted.Notifier = MultiNotifier{push, flaky}
+	assert.NoError(t, restarted.sendNotifications(retrieve()))
+	assert.Equal(t, 1, push.count())
+	assert.Equal(t, 1, flaky.count())
+
+	// a new attempt reaching a finished state is a new transition
+	retried := retrieve()
+	retried.State = StateProcessingFailed
+	retried.Attempts = 2
+	_, err = db.Edit(retried)
+	assert.NoError(t, err)
+	assert.NoError(t, followers[0].sendNotifications(retrieve()))
+	assert.Equal(t, 2, push.count())
+	assert.Equal(t, StateProcessingFailed, retrieve().Notified["push"].State)
+
+}
@@ -0,0 +1,192 @@
+package deepstylelib
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Checkpoint backends
+const (
+	CheckpointBackendFile   = "file"    // local file on the worker
+	CheckpointBackendSyncGw = "sync_gw" // _local/ doc in Sync Gateway
+)
+
+const (
+	DefaultCheckpointFile  = "lastprocessed.db"
+	DefaultCheckpointDocId = "deepstyle_checkpoint"
+)
+
+// CheckpointStore remembers the last changes feed sequence that was fully
+// processed, so that a restarted follower resumes where it stopped rather
+// than at the end of the feed.
+type CheckpointStore interface {
+
+	// Load returns the saved sequence, or "" if nothing has been saved yet.
+	Load() (since string, err error)
+
+	// Save records the sequence, replacing any previously saved one.
+	Save(since string) error
+}
+
+// NewCheckpointStore returns the checkpoint store for the given backend.  The
+// location is a file path for the file backend and a _local doc id for the
+// sync_gw backend.  An empty location uses the default for that backend.
+func NewCheckpointStore(backend, location string, db JobStore) (CheckpointStore, error) {
+
+	switch backend {
+	case "", CheckpointBackendFile:
+		if location == "" {
+			location = DefaultCheckpointFile
+		}
+		return FileCheckpointStore{Path: location}, nil
+	case CheckpointBackendSyncGw:
+		if location == "" {
+			location = DefaultCheckpointDocId
+		}
+		return SyncGwCheckpointStore{Database: db, DocId: location}, nil
+	default:
+		return nil, fmt.Errorf("Unknown checkpoint backend: %v", backend)
+	}
+
+}
+
+// FileCheckpointStore keeps the checkpoint in a local file
+type FileCheckpointStore struct {
+	Path string
+}
+
+func (s FileCheckpointStore) Load() (since string, err error) {
+
+	infile, err := os.Open(s.Path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer infile.Close()
+
+	reader := bufio.NewReader(infile)
+	line, err := reader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("Could not read from %v: %v", s.Path, err)
+	}
+	return strings.TrimSpace(line), nil
+
+}
+
+// Save writes the sequence to a temp file in the same directory and renames
+// it over the checkpoint, so a crash never leaves a truncated checkpoint.
+func (s FileCheckpointStore) Save(since string) error {
+
+	dir, name := filepath.Split(s.Path)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmpFile, err := ioutil.TempFile(dir, name+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+
+	if _, err := fmt.Fprintln(tmpFile, since); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, s.Path)
+
+}
+
+// SyncGwCheckpointStore keeps the checkpoint in a _local doc of the job
+// store, which is not replicated and doesn't show up on the changes feed.
+type SyncGwCheckpointStore struct {
+	Database JobStore
+	DocId    string
+}
+
+type checkpointDocument struct {
+	Revision     string `json:"_rev,omitempty"`
+	LastSequence string `json:"last_seq"`
+}
+
+func (s SyncGwCheckpointStore) Load() (since string, err error) {
+	checkpointDoc, err := s.retrieve()
+	if err != nil {
+		return "", err
+	}
+	return checkpointDoc.LastSequence, nil
+}
+
+func (s SyncGwCheckpointStore) Save(since string) error {
+
+	for i := 1; i <= 10; i++ {
+
+		// get the current revision, since _local docs are still MVCC
+		checkpointDoc, err := s.retrieve()
+		if err != nil {
+			return err
+		}
+		checkpointDoc.LastSequence = since
+
+		err = s.Database.SaveLocal(s.DocId, checkpointDoc)
+		if err != nil && isConflict(err) {
+			log.Printf("409 conflict saving checkpoint, retrying attempt #%v", i+1)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to save checkpoint %v: %v", s.DocId, err)
+		}
+
+		return nil
+
+	}
+
+	return fmt.Errorf("Tried to save checkpoint 10 times, giving up")
+
+}
+
+func (s SyncGwCheckpointStore) retrieve() (checkpointDoc checkpointDocument, err error) {
+	// no checkpoint saved yet if it's not found
+	_, err = s.Database.RetrieveLocal(s.DocId, &checkpointDoc)
+	return checkpointDoc, err
+}
+
+// sequenceString converts a changes feed sequence into the form expected by
+// the since parameter.  Sync Gateway sequences are either plain numbers or
+// compound strings such as "123:45", and the compound form must be passed
+// back verbatim.  Plain numbers must not be rendered in exponent notation.
+func sequenceString(seq interface{}) string {
+
+	switch v := seq.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+
+}
@@ -0,0 +1,116 @@
+package deepstylelib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tleyden/deepstyle/deepstylelib/fakesyncgw"
+)
+
+func TestFileCheckpointStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "deepstyle_checkpoint")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := FileCheckpointStore{Path: filepath.Join(dir, "lastprocessed.db")}
+
+	// nothing saved yet
+	since, err := store.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "", since)
+
+	assert.NoError(t, store.Save("123:45"))
+	assert.NoError(t, store.Save("124"))
+
+	since, err = store.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "124", since)
+
+	// the temp files used for the atomic write are cleaned up by the rename
+	entries, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+
+}
+
+func TestSyncGwCheckpointStore(t *testing.T) {
+
+	syncGw := fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+
+	db, err := GetDbConnection(syncGw.DBURL())
+	assert.NoError(t, err)
+
+	store, err := NewCheckpointStore(CheckpointBackendSyncGw, "", db)
+	assert.NoError(t, err)
+
+	since, err := store.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "", since)
+
+	assert.NoError(t, store.Save("123:45"))
+	assert.NoError(t, store.Save("124"))
+
+	since, err = store.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "124", since)
+
+	// _local docs don't show up as changes
+	assert.Equal(t, "0-2", syncGw.LocalDoc(DefaultCheckpointDocId)["_rev"])
+	lastSequence, err := db.LastSequence()
+	assert.NoError(t, err)
+	assert.Equal(t, "0", lastSequence)
+
+}
+
+func TestSequenceString(t *testing.T) {
+
+	assert.Equal(t, "", sequenceString(nil))
+	assert.Equal(t, "123:45", sequenceString("123:45"))
+	assert.Equal(t, "1234567", sequenceString(float64(1234567)))
+	assert.Equal(t, "1234567", sequenceString(json.Number("1234567")))
+
+	changes, err := decodeChanges(strings.NewReader(`{"results":[],"last_seq":12345678}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "12345678", sequenceString(changes.LastSequence))
+
+}
+
+type recordingCheckpointStore struct {
+	saved []string
+}
+
+func (s *recordingCheckpointStore) Load() (string, error) {
+	return "", nil
+}
+
+func (s *recordingCheckpointStore) Save(since string) error {
+	s.saved = append(s.saved, since)
+	return nil
+}
+
+func TestSequenceTrackerOnlyAdvancesPastFinishedWork(t *testing.T) {
+
+	store := &recordingCheckpointStore{}
+	tracker := newSequenceTracker(store)
+
+	slowJob := tracker.add("10")
+	notification := tracker.add("11:2")
+	lastSeq := tracker.add("12")
+
+	// later work finishing first must not move the checkpoint
+	tracker.done(notification)
+	tracker.done(lastSeq)
+	assert.Equal(t, 0, len(store.saved))
+
+	// once the slow job finishes, everything up to the batch end is done
+	tracker.done(slowJob)
+	assert.Equal(t, []string{"12"}, store.saved)
+
+}
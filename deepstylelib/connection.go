@@ -0,0 +1,203 @@
+package deepstylelib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// How long a request that deepstylelib makes directly to Sync Gateway may
+// take, including uploading the body.  Result images can be large.
+const DefaultHTTPTimeout = 5 * time.Minute
+
+// Cookie Sync Gateway uses for sessions
+const SyncGatewaySessionCookie = "SyncGatewaySession"
+
+// Database flavors deepstylelib can talk to
+const (
+	FlavorSyncGateway = "sync_gw" // Sync Gateway, backed by Couchbase Server or walrus
+	FlavorCouchDB     = "couchdb" // Apache CouchDB 2.x or 3.x
+)
+
+// ConnectionConfig is how to reach and authenticate with Sync Gateway.  It
+// applies to go-couch and to the requests deepstylelib makes itself
+// (attachment uploads, _local checkpoints, installing views).
+type ConnectionConfig struct {
+	Timeout time.Duration // 0 means DefaultHTTPTimeout (not for go-couch, which longpolls)
+
+	// What the url points at, FlavorSyncGateway (the default) or FlavorCouchDB
+	Flavor string
+
+	// Basic auth, unless the url has credentials
+	Username string
+	Password string
+
+	// A Sync Gateway session id, sent as the SyncGatewaySession cookie
+	SessionId string
+
+	// TLS: a PEM bundle of CAs to trust instead of the system ones, a client
+	// certificate and key for mutual TLS, and an escape hatch for test
+	// servers with self-signed certificates
+	CACertFile         string
+	ClientCertFile     string
+	ClientKeyFile      string
+	InsecureSkipVerify bool
+}
+
+var (
+	connectionMutex     sync.RWMutex
+	databaseTransport   http.RoundTripper = http.DefaultTransport
+	httpClient                            = newHTTPClient(ConnectionConfig{}, databaseTransport)
+	connectionConfig    ConnectionConfig
+	databaseHosts       = map[string]bool{} // host:ports of the database urls connected to
+	installGoCouchHooks sync.Once
+)
+
+// ConfigureConnection applies config to every connection to Sync Gateway.
+// deepstylelib's own requests go through a client of their own.  go-couch
+// can only use http.DefaultClient, so that gets a transport which applies
+// the config to requests for the database hosts only, and leaves every
+// other user of the default client, eg the AWS SDK, as it was.
+func ConfigureConnection(config ConnectionConfig) error {
+
+	switch config.Flavor {
+	case "", FlavorSyncGateway, FlavorCouchDB:
+	default:
+		return fmt.Errorf("Unknown database flavor: %v", config.Flavor)
+	}
+
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	installGoCouchHooks.Do(func() {
+		http.DefaultClient.Transport = goCouchTransport{fallback: http.DefaultClient.Transport}
+	})
+
+	connectionMutex.Lock()
+	defer connectionMutex.Unlock()
+
+	databaseTransport = transport
+	httpClient = newHTTPClient(config, transport)
+	connectionConfig = config
+	return nil
+
+}
+
+// goCouchTransport sends the default client's requests for database hosts
+// the way doRequest does, with the session cookie, and the rest through
+// fallback (http.DefaultTransport if nil) untouched
+type goCouchTransport struct {
+	fallback http.RoundTripper
+}
+
+func (t goCouchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	connectionMutex.RLock()
+	transport, config, isDatabase := databaseTransport, connectionConfig, databaseHosts[req.URL.Host]
+	connectionMutex.RUnlock()
+
+	if !isDatabase {
+		fallback := t.fallback
+		if fallback == nil {
+			fallback = http.DefaultTransport
+		}
+		return fallback.RoundTrip(req)
+	}
+
+	if config.SessionId != "" {
+		// a RoundTripper mustn't change the request it's given
+		req = req.Clone(req.Context())
+		req.AddCookie(&http.Cookie{Name: SyncGatewaySessionCookie, Value: config.SessionId})
+	}
+	return transport.RoundTrip(req)
+
+}
+
+func (config ConnectionConfig) tlsConfig() (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.CACertFile != "" {
+		pem, err := ioutil.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %v", config.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.ClientCertFile != "" || config.ClientKeyFile != "" {
+		if config.ClientCertFile == "" || config.ClientKeyFile == "" {
+			return nil, fmt.Errorf("A client certificate needs both a cert file and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+
+}
+
+func newHTTPClient(config ConnectionConfig, transport http.RoundTripper) *http.Client {
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHTTPTimeout
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+}
+
+// authenticateUrl adds the configured basic auth to a Sync Gateway url as
+// userinfo, since that's what go-couch understands, and marks its host as
+// a database host, so go-couch's requests to it get the TLS settings and
+// session cookie.
+func authenticateUrl(u *url.URL) {
+
+	connectionMutex.Lock()
+	config := connectionConfig
+	databaseHosts[u.Host] = true
+	connectionMutex.Unlock()
+
+	if config.Username != "" && u.User == nil {
+		u.User = url.UserPassword(config.Username, config.Password)
+	}
+
+}
+
+// doRequest sends req with the shared client, adding basic auth if it's
+// configured and the url doesn't carry its own credentials, and the session
+// cookie if there is one.
+func doRequest(req *http.Request) (*http.Response, error) {
+
+	connectionMutex.RLock()
+	client, config := httpClient, connectionConfig
+	connectionMutex.RUnlock()
+
+	if config.Username != "" && req.URL.User == nil {
+		req.SetBasicAuth(config.Username, config.Password)
+	}
+	if config.SessionId != "" {
+		req.AddCookie(&http.Cookie{Name: SyncGatewaySessionCookie, Value: config.SessionId})
+	}
+	return client.Do(req)
+
+}
@@ -0,0 +1,122 @@
+package deepstylelib
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigureConnection(t *testing.T) {
+
+	type seenRequest struct {
+		username, password, session string
+	}
+	var mutex sync.Mutex
+	var last seenRequest
+	lastSeen := func() seenRequest {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return last
+	}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		session := ""
+		if cookie, err := r.Cookie(SyncGatewaySessionCookie); err == nil {
+			session = cookie.Value
+		}
+		mutex.Lock()
+		last = seenRequest{username, password, session}
+		mutex.Unlock()
+		w.Write([]byte(`{"db_name": "db"}`))
+	}))
+	defer server.Close()
+	defer ConfigureConnection(ConnectionConfig{})
+
+	// without the server's CA, the request is refused
+	req, _ := http.NewRequest("GET", server.URL+"/db", nil)
+	_, err := doRequest(req)
+	assert.Error(t, err)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.NoError(t, ioutil.WriteFile(caFile, caPEM, 0600))
+
+	err = ConfigureConnection(ConnectionConfig{
+		Username:   "worker",
+		Password:   "secret",
+		SessionId:  "session1",
+		CACertFile: caFile,
+	})
+	assert.NoError(t, err)
+
+	req, _ = http.NewRequest("GET", server.URL+"/db", nil)
+	resp, err := doRequest(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, seenRequest{"worker", "secret", "session1"}, lastSeen())
+
+	// go-couch goes through http.DefaultClient
+	db, err := GetDbConnection(server.URL + "/db")
+	assert.NoError(t, err)
+	mutex.Lock()
+	last = seenRequest{}
+	mutex.Unlock()
+	assert.NoError(t, db.Retrieve("job1", &map[string]interface{}{}))
+	assert.Equal(t, seenRequest{"worker", "secret", "session1"}, lastSeen())
+
+	// other users of the default client, eg the AWS SDK, don't get the
+	// session
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := r.Cookie(SyncGatewaySessionCookie)
+		assert.Error(t, err)
+	}))
+	defer other.Close()
+	resp, err = http.Get(other.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	// credentials in the url win
+	req, _ = http.NewRequest("GET", "https://other:pw@"+server.Listener.Addr().String()+"/db", nil)
+	resp, err = doRequest(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, seenRequest{"other", "pw", "session1"}, lastSeen())
+
+	// the flavor picks the store
+	assert.NoError(t, ConfigureConnection(ConnectionConfig{CACertFile: caFile, Flavor: FlavorCouchDB}))
+	store, err := OpenJobStore(server.URL + "/db")
+	assert.NoError(t, err)
+	_, ok := store.(CouchDBStore)
+	assert.True(t, ok)
+	assert.Error(t, ConfigureConnection(ConnectionConfig{Flavor: "couchbase"}))
+
+}
+
+func TestConnectionConfigErrors(t *testing.T) {
+
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "not.pem")
+	assert.NoError(t, ioutil.WriteFile(notPEM, []byte("hello"), 0600))
+
+	invalidConfigs := []ConnectionConfig{
+		{CACertFile: filepath.Join(dir, "missing.pem")},
+		{CACertFile: notPEM},
+		{ClientCertFile: notPEM},
+		{ClientCertFile: notPEM, ClientKeyFile: notPEM},
+	}
+	for _, config := range invalidConfigs {
+		_, err := config.tlsConfig()
+		assert.Error(t, err, "%+v", config)
+	}
+
+	tlsConfig, err := ConnectionConfig{InsecureSkipVerify: true}.tlsConfig()
+	assert.NoError(t, err)
+	assert.True(t, tlsConfig.InsecureSkipVerify)
+
+}
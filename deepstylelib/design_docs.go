@@ -0,0 +1,342 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DesignDocVersion is the version of the design docs this build installs.
+// Bump it whenever a view changes, so that databases with the old views
+// get updated by whichever worker runs the new build first.
+const DesignDocVersion = 3
+
+// The version marker stored in the design doc alongside its views
+const designDocVersionField = "deepstyle_version"
+
+const (
+	DefaultViewPollInterval = time.Second
+	DefaultViewReadyTimeout = 2 * time.Minute
+)
+
+// The unprocessed_jobs view in Couchbase's javascript and in CouchDB's,
+// which has no meta argument.  Both emit the fields of the job the queue
+// stats need, see JobRow.
+const (
+	syncGwUnprocessedJobsMap  = `function (doc, meta) { if (doc.type != '%v') { return; } if (doc.state == '%v' || doc.state == '%v' || doc.state == '%v' || doc.state == '%v') { emit(doc.state, %v); }}`
+	couchDBUnprocessedJobsMap = `function (doc) { if (doc.type !== '%v') { return; } if (doc.state === '%v' || doc.state === '%v' || doc.state === '%v' || doc.state === '%v') { emit(doc.state, %v); } }`
+	unprocessedJobsValue      = `{state: doc.state, created_at: doc.created_at, claimed_at: doc.claimed_at, parameters: doc.parameters, effective_parameters: doc.effective_parameters, progress: doc.progress}`
+)
+
+// DesignDoc is a design doc deepstyle needs, with the javascript map
+// function of each of its views
+type DesignDoc struct {
+	Name    string
+	Version int
+	Views   map[string]string
+}
+
+// DesignDocs returns the design docs to install for a database flavor
+func DesignDocs(flavor string) []DesignDoc {
+	unprocessedJobsMap := syncGwUnprocessedJobsMap
+	if flavor == FlavorCouchDB {
+		unprocessedJobsMap = couchDBUnprocessedJobsMap
+	}
+	return []DesignDoc{
+		{
+			Name:    DesignDocName,
+			Version: DesignDocVersion,
+			Views: map[string]string{
+				ViewName: fmt.Sprintf(unprocessedJobsMap, Job, StateNotReadyToProcess, StateReadyToProcess, StateBeingProcessed, StateCancelRequested, unprocessedJobsValue),
+			},
+		},
+	}
+}
+
+// DesignDocManager keeps the design docs in a database up to date.  It's
+// safe to run from every worker at once: docs that are already current, or
+// were installed by a newer build, are left alone, and an update that loses
+// a race to another worker is retried against what that worker wrote.
+type DesignDocManager struct {
+	DBURL        string
+	Flavor       string
+	Docs         []DesignDoc
+	PollInterval time.Duration // How often to check whether an updated view is queryable
+	ReadyTimeout time.Duration // How long to wait for it
+}
+
+func NewDesignDocManager(dbUrl, flavor string) DesignDocManager {
+	return DesignDocManager{
+		DBURL:        dbUrl,
+		Flavor:       flavor,
+		Docs:         DesignDocs(flavor),
+		PollInterval: DefaultViewPollInterval,
+		ReadyTimeout: DefaultViewReadyTimeout,
+	}
+}
+
+// designDocManagerFor returns the manager for the store's database, if it
+// has design docs at all
+func designDocManagerFor(store JobStore) (manager DesignDocManager, ok bool) {
+	switch s := store.(type) {
+	case SyncGatewayStore:
+		return NewDesignDocManager(s.DBURL(), FlavorSyncGateway), true
+	case CouchDBStore:
+		return NewDesignDocManager(s.DBURL(), FlavorCouchDB), true
+	}
+	return manager, false
+}
+
+// designDocsEnsured has the urls of the databases whose design docs this
+// process has already brought up to date, so the stores that poll a view
+// only check the design docs the first time, and again if the view is gone
+var designDocsEnsured sync.Map
+
+// EnsureDesignDocs installs any design docs that are missing or out of
+// date, waiting until their views can be queried.  Returns the names of the
+// ones it installed.
+func (m DesignDocManager) EnsureDesignDocs() (installed []string, err error) {
+
+	installed = []string{}
+	for _, designDoc := range m.Docs {
+		updated, err := m.ensureDesignDoc(designDoc)
+		if err != nil {
+			return installed, err
+		}
+		if updated {
+			installed = append(installed, designDoc.Name)
+		}
+	}
+	designDocsEnsured.Store(m.DBURL, true)
+	return installed, nil
+
+}
+
+// OutOfDateDesignDocs returns the names of the design docs that
+// EnsureDesignDocs would install, without changing anything
+func (m DesignDocManager) OutOfDateDesignDocs() (outOfDate []string, err error) {
+
+	outOfDate = []string{}
+	for _, designDoc := range m.Docs {
+		current, found, err := m.getDesignDoc(designDoc.Name)
+		if err != nil {
+			return outOfDate, err
+		}
+		if needed, _ := needsInstall(designDoc, current, found); needed {
+			outOfDate = append(outOfDate, designDoc.Name)
+		}
+	}
+	return outOfDate, nil
+
+}
+
+// queryView runs query, ensuring the design docs first if this process
+// hasn't yet, and once more if query says the view isn't there, eg because
+// the design doc was deleted since
+func (m DesignDocManager) queryView(query func() error) error {
+
+	if _, ensured := designDocsEnsured.Load(m.DBURL); !ensured {
+		if _, err := m.EnsureDesignDocs(); err != nil {
+			return err
+		}
+	}
+
+	err := query()
+	if err == nil || !isNotFound(err) {
+		return err
+	}
+	log.Printf("View %v is missing, installing the design docs again", ViewName)
+	designDocsEnsured.Delete(m.DBURL)
+	if _, err := m.EnsureDesignDocs(); err != nil {
+		return err
+	}
+	return query()
+
+}
+
+func (m DesignDocManager) ensureDesignDoc(designDoc DesignDoc) (updated bool, err error) {
+
+	numRetries := 10
+	for i := 0; i < numRetries; i++ {
+
+		current, found, err := m.getDesignDoc(designDoc.Name)
+		if err != nil {
+			return false, err
+		}
+
+		needed, installedVersion := needsInstall(designDoc, current, found)
+		if !needed {
+			return false, nil
+		}
+
+		log.Printf("Installing design doc %v version %v (was %v)", designDoc.Name, designDoc.Version, installedVersion)
+		rev, _ := current["_rev"].(string)
+		if err := m.putDesignDoc(designDoc, rev); err != nil {
+			if isConflict(err) {
+				// another worker updated it first, see what they wrote
+				continue
+			}
+			return false, err
+		}
+
+		for viewName := range designDoc.Views {
+			if err := m.waitForView(designDoc.Name, viewName); err != nil {
+				return true, err
+			}
+		}
+		return true, nil
+
+	}
+
+	return false, fmt.Errorf("Unable to install design doc %v after %v retries", designDoc.Name, numRetries)
+
+}
+
+// needsInstall is true if the design doc is missing, or older than this
+// build's and without its views
+func needsInstall(designDoc DesignDoc, current map[string]interface{}, found bool) (needed bool, installedVersion int) {
+
+	if !found {
+		return true, 0
+	}
+	if version, ok := current[designDocVersionField].(json.Number); ok {
+		if number, err := version.Int64(); err == nil {
+			installedVersion = int(number)
+		}
+	}
+	if installedVersion > designDoc.Version {
+		log.Printf("Design doc %v is at version %v, newer than %v, leaving it", designDoc.Name, installedVersion, designDoc.Version)
+		return false, installedVersion
+	}
+	if installedVersion == designDoc.Version || hasViews(current, designDoc.Views) {
+		return false, installedVersion
+	}
+	return true, installedVersion
+
+}
+
+// hasViews is true if the design doc's views have these map functions,
+// eg when it was installed by a build that didn't write a version marker
+func hasViews(current map[string]interface{}, views map[string]string) bool {
+	currentViews, _ := current["views"].(map[string]interface{})
+	for viewName, mapFunc := range views {
+		currentView, _ := currentViews[viewName].(map[string]interface{})
+		if currentView["map"] != mapFunc {
+			return false
+		}
+	}
+	return true
+}
+
+func (m DesignDocManager) designDocUrl(name string) string {
+	return fmt.Sprintf("%v/_design/%v", m.DBURL, name)
+}
+
+func (m DesignDocManager) getDesignDoc(name string) (designDoc map[string]interface{}, found bool, err error) {
+
+	designDoc = map[string]interface{}{}
+
+	req, err := http.NewRequest("GET", m.designDocUrl(name), nil)
+	if err != nil {
+		return designDoc, false, err
+	}
+	resp, err := doRequest(req)
+	if err != nil {
+		return designDoc, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return designDoc, false, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return designDoc, false, fmt.Errorf("Unable to get design doc %v.  Unexpected status code in response: %v", name, resp.StatusCode)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	err = decoder.Decode(&designDoc)
+	return designDoc, true, err
+
+}
+
+// putDesignDoc saves the design doc on top of rev, which CouchDB needs to
+// update an existing one.  A stale rev fails with a 409 statusError.
+func (m DesignDocManager) putDesignDoc(designDoc DesignDoc, rev string) error {
+
+	views := map[string]interface{}{}
+	for viewName, mapFunc := range designDoc.Views {
+		views[viewName] = map[string]string{"map": mapFunc}
+	}
+	body := map[string]interface{}{
+		"views":               views,
+		designDocVersionField: designDoc.Version,
+	}
+	if rev != "" {
+		body["_rev"] = rev
+	}
+
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", m.designDocUrl(designDoc.Name), bytes.NewReader(bodyBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := doRequest(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return newStatusError(resp.StatusCode, "Unable to install design doc %v.  Unexpected status code in response: %v", designDoc.Name, resp.StatusCode)
+	}
+	return nil
+
+}
+
+// waitForView polls the view until querying it succeeds.  Right after an
+// install Couchbase can answer with view_undefined for a while.
+func (m DesignDocManager) waitForView(designDocName, viewName string) error {
+
+	params := url.Values{"limit": {"1"}}
+	if m.Flavor != FlavorCouchDB {
+		params.Set("stale", "false")
+	}
+	viewUrl := fmt.Sprintf("%v/_view/%v?%v", m.designDocUrl(designDocName), viewName, params.Encode())
+
+	deadline := time.Now().Add(m.ReadyTimeout)
+	for {
+
+		status := 0
+		req, err := http.NewRequest("GET", viewUrl, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := doRequest(req)
+		if err == nil {
+			resp.Body.Close()
+			status = resp.StatusCode
+			if status >= 200 && status < 300 {
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("View %v/%v not ready after %v.  Last status: %v, error: %v", designDocName, viewName, m.ReadyTimeout, status, err)
+		}
+		log.Printf("Waiting for view %v/%v to be ready", designDocName, viewName)
+		<-time.After(m.PollInterval)
+
+	}
+
+}
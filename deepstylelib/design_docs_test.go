@@ -0,0 +1,91 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tleyden/deepstyle/deepstylelib/fakesyncgw"
+)
+
+func putTestDesignDoc(t *testing.T, dbUrl string, designDoc map[string]interface{}) {
+	docBytes, err := json.Marshal(designDoc)
+	assert.NoError(t, err)
+	req, err := http.NewRequest("PUT", dbUrl+"/_design/"+DesignDocName, bytes.NewReader(docBytes))
+	assert.NoError(t, err)
+	resp, err := doRequest(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
+func TestDesignDocManager(t *testing.T) {
+
+	syncGw := fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+	syncGw.DefineView(DesignDocName, ViewName, unprocessedJobsView)
+
+	manager := NewDesignDocManager(syncGw.DBURL(), FlavorSyncGateway)
+	manager.PollInterval = time.Millisecond
+
+	// views from an older build, without a version marker, get replaced.
+	// Right after that the view isn't queryable for a bit.
+	putTestDesignDoc(t, syncGw.DBURL(), map[string]interface{}{
+		"views": map[string]interface{}{ViewName: map[string]interface{}{"map": "function (doc, meta) { emit(doc.state, meta.id); }"}},
+	})
+	syncGw.FailRequests("GET", "_design/"+DesignDocName+"/_view/"+ViewName, http.StatusInternalServerError, 2)
+	installed, err := manager.EnsureDesignDocs()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{DesignDocName}, installed)
+	designDoc := syncGw.DesignDoc(DesignDocName)
+	assert.Equal(t, float64(DesignDocVersion), designDoc[designDocVersionField])
+	assert.True(t, hasViews(designDoc, manager.Docs[0].Views))
+
+	// the second time there's nothing to do
+	installed, err = manager.EnsureDesignDocs()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, installed)
+
+	// a newer build's views are left alone
+	putTestDesignDoc(t, syncGw.DBURL(), map[string]interface{}{
+		"views":               map[string]interface{}{ViewName: map[string]interface{}{"map": "function (doc, meta) {}"}},
+		designDocVersionField: DesignDocVersion + 1,
+	})
+	installed, err = manager.EnsureDesignDocs()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, installed)
+
+	// a view that never becomes queryable is an error
+	syncGw.Close()
+	syncGw = fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+	manager.DBURL = syncGw.DBURL()
+	manager.ReadyTimeout = 10 * time.Millisecond
+	_, err = manager.EnsureDesignDocs()
+	assert.Error(t, err)
+
+}
+
+func TestDesignDocManagerCouchDB(t *testing.T) {
+
+	couchDB := fakesyncgw.NewCouchDBServer("deepstyle")
+	defer couchDB.Close()
+	couchDB.DefineView(DesignDocName, ViewName, unprocessedJobsView)
+
+	// updating an existing design doc needs its _rev
+	putTestDesignDoc(t, couchDB.DBURL(), map[string]interface{}{
+		"views": map[string]interface{}{ViewName: map[string]interface{}{"map": "function (doc, meta) { emit(doc.state, meta.id); }"}},
+	})
+	manager := NewDesignDocManager(couchDB.DBURL(), FlavorCouchDB)
+	installed, err := manager.EnsureDesignDocs()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{DesignDocName}, installed)
+
+	designDoc := couchDB.DesignDoc(DesignDocName)
+	assert.Equal(t, "2-", designDoc["_rev"].(string)[:2])
+	assert.True(t, hasViews(designDoc, DesignDocs(FlavorCouchDB)[0].Views))
+
+}
@@ -1,12 +1,11 @@
 package deepstylelib
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
-	"os"
+	"reflect"
+	"time"
 )
 
 // Doc types
@@ -21,6 +20,10 @@ const (
 	StateBeingProcessed       = "BEING_PROCESSED"       // worker running
 	StateProcessingSuccessful = "PROCESSING_SUCCESSFUL" // worker done
 	StateProcessingFailed     = "PROCESSING_FAILED"     // processing failed
+	StateProcessingAbandoned  = "PROCESSING_ABANDONED"  // failed too many times, gave up
+	StateProcessingTimedOut   = "PROCESSING_TIMED_OUT"  // ran too long, partial result attached
+	StateCancelRequested      = "CANCEL_REQUESTED"      // owner asked to stop the job
+	StateCancelled            = "CANCELLED"             // job stopped, worker cleaned up
 )
 
 type Attachments map[string]interface{}
@@ -46,9 +49,39 @@ type JobDocument struct {
 	CreatedAt        string      `json:"created_at"`
 	Owner            string      `json:"owner"`
 	OwnerDeviceToken string      `json:"owner_devicetoken"`
+	OwnerDeviceType  string      `json:"owner_device_type,omitempty"` // ios (default) or android
+	OwnerEmail       string      `json:"owner_email,omitempty"`
 	ErrorMessage     string      `json:"error_message"`
 	StdOutAndErr     string      `json:"std_out_and_err"`
-	config           configuration
+
+	// Which worker claimed the job, when, and when its claim runs out
+	// unless renewed (RFC 3339)
+	WorkerId       string `json:"worker_id,omitempty"`
+	ClaimedAt      string `json:"claimed_at,omitempty"`
+	LeaseExpiresAt string `json:"lease_expires_at,omitempty"`
+
+	// How many times the job has been claimed, what happened each time,
+	// and when it may next be retried after a failure (RFC 3339)
+	Attempts       int          `json:"attempts,omitempty"`
+	AttemptHistory []JobAttempt `json:"attempt_history,omitempty"`
+	NotBefore      string       `json:"not_before,omitempty"`
+
+	// Optional style transfer settings requested by the app
+	Parameters *JobParameters `json:"parameters,omitempty"`
+
+	// The settings the job actually ran with, including defaults
+	EffectiveParameters *JobParameters `json:"effective_parameters,omitempty"`
+
+	// How far the job has got while BEING_PROCESSED
+	Progress *JobProgress `json:"progress,omitempty"`
+
+	// Set if the job ran past its time limit
+	Timeout *JobTimeout `json:"timeout,omitempty"`
+
+	// What the owner has been notified about, by notification channel
+	Notified map[string]NotifiedState `json:"notified,omitempty"`
+
+	config configuration
 }
 
 func NewJobDocument(documentId string, config configuration) (jobDocument *JobDocument, err error) {
@@ -72,6 +105,55 @@ func (doc JobDocument) IsProcessingFailed() bool {
 	return doc.State == StateProcessingFailed
 }
 
+func (doc JobDocument) IsProcessingAbandoned() bool {
+	return doc.State == StateProcessingAbandoned
+}
+
+func (doc JobDocument) IsProcessingTimedOut() bool {
+	return doc.State == StateProcessingTimedOut
+}
+
+// IsFinished returns true if the job is in a terminal state that the owner
+// should be notified about.  CANCELLED is terminal too, but the owner asked
+// for it so there is nothing to tell them.
+func (doc JobDocument) IsFinished() bool {
+	return doc.IsProcessingSuccessful() || doc.IsProcessingFailed() || doc.IsProcessingAbandoned() || doc.IsProcessingTimedOut()
+}
+
+// RequestedParameters returns the job's parameters, or the zero value
+// (all defaults) if the job didn't specify any.
+func (doc JobDocument) RequestedParameters() JobParameters {
+	if doc.Parameters == nil {
+		return JobParameters{}
+	}
+	return *doc.Parameters
+}
+
+func (doc *JobDocument) SetEffectiveParameters(params JobParameters) (updated bool, err error) {
+
+	db := doc.config.Database
+
+	retryUpdater := func() {
+		doc.EffectiveParameters = &params
+	}
+
+	retryDoneMetric := func() bool {
+		return doc.EffectiveParameters != nil && reflect.DeepEqual(*doc.EffectiveParameters, params)
+	}
+
+	retryRefresh := func() error {
+		return doc.RefreshFromDB()
+	}
+
+	return db.EditRetry(
+		doc,
+		retryUpdater,
+		retryDoneMetric,
+		retryRefresh,
+	)
+
+}
+
 func (doc *JobDocument) SetStdOutAndErr(stdOutAndErr string) (updated bool, err error) {
 
 	db := doc.config.Database
@@ -104,7 +186,11 @@ func (doc *JobDocument) UpdateState(newState string) (updated bool, err error) {
 
 	db := doc.config.Database
 
+	// the state the last (and so saved) update was made on top of
+	oldState := ""
+
 	retryUpdater := func() {
+		oldState = doc.State
 		doc.State = newState
 	}
 
@@ -116,12 +202,87 @@ func (doc *JobDocument) UpdateState(newState string) (updated bool, err error) {
 		return doc.RefreshFromDB()
 	}
 
-	return db.EditRetry(
+	updated, err = db.EditRetry(
 		doc,
 		retryUpdater,
 		retryDoneMetric,
 		retryRefresh,
 	)
+	if updated {
+		doc.publishTransition(oldState)
+	}
+	return updated, err
+
+}
+
+// Claim atomically moves the job from READY_TO_PROCESS to BEING_PROCESSED on
+// behalf of workerId, with a lease that the worker must keep renewing.
+// Unlike UpdateState, a conflicting update is never retried blindly: the doc
+// is re-read, and if it is no longer ready then another worker won the race
+// and Claim returns false.
+func (doc *JobDocument) Claim(workerId string, leaseDuration time.Duration) (claimed bool, err error) {
+
+	isClaimable := func() bool {
+		if !doc.IsReadyToProcess() {
+			log.Printf("Job %v is %v (worker: %v), not claiming", doc.Id, doc.State, doc.WorkerId)
+			return false
+		}
+		if until, backingOff := doc.IsBackingOff(); backingOff {
+			log.Printf("Job %v failed recently, not retrying until %v", doc.Id, until)
+			return false
+		}
+		return true
+	}
+
+	claimUpdater := func() {
+		doc.startAttempt(workerId)
+		doc.State = StateBeingProcessed
+		doc.WorkerId = workerId
+		doc.ClaimedAt = time.Now().UTC().Format(time.RFC3339)
+		doc.LeaseExpiresAt = leaseExpiresAt(leaseDuration)
+	}
+
+	return doc.editIf(isClaimable, claimUpdater)
+
+}
+
+// editIf re-reads the doc, and if precondition still holds applies updater
+// and saves it at the revision that was read.  On a conflict it starts over,
+// so the update only ever lands on a revision the precondition was checked
+// against.  Returns false without saving once the precondition fails.
+func (doc *JobDocument) editIf(precondition func() bool, updater func()) (updated bool, err error) {
+
+	db := doc.config.Database
+
+	for i := 1; i <= 10; i++ {
+
+		if err := doc.RefreshFromDB(); err != nil {
+			return false, err
+		}
+
+		if !precondition() {
+			return false, nil
+		}
+
+		oldState := doc.State
+		updater()
+
+		newRevision, err := db.Edit(doc)
+		if err == nil {
+			doc.Revision = newRevision
+			doc.publishTransition(oldState)
+			return true, nil
+		}
+
+		if !isConflict(err) {
+			return false, err
+		}
+
+		log.Printf("Conflict updating job %v, re-checking attempt #%v", doc.Id, i+1)
+
+	}
+
+	return false, fmt.Errorf("Tried to update job %v 10 times, giving up", doc.Id)
 
 }
 
@@ -179,65 +340,3 @@ func (doc *JobDocument) RefreshFromDB() error {
 	*doc = jobDoc
 	return nil
 }
-
-func (doc *JobDocument) AddAttachment(attachmentName, filepath string) (err error) {
-
-	db := doc.config.Database
-	dbUrl := db.DBURL()
-
-	endpointUrlStr := fmt.Sprintf("%v/%v/%v",
-		dbUrl,
-		doc.Id,
-		attachmentName,
-	)
-
-	client := &http.Client{}
-
-	f, err := os.Open(filepath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	reader := bufio.NewReader(f)
-
-	for i := 1; i <= 10; i++ {
-
-		// get latest revision of doc so we are updating the current rev
-		if err := doc.RefreshFromDB(); err != nil {
-			return err
-		}
-
-		endpointUrlStr = fmt.Sprintf("%v?rev=%v", endpointUrlStr, doc.Revision)
-		log.Printf("endpointUrlStr: %v", endpointUrlStr)
-
-		req, err := http.NewRequest("PUT", endpointUrlStr, reader)
-		if err != nil {
-			return err
-		}
-
-		req.Header.Set("Content-Type", "image/png")
-
-		resp, err := client.Do(req)
-		if err != nil {
-			return err
-		}
-
-		resp.Body.Close()
-
-		if resp.StatusCode == 409 {
-			log.Printf("409 conflict, retrying attempt #%v", i+1)
-			continue
-		}
-
-		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-			return fmt.Errorf("Unable to upload attachment: %v from %v. Unexpected status code in response: %v", attachmentName, filepath, resp.StatusCode)
-		}
-
-		return nil
-
-	}
-
-	return fmt.Errorf("Tried to add attachment 10 times, giving up")
-
-}
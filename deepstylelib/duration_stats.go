@@ -0,0 +1,115 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	DefaultDurationStatsDocId = "deepstyle_duration_stats"
+
+	// How much each finished job moves the rolling average
+	durationStatsWeight = 0.1
+)
+
+// BackendDurationStats is a rolling average of how long one executor
+// backend takes, normalized to a job with the default parameters
+type BackendDurationStats struct {
+	SecondsPerUnit float64 `json:"seconds_per_unit"`
+	Jobs           int     `json:"jobs"` // how many finished jobs went into the average
+	UpdatedAt      string  `json:"updated_at"`
+}
+
+type durationStatsDocument struct {
+	Revision string                          `json:"_rev,omitempty"`
+	Backends map[string]BackendDurationStats `json:"backends"`
+}
+
+// DurationStatsStore keeps the duration stats of every backend in a _local
+// doc of the job store.  Workers record finished jobs and the metrics
+// publisher reads them to estimate the backlog.
+type DurationStatsStore struct {
+	Database JobStore
+	DocId    string
+}
+
+// jobWorkUnits is how much work a job is compared to one with the default
+// parameters.  Time goes up with iterations and with the number of pixels.
+func jobWorkUnits(params JobParameters) float64 {
+	effective := params.WithDefaults()
+	defaults := DefaultJobParameters()
+	scale := float64(effective.ImageSize) / float64(defaults.ImageSize)
+	return float64(effective.Iterations) / float64(defaults.Iterations) * scale * scale
+}
+
+// Load returns the stats by backend, empty if nothing was recorded yet
+func (s DurationStatsStore) Load() (map[string]BackendDurationStats, error) {
+	statsDoc, err := s.retrieve()
+	return statsDoc.Backends, err
+}
+
+// Record adds a finished job, of the given work units, to the rolling
+// average for the backend
+func (s DurationStatsStore) Record(backend string, units float64, duration time.Duration) error {
+
+	if units <= 0 {
+		return fmt.Errorf("Invalid work units: %v", units)
+	}
+	secondsPerUnit := duration.Seconds() / units
+
+	for i := 1; i <= 10; i++ {
+
+		statsDoc, err := s.retrieve()
+		if err != nil {
+			return err
+		}
+		if statsDoc.Backends == nil {
+			statsDoc.Backends = map[string]BackendDurationStats{}
+		}
+		stats := statsDoc.Backends[backend]
+		if stats.Jobs == 0 {
+			stats.SecondsPerUnit = secondsPerUnit
+		} else {
+			stats.SecondsPerUnit += durationStatsWeight * (secondsPerUnit - stats.SecondsPerUnit)
+		}
+		stats.Jobs += 1
+		stats.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+		statsDoc.Backends[backend] = stats
+
+		err = s.Database.SaveLocal(s.DocId, statsDoc)
+		if err != nil && isConflict(err) {
+			log.Printf("409 conflict saving duration stats, retrying attempt #%v", i+1)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to save duration stats %v: %v", s.DocId, err)
+		}
+		return nil
+
+	}
+
+	return fmt.Errorf("Tried to save duration stats 10 times, giving up")
+
+}
+
+func (s DurationStatsStore) retrieve() (statsDoc durationStatsDocument, err error) {
+	// no jobs recorded yet if it's not found
+	_, err = s.Database.RetrieveLocal(s.DocId, &statsDoc)
+	return statsDoc, err
+}
+
+// recordJobDuration adds a successful run of the job to the stats of the
+// backend it ran on.  Failing to is only logged, the job itself is done.
+func recordJobDuration(config configuration, jobDoc JobDocument, duration time.Duration) {
+
+	if config.ExecutorName == "" {
+		return
+	}
+	store := DurationStatsStore{Database: config.Database, DocId: DefaultDurationStatsDocId}
+	units := jobWorkUnits(jobDoc.RequestedParameters())
+	if err := store.Record(config.ExecutorName, units, duration); err != nil {
+		log.Printf("Unable to record duration of job %v: %v", jobDoc.Id, err)
+	}
+
+}
@@ -0,0 +1,84 @@
+package deepstylelib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Type of the event sent for every job state transition
+const EventTypeJobStateChanged = "job.state_changed"
+
+// JobEvent is sent to webhook subscribers whenever a worker or the reaper
+// moves a job from one state to another
+type JobEvent struct {
+	Id         string `json:"id"` // unique, so receivers can drop redeliveries
+	Type       string `json:"type"`
+	JobId      string `json:"job_id"`
+	Owner      string `json:"owner"`
+	OldState   string `json:"old_state"`
+	NewState   string `json:"new_state"`
+	Attempt    int    `json:"attempt,omitempty"`
+	WorkerId   string `json:"worker_id,omitempty"`
+	CreatedAt  string `json:"created_at,omitempty"` // when the job was created
+	OccurredAt string `json:"occurred_at"`          // when the transition happened (RFC 3339)
+	ResultURL  string `json:"result_url,omitempty"` // the result_image attachment, once there is one
+}
+
+func newRandomId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// newJobEvent describes the transition of the job from oldState to the
+// state it's in now
+func newJobEvent(doc JobDocument, oldState string) JobEvent {
+
+	event := JobEvent{
+		Id:         newRandomId(),
+		Type:       EventTypeJobStateChanged,
+		JobId:      doc.Id,
+		Owner:      doc.Owner,
+		OldState:   oldState,
+		NewState:   doc.State,
+		Attempt:    doc.Attempts,
+		WorkerId:   doc.WorkerId,
+		CreatedAt:  doc.CreatedAt,
+		OccurredAt: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	switch doc.State {
+	case StateProcessingSuccessful, StateProcessingTimedOut:
+		event.ResultURL = doc.resultUrl()
+	}
+	return event
+
+}
+
+// resultUrl is where the result image can be downloaded, without any
+// credentials the worker itself connects with
+func (doc JobDocument) resultUrl() string {
+	if _, ok := doc.Attachments[ResultImageAttachment]; !ok {
+		return ""
+	}
+	return doc.config.Database.AttachmentURL(doc.Id, ResultImageAttachment)
+}
+
+// publishTransition records an event for the webhook subscribers if the
+// state of the job changed from oldState.  The transition has already been
+// saved, so failing to record it is only logged.
+func (doc JobDocument) publishTransition(oldState string) {
+
+	if doc.config.Events == nil || oldState == doc.State {
+		return
+	}
+	if err := doc.config.Events.Publish(newJobEvent(doc, oldState)); err != nil {
+		log.Printf("Unable to record %v -> %v event for job %v: %v", oldState, doc.State, doc.Id, err)
+	}
+
+}
@@ -0,0 +1,97 @@
+package deepstylelib
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Executor backends
+const (
+	ExecutorNeuralStyle = "neural_style" // th neural_style.lua (torch)
+	ExecutorCommand     = "command"      // any command with templated args
+	ExecutorFake        = "fake"         // deterministic pure-Go blend, for tests
+)
+
+// StyleTransferRequest describes a single style transfer for an Executor
+type StyleTransferRequest struct {
+	SourceImagePath string        // The photo (content image)
+	StyleImagePath  string        // The painting (style image)
+	OutputFilePath  string        // Where the executor should write the result
+	Parameters      JobParameters // Effective parameters, defaults filled in
+	GpuIndex        int           // Which GPU to use, if the machine has one
+	Progress        ProgressFunc  // Called as iterations complete, may be nil
+}
+
+// Executor applies the style of one image to another.  Implementations must
+// write the result to req.OutputFilePath and return whatever the underlying
+// process wrote to stdout/stderr, so it can be saved on the job.  When ctx is
+// done they must stop promptly, killing any process they started, and
+// return ctx.Err().
+type Executor interface {
+	Execute(ctx context.Context, req StyleTransferRequest) (stdOutAndErr []byte, err error)
+}
+
+// ExecutorConfig is the backend-agnostic configuration that an
+// ExecutorFactory uses to build an Executor.  Backends ignore any fields
+// they don't need.
+type ExecutorConfig struct {
+	Command string   // Binary to run (command backend, or override th)
+	Args    []string // Templated args (command backend)
+	WorkDir string   // Working directory for the process
+
+	// Kill jobs that run longer than this, 0 for no limit.  Jobs can ask
+	// for a shorter limit with the timeout_seconds parameter.
+	Timeout time.Duration `toml:"-"`
+}
+
+// ExecutorFactory builds an Executor from its configuration
+type ExecutorFactory func(config ExecutorConfig) (Executor, error)
+
+var (
+	executorRegistryMutex sync.RWMutex
+	executorRegistry      = map[string]ExecutorFactory{}
+)
+
+// RegisterExecutor makes an executor backend available by name.  Registering
+// the same name twice replaces the earlier factory.
+func RegisterExecutor(name string, factory ExecutorFactory) {
+	executorRegistryMutex.Lock()
+	defer executorRegistryMutex.Unlock()
+	executorRegistry[name] = factory
+}
+
+// NewExecutor builds the executor backend registered under name
+func NewExecutor(name string, config ExecutorConfig) (Executor, error) {
+
+	executorRegistryMutex.RLock()
+	factory, ok := executorRegistry[name]
+	executorRegistryMutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown executor: %v.  Valid executors: %v", name, ExecutorNames())
+	}
+	executor, err := factory(config)
+	if err != nil || config.Timeout <= 0 {
+		return executor, err
+	}
+	return timeoutExecutor{Executor: executor, timeout: config.Timeout}, nil
+
+}
+
+// ExecutorNames returns the names of all registered executor backends
+func ExecutorNames() []string {
+
+	executorRegistryMutex.RLock()
+	defer executorRegistryMutex.RUnlock()
+
+	names := []string{}
+	for name := range executorRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+
+}
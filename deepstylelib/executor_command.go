@@ -0,0 +1,85 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"text/template"
+)
+
+func init() {
+	RegisterExecutor(ExecutorCommand, NewCommandExecutor)
+}
+
+// CommandExecutor runs an arbitrary style transfer command.  Each arg is a
+// text/template evaluated against CommandArgs, eg:
+//
+//	-content {{.SourceImagePath}} -style {{.StyleImagePath}} -out {{.OutputFilePath}}
+type CommandExecutor struct {
+	Command string
+	Args    []*template.Template
+	WorkDir string
+}
+
+// CommandArgs are the values available to CommandExecutor arg templates
+type CommandArgs struct {
+	StyleTransferRequest
+	GpuId string // The GPU index if a GPU is available, otherwise "-1"
+}
+
+func NewCommandExecutor(config ExecutorConfig) (Executor, error) {
+
+	if config.Command == "" {
+		return nil, fmt.Errorf("The %v executor requires a command", ExecutorCommand)
+	}
+
+	executor := CommandExecutor{
+		Command: config.Command,
+		WorkDir: config.WorkDir,
+	}
+
+	for i, arg := range config.Args {
+		tmpl, err := template.New(fmt.Sprintf("arg%v", i)).Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid arg template %q: %v", arg, err)
+		}
+		executor.Args = append(executor.Args, tmpl)
+	}
+
+	return executor, nil
+
+}
+
+func (e CommandExecutor) Execute(ctx context.Context, req StyleTransferRequest) (stdOutAndErr []byte, err error) {
+
+	args, err := e.renderArgs(CommandArgs{
+		StyleTransferRequest: req,
+		GpuId:                gpuId(hasGPU(), req.GpuIndex),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(e.Command, args...)
+	cmd.Dir = e.WorkDir
+
+	log.Printf("Invoking %v %v", e.Command, args)
+	return runCommand(ctx, cmd, req.Progress)
+
+}
+
+func (e CommandExecutor) renderArgs(commandArgs CommandArgs) (args []string, err error) {
+
+	args = []string{}
+	for _, tmpl := range e.Args {
+		var buffer bytes.Buffer
+		if err := tmpl.Execute(&buffer, commandArgs); err != nil {
+			return nil, err
+		}
+		args = append(args, buffer.String())
+	}
+	return args, nil
+
+}
@@ -0,0 +1,132 @@
+package deepstylelib
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path"
+	"strings"
+
+	_ "image/gif"
+)
+
+func init() {
+	RegisterExecutor(ExecutorFake, NewFakeExecutor)
+}
+
+// FakeExecutor doesn't need torch or a GPU.  It writes a 50/50 blend of the
+// source and style images, so the output is deterministic for a given pair
+// of inputs and can be asserted on in tests.
+type FakeExecutor struct{}
+
+func NewFakeExecutor(config ExecutorConfig) (Executor, error) {
+	return FakeExecutor{}, nil
+}
+
+func (e FakeExecutor) Execute(ctx context.Context, req StyleTransferRequest) (stdOutAndErr []byte, err error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	sourceImage, err := decodeImageFile(req.SourceImagePath)
+	if err != nil {
+		return nil, err
+	}
+	styleImage, err := decodeImageFile(req.StyleImagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	result := blendImages(sourceImage, styleImage)
+
+	if err := encodeImageFile(result, req.OutputFilePath); err != nil {
+		return nil, err
+	}
+
+	// the blend is done in one go, so report it as all iterations at once
+	if req.Progress != nil {
+		req.Progress(req.Parameters.Iterations, req.Parameters.Iterations)
+	}
+
+	stdOutAndErr = []byte(fmt.Sprintf(
+		"Fake executor blended %v and %v into %v",
+		req.SourceImagePath,
+		req.StyleImagePath,
+		req.OutputFilePath,
+	))
+	return stdOutAndErr, nil
+
+}
+
+// blendImages averages each pixel of source with the corresponding pixel of
+// style, with style scaled to the bounds of source.
+func blendImages(source, style image.Image) image.Image {
+
+	sourceBounds := source.Bounds()
+	styleBounds := style.Bounds()
+	result := image.NewRGBA(image.Rect(0, 0, sourceBounds.Dx(), sourceBounds.Dy()))
+
+	for y := 0; y < sourceBounds.Dy(); y++ {
+		for x := 0; x < sourceBounds.Dx(); x++ {
+
+			styleX := styleBounds.Min.X + x*styleBounds.Dx()/sourceBounds.Dx()
+			styleY := styleBounds.Min.Y + y*styleBounds.Dy()/sourceBounds.Dy()
+
+			sr, sg, sb, _ := source.At(sourceBounds.Min.X+x, sourceBounds.Min.Y+y).RGBA()
+			tr, tg, tb, _ := style.At(styleX, styleY).RGBA()
+
+			result.Set(x, y, color.RGBA{
+				R: uint8((sr + tr) >> 9),
+				G: uint8((sg + tg) >> 9),
+				B: uint8((sb + tb) >> 9),
+				A: 0xff,
+			})
+		}
+	}
+
+	return result
+
+}
+
+func decodeImageFile(filepath string) (image.Image, error) {
+
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode image %v: %v", filepath, err)
+	}
+	return img, nil
+
+}
+
+// encodeImageFile writes img as png if the file has a .png extension,
+// otherwise as jpeg.
+func encodeImageFile(img image.Image, filepath string) error {
+
+	f, err := os.Create(filepath)
+	if err != nil {
+		return err
+	}
+
+	if strings.ToLower(path.Ext(filepath)) == ".png" {
+		err = png.Encode(f, img)
+	} else {
+		err = jpeg.Encode(f, img, &jpeg.Options{Quality: 90})
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+
+}
@@ -0,0 +1,85 @@
+package deepstylelib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+)
+
+const (
+	DefaultNeuralStyleCommand = "th"
+	DefaultNeuralStyleWorkDir = "/home/ubuntu/neural-style"
+)
+
+func init() {
+	RegisterExecutor(ExecutorNeuralStyle, NewNeuralStyleExecutor)
+}
+
+// NeuralStyleExecutor runs jcjohnson/neural-style via torch
+type NeuralStyleExecutor struct {
+	Command string // Defaults to th
+	WorkDir string // Where neural_style.lua lives
+}
+
+func NewNeuralStyleExecutor(config ExecutorConfig) (Executor, error) {
+
+	executor := NeuralStyleExecutor{
+		Command: config.Command,
+		WorkDir: config.WorkDir,
+	}
+	if executor.Command == "" {
+		executor.Command = DefaultNeuralStyleCommand
+	}
+	if executor.WorkDir == "" {
+		executor.WorkDir = DefaultNeuralStyleWorkDir
+	}
+	return executor, nil
+
+}
+
+func (e NeuralStyleExecutor) Execute(ctx context.Context, req StyleTransferRequest) (stdOutAndErr []byte, err error) {
+
+	if !torchInstalled() {
+		return nil, fmt.Errorf("Torch not installed, unable to run neural-style.  Use the %v executor for testing", ExecutorFake)
+	}
+
+	useGpu := hasGPU()
+	log.Printf("useGpu: %v", useGpu)
+
+	cmd := e.generateCommand(req, useGpu)
+	cmd.Dir = e.WorkDir
+
+	// Execute the command and get the output
+	log.Printf("Invoking neural-style")
+	return runCommand(ctx, cmd, req.Progress)
+
+}
+
+func (e NeuralStyleExecutor) generateCommand(req StyleTransferRequest, useGpu bool) (cmd *exec.Cmd) {
+
+	args := []string{
+		"neural_style.lua",
+		"-gpu",
+		gpuId(useGpu, req.GpuIndex),
+		"-style_image",
+		req.StyleImagePath,
+		"-content_image",
+		req.SourceImagePath,
+		"-output_image",
+		req.OutputFilePath,
+	}
+	args = append(args, req.Parameters.NeuralStyleArgs()...)
+
+	return exec.Command(e.Command, args...)
+
+}
+
+// gpuId returns the neural-style -gpu arg: the GPU index, or -1 for cpu mode
+func gpuId(useGpu bool, gpuIndex int) string {
+	if useGpu {
+		return strconv.Itoa(gpuIndex)
+	}
+	return "-1"
+}
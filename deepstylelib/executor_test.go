@@ -0,0 +1,251 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/gif"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeExecutorIsDeterministic(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "deepstyle_executor")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sourcePath := filepath.Join(dir, "source.png")
+	stylePath := filepath.Join(dir, "style.png")
+	assert.NoError(t, encodeImageFile(solidImage(4, 4, color.RGBA{R: 200, A: 0xff}), sourcePath))
+	assert.NoError(t, encodeImageFile(solidImage(2, 2, color.RGBA{B: 100, A: 0xff}), stylePath))
+
+	executor, err := NewExecutor(ExecutorFake, ExecutorConfig{})
+	assert.NoError(t, err)
+
+	outputs := [][]byte{}
+	for i := 0; i < 2; i++ {
+		req := StyleTransferRequest{
+			SourceImagePath: sourcePath,
+			StyleImagePath:  stylePath,
+			OutputFilePath:  filepath.Join(dir, "result.png"),
+		}
+		_, err := executor.Execute(context.Background(), req)
+		assert.NoError(t, err)
+		output, err := ioutil.ReadFile(req.OutputFilePath)
+		assert.NoError(t, err)
+		outputs = append(outputs, output)
+	}
+	assert.True(t, bytes.Equal(outputs[0], outputs[1]))
+
+	result, err := decodeImageFile(filepath.Join(dir, "result.png"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, result.Bounds().Dx())
+	r, g, b, _ := result.At(3, 3).RGBA()
+	assert.Equal(t, []uint32{100, 0, 50}, []uint32{r >> 8, g >> 8, b >> 8})
+
+}
+
+func TestCommandExecutorArgs(t *testing.T) {
+
+	_, err := NewExecutor(ExecutorCommand, ExecutorConfig{})
+	assert.Error(t, err)
+
+	executor, err := NewExecutor(ExecutorCommand, ExecutorConfig{
+		Command: "stylize",
+		Args:    []string{"-in", "{{.SourceImagePath}}", "-gpu={{.GpuId}}"},
+	})
+	assert.NoError(t, err)
+
+	args, err := executor.(CommandExecutor).renderArgs(CommandArgs{
+		StyleTransferRequest: StyleTransferRequest{SourceImagePath: "/tmp/photo.jpg"},
+		GpuId:                "-1",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-in", "/tmp/photo.jpg", "-gpu=-1"}, args)
+
+	_, err = NewExecutor("no_such_executor", ExecutorConfig{})
+	assert.Error(t, err)
+
+}
+
+func TestCommandExecutorCancel(t *testing.T) {
+
+	// the shell's child sleep is killed too, otherwise Execute would block
+	// until it exits
+	executor, err := NewExecutor(ExecutorCommand, ExecutorConfig{
+		Command: "sh",
+		Args:    []string{"-c", "sleep 30; echo done"},
+	})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	startedAt := time.Now()
+	_, err = executor.Execute(ctx, StyleTransferRequest{})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(startedAt) < 10*time.Second)
+
+}
+
+func TestCommandExecutorProgress(t *testing.T) {
+
+	executor, err := NewExecutor(ExecutorCommand, ExecutorConfig{
+		Command: "sh",
+		Args:    []string{"-c", "printf 'Iteration 50 / 100\\n  Content 1 loss: 1\\nIterat'; printf 'ion 100 / 100\\n' >&2"},
+	})
+	assert.NoError(t, err)
+
+	progress := [][2]int{}
+	output, err := executor.Execute(context.Background(), StyleTransferRequest{
+		Progress: func(iteration, totalIterations int) {
+			progress = append(progress, [2]int{iteration, totalIterations})
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, [][2]int{{50, 100}, {100, 100}}, progress)
+	assert.Contains(t, string(output), "Content 1 loss")
+
+	assert.Equal(t, 42, newJobProgress(420, 1000).Percent)
+
+}
+
+func TestExecutorTimeout(t *testing.T) {
+
+	executor, err := NewExecutor(ExecutorCommand, ExecutorConfig{
+		Command: "sleep",
+		Args:    []string{"30"},
+		Timeout: 100 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	_, err = executor.Execute(context.Background(), StyleTransferRequest{})
+	timeoutErr, ok := err.(*TimeoutError)
+	assert.True(t, ok)
+	assert.Equal(t, 100*time.Millisecond, timeoutErr.Limit)
+
+	// cancellation isn't reported as a timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = executor.Execute(ctx, StyleTransferRequest{})
+	assert.Equal(t, context.Canceled, err)
+
+}
+
+func TestNewestIntermediateResult(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "deepstyle_intermediate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	outputFilePath := filepath.Join(dir, "job_result_image.jpg")
+
+	_, _, ok := newestIntermediateResult(outputFilePath)
+	assert.False(t, ok)
+
+	for _, name := range []string{"job_result_image_100.jpg", "job_result_image_900.jpg", "job_result_image_1000.png", "job_result_image_x.jpg"} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte{}, 0644))
+	}
+
+	path, iteration, ok := newestIntermediateResult(outputFilePath)
+	assert.True(t, ok)
+	assert.Equal(t, 900, iteration)
+	assert.Equal(t, filepath.Join(dir, "job_result_image_900.jpg"), path)
+
+}
+
+func TestBuildTimelapseGif(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "deepstyle_timelapse")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	framePaths := []string{
+		filepath.Join(dir, "result_100.png"),
+		filepath.Join(dir, "result_200.jpg"),
+		filepath.Join(dir, "result.png"),
+	}
+	assert.NoError(t, encodeImageFile(solidImage(2, 2, color.RGBA{R: 0xff, A: 0xff}), framePaths[0]))
+	assert.NoError(t, encodeImageFile(solidImage(8, 8, color.RGBA{G: 0xff, A: 0xff}), framePaths[1]))
+	assert.NoError(t, encodeImageFile(solidImage(4, 4, color.RGBA{B: 0xff, A: 0xff}), framePaths[2]))
+
+	gifPath := filepath.Join(dir, "timelapse.gif")
+	assert.NoError(t, buildTimelapseGif(framePaths, gifPath))
+
+	f, err := os.Open(gifPath)
+	assert.NoError(t, err)
+	defer f.Close()
+	animation, err := gif.DecodeAll(f)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 3, len(animation.Image))
+	assert.Equal(t, []int{timelapseFrameDelay, timelapseFrameDelay, timelapseFinalDelay}, animation.Delay)
+	for _, frame := range animation.Image {
+		assert.Equal(t, 4, frame.Bounds().Dx())
+	}
+	r, _, _, _ := animation.Image[0].At(1, 1).RGBA()
+	assert.Equal(t, uint32(0xff), r>>8)
+
+	assert.Equal(t, "snapshot_00200", snapshotAttachmentName(200))
+
+}
+
+func solidImage(width, height int, c color.Color) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestNeuralStyleParameters(t *testing.T) {
+
+	iterations := JobParameters{Iterations: 5001}
+	assert.Error(t, iterations.Validate())
+	optimizer := JobParameters{Optimizer: "sgd"}
+	assert.Error(t, optimizer.Validate())
+
+	seed, styleWeight, tvWeight := 42, 2e2, 0.0
+	params := JobParameters{Iterations: 200, StyleWeight: &styleWeight, TVWeight: &tvWeight, Seed: &seed, OutputFormat: "PNG"}
+	assert.NoError(t, params.Validate())
+	negativeWeight := -1.0
+	assert.Error(t, JobParameters{TVWeight: &negativeWeight}.Validate())
+
+	// a weight of 0 survives being saved on the job doc
+	paramsBytes, err := json.Marshal(params)
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(string(paramsBytes), `"tv_weight":0`))
+
+	effective := params.WithDefaults()
+	assert.Equal(t, OutputFormatPng, effective.OutputFormat)
+	assert.Equal(t, 512, effective.ImageSize)
+
+	executor := NeuralStyleExecutor{Command: "th"}
+	cmd := executor.generateCommand(StyleTransferRequest{Parameters: effective}, false)
+	assert.Equal(t, []string{
+		"th", "neural_style.lua", "-gpu", "-1",
+		"-style_image", "", "-content_image", "", "-output_image", "",
+		"-num_iterations", "200",
+		"-image_size", "512",
+		"-content_weight", "5",
+		"-style_weight", "200",
+		"-tv_weight", "0",
+		"-style_scale", "1",
+		"-optimizer", "lbfgs",
+		"-init", "random",
+		"-seed", "42",
+		"-save_iter", "100",
+	}, cmd.Args)
+
+}
@@ -0,0 +1,541 @@
+// Package fakeredis is an in-memory stand-in for Redis, for tests.  It
+// speaks just enough RESP for deepstylelib's RedisStreamQueue: streams with
+// XADD, consumer groups with XGROUP CREATE, XREADGROUP (blocking, and
+// re-reading pending entries), XAUTOCLAIM and XACK, plus PING.
+package fakeredis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a fake Redis listening on localhost
+type Server struct {
+	Addr string
+
+	listener net.Listener
+	mutex    sync.Mutex
+	streams  map[string]*stream
+	changed  chan struct{} // closed and replaced whenever an entry is added
+	closed   bool
+	conns    map[net.Conn]bool
+	lastId   entryId
+}
+
+// Entry is an entry in a stream
+type Entry struct {
+	Id     string
+	Fields map[string]string
+}
+
+type entryId struct {
+	millis   int64
+	sequence int64
+}
+
+type stream struct {
+	entries []Entry
+	groups  map[string]*group
+}
+
+type group struct {
+	next    int                  // index of the next entry to deliver
+	pending map[string]*delivery // entries delivered but not acked, by entry id
+}
+
+// delivery is who a pending entry was last delivered to, and when
+type delivery struct {
+	consumer    string
+	deliveredAt time.Time
+}
+
+// NewServer starts a fake Redis.  Call Close when done with it.
+func NewServer() *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("fakeredis: failed to listen: %v", err))
+	}
+	s := &Server{
+		Addr:     listener.Addr().String(),
+		listener: listener,
+		streams:  map[string]*stream{},
+		changed:  make(chan struct{}),
+		conns:    map[net.Conn]bool{},
+	}
+	go s.accept()
+	return s
+}
+
+// Close releases any blocked reads, drops the clients and stops listening
+func (s *Server) Close() {
+	s.mutex.Lock()
+	s.closed = true
+	close(s.changed)
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.listener.Close()
+}
+
+// DropConnections disconnects every client, as if the server restarted
+// without losing data
+func (s *Server) DropConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Add adds an entry to the stream, like XADD with an id of *, and returns
+// its id
+func (s *Server) Add(streamName string, fields map[string]string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.add(streamName, fields)
+}
+
+// Entries returns a copy of the entries in the stream
+func (s *Server) Entries(streamName string) []Entry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entries := []Entry{}
+	if st, ok := s.streams[streamName]; ok {
+		for _, entry := range st.entries {
+			fields := map[string]string{}
+			for field, value := range entry.Fields {
+				fields[field] = value
+			}
+			entries = append(entries, Entry{Id: entry.Id, Fields: fields})
+		}
+	}
+	return entries
+}
+
+// Pending returns the ids of the entries delivered to the group but not
+// yet acked
+func (s *Server) Pending(streamName, groupName string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ids := []string{}
+	if st, ok := s.streams[streamName]; ok {
+		if g, ok := st.groups[groupName]; ok {
+			for id := range g.pending {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return parseEntryId(ids[i]).less(parseEntryId(ids[j])) })
+	return ids
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.mutex.Unlock()
+		go s.serve(conn)
+	}
+}
+
+// serve runs the commands a client sends, one at a time
+func (s *Server) serve(conn net.Conn) {
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(encode(s.run(args))); err != nil {
+			return
+		}
+	}
+
+}
+
+// status and errorReply are simple string and error replies, other
+// strings are bulk strings
+type status string
+type errorReply string
+
+func (s *Server) run(args []string) interface{} {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return status("PONG")
+	case "XADD":
+		return s.xadd(args[1:])
+	case "XGROUP":
+		return s.xgroup(args[1:])
+	case "XREADGROUP":
+		return s.xreadgroup(args[1:])
+	case "XAUTOCLAIM":
+		return s.xautoclaim(args[1:])
+	case "XACK":
+		return s.xack(args[1:])
+	default:
+		return errorReply(fmt.Sprintf("ERR unknown command '%v'", args[0]))
+	}
+}
+
+// XADD key * field value [field value ...]
+func (s *Server) xadd(args []string) interface{} {
+	if len(args) < 4 || len(args)%2 != 0 || args[1] != "*" {
+		return errorReply("ERR wrong number of arguments for 'xadd' command")
+	}
+	fields := map[string]string{}
+	for i := 2; i < len(args); i += 2 {
+		fields[args[i]] = args[i+1]
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.add(args[0], fields)
+}
+
+// XGROUP CREATE key group 0|$ [MKSTREAM]
+func (s *Server) xgroup(args []string) interface{} {
+
+	if len(args) < 4 || strings.ToUpper(args[0]) != "CREATE" {
+		return errorReply("ERR unsupported XGROUP subcommand")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st, ok := s.streams[args[1]]
+	if !ok {
+		if len(args) < 5 || strings.ToUpper(args[4]) != "MKSTREAM" {
+			return errorReply("ERR The XGROUP subcommand requires the key to exist.")
+		}
+		st = &stream{groups: map[string]*group{}}
+		s.streams[args[1]] = st
+	}
+	if _, ok := st.groups[args[2]]; ok {
+		return errorReply("BUSYGROUP Consumer Group name already exists")
+	}
+	g := &group{pending: map[string]*delivery{}}
+	if args[3] == "$" {
+		g.next = len(st.entries)
+	}
+	st.groups[args[2]] = g
+	return status("OK")
+
+}
+
+// XREADGROUP GROUP group consumer [COUNT n] [BLOCK ms] STREAMS key id, for
+// a single stream.  An id of > reads new entries, any other id re-reads the
+// consumer's pending entries after it.
+func (s *Server) xreadgroup(args []string) interface{} {
+
+	if len(args) < 6 || strings.ToUpper(args[0]) != "GROUP" {
+		return errorReply("ERR syntax error")
+	}
+	groupName, consumer := args[1], args[2]
+	count := 0
+	block := time.Duration(-1)
+	i := 3
+	for ; i < len(args) && strings.ToUpper(args[i]) != "STREAMS"; i += 2 {
+		if i+1 >= len(args) {
+			return errorReply("ERR syntax error")
+		}
+		value, err := strconv.Atoi(args[i+1])
+		if err != nil {
+			return errorReply("ERR value is not an integer or out of range")
+		}
+		switch strings.ToUpper(args[i]) {
+		case "COUNT":
+			count = value
+		case "BLOCK":
+			block = time.Duration(value) * time.Millisecond
+		default:
+			return errorReply("ERR syntax error")
+		}
+	}
+	if i+3 != len(args) {
+		return errorReply("ERR only a single stream is supported")
+	}
+	streamName, after := args[i+1], args[i+2]
+
+	var deadline <-chan time.Time
+	if block > 0 {
+		deadline = time.After(block)
+	}
+	for {
+		s.mutex.Lock()
+		st, ok := s.streams[streamName]
+		var g *group
+		if ok {
+			g = st.groups[groupName]
+		}
+		if g == nil {
+			s.mutex.Unlock()
+			return errorReply(fmt.Sprintf("NOGROUP No such key '%v' or consumer group '%v'", streamName, groupName))
+		}
+
+		if after != ">" {
+			entries := st.pendingEntries(g, consumer, parseEntryId(after), count)
+			s.mutex.Unlock()
+			return []interface{}{[]interface{}{streamName, entries}}
+		}
+
+		if g.next < len(st.entries) {
+			entries := []interface{}{}
+			for ; g.next < len(st.entries) && (count <= 0 || len(entries) < count); g.next++ {
+				entry := st.entries[g.next]
+				g.pending[entry.Id] = &delivery{consumer: consumer, deliveredAt: time.Now()}
+				entries = append(entries, entry.reply())
+			}
+			s.mutex.Unlock()
+			return []interface{}{[]interface{}{streamName, entries}}
+		}
+
+		changed, closed := s.changed, s.closed
+		s.mutex.Unlock()
+		if block < 0 || closed {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil
+		}
+	}
+
+}
+
+// XAUTOCLAIM key group consumer min-idle-time start [COUNT n] gives the
+// consumer the pending entries from start on that have been idle for at
+// least min-idle-time milliseconds.  The reply has the id to carry on from
+// (0-0 once the end is reached), the claimed entries and the ids of deleted
+// ones, which is always empty since entries can't be deleted.
+func (s *Server) xautoclaim(args []string) interface{} {
+
+	if len(args) != 5 && len(args) != 7 {
+		return errorReply("ERR wrong number of arguments for 'xautoclaim' command")
+	}
+	minIdle, err := strconv.Atoi(args[3])
+	if err != nil {
+		return errorReply("ERR value is not an integer or out of range")
+	}
+	count := 100
+	if len(args) == 7 {
+		if strings.ToUpper(args[5]) != "COUNT" {
+			return errorReply("ERR syntax error")
+		}
+		if count, err = strconv.Atoi(args[6]); err != nil || count < 1 {
+			return errorReply("ERR COUNT must be > 0")
+		}
+	}
+	streamName, groupName, consumer, start := args[0], args[1], args[2], parseEntryId(args[4])
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st, ok := s.streams[streamName]
+	var g *group
+	if ok {
+		g = st.groups[groupName]
+	}
+	if g == nil {
+		return errorReply(fmt.Sprintf("NOGROUP No such key '%v' or consumer group '%v'", streamName, groupName))
+	}
+
+	now := time.Now()
+	cursor := "0-0"
+	entries := []interface{}{}
+	for _, entry := range st.entries {
+		id := parseEntryId(entry.Id)
+		pending, ok := g.pending[entry.Id]
+		if !ok || id.less(start) || now.Sub(pending.deliveredAt) < time.Duration(minIdle)*time.Millisecond {
+			continue
+		}
+		if len(entries) >= count {
+			cursor = entry.Id
+			break
+		}
+		g.pending[entry.Id] = &delivery{consumer: consumer, deliveredAt: now}
+		entries = append(entries, entry.reply())
+	}
+	return []interface{}{cursor, entries, []interface{}{}}
+
+}
+
+// XACK key group id [id ...]
+func (s *Server) xack(args []string) interface{} {
+	if len(args) < 3 {
+		return errorReply("ERR wrong number of arguments for 'xack' command")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	acked := int64(0)
+	if st, ok := s.streams[args[0]]; ok {
+		if g, ok := st.groups[args[1]]; ok {
+			for _, id := range args[2:] {
+				if _, ok := g.pending[id]; ok {
+					delete(g.pending, id)
+					acked += 1
+				}
+			}
+		}
+	}
+	return acked
+}
+
+func (s *Server) add(streamName string, fields map[string]string) string {
+
+	st, ok := s.streams[streamName]
+	if !ok {
+		st = &stream{groups: map[string]*group{}}
+		s.streams[streamName] = st
+	}
+
+	id := entryId{millis: time.Now().UnixNano() / int64(time.Millisecond)}
+	if !s.lastId.less(id) {
+		id = entryId{millis: s.lastId.millis, sequence: s.lastId.sequence + 1}
+	}
+	s.lastId = id
+
+	entry := Entry{Id: id.String(), Fields: fields}
+	st.entries = append(st.entries, entry)
+
+	if !s.closed {
+		close(s.changed)
+		s.changed = make(chan struct{})
+	}
+	return entry.Id
+
+}
+
+// pendingEntries returns the consumer's pending entries after the id
+func (st *stream) pendingEntries(g *group, consumer string, after entryId, count int) []interface{} {
+	entries := []interface{}{}
+	for _, entry := range st.entries {
+		if count > 0 && len(entries) >= count {
+			break
+		}
+		pending, ok := g.pending[entry.Id]
+		if !ok || pending.consumer != consumer || !after.less(parseEntryId(entry.Id)) {
+			continue
+		}
+		entries = append(entries, entry.reply())
+	}
+	return entries
+}
+
+// reply is the entry as XREADGROUP returns it, its id then its fields and
+// values
+func (entry Entry) reply() []interface{} {
+	fields := []string{}
+	for field := range entry.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	fieldValues := []interface{}{}
+	for _, field := range fields {
+		fieldValues = append(fieldValues, field, entry.Fields[field])
+	}
+	return []interface{}{entry.Id, fieldValues}
+}
+
+func parseEntryId(id string) entryId {
+	parts := strings.SplitN(id, "-", 2)
+	millis, _ := strconv.ParseInt(parts[0], 10, 64)
+	sequence := int64(0)
+	if len(parts) == 2 {
+		sequence, _ = strconv.ParseInt(parts[1], 10, 64)
+	}
+	return entryId{millis: millis, sequence: sequence}
+}
+
+func (id entryId) less(other entryId) bool {
+	return id.millis < other.millis || (id.millis == other.millis && id.sequence < other.sequence)
+}
+
+func (id entryId) String() string {
+	return fmt.Sprintf("%v-%v", id.millis, id.sequence)
+}
+
+// readCommand reads a command sent as a RESP array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("Expected an array, got %q", line)
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || length < 1 {
+		return nil, fmt.Errorf("Invalid array length %q", line)
+	}
+
+	args := make([]string, length)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("Expected a bulk string, got %q", line)
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("Invalid bulk string length %q", line)
+		}
+		bulk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, bulk); err != nil {
+			return nil, err
+		}
+		args[i] = string(bulk[:size])
+	}
+	return args, nil
+
+}
+
+// encode writes a reply in RESP
+func encode(reply interface{}) []byte {
+	switch value := reply.(type) {
+	case nil:
+		return []byte("*-1\r\n")
+	case status:
+		return []byte(fmt.Sprintf("+%v\r\n", value))
+	case errorReply:
+		return []byte(fmt.Sprintf("-%v\r\n", value))
+	case int64:
+		return []byte(fmt.Sprintf(":%d\r\n", value))
+	case string:
+		return []byte(fmt.Sprintf("$%d\r\n%v\r\n", len(value), value))
+	case []interface{}:
+		encoded := []byte(fmt.Sprintf("*%d\r\n", len(value)))
+		for _, item := range value {
+			encoded = append(encoded, encode(item)...)
+		}
+		return encoded
+	default:
+		panic(fmt.Sprintf("fakeredis: can't encode %T", reply))
+	}
+}
@@ -0,0 +1,141 @@
+package fakesyncgw
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+type attachment struct {
+	contentType string
+	data        []byte
+	revpos      uint64
+}
+
+// digest is in the CouchDB format, a base64 md5
+func (att *attachment) digest() string {
+	sum := md5.Sum(att.data)
+	return "md5-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (att *attachment) stub() map[string]interface{} {
+	return map[string]interface{}{
+		"content_type": att.contentType,
+		"digest":       att.digest(),
+		"length":       len(att.data),
+		"revpos":       att.revpos,
+		"stub":         true,
+	}
+}
+
+// serveAttachment handles GET and PUT of /db/doc/attachment.  A PUT
+// creates the doc if it doesn't exist yet, like Sync Gateway does.
+func (s *Server) serveAttachment(w http.ResponseWriter, r *http.Request, docId, attachmentName string) {
+
+	switch r.Method {
+	case "GET", "HEAD":
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		doc, ok := s.docs[docId]
+		if !ok || doc.deleted {
+			writeError(w, http.StatusNotFound, "not_found", "missing")
+			return
+		}
+		att, ok := doc.attachments[attachmentName]
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found", "missing attachment")
+			return
+		}
+		w.Header().Set("Content-Type", att.contentType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(att.data)
+	case "PUT":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		s.putAttachment(w, docId, attachmentName, r.URL.Query().Get("rev"), r.Header.Get("Content-Type"), data)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method)
+	}
+
+}
+
+func (s *Server) putAttachment(w http.ResponseWriter, docId, attachmentName, rev, contentType string, data []byte) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	doc, exists := s.docs[docId]
+	currentRev := ""
+	if exists && !doc.deleted {
+		currentRev = doc.revision
+	}
+	if rev != currentRev {
+		writeError(w, http.StatusConflict, "conflict", "Document revision conflict")
+		return
+	}
+	if !exists || doc.deleted {
+		doc = &document{body: map[string]interface{}{}}
+		s.docs[docId] = doc
+	}
+	if doc.attachments == nil {
+		doc.attachments = map[string]*attachment{}
+	}
+
+	doc.attachments[attachmentName] = &attachment{
+		contentType: contentType,
+		data:        data,
+		revpos:      s.sequence + 1,
+	}
+	s.updateDocument(docId, doc, doc.body, false)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"ok": true, "id": docId, "rev": doc.revision})
+
+}
+
+// updatedAttachments works out the attachments of a doc being PUT.  Stubs
+// keep the existing attachment, inline base64 data replaces it, and any
+// attachment left out of _attachments is removed.
+func (doc *document) updatedAttachments(attachmentsJSON interface{}, revpos uint64) (map[string]*attachment, error) {
+
+	attachments := map[string]*attachment{}
+	if attachmentsJSON == nil {
+		return attachments, nil
+	}
+
+	attachmentsMap, ok := attachmentsJSON.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("_attachments must be an object")
+	}
+
+	for name, attJSON := range attachmentsMap {
+		attMap, ok := attJSON.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Attachment %v must be an object", name)
+		}
+		if stub, _ := attMap["stub"].(bool); stub {
+			existing, ok := doc.attachments[name]
+			if !ok {
+				return nil, fmt.Errorf("Stub for missing attachment %v", name)
+			}
+			attachments[name] = existing
+			continue
+		}
+		encoded, _ := attMap["data"].(string)
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("Attachment %v has invalid data: %v", name, err)
+		}
+		contentType, _ := attMap["content_type"].(string)
+		attachments[name] = &attachment{
+			contentType: contentType,
+			data:        data,
+			revpos:      revpos,
+		}
+	}
+	return attachments, nil
+
+}
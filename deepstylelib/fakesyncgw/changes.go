@@ -0,0 +1,97 @@
+package fakesyncgw
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a longpoll _changes request waits for a change when the request
+// doesn't pass a timeout
+const DefaultLongpollTimeout = 60 * time.Second
+
+// serveChanges handles _changes with the since, limit, include_docs,
+// timeout and feed=longpoll|normal params.  Only the latest revision of each
+// doc is listed, at the sequence it was last changed.
+func (s *Server) serveChanges(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+
+	since := parseSequence(query.Get("since"))
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	includeDocs := query.Get("include_docs") == "true"
+
+	timeout := DefaultLongpollTimeout
+	if timeoutMs, err := strconv.Atoi(query.Get("timeout")); err == nil {
+		timeout = time.Duration(timeoutMs) * time.Millisecond
+	}
+	deadline := time.After(timeout)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// a longpoll waits until there is something to return
+	for query.Get("feed") == "longpoll" && s.sequence <= since && !s.closed {
+		changed := s.changed
+		s.mutex.Unlock()
+		select {
+		case <-changed:
+			s.mutex.Lock()
+			continue
+		case <-deadline:
+		case <-r.Context().Done():
+		}
+		s.mutex.Lock()
+		break
+	}
+
+	changedDocIds := []string{}
+	for docId, doc := range s.docs {
+		if doc.sequence > since {
+			changedDocIds = append(changedDocIds, docId)
+		}
+	}
+	sort.Slice(changedDocIds, func(i, j int) bool {
+		return s.docs[changedDocIds[i]].sequence < s.docs[changedDocIds[j]].sequence
+	})
+	if limit > 0 && len(changedDocIds) > limit {
+		changedDocIds = changedDocIds[:limit]
+	}
+
+	results := []map[string]interface{}{}
+	lastSequence := since
+	for _, docId := range changedDocIds {
+		doc := s.docs[docId]
+		result := map[string]interface{}{
+			"seq":     s.sequenceValue(doc.sequence),
+			"id":      docId,
+			"changes": []map[string]interface{}{{"rev": doc.revision}},
+		}
+		if doc.deleted {
+			result["deleted"] = true
+		}
+		if includeDocs {
+			result["doc"] = doc.render()
+		}
+		results = append(results, result)
+		lastSequence = doc.sequence
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"results":  results,
+		"last_seq": s.sequenceValue(lastSequence),
+	})
+
+}
+
+// parseSequence accepts plain, compound (eg "12:34") and CouchDB (eg
+// "12-g1AAAA...") sequences.  The fake only ever hands out plain ones or
+// CouchDB ones that start with the plain one, so that's what counts.
+func parseSequence(since string) uint64 {
+	since = strings.SplitN(since, "-", 2)[0]
+	parts := strings.Split(since, ":")
+	sequence, _ := strconv.ParseUint(parts[len(parts)-1], 10, 64)
+	return sequence
+}
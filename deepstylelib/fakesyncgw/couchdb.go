@@ -0,0 +1,90 @@
+package fakesyncgw
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// NewCouchDBServer starts a fake that behaves like Apache CouchDB 2.x/3.x
+// where it differs from Sync Gateway:
+//
+//   - sequences are opaque strings, eg "12-g1AAAA..."
+//   - docs with unknown special members, a non-object _attachments or an
+//     empty _rev are rejected with a 400
+//   - views reject stale=false (only ok and update_after are accepted)
+//   - design docs have revisions, so updating one needs its _rev
+//   - docs can have conflicting revisions (see AddConflict), listed by
+//     GET ?conflicts=true, read by GET ?rev= and removed by DELETE ?rev=
+func NewCouchDBServer(dbName string) *Server {
+	return newServer(dbName, true)
+}
+
+// Special members CouchDB accepts in a doc body
+var couchDBSpecialMembers = map[string]bool{
+	"_id":          true,
+	"_rev":         true,
+	"_attachments": true,
+	"_deleted":     true,
+}
+
+// AddConflict gives a doc a conflicting revision with this body, as if it
+// had been replicated in from elsewhere and lost.  Returns its revision.
+func (s *Server) AddConflict(docId string, body map[string]interface{}) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	doc, ok := s.docs[docId]
+	if !ok {
+		return ""
+	}
+	bodyBytes, _ := json.Marshal(body)
+	rev := fmt.Sprintf("%v-%x", strings.SplitN(doc.revision, "-", 2)[0], md5.Sum(bodyBytes))
+	if doc.conflicts == nil {
+		doc.conflicts = map[string]map[string]interface{}{}
+	}
+	doc.conflicts[rev] = copyJSON(body)
+	return rev
+}
+
+// Conflicts returns the conflicting revisions a doc still has
+func (s *Server) Conflicts(docId string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	revs := []string{}
+	if doc, ok := s.docs[docId]; ok {
+		for rev := range doc.conflicts {
+			revs = append(revs, rev)
+		}
+	}
+	return revs
+}
+
+// sequenceValue is how a sequence appears in responses.  Caller must hold
+// the lock, or the sequence must not be shared.
+func (s *Server) sequenceValue(sequence uint64) interface{} {
+	if !s.couchDB {
+		return sequence
+	}
+	return fmt.Sprintf("%v-g1AAAA%x", sequence, md5.Sum([]byte(fmt.Sprintf("%v", sequence))))
+}
+
+// validateCouchDBBody rejects what CouchDB would refuse to store
+func validateCouchDBBody(body map[string]interface{}) error {
+	for key, value := range body {
+		if strings.HasPrefix(key, "_") && !couchDBSpecialMembers[key] {
+			return fmt.Errorf("Bad special document member: %v", key)
+		}
+		switch key {
+		case "_attachments":
+			if _, ok := value.(map[string]interface{}); !ok {
+				return fmt.Errorf("_attachments is not an object")
+			}
+		case "_rev":
+			if rev, ok := value.(string); !ok || rev == "" {
+				return fmt.Errorf("Invalid rev format")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package fakesyncgw
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// _local docs have revisions (0-1, 0-2, ..) but aren't on the changes feed
+type localDocument struct {
+	generation int
+	body       map[string]interface{}
+}
+
+func (doc *localDocument) revision() string {
+	return fmt.Sprintf("0-%v", doc.generation)
+}
+
+// LocalDoc returns a copy of a _local doc, or nil if it doesn't exist
+func (s *Server) LocalDoc(docId string) map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	doc, ok := s.localDocs[docId]
+	if !ok {
+		return nil
+	}
+	return copyJSON(doc.body)
+}
+
+func (s *Server) serveLocalDocument(w http.ResponseWriter, r *http.Request, docId string) {
+
+	switch r.Method {
+	case "GET", "HEAD":
+		localDoc := s.LocalDoc(docId)
+		if localDoc == nil {
+			writeError(w, http.StatusNotFound, "not_found", "missing")
+			return
+		}
+		writeJSON(w, http.StatusOK, localDoc)
+	case "PUT":
+		body, err := decodeBody(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		doc, exists := s.localDocs[docId]
+		currentRev := ""
+		if exists {
+			currentRev = doc.revision()
+		}
+		rev, _ := body["_rev"].(string)
+		if rev != currentRev {
+			writeError(w, http.StatusConflict, "conflict", "Document revision conflict")
+			return
+		}
+		if !exists {
+			doc = &localDocument{}
+			s.localDocs[docId] = doc
+		}
+		doc.generation += 1
+		doc.body = body
+		doc.body["_id"] = "_local/" + docId
+		doc.body["_rev"] = doc.revision()
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"ok": true, "id": "_local/" + docId, "rev": doc.revision()})
+	case "DELETE":
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		doc, ok := s.localDocs[docId]
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found", "missing")
+			return
+		}
+		if r.URL.Query().Get("rev") != doc.revision() {
+			writeError(w, http.StatusConflict, "conflict", "Document revision conflict")
+			return
+		}
+		delete(s.localDocs, docId)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method)
+	}
+
+}
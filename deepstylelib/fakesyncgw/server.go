@@ -0,0 +1,409 @@
+// Package fakesyncgw is an in-memory stand-in for Sync Gateway, for tests.
+// It speaks just enough of the REST api for deepstylelib: documents with
+// revisions and 409 conflicts, attachments, the longpoll changes feed,
+// design docs with views (backed by Go map funcs, see DefineView) and
+// _local docs.  NewCouchDBServer starts one that acts like CouchDB instead.
+package fakesyncgw
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is a single-database fake Sync Gateway listening on localhost
+type Server struct {
+	*httptest.Server
+	DBName string
+
+	couchDB    bool // see NewCouchDBServer
+	mutex      sync.Mutex
+	docs       map[string]*document
+	sequence   uint64
+	changed    chan struct{} // closed and replaced whenever a doc changes
+	closed     bool
+	localDocs  map[string]*localDocument
+	designDocs map[string]map[string]interface{}
+	viewFuncs  map[string]MapFunc
+	failures   []*injectedFailure
+}
+
+type injectedFailure struct {
+	method string
+	path   string
+	status int
+	count  int
+}
+
+type document struct {
+	revision    string
+	body        map[string]interface{}
+	attachments map[string]*attachment
+	deleted     bool
+	sequence    uint64
+	conflicts   map[string]map[string]interface{} // losing revision -> body, CouchDB only
+}
+
+// NewServer starts a fake Sync Gateway serving a database called dbName.
+// Call Close when done with it.
+func NewServer(dbName string) *Server {
+	return newServer(dbName, false)
+}
+
+func newServer(dbName string, couchDB bool) *Server {
+	s := &Server{
+		DBName:     dbName,
+		couchDB:    couchDB,
+		docs:       map[string]*document{},
+		changed:    make(chan struct{}),
+		localDocs:  map[string]*localDocument{},
+		designDocs: map[string]map[string]interface{}{},
+		viewFuncs:  map[string]MapFunc{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Close releases any longpoll _changes requests, then shuts down the server
+func (s *Server) Close() {
+	s.mutex.Lock()
+	s.closed = true
+	s.notifyChanged()
+	s.mutex.Unlock()
+	s.Server.Close()
+}
+
+// DBURL is the url to pass to deepstylelib, eg http://127.0.0.1:1234/db
+func (s *Server) DBURL() string {
+	return fmt.Sprintf("%v/%v", s.URL, s.DBName)
+}
+
+// Doc returns a copy of the current body of a doc, including attachment
+// stubs, or nil if it doesn't exist or has been deleted.
+func (s *Server) Doc(docId string) map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	doc, ok := s.docs[docId]
+	if !ok || doc.deleted {
+		return nil
+	}
+	return doc.render()
+}
+
+// Attachment returns the content of an attachment, or nil if there is no
+// such doc or attachment.
+func (s *Server) Attachment(docId, attachmentName string) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	doc, ok := s.docs[docId]
+	if !ok || doc.deleted {
+		return nil
+	}
+	att, ok := doc.attachments[attachmentName]
+	if !ok {
+		return nil
+	}
+	return append([]byte{}, att.data...)
+}
+
+// FailRequests makes the next count requests with this method and path
+// (relative to the db, eg "job1/result_image") fail with status, without
+// touching the db.  Handy for 409s and 5xxs.
+func (s *Server) FailRequests(method, path string, status, count int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures = append(s.failures, &injectedFailure{
+		method: method,
+		path:   path,
+		status: status,
+		count:  count,
+	})
+}
+
+// injectedFailure returns the status to fail the request with, if any
+func (s *Server) injectedFailure(method string, pathParts []string) (status int, ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	path := strings.Join(pathParts, "/")
+	for _, failure := range s.failures {
+		if failure.count > 0 && failure.method == method && failure.path == path {
+			failure.count -= 1
+			return failure.status, true
+		}
+	}
+	return 0, false
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+
+	dbPrefix := "/" + s.DBName
+	escapedPath := r.URL.EscapedPath()
+	if escapedPath != dbPrefix && !strings.HasPrefix(escapedPath, dbPrefix+"/") {
+		writeError(w, http.StatusNotFound, "not_found", "no such database")
+		return
+	}
+
+	// split before unescaping, so doc ids can contain an escaped /
+	pathParts := []string{}
+	for _, part := range strings.Split(strings.TrimPrefix(escapedPath, dbPrefix), "/") {
+		if part == "" {
+			continue
+		}
+		unescaped, err := url.PathUnescape(part)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		pathParts = append(pathParts, unescaped)
+	}
+
+	if status, ok := s.injectedFailure(r.Method, pathParts); ok {
+		ioutil.ReadAll(r.Body)
+		writeError(w, status, http.StatusText(status), "injected failure")
+		return
+	}
+
+	switch {
+	case len(pathParts) == 0:
+		s.serveDatabase(w, r)
+	case pathParts[0] == "_changes" && len(pathParts) == 1:
+		s.serveChanges(w, r)
+	case pathParts[0] == "_local" && len(pathParts) == 2:
+		s.serveLocalDocument(w, r, pathParts[1])
+	case pathParts[0] == "_design" && len(pathParts) == 2:
+		s.serveDesignDocument(w, r, pathParts[1])
+	case pathParts[0] == "_design" && len(pathParts) == 4 && pathParts[2] == "_view":
+		s.serveView(w, r, pathParts[1], pathParts[3])
+	case strings.HasPrefix(pathParts[0], "_"):
+		writeError(w, http.StatusNotFound, "not_found", "unsupported endpoint")
+	case len(pathParts) == 1:
+		s.serveDocument(w, r, pathParts[0])
+	case len(pathParts) == 2:
+		s.serveAttachment(w, r, pathParts[0], pathParts[1])
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "unsupported endpoint")
+	}
+
+}
+
+func (s *Server) serveDatabase(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case "GET", "HEAD":
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"db_name":    s.DBName,
+			"update_seq": s.sequenceValue(s.sequence),
+		})
+	case "POST":
+		body, err := decodeBody(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		docId, _ := body["_id"].(string)
+		s.putDocument(w, docId, "", body)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method)
+	}
+
+}
+
+func (s *Server) serveDocument(w http.ResponseWriter, r *http.Request, docId string) {
+
+	switch r.Method {
+	case "GET", "HEAD":
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		doc, ok := s.docs[docId]
+		if !ok || doc.deleted {
+			writeError(w, http.StatusNotFound, "not_found", "missing")
+			return
+		}
+		// a losing revision, without attachments
+		if rev := r.URL.Query().Get("rev"); rev != "" && rev != doc.revision {
+			conflict, ok := doc.conflicts[rev]
+			if !ok {
+				writeError(w, http.StatusNotFound, "not_found", "missing")
+				return
+			}
+			body := copyJSON(conflict)
+			body["_id"] = docId
+			body["_rev"] = rev
+			writeJSON(w, http.StatusOK, body)
+			return
+		}
+		body := doc.render()
+		if r.URL.Query().Get("conflicts") == "true" && len(doc.conflicts) > 0 {
+			conflicts := []string{}
+			for rev := range doc.conflicts {
+				conflicts = append(conflicts, rev)
+			}
+			body["_conflicts"] = conflicts
+		}
+		writeJSON(w, http.StatusOK, body)
+	case "PUT":
+		body, err := decodeBody(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		s.putDocument(w, docId, r.URL.Query().Get("rev"), body)
+	case "DELETE":
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		doc, ok := s.docs[docId]
+		if !ok || doc.deleted {
+			writeError(w, http.StatusNotFound, "not_found", "missing")
+			return
+		}
+		// deleting a losing revision leaves the winner alone
+		if _, ok := doc.conflicts[r.URL.Query().Get("rev")]; ok {
+			delete(doc.conflicts, r.URL.Query().Get("rev"))
+			writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "id": docId})
+			return
+		}
+		if doc.revision != r.URL.Query().Get("rev") {
+			writeError(w, http.StatusConflict, "conflict", "Document revision conflict")
+			return
+		}
+		doc.attachments = map[string]*attachment{}
+		s.updateDocument(docId, doc, map[string]interface{}{"_deleted": true}, true)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "id": docId, "rev": doc.revision})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method)
+	}
+
+}
+
+// putDocument creates or updates a doc.  The revision comes from the ?rev=
+// param or the _rev in the body, and must match the current revision.  An
+// empty docId gets a generated one.
+func (s *Server) putDocument(w http.ResponseWriter, docId, rev string, body map[string]interface{}) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.couchDB {
+		if err := validateCouchDBBody(body); err != nil {
+			writeError(w, http.StatusBadRequest, "doc_validation", err.Error())
+			return
+		}
+	}
+
+	if docId == "" {
+		docId = fmt.Sprintf("%x", md5.Sum([]byte(strconv.FormatUint(s.sequence+1, 10))))
+	}
+
+	if rev == "" {
+		rev, _ = body["_rev"].(string)
+	}
+
+	doc, exists := s.docs[docId]
+	currentRev := ""
+	if exists && !doc.deleted {
+		currentRev = doc.revision
+	}
+	if rev != currentRev {
+		writeError(w, http.StatusConflict, "conflict", "Document revision conflict")
+		return
+	}
+	if !exists {
+		doc = &document{}
+		s.docs[docId] = doc
+	}
+
+	attachments, err := doc.updatedAttachments(body["_attachments"], s.sequence+1)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	delete(body, "_attachments")
+	doc.attachments = attachments
+
+	s.updateDocument(docId, doc, body, false)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"ok": true, "id": docId, "rev": doc.revision})
+
+}
+
+// updateDocument stores a new revision of a doc and wakes up the changes
+// feed.  Caller must hold the lock.
+func (s *Server) updateDocument(docId string, doc *document, body map[string]interface{}, deleted bool) {
+
+	generation := 0
+	if doc.revision != "" {
+		generation, _ = strconv.Atoi(strings.SplitN(doc.revision, "-", 2)[0])
+	}
+
+	bodyBytes, _ := json.Marshal(body)
+	digest := md5.Sum(append([]byte(doc.revision), bodyBytes...))
+
+	s.sequence += 1
+	doc.revision = fmt.Sprintf("%v-%x", generation+1, digest)
+	doc.deleted = deleted
+	doc.sequence = s.sequence
+	doc.body = body
+	doc.body["_id"] = docId
+	doc.body["_rev"] = doc.revision
+
+	s.notifyChanged()
+
+}
+
+// notifyChanged wakes up longpoll _changes requests.  Caller must hold the
+// lock.
+func (s *Server) notifyChanged() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// render returns a copy of the body with stubs for the attachments
+func (doc *document) render() map[string]interface{} {
+	body := copyJSON(doc.body)
+	if len(doc.attachments) > 0 {
+		stubs := map[string]interface{}{}
+		for name, att := range doc.attachments {
+			stubs[name] = att.stub()
+		}
+		body["_attachments"] = stubs
+	}
+	return body
+}
+
+func copyJSON(value map[string]interface{}) map[string]interface{} {
+	valueBytes, _ := json.Marshal(value)
+	valueCopy := map[string]interface{}{}
+	json.Unmarshal(valueBytes, &valueCopy)
+	return valueCopy
+}
+
+func decodeBody(r *http.Request) (map[string]interface{}, error) {
+	body := map[string]interface{}{}
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, errorName, reason string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error":  errorName,
+		"reason": reason,
+	})
+}
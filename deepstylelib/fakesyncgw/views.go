@@ -0,0 +1,173 @@
+package fakesyncgw
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MapFunc stands in for the javascript map function of a view, since the
+// fake can't run javascript.  It is called with a copy of each live doc.
+type MapFunc func(doc map[string]interface{}, emit func(key, value interface{}))
+
+// DefineView sets the Go map func used when ddoc/view is queried.  The
+// design doc itself still has to be PUT before the view can be queried,
+// just like against a real Sync Gateway.
+func (s *Server) DefineView(designDocName, viewName string, mapFunc MapFunc) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.viewFuncs[viewKey(designDocName, viewName)] = mapFunc
+}
+
+// DesignDoc returns the design doc as it was PUT, or nil
+func (s *Server) DesignDoc(designDocName string) map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	designDoc, ok := s.designDocs[designDocName]
+	if !ok {
+		return nil
+	}
+	return copyJSON(designDoc)
+}
+
+func viewKey(designDocName, viewName string) string {
+	return fmt.Sprintf("%v/%v", designDocName, viewName)
+}
+
+func (s *Server) serveDesignDocument(w http.ResponseWriter, r *http.Request, designDocName string) {
+
+	switch r.Method {
+	case "GET", "HEAD":
+		designDoc := s.DesignDoc(designDocName)
+		if designDoc == nil {
+			writeError(w, http.StatusNotFound, "not_found", "missing")
+			return
+		}
+		writeJSON(w, http.StatusOK, designDoc)
+	case "PUT":
+		body, err := decodeBody(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		rev := ""
+		if s.couchDB {
+			// CouchDB design docs have revisions like any other doc
+			current, _ := s.designDocs[designDocName]["_rev"].(string)
+			if body["_rev"] == nil {
+				body["_rev"] = ""
+			}
+			if body["_rev"] != current {
+				writeError(w, http.StatusConflict, "conflict", "Document update conflict.")
+				return
+			}
+			generation, _ := strconv.Atoi(strings.SplitN(current, "-", 2)[0])
+			bodyBytes, _ := json.Marshal(body)
+			rev = fmt.Sprintf("%v-%x", generation+1, md5.Sum(bodyBytes))
+			body["_rev"] = rev
+		}
+		s.designDocs[designDocName] = body
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"ok": true, "id": "_design/" + designDocName, "rev": rev})
+	case "DELETE":
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if _, ok := s.designDocs[designDocName]; !ok {
+			writeError(w, http.StatusNotFound, "not_found", "missing")
+			return
+		}
+		delete(s.designDocs, designDocName)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method)
+	}
+
+}
+
+type viewRow struct {
+	Id    string      `json:"id"`
+	Key   interface{} `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// serveView runs the Go map func for the view over every live doc.  Rows
+// are sorted by key, then doc id.  The key, startkey and endkey params are
+// supported for string keys.
+func (s *Server) serveView(w http.ResponseWriter, r *http.Request, designDocName, viewName string) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if stale := r.URL.Query().Get("stale"); s.couchDB && stale != "" && stale != "ok" && stale != "update_after" {
+		writeError(w, http.StatusBadRequest, "query_parse_error", "Invalid value for `stale`.")
+		return
+	}
+
+	designDoc, ok := s.designDocs[designDocName]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "missing")
+		return
+	}
+	views, _ := designDoc["views"].(map[string]interface{})
+	if _, ok := views[viewName]; !ok {
+		writeError(w, http.StatusNotFound, "not_found", "missing view")
+		return
+	}
+	mapFunc, ok := s.viewFuncs[viewKey(designDocName, viewName)]
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "unknown_error", "view_undefined")
+		return
+	}
+
+	query := r.URL.Query()
+	keyFilter := func(key interface{}) bool {
+		keyString, isString := key.(string)
+		if param := query.Get("key"); param != "" {
+			var matchKey string
+			return json.Unmarshal([]byte(param), &matchKey) == nil && isString && keyString == matchKey
+		}
+		if param := query.Get("startkey"); param != "" {
+			var startKey string
+			if json.Unmarshal([]byte(param), &startKey) == nil && (!isString || keyString < startKey) {
+				return false
+			}
+		}
+		if param := query.Get("endkey"); param != "" {
+			var endKey string
+			if json.Unmarshal([]byte(param), &endKey) == nil && (!isString || keyString > endKey) {
+				return false
+			}
+		}
+		return true
+	}
+
+	rows := []viewRow{}
+	for docId, doc := range s.docs {
+		if doc.deleted {
+			continue
+		}
+		mapFunc(doc.render(), func(key, value interface{}) {
+			if keyFilter(key) {
+				rows = append(rows, viewRow{Id: docId, Key: key, Value: value})
+			}
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		keyI, keyJ := fmt.Sprintf("%v", rows[i].Key), fmt.Sprintf("%v", rows[j].Key)
+		if keyI != keyJ {
+			return keyI < keyJ
+		}
+		return rows[i].Id < rows[j].Id
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total_rows": len(rows),
+		"rows":       rows,
+	})
+
+}
@@ -0,0 +1,587 @@
+package deepstylelib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultHotFolderPollInterval = 2 * time.Second
+	DefaultHotFolderSettleTime   = 2 * time.Second
+	DefaultHotFolderImageTimeout = 10 * time.Minute
+)
+
+// Paired files are named eg cat.source.jpg and cat.style.png, and a
+// manifest cat.json
+const (
+	hotFolderSourceSuffix  = ".source"
+	hotFolderStyleSuffix   = ".style"
+	hotFolderManifestExt   = ".json"
+	hotFolderProcessingDir = "processing"
+	hotFolderTempDir       = "tmp"
+)
+
+// HotFolderManifest describes a job dropped into the inbox.  The images are
+// file names in the inbox, and default to the paired files.
+type HotFolderManifest struct {
+	SourceImage string         `json:"source_image,omitempty"`
+	StyleImage  string         `json:"style_image,omitempty"`
+	Parameters  *JobParameters `json:"parameters,omitempty"`
+}
+
+// HotFolder turns files dropped into an inbox directory into jobs, for
+// people who'd rather not go through the app.  A job is either a pair of
+// files, eg cat.source.jpg and cat.style.png, or a manifest, eg cat.json
+// (see HotFolderManifest).  Each one is run through the same pipeline as
+// jobs from Sync Gateway, with the jobs kept in a FileStore under StateDir,
+// then everything ends up in a directory named after the job: in Outbox
+// with the result and the executor's log, or in ErrorDir with the log and
+// error message.
+type HotFolder struct {
+	Inbox        string
+	Outbox       string
+	ErrorDir     string
+	StateDir     string        // Where the jobs are kept while they run
+	Executor     Executor      // Runs the actual style transfer
+	ExecutorName string        // Which backend Executor is, for duration stats
+	RetryPolicy  RetryPolicy   // How often to retry failing jobs
+	PollInterval time.Duration // How often to look for new files
+	SettleTime   time.Duration // How long files must be unchanged, so half-copied ones aren't picked up
+	ImageTimeout time.Duration // How long after a manifest was written to wait for the images it names
+	Metrics      MetricsSink   // Where job metrics go, may be nil
+
+	store *FileStore
+}
+
+// NewHotFolder returns a hot folder with its outbox, error and state
+// directories inside the inbox.  The executor still has to be set.
+func NewHotFolder(inbox string) *HotFolder {
+	return &HotFolder{
+		Inbox:        inbox,
+		Outbox:       filepath.Join(inbox, "outbox"),
+		ErrorDir:     filepath.Join(inbox, "errors"),
+		StateDir:     filepath.Join(inbox, ".deepstyle"),
+		RetryPolicy:  DefaultRetryPolicy(),
+		PollInterval: DefaultHotFolderPollInterval,
+		SettleTime:   DefaultHotFolderSettleTime,
+		ImageTimeout: DefaultHotFolderImageTimeout,
+	}
+}
+
+// hotFolderJob is the files in the inbox that make up one job
+type hotFolderJob struct {
+	name     string
+	files    []string // base names in the inbox
+	manifest string
+	source   string
+	style    string
+}
+
+// Watch processes jobs as they're dropped into the inbox, until stop is
+// closed
+func (h *HotFolder) Watch(stop <-chan struct{}) error {
+
+	if err := h.open(); err != nil {
+		return err
+	}
+	defer h.Close()
+
+	log.Printf("Watching %v for jobs", h.Inbox)
+	for {
+		if _, err := h.ProcessInbox(); err != nil {
+			log.Printf("Error processing %v: %v", h.Inbox, err)
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(h.PollInterval):
+		}
+	}
+
+}
+
+// Close closes the job store
+func (h *HotFolder) Close() {
+	if h.store != nil {
+		h.store.Close()
+		h.store = nil
+	}
+}
+
+// open creates the directories and opens the job store.  Jobs that were
+// being processed when the last run stopped are put back in the inbox, to
+// be run again as new jobs, and the old ones are deleted from the store.
+func (h *HotFolder) open() error {
+
+	if h.store != nil {
+		return nil
+	}
+	for _, dir := range []string{h.Inbox, h.Outbox, h.ErrorDir, filepath.Join(h.StateDir, hotFolderProcessingDir), filepath.Join(h.StateDir, hotFolderTempDir)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	interrupted, err := ioutil.ReadDir(filepath.Join(h.StateDir, hotFolderProcessingDir))
+	if err != nil {
+		return err
+	}
+	for _, workDir := range interrupted {
+		log.Printf("Job %v was interrupted, putting it back in the inbox", workDir.Name())
+		if err := h.moveFiles(filepath.Join(h.StateDir, hotFolderProcessingDir, workDir.Name()), h.Inbox); err != nil {
+			return err
+		}
+	}
+
+	store, err := OpenFileStore(filepath.Join(h.StateDir, "jobs"))
+	if err != nil {
+		return err
+	}
+
+	// finished jobs are deleted once they're filed, so anything left is
+	// from an interrupted run
+	leftover, err := store.JobsInStates(StateNotReadyToProcess, StateReadyToProcess, StateBeingProcessed, StateCancelRequested, StateProcessingSuccessful, StateProcessingFailed, StateProcessingAbandoned, StateProcessingTimedOut, StateCancelled)
+	if err != nil {
+		store.Close()
+		return err
+	}
+	for _, row := range leftover {
+		log.Printf("Deleting job %v left over from an interrupted run", row.Id)
+		if err := store.Delete(row.Id, row.Job.Revision); err != nil {
+			store.Close()
+			return err
+		}
+	}
+
+	h.store = store
+	return nil
+
+}
+
+// ProcessInbox runs every job that's complete in the inbox, one at a time,
+// and returns how many it ran
+func (h *HotFolder) ProcessInbox() (processed int, err error) {
+
+	if err := h.open(); err != nil {
+		return 0, err
+	}
+
+	jobs, err := h.scanInbox()
+	if err != nil {
+		return 0, err
+	}
+	for _, job := range jobs {
+		ran, err := h.process(job)
+		if err != nil {
+			log.Printf("Error processing %v: %v", job.name, err)
+		}
+		if ran {
+			processed += 1
+		}
+	}
+	return processed, nil
+
+}
+
+// scanInbox groups the files in the inbox into jobs, returning the ones
+// that are complete and whose files have stopped changing
+func (h *HotFolder) scanInbox() ([]hotFolderJob, error) {
+
+	entries, err := ioutil.ReadDir(h.Inbox)
+	if err != nil {
+		return nil, err
+	}
+
+	jobsByName := map[string]*hotFolderJob{}
+	settled := map[string]bool{}
+	for _, entry := range entries {
+
+		fileName := entry.Name()
+		if !entry.Mode().IsRegular() || strings.HasPrefix(fileName, ".") {
+			continue
+		}
+
+		ext := filepath.Ext(fileName)
+		base := strings.TrimSuffix(fileName, ext)
+		name := base
+		switch {
+		case ext == hotFolderManifestExt:
+		case strings.HasSuffix(base, hotFolderSourceSuffix):
+			name = strings.TrimSuffix(base, hotFolderSourceSuffix)
+		case strings.HasSuffix(base, hotFolderStyleSuffix):
+			name = strings.TrimSuffix(base, hotFolderStyleSuffix)
+		default:
+			// maybe an image a manifest refers to
+			continue
+		}
+
+		job, ok := jobsByName[name]
+		if !ok {
+			job = &hotFolderJob{name: name}
+			jobsByName[name] = job
+			settled[name] = true
+		}
+		switch {
+		case ext == hotFolderManifestExt:
+			job.manifest = fileName
+		case strings.HasSuffix(base, hotFolderSourceSuffix):
+			job.source = fileName
+		default:
+			job.style = fileName
+		}
+		job.files = append(job.files, fileName)
+		if time.Since(entry.ModTime()) < h.SettleTime {
+			settled[name] = false
+		}
+
+	}
+
+	jobs := []hotFolderJob{}
+	for name, job := range jobsByName {
+		if !settled[name] {
+			continue
+		}
+		if job.manifest == "" && (job.source == "" || job.style == "") {
+			continue
+		}
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].name < jobs[j].name })
+	return jobs, nil
+
+}
+
+// process moves the job's files out of the inbox, runs it and files the
+// outcome.  It isn't run if the images a manifest names are still changing,
+// or haven't turned up yet.
+func (h *HotFolder) process(job hotFolderJob) (ran bool, err error) {
+
+	manifest, settled, err := h.readManifest(&job)
+	if err != nil {
+		return true, h.fileUnrunnable(job, err)
+	}
+	if !settled {
+		return false, nil
+	}
+
+	workDir := filepath.Join(h.StateDir, hotFolderProcessingDir, job.name)
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return false, err
+	}
+	log.Printf("Picked up %v from %v", job.name, h.Inbox)
+	for _, fileName := range job.files {
+		if err := os.Rename(filepath.Join(h.Inbox, fileName), filepath.Join(workDir, fileName)); err != nil {
+			return false, err
+		}
+	}
+
+	jobDoc, err := h.submit(job, manifest, workDir)
+	if err != nil {
+		return true, h.fileOutcome(job, workDir, nil, err)
+	}
+	h.run(jobDoc)
+	if err := h.fileOutcome(job, workDir, jobDoc, nil); err != nil {
+		return true, err
+	}
+
+	// everything's been copied out, so the store doesn't need it any more
+	return true, h.deleteJob(jobDoc.Id)
+
+}
+
+// readManifest reads the job's manifest, if it has one, and checks that the
+// images it names are in the inbox.  It's not settled while they're still
+// changing, or while they're missing but the manifest was written less than
+// ImageTimeout ago, since they're often copied in after it.
+func (h *HotFolder) readManifest(job *hotFolderJob) (manifest HotFolderManifest, settled bool, err error) {
+
+	// when the manifest was last written, to time out missing images from
+	var writtenAt time.Time
+	if job.manifest != "" {
+		manifestPath := filepath.Join(h.Inbox, job.manifest)
+		manifestInfo, err := os.Stat(manifestPath)
+		if err != nil {
+			return manifest, false, err
+		}
+		writtenAt = manifestInfo.ModTime()
+		manifestBytes, err := ioutil.ReadFile(manifestPath)
+		if err != nil {
+			return manifest, false, err
+		}
+		if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+			return manifest, false, fmt.Errorf("Invalid manifest %v: %v", job.manifest, err)
+		}
+	}
+
+	if manifest.SourceImage == "" {
+		manifest.SourceImage = job.source
+	}
+	if manifest.StyleImage == "" {
+		manifest.StyleImage = job.style
+	}
+
+	settled = true
+	for _, image := range []struct{ field, fileName string }{
+		{SourceImageAttachment, manifest.SourceImage},
+		{StyleImageAttachment, manifest.StyleImage},
+	} {
+		if image.fileName == "" {
+			return manifest, false, fmt.Errorf("No %v for %v", image.field, job.name)
+		}
+		if image.fileName != filepath.Base(image.fileName) {
+			return manifest, false, fmt.Errorf("Invalid %v: %v.  Must be a file in the inbox", image.field, image.fileName)
+		}
+		fileInfo, err := os.Stat(filepath.Join(h.Inbox, image.fileName))
+		if os.IsNotExist(err) && time.Since(writtenAt) < h.ImageTimeout {
+			log.Printf("Waiting for %v %v for %v", image.field, image.fileName, job.name)
+			settled = false
+			continue
+		}
+		if err != nil {
+			return manifest, false, fmt.Errorf("Missing %v: %v", image.field, err)
+		}
+		if time.Since(fileInfo.ModTime()) < h.SettleTime {
+			settled = false
+		}
+		if !containsString(job.files, image.fileName) {
+			job.files = append(job.files, image.fileName)
+		}
+	}
+
+	return manifest, settled, nil
+
+}
+
+// submit adds the job to the store the way the app does: doc first, then
+// the images, then marks it ready.  If that fails the job is deleted again.
+func (h *HotFolder) submit(job hotFolderJob, manifest HotFolderManifest, workDir string) (jobDoc *JobDocument, err error) {
+
+	body := map[string]interface{}{
+		"type":       Job,
+		"state":      StateNotReadyToProcess,
+		"created_at": time.Now().UTC().Format(time.RFC3339),
+		"owner":      job.name,
+	}
+	if manifest.Parameters != nil {
+		body["parameters"] = manifest.Parameters
+	}
+
+	jobId := newRandomId()
+	if _, _, err := h.store.InsertWith(body, jobId); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if deleteErr := h.deleteJob(jobId); deleteErr != nil {
+			log.Printf("Unable to delete job %v: %v", jobId, deleteErr)
+		}
+	}()
+
+	jobDoc, err = NewJobDocument(jobId, h.config())
+	if err != nil {
+		return nil, err
+	}
+
+	images := map[string]string{
+		SourceImageAttachment: manifest.SourceImage,
+		StyleImageAttachment:  manifest.StyleImage,
+	}
+	for attachmentName, fileName := range images {
+		if err := jobDoc.AddAttachment(attachmentName, filepath.Join(workDir, fileName)); err != nil {
+			return nil, fmt.Errorf("Unable to attach %v: %v", fileName, err)
+		}
+	}
+
+	if _, err := jobDoc.UpdateState(StateReadyToProcess); err != nil {
+		return nil, err
+	}
+	log.Printf("Job %v is %v", job.name, jobId)
+	return jobDoc, nil
+
+}
+
+// deleteJob removes the job from the store, at whatever revision it's at
+func (h *HotFolder) deleteJob(jobId string) error {
+	jobDoc := JobDocument{}
+	if err := h.store.Retrieve(jobId, &jobDoc); err != nil {
+		return err
+	}
+	return h.store.Delete(jobId, jobDoc.Revision)
+}
+
+func (h *HotFolder) config() configuration {
+	return configuration{
+		Database:         h.store,
+		TempDir:          filepath.Join(h.StateDir, hotFolderTempDir),
+		Executor:         h.Executor,
+		ExecutorName:     h.ExecutorName,
+		WorkerId:         DefaultWorkerId(),
+		LeaseDuration:    DefaultLeaseDuration,
+		RetryPolicy:      h.RetryPolicy,
+		SnapshotInterval: DefaultSnapshotInterval,
+		Metrics:          h.Metrics,
+	}
+}
+
+// run executes the job until it's finished, waiting out the backoff
+// between attempts, or the poll interval if an attempt never started
+func (h *HotFolder) run(jobDoc *JobDocument) {
+
+	for {
+
+		attempts := jobDoc.Attempts
+		if err := executeDeepStyleJob(h.config(), *jobDoc); err != nil {
+			log.Printf("Job %v failed: %v", jobDoc.Id, err)
+		}
+		if err := jobDoc.RefreshFromDB(); err != nil {
+			log.Printf("Unable to refresh job %v: %v", jobDoc.Id, err)
+			return
+		}
+		if !jobDoc.IsReadyToProcess() {
+			return
+		}
+
+		if until, backingOff := jobDoc.IsBackingOff(); backingOff {
+			log.Printf("Retrying job %v at %v", jobDoc.Id, until)
+			<-time.After(time.Until(until))
+		} else if jobDoc.Attempts == attempts {
+			// the job was never claimed, eg the store couldn't be written,
+			// so there's no backoff to wait out
+			log.Printf("Job %v wasn't claimed, retrying in %v", jobDoc.Id, h.PollInterval)
+			<-time.After(h.PollInterval)
+		}
+
+	}
+
+}
+
+// fileOutcome moves the job's files from workDir into a directory named
+// after it, in the outbox if it succeeded and the error dir otherwise,
+// along with the result and log
+func (h *HotFolder) fileOutcome(job hotFolderJob, workDir string, jobDoc *JobDocument, submitErr error) error {
+
+	parentDir := h.ErrorDir
+	if jobDoc != nil && jobDoc.IsProcessingSuccessful() {
+		parentDir = h.Outbox
+	}
+	outcomeDir, err := uniqueDir(parentDir, job.name)
+	if err != nil {
+		return err
+	}
+	if err := h.moveFiles(workDir, outcomeDir); err != nil {
+		return err
+	}
+
+	if submitErr != nil {
+		log.Printf("Job %v failed: %v", job.name, submitErr)
+		return ioutil.WriteFile(filepath.Join(outcomeDir, "error.txt"), []byte(submitErr.Error()+"\n"), 0644)
+	}
+
+	log.Printf("Job %v is %v, see %v", job.name, jobDoc.State, outcomeDir)
+	if jobDoc.ErrorMessage != "" {
+		if err := ioutil.WriteFile(filepath.Join(outcomeDir, "error.txt"), []byte(jobDoc.ErrorMessage+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	if jobDoc.StdOutAndErr != "" {
+		if err := ioutil.WriteFile(filepath.Join(outcomeDir, "job.log"), []byte(jobDoc.StdOutAndErr), 0644); err != nil {
+			return err
+		}
+	}
+
+	// timed out jobs can have a partial result too
+	outputFormat := jobDoc.RequestedParameters().WithDefaults().OutputFormat
+	attachments := map[string]string{
+		ResultImageAttachment:  ResultImageAttachment + "." + outputFormat,
+		TimelapseGifAttachment: "timelapse.gif",
+	}
+	for attachmentName, fileName := range attachments {
+		if _, ok := jobDoc.Attachments[attachmentName]; !ok {
+			continue
+		}
+		reader, err := jobDoc.RetrieveAttachment(attachmentName)
+		if err != nil {
+			return err
+		}
+		if _, err := writeToFile(reader, filepath.Join(outcomeDir, fileName)); err != nil {
+			return err
+		}
+	}
+
+	jobBytes, err := json.MarshalIndent(jobDoc, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(outcomeDir, "job.json"), jobBytes, 0644)
+
+}
+
+// fileUnrunnable moves a job that couldn't be started, eg with an invalid
+// manifest, straight from the inbox to the error dir
+func (h *HotFolder) fileUnrunnable(job hotFolderJob, jobErr error) error {
+
+	outcomeDir, err := uniqueDir(h.ErrorDir, job.name)
+	if err != nil {
+		return err
+	}
+	log.Printf("Job %v can't be run: %v", job.name, jobErr)
+	for _, fileName := range job.files {
+		if err := os.Rename(filepath.Join(h.Inbox, fileName), filepath.Join(outcomeDir, fileName)); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(outcomeDir, "error.txt"), []byte(jobErr.Error()+"\n"), 0644)
+
+}
+
+// moveFiles moves every file in fromDir to toDir, then removes fromDir
+func (h *HotFolder) moveFiles(fromDir, toDir string) error {
+
+	entries, err := ioutil.ReadDir(fromDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.Rename(filepath.Join(fromDir, entry.Name()), filepath.Join(toDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return os.Remove(fromDir)
+
+}
+
+// uniqueDir creates parentDir/name, or name.2, name.3 .. if it's taken, eg
+// when the same job is dropped in twice
+func uniqueDir(parentDir, name string) (string, error) {
+
+	dir := filepath.Join(parentDir, name)
+	for i := 2; ; i++ {
+		err := os.Mkdir(dir, 0755)
+		if err == nil {
+			return dir, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		dir = filepath.Join(parentDir, fmt.Sprintf("%v.%v", name, i))
+	}
+
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,210 @@
+package deepstylelib
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestHotFolder(t *testing.T, executor Executor) (*HotFolder, func()) {
+	dir, err := ioutil.TempDir("", "deepstyle_hot_folder")
+	assert.NoError(t, err)
+	hotFolder := NewHotFolder(dir)
+	hotFolder.Executor = executor
+	hotFolder.SettleTime = 0
+	hotFolder.RetryPolicy = RetryPolicy{MaxAttempts: 2, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	return hotFolder, func() {
+		hotFolder.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// assertNoStoredJobs checks that every job has been deleted from the store
+func assertNoStoredJobs(t *testing.T, hotFolder *HotFolder) {
+	rows, err := hotFolder.store.JobsInStates(StateNotReadyToProcess, StateReadyToProcess, StateBeingProcessed, StateProcessingSuccessful, StateProcessingFailed, StateProcessingAbandoned)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(rows))
+}
+
+func dropTestImage(t *testing.T, dir, fileName string, c color.Color) {
+	assert.NoError(t, encodeImageFile(solidImage(4, 4, c), filepath.Join(dir, fileName)))
+}
+
+func TestHotFolder(t *testing.T) {
+
+	hotFolder, cleanup := newTestHotFolder(t, FakeExecutor{})
+	defer cleanup()
+	inbox := hotFolder.Inbox
+
+	// a pair of files, a manifest, and half a pair which has to wait
+	dropTestImage(t, inbox, "cat.source.png", color.RGBA{R: 200, A: 0xff})
+	dropTestImage(t, inbox, "cat.style.png", color.RGBA{B: 100, A: 0xff})
+	dropTestImage(t, inbox, "dog.jpg", color.RGBA{G: 200, A: 0xff})
+	dropTestImage(t, inbox, "starry_night.png", color.RGBA{B: 200, A: 0xff})
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(inbox, "dog.json"), []byte(`{"source_image": "dog.jpg", "style_image": "starry_night.png", "parameters": {"output_format": "png"}}`), 0644))
+	dropTestImage(t, inbox, "fox.source.png", color.RGBA{R: 100, A: 0xff})
+
+	processed, err := hotFolder.ProcessInbox()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, processed)
+
+	for name, files := range map[string][]string{
+		"cat": {"cat.source.png", "cat.style.png", "result_image.jpg", "job.log", "job.json"},
+		"dog": {"dog.json", "dog.jpg", "starry_night.png", "result_image.png", "job.log", "job.json"},
+	} {
+		for _, fileName := range files {
+			_, err := os.Stat(filepath.Join(hotFolder.Outbox, name, fileName))
+			assert.NoError(t, err)
+		}
+	}
+	result, err := os.Open(filepath.Join(hotFolder.Outbox, "dog", "result_image.png"))
+	assert.NoError(t, err)
+	_, format, err := image.Decode(result)
+	result.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "png", format)
+
+	// only the half pair is left in the inbox
+	entries, err := ioutil.ReadDir(inbox)
+	assert.NoError(t, err)
+	left := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			left = append(left, entry.Name())
+		}
+	}
+	assert.Equal(t, []string{"fox.source.png"}, left)
+	assertNoStoredJobs(t, hotFolder)
+
+	// dropping the same job in again doesn't overwrite the first one
+	dropTestImage(t, inbox, "cat.source.png", color.RGBA{R: 200, A: 0xff})
+	dropTestImage(t, inbox, "cat.style.png", color.RGBA{B: 100, A: 0xff})
+	processed, err = hotFolder.ProcessInbox()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, processed)
+	_, err = os.Stat(filepath.Join(hotFolder.Outbox, "cat.2", "result_image.jpg"))
+	assert.NoError(t, err)
+
+}
+
+func TestHotFolderFailures(t *testing.T) {
+
+	executor, err := NewExecutor(ExecutorCommand, ExecutorConfig{Command: "sh", Args: []string{"-c", "echo out of memory; exit 3"}})
+	assert.NoError(t, err)
+	hotFolder, cleanup := newTestHotFolder(t, executor)
+	defer cleanup()
+	inbox := hotFolder.Inbox
+
+	// the executor fails every attempt
+	dropTestImage(t, inbox, "cat.source.png", color.RGBA{R: 200, A: 0xff})
+	dropTestImage(t, inbox, "cat.style.png", color.RGBA{B: 100, A: 0xff})
+
+	// the parameters are out of range
+	dropTestImage(t, inbox, "dog.source.png", color.RGBA{G: 200, A: 0xff})
+	dropTestImage(t, inbox, "dog.style.png", color.RGBA{B: 200, A: 0xff})
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(inbox, "dog.json"), []byte(`{"parameters": {"output_format": "tiff"}}`), 0644))
+
+	// the manifest names an image that still isn't there long after it
+	// was written
+	foxManifest := filepath.Join(inbox, "fox.json")
+	assert.NoError(t, ioutil.WriteFile(foxManifest, []byte(`{"source_image": "fox.jpg", "style_image": "fox.jpg"}`), 0644))
+	writtenAt := time.Now().Add(-2 * hotFolder.ImageTimeout)
+	assert.NoError(t, os.Chtimes(foxManifest, writtenAt, writtenAt))
+
+	processed, err := hotFolder.ProcessInbox()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, processed)
+
+	log, err := ioutil.ReadFile(filepath.Join(hotFolder.ErrorDir, "cat", "job.log"))
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(string(log), "out of memory"))
+	_, err = os.Stat(filepath.Join(hotFolder.ErrorDir, "cat", "cat.source.png"))
+	assert.NoError(t, err)
+	jobBytes, err := ioutil.ReadFile(filepath.Join(hotFolder.ErrorDir, "cat", "job.json"))
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(string(jobBytes), StateProcessingAbandoned))
+
+	errorMessage, err := ioutil.ReadFile(filepath.Join(hotFolder.ErrorDir, "dog", "error.txt"))
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(string(errorMessage), "output_format"))
+
+	errorMessage, err = ioutil.ReadFile(filepath.Join(hotFolder.ErrorDir, "fox", "error.txt"))
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(string(errorMessage), "fox.jpg"))
+	_, err = os.Stat(filepath.Join(hotFolder.ErrorDir, "fox", "fox.json"))
+	assert.NoError(t, err)
+	assertNoStoredJobs(t, hotFolder)
+
+}
+
+func TestHotFolderManifestBeforeImages(t *testing.T) {
+
+	hotFolder, cleanup := newTestHotFolder(t, FakeExecutor{})
+	defer cleanup()
+	inbox := hotFolder.Inbox
+
+	// the manifest is copied in first, and waits for its images
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(inbox, "dog.json"), []byte(`{"source_image": "dog.jpg", "style_image": "starry_night.png"}`), 0644))
+	processed, err := hotFolder.ProcessInbox()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, processed)
+	_, err = os.Stat(filepath.Join(inbox, "dog.json"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(hotFolder.ErrorDir, "dog"))
+	assert.True(t, os.IsNotExist(err))
+
+	dropTestImage(t, inbox, "dog.jpg", color.RGBA{G: 200, A: 0xff})
+	processed, err = hotFolder.ProcessInbox()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, processed)
+
+	dropTestImage(t, inbox, "starry_night.png", color.RGBA{B: 200, A: 0xff})
+	processed, err = hotFolder.ProcessInbox()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, processed)
+	_, err = os.Stat(filepath.Join(hotFolder.Outbox, "dog", "result_image.jpg"))
+	assert.NoError(t, err)
+	assertNoStoredJobs(t, hotFolder)
+
+}
+
+func TestHotFolderRecoversInterruptedJobs(t *testing.T) {
+
+	hotFolder, cleanup := newTestHotFolder(t, FakeExecutor{})
+	defer cleanup()
+
+	// a job that was being processed when the last run died
+	workDir := filepath.Join(hotFolder.StateDir, hotFolderProcessingDir, "cat")
+	assert.NoError(t, os.MkdirAll(workDir, 0755))
+	dropTestImage(t, workDir, "cat.source.png", color.RGBA{R: 200, A: 0xff})
+	dropTestImage(t, workDir, "cat.style.png", color.RGBA{B: 100, A: 0xff})
+	store, err := OpenFileStore(filepath.Join(hotFolder.StateDir, "jobs"))
+	assert.NoError(t, err)
+	_, _, err = store.InsertWith(map[string]interface{}{"type": Job, "state": StateBeingProcessed}, "interrupted")
+	assert.NoError(t, err)
+	store.Close()
+
+	// files that are still being copied in wait
+	hotFolder.SettleTime = time.Hour
+	processed, err := hotFolder.ProcessInbox()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, processed)
+	_, err = os.Stat(filepath.Join(hotFolder.Inbox, "cat.source.png"))
+	assert.NoError(t, err)
+	assertNoStoredJobs(t, hotFolder)
+
+	hotFolder.SettleTime = 0
+	processed, err = hotFolder.ProcessInbox()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, processed)
+	_, err = os.Stat(filepath.Join(hotFolder.Outbox, "cat", "result_image.jpg"))
+	assert.NoError(t, err)
+
+}
@@ -1,12 +1,12 @@
 package deepstylelib
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"os/exec"
+	"os"
 	"path"
-
-	"github.com/tleyden/go-couch"
+	"time"
 )
 
 const (
@@ -16,14 +16,26 @@ const (
 )
 
 type configuration struct {
-	Database     couch.Database
-	TempDir      string // Where to store attachments and output
-	UnitTestMode bool   // Are we in "Unit Test Mode"?
+	Database         JobStore
+	TempDir          string        // Where to store attachments and output
+	Executor         Executor      // Runs the actual style transfer
+	ExecutorName     string        // Which backend Executor is, for duration stats
+	GpuIndex         int           // Which GPU to run on, if there are several
+	WorkerId         string        // Identifies this worker when claiming jobs
+	LeaseDuration    time.Duration // How long a claim lasts between heartbeats
+	RetryPolicy      RetryPolicy   // How often to retry failing jobs
+	RunningJobs      *runningJobs  // Lets the follower cancel jobs on this worker
+	ProgressInterval time.Duration // How often to save progress, 0 to never
+	SnapshotInterval time.Duration // How often timelapse jobs upload a snapshot
+	Events           *EventOutbox  // Where state transitions are sent, may be nil
+	Metrics          MetricsSink   // Where job metrics go, may be nil
+	UnitTestMode     bool          // Are we in "Unit Test Mode"?
 }
 
 type DeepStyleJob struct {
-	config configuration
-	jobDoc JobDocument
+	config   configuration
+	jobDoc   JobDocument
+	progress ProgressFunc // passed on to the executor, may be nil
 }
 
 func NewDeepStyleJob(jobDoc JobDocument, config configuration) *DeepStyleJob {
@@ -33,7 +45,7 @@ func NewDeepStyleJob(jobDoc JobDocument, config configuration) *DeepStyleJob {
 	}
 }
 
-func (d DeepStyleJob) Execute() (err error, outputFilePath, stdOutAndErr string) {
+func (d DeepStyleJob) Execute(ctx context.Context) (err error, outputFilePath, stdOutAndErr string) {
 
 	if d.config.UnitTestMode == true {
 		return nil, "/tmp/foo", "/tmp"
@@ -45,77 +57,27 @@ func (d DeepStyleJob) Execute() (err error, outputFilePath, stdOutAndErr string)
 		return err, "", ""
 	}
 
-	outputFilename := fmt.Sprintf(
-		"%v_%v.jpg",
-		d.jobDoc.Id,
-		ResultImageAttachment,
-	)
-	outputFilePath = path.Join(
-		d.config.TempDir,
-		outputFilename,
-	)
-
-	stdOutAndErrByteSlice, err := d.executeNeuralStyle(
-		sourceImagePath,
-		styleImagePath,
-		outputFilePath,
+	params := d.jobDoc.RequestedParameters().WithDefaults()
+	outputFilePath = d.outputFilePath(params)
+
+	stdOutAndErrByteSlice, err := executeWithTimeout(
+		ctx,
+		d.config.Executor,
+		StyleTransferRequest{
+			SourceImagePath: sourceImagePath,
+			StyleImagePath:  styleImagePath,
+			OutputFilePath:  outputFilePath,
+			Parameters:      params,
+			GpuIndex:        d.config.GpuIndex,
+			Progress:        d.progress,
+		},
+		params.Timeout(),
 	)
 
 	return err, outputFilePath, string(stdOutAndErrByteSlice)
 
 }
 
-func (d DeepStyleJob) executeNeuralStyle(sourceImagePath, styleImagePath, outputFilePath string) (stdOutAndErr []byte, err error) {
-
-	torchInstalled := torchInstalled()
-
-	if torchInstalled {
-		useGpu := hasGPU()
-		cmd := d.generateNeuralStyleCommand(
-			sourceImagePath,
-			styleImagePath,
-			outputFilePath,
-			useGpu,
-		)
-		// set the current working directory to ~/neural_style
-		cmd.Dir = "/home/ubuntu/neural-style"
-
-		// Execute the command and get the output
-		log.Printf("Invoking neural-style")
-		return cmd.CombinedOutput()
-
-	} else {
-		useGpu := hasGPU()
-		log.Printf("useGpu: %v", useGpu)
-		// copy the sourceImagePath to the outputFilePath
-		cp(outputFilePath, sourceImagePath)
-		return []byte("Torch not installed, just created a fake output file"), nil
-	}
-
-}
-
-func (d DeepStyleJob) generateNeuralStyleCommand(sourceImagePath, styleImagePath, outputFilePath string, useGpu bool) (cmd *exec.Cmd) {
-
-	gpuId := "-1"
-	if useGpu {
-		gpuId = "0"
-	}
-
-	return exec.Command(
-		"th",
-		"neural_style.lua",
-		"-gpu",
-		gpuId,
-		"-style_image",
-		styleImagePath,
-		"-content_image",
-		sourceImagePath,
-		"-output_image",
-		outputFilePath,
-	)
-
-}
-
 func (d DeepStyleJob) DownloadAttachments() (err error, sourceImagePath, styleImagePath string) {
 
 	attachmentNames := []string{SourceImageAttachment, StyleImageAttachment}
@@ -125,23 +87,16 @@ func (d DeepStyleJob) DownloadAttachments() (err error, sourceImagePath, styleIm
 
 		attachmentReader, err := d.jobDoc.RetrieveAttachment(attachmentName)
 		if err != nil {
-			return fmt.Errorf("Error retrieving attachment: %v", err), "", ""
+			return downloadError{fmt.Errorf("Error retrieving attachment: %v", err)}, "", ""
 		}
 
-		filename := fmt.Sprintf(
-			"%v_%v.jpg",
-			d.jobDoc.Id,
-			attachmentName,
-		)
-		attachmentFilepath := path.Join(
-			d.config.TempDir,
-			filename,
-		)
+		attachmentFilepath := d.attachmentFilePath(attachmentName)
 		attachmentPaths = append(attachmentPaths, attachmentFilepath)
 
-		err = writeToFile(attachmentReader, attachmentFilepath)
+		written, err := writeToFile(attachmentReader, attachmentFilepath)
+		d.config.metrics().AddCounter(MetricAttachmentBytes, Labels{"direction": "download"}, float64(written))
 		if err != nil {
-			return fmt.Errorf("Error writing file: %v", err), "", ""
+			return downloadError{fmt.Errorf("Error writing file: %v", err)}, "", ""
 		}
 
 	}
@@ -149,40 +104,231 @@ func (d DeepStyleJob) DownloadAttachments() (err error, sourceImagePath, styleIm
 
 }
 
+func (d DeepStyleJob) attachmentFilePath(attachmentName string) string {
+	filename := fmt.Sprintf(
+		"%v_%v.jpg",
+		d.jobDoc.Id,
+		attachmentName,
+	)
+	return path.Join(
+		d.config.TempDir,
+		filename,
+	)
+}
+
+func (d DeepStyleJob) timelapseFilePath() string {
+	return path.Join(
+		d.config.TempDir,
+		fmt.Sprintf("%v_%v.gif", d.jobDoc.Id, TimelapseGifAttachment),
+	)
+}
+
+func (d DeepStyleJob) outputFilePath(params JobParameters) string {
+	outputFilename := fmt.Sprintf(
+		"%v_%v.%v",
+		d.jobDoc.Id,
+		ResultImageAttachment,
+		params.OutputFormat,
+	)
+	return path.Join(
+		d.config.TempDir,
+		outputFilename,
+	)
+}
+
+// RemoveTempFiles deletes the downloaded attachments and any output,
+// including intermediate results
+func (d DeepStyleJob) RemoveTempFiles() {
+
+	params := d.jobDoc.RequestedParameters().WithDefaults()
+	outputFilePath := d.outputFilePath(params)
+	tempFiles := []string{
+		d.attachmentFilePath(SourceImageAttachment),
+		d.attachmentFilePath(StyleImageAttachment),
+		outputFilePath,
+		d.timelapseFilePath(),
+	}
+	for {
+		intermediatePath, _, ok := newestIntermediateResult(outputFilePath)
+		if !ok {
+			break
+		}
+		if err := os.Remove(intermediatePath); err != nil {
+			log.Printf("Unable to remove temp file %v: %v", intermediatePath, err)
+			break
+		}
+	}
+
+	for _, tempFile := range tempFiles {
+		if err := os.Remove(tempFile); err != nil && !os.IsNotExist(err) {
+			log.Printf("Unable to remove temp file %v: %v", tempFile, err)
+		}
+	}
+
+}
+
 func executeDeepStyleJob(config configuration, jobDoc JobDocument) error {
 
 	jobDoc.SetConfiguration(config)
-	jobDoc.UpdateState(StateBeingProcessed)
+
+	// Make sure no other worker is processing this job
+	leaseDuration := config.LeaseDuration
+	if leaseDuration <= 0 {
+		leaseDuration = DefaultLeaseDuration
+	}
+	claimed, err := jobDoc.Claim(config.WorkerId, leaseDuration)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		log.Printf("Job %v was claimed by another worker, skipping", jobDoc.Id)
+		return nil
+	}
+
+	// The job can be cancelled by the follower (via RunningJobs) or by the
+	// heartbeat, if the job is cancelled, deleted or reaped while it runs.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config.RunningJobs.add(jobDoc.Id, cancel)
+	defer config.RunningJobs.remove(jobDoc.Id)
+
+	// Keep renewing our claim for as long as the job runs, so the reaper
+	// can tell a long running job from one whose worker died.
+	stopHeartbeat := startLeaseHeartbeat(jobDoc, config.WorkerId, leaseDuration, cancel)
+	defer stopHeartbeat()
+
+	// Record the outcome of this attempt on the job, and in the metrics.
+	// reason is one of the FailureReason constants, or empty on success.
+	startedAt := time.Now()
+	completeAttempt := func(result AttemptResult, reason string) {
+		stopHeartbeat()
+		duration := time.Since(startedAt)
+		updated, err := jobDoc.CompleteAttempt(config.WorkerId, result, config.RetryPolicy)
+		// jobDoc is only abandoned if our update went in
+		state := ""
+		if updated {
+			state = jobDoc.State
+		}
+		recordAttemptMetrics(config.metrics(), duration, attemptOutcome(reason, state), reason)
+		if err != nil {
+			log.Printf("Unable to record result of job %v: %v", jobDoc.Id, err)
+		} else if !updated && jobDoc.IsCancelRequested() {
+			// cancelled just as it finished
+			jobDoc.MarkCancelled(config.WorkerId)
+		} else if !updated {
+			log.Printf("Job %v is no longer held by %v, result not recorded", jobDoc.Id, config.WorkerId)
+		}
+	}
+
+	// Reject out-of-range parameters before spending any GPU time on them
+	requestedParams := jobDoc.RequestedParameters()
+	if err := requestedParams.Validate(); err != nil {
+		log.Printf("Job %v has invalid parameters: %v", jobDoc.Id, err)
+		completeAttempt(AttemptResult{
+			Err:        err,
+			Retryable:  false,
+			ExitStatus: noExitStatus,
+		}, FailureReasonInvalidParameters)
+		return err
+	}
+
+	// Record exactly what we ran with, for reproducibility
+	jobDoc.SetEffectiveParameters(requestedParams.WithDefaults())
+
+	// Save progress on the job as the executor reports it
+	reportProgress, stopProgress := startProgressReporter(jobDoc, config.WorkerId, config.ProgressInterval)
+	defer stopProgress()
 
 	deepStyleJob := NewDeepStyleJob(jobDoc, config)
-	err, outputFilePath, stdOutAndErr := deepStyleJob.Execute()
+	deepStyleJob.progress = reportProgress
+
+	// Retries run in the same temp dir with the same file names, so start
+	// without whatever an attempt that died here left behind, and leave
+	// nothing behind however this one ends
+	deepStyleJob.RemoveTempFiles()
+	defer deepStyleJob.RemoveTempFiles()
+
+	// Upload snapshots as the job runs, if the app asked for a timelapse
+	stopSnapshots := func() []string { return nil }
+	if requestedParams.Timelapse {
+		snapshots := startSnapshotUploader(
+			jobDoc,
+			deepStyleJob.outputFilePath(requestedParams.WithDefaults()),
+			config.SnapshotInterval,
+		)
+		stopSnapshots = snapshots.stop
+		defer stopSnapshots()
+	}
+
+	executeStartedAt := time.Now()
+	err, outputFilePath, stdOutAndErr := deepStyleJob.Execute(ctx)
+	executeDuration := time.Since(executeStartedAt)
+	stopProgress()
+	snapshotPaths := stopSnapshots()
+
+	// Was the job cancelled while it was running?
+	if ctx.Err() != nil {
+		stopHeartbeat()
+		recordAttemptMetrics(config.metrics(), time.Since(startedAt), OutcomeCancelled, "")
+		finishCancelledJob(jobDoc, deepStyleJob, config.WorkerId)
+		return nil
+	}
+
+	// Did it run too long?  Keep the newest intermediate result if any.
+	if timeoutErr, ok := err.(*TimeoutError); ok {
+		log.Printf("Job %v: %v", jobDoc.Id, timeoutErr)
+		if partialPath, iteration, ok := newestIntermediateResult(outputFilePath); ok {
+			if err := jobDoc.AddAttachment(ResultImageAttachment, partialPath); err != nil {
+				log.Printf("Unable to attach partial result of job %v: %v", jobDoc.Id, err)
+			} else {
+				timeoutErr.PartialResultIteration = iteration
+			}
+		}
+		completeAttempt(AttemptResult{
+			Err:          timeoutErr,
+			Retryable:    false,
+			ExitStatus:   noExitStatus,
+			StdOutAndErr: stdOutAndErr,
+		}, FailureReasonTimeout)
+		return timeoutErr
+	}
 
 	// Did the job fail?
 	if err != nil {
-		// Record failure
+		// Record failure, it will be retried if it has attempts left
 		log.Printf("Job failed with error: %v", err)
-		jobDoc.UpdateState(StateProcessingFailed)
-		jobDoc.SetErrorMessage(err)
-		jobDoc.SetStdOutAndErr(stdOutAndErr)
+		completeAttempt(AttemptResult{
+			Err:          err,
+			Retryable:    true,
+			ExitStatus:   exitStatus(err),
+			StdOutAndErr: stdOutAndErr,
+		}, failureReason(err))
 		return err
 	}
 
 	// Try to attach the result image, otherwise consider it a failure
 	if err := jobDoc.AddAttachment(ResultImageAttachment, outputFilePath); err != nil {
-		jobDoc.UpdateState(StateProcessingFailed)
 		log.Printf("Set err message to: %v", err)
-		updated, errSet := jobDoc.SetErrorMessage(err)
-		log.Printf("setErrorMessage updated: %v errSet: %v", updated, errSet)
-		updated, errSet = jobDoc.SetStdOutAndErr(stdOutAndErr)
-		log.Printf("SetStdOutAndErr updated: %v errSet: %v", updated, errSet)
+		completeAttempt(AttemptResult{
+			Err:          err,
+			Retryable:    true,
+			ExitStatus:   noExitStatus,
+			StdOutAndErr: stdOutAndErr,
+		}, FailureReasonUpload)
 		return err
 	}
 
+	if requestedParams.Timelapse {
+		deepStyleJob.attachTimelapse(&jobDoc, snapshotPaths, outputFilePath)
+	}
+
 	// Record successful result in job
-	jobDoc.SetStdOutAndErr(stdOutAndErr)
-	jobDoc.UpdateState(StateProcessingSuccessful)
+	completeAttempt(AttemptResult{
+		StdOutAndErr: stdOutAndErr,
+	}, "")
 
-	// TODO: Delete all temp files
+	// Only successful runs say how long a job of this size takes
+	recordJobDuration(config, jobDoc, executeDuration)
 
 	return nil
 }
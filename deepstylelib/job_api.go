@@ -0,0 +1,280 @@
+package deepstylelib
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Largest upload the job API accepts, both images together
+const maxJobUploadBytes = 64 << 20
+
+// JobAPI is a small HTTP API over a job store, standing in for the Sync
+// Gateway REST API when running with deepstyle serve:
+//
+//	POST /jobs                      multipart source_image and style_image files,
+//	                                optional parameters (JSON), owner and owner_email
+//	GET  /jobs/{id}                 the job doc
+//	GET  /jobs/{id}/{attachment}    eg result_image
+//	POST /jobs/{id}/cancel          ask the worker to stop the job
+//
+// If Token is set, every request needs an Authorization: Bearer <token>
+// header.
+type JobAPI struct {
+	Store   JobStore
+	TempDir string // Where uploads are spooled before being attached
+	Token   string // Bearer token every request must carry, empty for none
+}
+
+func (a JobAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if !a.isAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.URL.Path != "/jobs" && !strings.HasPrefix(r.URL.Path, "/jobs/") {
+		http.NotFound(w, r)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	parts := []string{}
+	if path != "" {
+		parts = strings.Split(path, "/")
+	}
+
+	switch {
+	case len(parts) == 0 && r.Method == "POST":
+		a.createJob(w, r)
+	case len(parts) == 1 && r.Method == "GET":
+		a.getJob(w, parts[0])
+	case len(parts) == 2 && parts[1] == "cancel" && r.Method == "POST":
+		a.cancelJob(w, parts[0])
+	case len(parts) == 2 && r.Method == "GET":
+		a.getAttachment(w, parts[0], parts[1])
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+
+}
+
+// isAuthorized returns true if the request carries the token, or there's no
+// token to check
+func (a JobAPI) isAuthorized(r *http.Request) bool {
+	if a.Token == "" {
+		return true
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+}
+
+// createJob adds the job the way the app does: doc first, then the source
+// and style images, then marks it ready
+func (a JobAPI) createJob(w http.ResponseWriter, r *http.Request) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxJobUploadBytes)
+	if err := r.ParseMultipartForm(maxJobUploadBytes); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid upload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	body := map[string]interface{}{
+		"type":        Job,
+		"state":       StateNotReadyToProcess,
+		"created_at":  time.Now().UTC().Format(time.RFC3339),
+		"owner":       r.FormValue("owner"),
+		"owner_email": r.FormValue("owner_email"),
+	}
+	if rawParams := r.FormValue("parameters"); rawParams != "" {
+		params := JobParameters{}
+		if err := json.Unmarshal([]byte(rawParams), &params); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid parameters: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := params.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body["parameters"] = params
+	}
+	for _, attachmentName := range []string{SourceImageAttachment, StyleImageAttachment} {
+		if _, _, err := r.FormFile(attachmentName); err != nil {
+			http.Error(w, fmt.Sprintf("Missing %v: %v", attachmentName, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	jobId := newRandomId()
+	if _, _, err := a.Store.InsertWith(body, jobId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jobDoc, err := NewJobDocument(jobId, configuration{Database: a.Store})
+	if err != nil {
+		a.failJob(jobId, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, attachmentName := range []string{SourceImageAttachment, StyleImageAttachment} {
+		if err := a.attachUpload(jobDoc, r, attachmentName); err != nil {
+			err = fmt.Errorf("Unable to attach %v: %v", attachmentName, err)
+			a.failJob(jobId, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if _, err := jobDoc.UpdateState(StateReadyToProcess); err != nil {
+		a.failJob(jobId, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Created job %v", jobId)
+
+	w.Header().Set("Location", "/jobs/"+jobId)
+	writeJSON(w, http.StatusCreated, map[string]string{"id": jobId})
+
+}
+
+// failJob marks a job that couldn't be created PROCESSING_FAILED, so it
+// isn't left NOT_READY_TO_PROCESS forever
+func (a JobAPI) failJob(jobId string, cause error) {
+
+	jobDoc := JobDocument{}
+	jobDoc.Id = jobId
+	jobDoc.SetConfiguration(configuration{Database: a.Store})
+
+	isNotReady := func() bool {
+		return jobDoc.State == StateNotReadyToProcess
+	}
+
+	failUpdater := func() {
+		jobDoc.State = StateProcessingFailed
+		jobDoc.ErrorMessage = cause.Error()
+	}
+
+	if _, err := jobDoc.editIf(isNotReady, failUpdater); err != nil {
+		log.Printf("Unable to mark job %v failed: %v", jobId, err)
+	}
+
+}
+
+// attachUpload spools the uploaded file to disk, since AddAttachment sniffs
+// and verifies it from a file
+func (a JobAPI) attachUpload(jobDoc *JobDocument, r *http.Request, attachmentName string) error {
+
+	upload, header, err := r.FormFile(attachmentName)
+	if err != nil {
+		return err
+	}
+	defer upload.Close()
+
+	dir, err := ioutil.TempDir(a.TempDir, "deepstyle_upload")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// keep the extension, it's the fallback for the content type
+	uploadPath := filepath.Join(dir, attachmentName+filepath.Ext(header.Filename))
+	if _, err := writeToFile(upload, uploadPath); err != nil {
+		return err
+	}
+	return jobDoc.AddAttachment(attachmentName, uploadPath)
+
+}
+
+func (a JobAPI) getJob(w http.ResponseWriter, jobId string) {
+
+	doc := map[string]interface{}{}
+	if err := a.Store.Retrieve(jobId, &doc); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if doc["type"] != Job {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, doc)
+
+}
+
+func (a JobAPI) getAttachment(w http.ResponseWriter, jobId, attachmentName string) {
+
+	jobDoc, err := NewJobDocument(jobId, configuration{Database: a.Store})
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	content, err := jobDoc.RetrieveAttachment(attachmentName)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	if stub, ok := jobDoc.Attachments[attachmentName].(map[string]interface{}); ok {
+		if contentType, ok := stub["content_type"].(string); ok {
+			w.Header().Set("Content-Type", contentType)
+		}
+	}
+	if _, err := io.Copy(w, content); err != nil {
+		log.Printf("Error sending %v of job %v: %v", attachmentName, jobId, err)
+	}
+
+}
+
+// cancelJob moves the job to CANCEL_REQUESTED, unless it's already done
+func (a JobAPI) cancelJob(w http.ResponseWriter, jobId string) {
+
+	jobDoc, err := NewJobDocument(jobId, configuration{Database: a.Store})
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	isCancellable := func() bool {
+		return !jobDoc.IsFinished() && !jobDoc.IsCancelRequested() && jobDoc.State != StateCancelled
+	}
+	cancelUpdater := func() {
+		jobDoc.State = StateCancelRequested
+	}
+	if _, err := jobDoc.editIf(isCancellable, cancelUpdater); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"id": jobId, "state": jobDoc.State})
+
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case isNotFound(err):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case isConflict(err):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
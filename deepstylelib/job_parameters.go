@@ -0,0 +1,220 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Optimizers supported by neural-style
+const (
+	OptimizerLbfgs = "lbfgs"
+	OptimizerAdam  = "adam"
+)
+
+// Init modes supported by neural-style
+const (
+	InitRandom = "random"
+	InitImage  = "image"
+)
+
+// Output formats for the result image
+const (
+	OutputFormatJpg = "jpg"
+	OutputFormatPng = "png"
+)
+
+// JobParameters are the optional style transfer settings on a job.  Any
+// field left at its zero value uses the neural-style default, see
+// DefaultJobParameters.  The weights and Seed are pointers since 0 is a
+// meaningful value for them, eg a tv_weight of 0 turns off TV
+// regularization, so only nil uses the default.
+type JobParameters struct {
+	Iterations    int      `json:"iterations,omitempty"`
+	ImageSize     int      `json:"image_size,omitempty"`
+	ContentWeight *float64 `json:"content_weight,omitempty"`
+	StyleWeight   *float64 `json:"style_weight,omitempty"`
+	TVWeight      *float64 `json:"tv_weight,omitempty"`
+	StyleScale    float64  `json:"style_scale,omitempty"`
+	Optimizer     string   `json:"optimizer,omitempty"`
+	Init          string   `json:"init,omitempty"`
+	Seed          *int     `json:"seed,omitempty"`
+	OutputFormat  string   `json:"output_format,omitempty"`
+
+	// Save an intermediate result every SaveIter iterations, and with
+	// Timelapse, upload them as snapshots and make a timelapse gif
+	SaveIter  int  `json:"save_iter,omitempty"`
+	Timelapse bool `json:"timelapse,omitempty"`
+
+	// Kill the job if it runs longer than this, keeping the newest
+	// intermediate result if there is one.  0 uses the executor's limit.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+}
+
+// DefaultJobParameters returns the neural-style defaults
+func DefaultJobParameters() JobParameters {
+	seed := -1
+	contentWeight, styleWeight, tvWeight := 5.0, 100.0, 1e-3
+	return JobParameters{
+		Iterations:    1000,
+		ImageSize:     512,
+		ContentWeight: &contentWeight,
+		StyleWeight:   &styleWeight,
+		TVWeight:      &tvWeight,
+		StyleScale:    1.0,
+		Optimizer:     OptimizerLbfgs,
+		Init:          InitRandom,
+		Seed:          &seed,
+		OutputFormat:  OutputFormatJpg,
+		SaveIter:      100,
+	}
+}
+
+// Validate returns an error describing the first out-of-range value
+func (p JobParameters) Validate() error {
+
+	if p.Iterations < 0 || p.Iterations > 5000 {
+		return fmt.Errorf("Invalid iterations: %v.  Must be between 1 and 5000", p.Iterations)
+	}
+	if p.ImageSize != 0 && (p.ImageSize < 64 || p.ImageSize > 2048) {
+		return fmt.Errorf("Invalid image_size: %v.  Must be between 64 and 2048", p.ImageSize)
+	}
+	if p.ContentWeight != nil && (*p.ContentWeight < 0 || *p.ContentWeight > 1e6) {
+		return fmt.Errorf("Invalid content_weight: %v.  Must be between 0 and 1000000", *p.ContentWeight)
+	}
+	if p.StyleWeight != nil && (*p.StyleWeight < 0 || *p.StyleWeight > 1e6) {
+		return fmt.Errorf("Invalid style_weight: %v.  Must be between 0 and 1000000", *p.StyleWeight)
+	}
+	if p.TVWeight != nil && (*p.TVWeight < 0 || *p.TVWeight > 1) {
+		return fmt.Errorf("Invalid tv_weight: %v.  Must be between 0 and 1", *p.TVWeight)
+	}
+	if p.StyleScale < 0 || p.StyleScale > 4 {
+		return fmt.Errorf("Invalid style_scale: %v.  Must be between 0 and 4", p.StyleScale)
+	}
+	switch p.Optimizer {
+	case "", OptimizerLbfgs, OptimizerAdam:
+	default:
+		return fmt.Errorf("Invalid optimizer: %q.  Must be %v or %v", p.Optimizer, OptimizerLbfgs, OptimizerAdam)
+	}
+	switch p.Init {
+	case "", InitRandom, InitImage:
+	default:
+		return fmt.Errorf("Invalid init: %q.  Must be %v or %v", p.Init, InitRandom, InitImage)
+	}
+	if p.Seed != nil && *p.Seed < -1 {
+		return fmt.Errorf("Invalid seed: %v.  Must be -1 (random) or greater", *p.Seed)
+	}
+	switch strings.ToLower(p.OutputFormat) {
+	case "", OutputFormatJpg, OutputFormatPng:
+	default:
+		return fmt.Errorf("Invalid output_format: %q.  Must be %v or %v", p.OutputFormat, OutputFormatJpg, OutputFormatPng)
+	}
+	if p.SaveIter < 0 || p.SaveIter > 5000 {
+		return fmt.Errorf("Invalid save_iter: %v.  Must be between 1 and 5000", p.SaveIter)
+	}
+	if p.TimeoutSeconds < 0 || time.Duration(p.TimeoutSeconds)*time.Second > MaxJobTimeout {
+		return fmt.Errorf("Invalid timeout_seconds: %v.  Must be between 1 and %v", p.TimeoutSeconds, int(MaxJobTimeout.Seconds()))
+	}
+	return nil
+
+}
+
+// WithDefaults returns a copy of the parameters with every unset field
+// filled in from DefaultJobParameters.
+func (p JobParameters) WithDefaults() JobParameters {
+
+	defaults := DefaultJobParameters()
+	effective := p
+
+	if effective.Iterations == 0 {
+		effective.Iterations = defaults.Iterations
+	}
+	if effective.ImageSize == 0 {
+		effective.ImageSize = defaults.ImageSize
+	}
+	effective.ContentWeight = floatOrDefault(effective.ContentWeight, defaults.ContentWeight)
+	effective.StyleWeight = floatOrDefault(effective.StyleWeight, defaults.StyleWeight)
+	effective.TVWeight = floatOrDefault(effective.TVWeight, defaults.TVWeight)
+	if effective.StyleScale == 0 {
+		effective.StyleScale = defaults.StyleScale
+	}
+	if effective.Optimizer == "" {
+		effective.Optimizer = defaults.Optimizer
+	}
+	if effective.Init == "" {
+		effective.Init = defaults.Init
+	}
+	if effective.Seed == nil {
+		effective.Seed = defaults.Seed
+	} else {
+		seed := *effective.Seed
+		effective.Seed = &seed
+	}
+	if effective.SaveIter == 0 {
+		effective.SaveIter = defaults.SaveIter
+	}
+	effective.OutputFormat = strings.ToLower(effective.OutputFormat)
+	if effective.OutputFormat == "" {
+		effective.OutputFormat = defaults.OutputFormat
+	}
+	return effective
+
+}
+
+// Timeout returns the time limit the job asked for, 0 if none
+func (p JobParameters) Timeout() time.Duration {
+	return time.Duration(p.TimeoutSeconds) * time.Second
+}
+
+// NeuralStyleArgs maps the parameters to neural_style.lua flags.  Call it on
+// the result of WithDefaults so every flag is passed explicitly.
+func (p JobParameters) NeuralStyleArgs() []string {
+
+	args := []string{}
+	if p.Iterations != 0 {
+		args = append(args, "-num_iterations", strconv.Itoa(p.Iterations))
+	}
+	if p.ImageSize != 0 {
+		args = append(args, "-image_size", strconv.Itoa(p.ImageSize))
+	}
+	if p.ContentWeight != nil {
+		args = append(args, "-content_weight", formatFloat(*p.ContentWeight))
+	}
+	if p.StyleWeight != nil {
+		args = append(args, "-style_weight", formatFloat(*p.StyleWeight))
+	}
+	if p.TVWeight != nil {
+		args = append(args, "-tv_weight", formatFloat(*p.TVWeight))
+	}
+	if p.StyleScale != 0 {
+		args = append(args, "-style_scale", formatFloat(p.StyleScale))
+	}
+	if p.Optimizer != "" {
+		args = append(args, "-optimizer", p.Optimizer)
+	}
+	if p.Init != "" {
+		args = append(args, "-init", p.Init)
+	}
+	if p.Seed != nil {
+		args = append(args, "-seed", strconv.Itoa(*p.Seed))
+	}
+	if p.SaveIter != 0 {
+		args = append(args, "-save_iter", strconv.Itoa(p.SaveIter))
+	}
+	return args
+
+}
+
+// floatOrDefault returns a copy of value, or of defaultValue if it's nil
+func floatOrDefault(value, defaultValue *float64) *float64 {
+	if value == nil {
+		value = defaultValue
+	}
+	f := *value
+	return &f
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,51 @@
+package deepstylelib
+
+import "time"
+
+// JobSource is where a worker's jobs come from.  ChangesFeedFollower runs
+// the jobs apps save to Sync Gateway, as they show up on the changes feed.
+// QueueJobSource runs jobs other services publish to a message queue.
+type JobSource interface {
+
+	// Follow runs jobs as they arrive, until the source can't be read from
+	// anymore
+	Follow()
+}
+
+var (
+	_ JobSource = ChangesFeedFollower{}
+	_ JobSource = (*QueueJobSource)(nil)
+)
+
+// MessageQueue is a queue of job messages on a broker, eg a Redis stream,
+// read by a group of workers that each get different messages.  A message
+// received but neither acked nor nacked, eg because the worker died, is
+// delivered again, to the same worker if it comes back or to another once
+// the message has been left long enough (see RedisStreamQueue).
+type MessageQueue interface {
+
+	// Receive waits up to wait for the next message, returning nil if there
+	// wasn't one
+	Receive(wait time.Duration) (*QueueMessage, error)
+
+	// Ack removes a message from the queue, once it's been handled
+	Ack(message *QueueMessage) error
+
+	// Nack gives a message back to be delivered again straight away, with
+	// NackedAt set, or if deadLetter moves it to the dead letter queue,
+	// along with why it failed
+	Nack(message *QueueMessage, reason error, deadLetter bool) error
+
+	// Close disconnects from the broker
+	Close() error
+}
+
+// QueueMessage is a message received from a MessageQueue
+type QueueMessage struct {
+	Id         string // Stays the same when the message is delivered again
+	Body       []byte
+	Deliveries int       // How many times the message has been delivered, including this one
+	NackedAt   time.Time // When it was last nacked, zero if it never was
+
+	receipt string // What the queue acks this delivery by
+}
@@ -1,42 +1,496 @@
 package deepstylelib
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/tleyden/go-couch"
+	"github.com/stretchr/testify/assert"
+	"github.com/tleyden/deepstyle/deepstylelib/fakesyncgw"
 )
 
-/*
+// newTestJob adds a job to the fake Sync Gateway the way the app does: doc
+// first, then the source and style images, then marks it ready.
+func newTestJob(t *testing.T, db JobStore, jobId string, params *JobParameters) JobDocument {
+
+	dir, err := ioutil.TempDir("", "deepstyle_job")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	body := map[string]interface{}{
+		"type":  Job,
+		"state": StateNotReadyToProcess,
+	}
+	if params != nil {
+		body["parameters"] = params
+	}
+	_, _, err = db.InsertWith(body, jobId)
+	assert.NoError(t, err)
+
+	jobDoc, err := NewJobDocument(jobId, configuration{Database: db})
+	assert.NoError(t, err)
+
+	images := map[string]color.Color{
+		SourceImageAttachment: color.RGBA{R: 200, A: 0xff},
+		StyleImageAttachment:  color.RGBA{B: 100, A: 0xff},
+	}
+	for attachmentName, c := range images {
+		imagePath := filepath.Join(dir, attachmentName+".png")
+		assert.NoError(t, encodeImageFile(solidImage(4, 4, c), imagePath))
+		assert.NoError(t, jobDoc.AddAttachment(attachmentName, imagePath))
+	}
+
+	updated, err := jobDoc.UpdateState(StateReadyToProcess)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+	return *jobDoc
+
+}
+
+// waitForState polls the fake Sync Gateway until the job is in state
+func waitForState(t *testing.T, syncGw *fakesyncgw.Server, jobId, state string) bool {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if doc := syncGw.Doc(jobId); doc != nil && doc["state"] == state {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Job %v never reached %v, is %v", jobId, state, syncGw.Doc(jobId)["state"])
+	return false
+}
 
-TODO:
-   - spin up local database
-   - add job document
-   - etc ..
 func TestExecuteDeepStyleJob(t *testing.T) {
 
+	syncGw := fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+
+	db, err := GetDbConnection(syncGw.DBURL())
+	assert.NoError(t, err)
+
+	tempDir, err := ioutil.TempDir("", "deepstyle_execute")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
 	config := configuration{
-		Database:     couch.Database{},
-		TempDir:      "/tmp",
-		UnitTestMode: true,
+		Database:      db,
+		TempDir:       tempDir,
+		Executor:      FakeExecutor{},
+		WorkerId:      "worker1",
+		LeaseDuration: time.Minute,
+		RetryPolicy:   DefaultRetryPolicy(),
 	}
 
-	jobDoc := JobDocument{}
+	jobDoc := newTestJob(t, db, "job1", &JobParameters{OutputFormat: OutputFormatPng})
+	assert.NoError(t, executeDeepStyleJob(config, jobDoc))
+
+	stored := syncGw.Doc("job1")
+	assert.Equal(t, StateProcessingSuccessful, stored["state"])
+	assert.Equal(t, "worker1", stored["worker_id"])
+	assert.Equal(t, OutputFormatPng, stored["effective_parameters"].(map[string]interface{})["output_format"])
 
-	err := executeDeepStyleJob(config, jobDoc)
-	assert.True(t, err == nil)
+	result, _, err := image.Decode(bytes.NewReader(syncGw.Attachment("job1", ResultImageAttachment)))
+	assert.NoError(t, err)
+	r, g, b, _ := result.At(0, 0).RGBA()
+	assert.Equal(t, []uint32{100, 0, 50}, []uint32{r >> 8, g >> 8, b >> 8})
+
+	// temp files are cleaned up
+	tempFiles, err := ioutil.ReadDir(tempDir)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(tempFiles))
+
+	// a job that's already been processed can't be run again
+	assert.NoError(t, executeDeepStyleJob(config, jobDoc))
+	assert.Equal(t, stored["_rev"], syncGw.Doc("job1")["_rev"])
 
 }
-*/
 
 func TestAddAttachment(t *testing.T) {
-	config := configuration{
-		Database:     couch.Database{},
-		TempDir:      "/tmp",
-		UnitTestMode: true,
-	}
+
+	syncGw := fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+
+	db, err := GetDbConnection(syncGw.DBURL())
+	assert.NoError(t, err)
+	config := configuration{Database: db}
+
+	_, _, err = db.InsertWith(map[string]interface{}{"type": Job}, "job1")
+	assert.NoError(t, err)
+
+	f, err := ioutil.TempFile("", "deepstyle_attachment")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write([]byte("not really a png"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
 
 	jobDoc := JobDocument{}
+	jobDoc.Id = "job1"
 	jobDoc.SetConfiguration(config)
-	jobDoc.AddAttachment("foo", "/tmp/foo.png")
+	assert.NoError(t, jobDoc.AddAttachment("foo", f.Name()))
+	assert.Equal(t, []byte("not really a png"), syncGw.Attachment("job1", "foo"))
+
+	// attachments survive later edits of the doc
+	assert.NoError(t, jobDoc.RefreshFromDB())
+	updated, err := jobDoc.UpdateState(StateReadyToProcess)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+	assert.Equal(t, []byte("not really a png"), syncGw.Attachment("job1", "foo"))
+
+	// a conflict means uploading the whole file again, not what's left of it
+	syncGw.FailRequests("PUT", "job1/bar", 409, 2)
+	assert.NoError(t, jobDoc.AddAttachment("bar", f.Name()))
+	assert.Equal(t, []byte("not really a png"), syncGw.Attachment("job1", "bar"))
+
+	// the content type comes from the bytes, not the file name
+	pngPath := f.Name() + ".jpg"
+	assert.NoError(t, encodeImageFile(solidImage(2, 2, color.White), f.Name()+".png"))
+	assert.NoError(t, os.Rename(f.Name()+".png", pngPath))
+	defer os.Remove(pngPath)
+	assert.NoError(t, jobDoc.AddAttachment(ResultImageAttachment, pngPath))
+	stub := syncGw.Doc("job1")["_attachments"].(map[string]interface{})[ResultImageAttachment]
+	assert.Equal(t, "image/png", stub.(map[string]interface{})["content_type"])
+
+	// a doc that doesn't exist can't be attached to
+	missingDoc := JobDocument{}
+	missingDoc.Id = "missing"
+	missingDoc.SetConfiguration(config)
+	assert.Error(t, missingDoc.AddAttachment("foo", f.Name()))
+
+}
+
+func TestUpdateStateRetriesConflicts(t *testing.T) {
+
+	syncGw := fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+
+	db, err := GetDbConnection(syncGw.DBURL())
+	assert.NoError(t, err)
+	config := configuration{Database: db}
+
+	_, _, err = db.InsertWith(map[string]interface{}{"type": Job, "state": StateNotReadyToProcess}, "job1")
+	assert.NoError(t, err)
+
+	staleDoc, err := NewJobDocument("job1", config)
+	assert.NoError(t, err)
+
+	// someone else edits the doc, so staleDoc's revision is out of date
+	otherDoc, err := NewJobDocument("job1", config)
+	assert.NoError(t, err)
+	otherDoc.Owner = "someone"
+	_, err = db.Edit(otherDoc)
+	assert.NoError(t, err)
+
+	updated, err := staleDoc.UpdateState(StateReadyToProcess)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+
+	stored := syncGw.Doc("job1")
+	assert.Equal(t, StateReadyToProcess, stored["state"])
+	assert.Equal(t, "someone", stored["owner"])
+
+}
+
+func TestClaimOnlyOneWorkerWins(t *testing.T) {
+
+	syncGw := fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+
+	db, err := GetDbConnection(syncGw.DBURL())
+	assert.NoError(t, err)
+	config := configuration{Database: db}
+
+	_, _, err = db.InsertWith(map[string]interface{}{
+		"type":  Job,
+		"state": StateReadyToProcess,
+	}, "job1")
+	assert.NoError(t, err)
+
+	// every worker reads the job while it's still ready, then they all race
+	numWorkers := 5
+	jobDocs := []*JobDocument{}
+	for i := 0; i < numWorkers; i++ {
+		jobDoc, err := NewJobDocument("job1", config)
+		assert.NoError(t, err)
+		assert.True(t, jobDoc.IsReadyToProcess())
+		jobDocs = append(jobDocs, jobDoc)
+	}
+
+	var wg sync.WaitGroup
+	claims := make(chan string, numWorkers)
+	for i, jobDoc := range jobDocs {
+		wg.Add(1)
+		go func(workerId string, jobDoc *JobDocument) {
+			defer wg.Done()
+			claimed, err := jobDoc.Claim(workerId, DefaultLeaseDuration)
+			assert.NoError(t, err)
+			if claimed {
+				claims <- workerId
+			}
+		}(fmt.Sprintf("worker%v", i), jobDoc)
+	}
+	wg.Wait()
+	close(claims)
+
+	winners := []string{}
+	for workerId := range claims {
+		winners = append(winners, workerId)
+	}
+	assert.Equal(t, 1, len(winners))
+
+	stored := syncGw.Doc("job1")
+	assert.Equal(t, StateBeingProcessed, stored["state"])
+	assert.Equal(t, winners[0], stored["worker_id"])
+	assert.NotEqual(t, "", stored["claimed_at"])
+
+	// a worker that shows up late with a stale copy also loses
+	lateJobDoc := JobDocument{}
+	lateJobDoc.Id = "job1"
+	lateJobDoc.SetConfiguration(config)
+	claimed, err := lateJobDoc.Claim("late_worker", DefaultLeaseDuration)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+
+}
+
+func TestReleaseExpiredLease(t *testing.T) {
+
+	syncGw := fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+
+	db, err := GetDbConnection(syncGw.DBURL())
+	assert.NoError(t, err)
+	config := configuration{Database: db}
+
+	for _, jobId := range []string{"expired", "renewed"} {
+		_, _, err = db.InsertWith(map[string]interface{}{
+			"type":  Job,
+			"state": StateReadyToProcess,
+		}, jobId)
+		assert.NoError(t, err)
+
+		jobDoc, err := NewJobDocument(jobId, config)
+		assert.NoError(t, err)
+		claimed, err := jobDoc.Claim("worker1", -time.Hour)
+		assert.NoError(t, err)
+		assert.True(t, claimed)
+	}
+
+	// the worker on the second job is alive and renews its lease
+	renewedJob, err := NewJobDocument("renewed", config)
+	assert.NoError(t, err)
+	renewed, err := renewedJob.RenewLease("worker1", time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, renewed)
+
+	// another worker can't renew a lease it doesn't hold
+	renewed, err = renewedJob.RenewLease("worker2", time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, renewed)
+
+	jobs := []JobDocument{}
+	for _, jobId := range []string{"expired", "renewed"} {
+		jobDoc, err := NewJobDocument(jobId, config)
+		assert.NoError(t, err)
+		jobs = append(jobs, *jobDoc)
+	}
+	assert.NoError(t, reapStuckJobs(jobs, ReaperConfig{GracePeriod: time.Minute, RetryPolicy: DefaultRetryPolicy()}))
+
+	assert.Equal(t, StateReadyToProcess, syncGw.Doc("expired")["state"])
+	assert.Equal(t, nil, syncGw.Doc("expired")["worker_id"])
+	assert.Equal(t, StateBeingProcessed, syncGw.Doc("renewed")["state"])
+	assert.Equal(t, "worker1", syncGw.Doc("renewed")["worker_id"])
+
+}
+
+func TestReapStuckJobsViaView(t *testing.T) {
+
+	syncGw := fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+
+	syncGw.DefineView(DesignDocName, ViewName, unprocessedJobsView)
+
+	db, err := GetDbConnection(syncGw.DBURL())
+	assert.NoError(t, err)
+	config := configuration{Database: db}
+
+	jobDoc := newTestJob(t, db, "stuck", nil)
+	jobDoc.SetConfiguration(config)
+	claimed, err := jobDoc.Claim("dead_worker", -time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	_, _, err = db.InsertWith(map[string]interface{}{"type": Job, "state": StateProcessingSuccessful}, "done")
+	assert.NoError(t, err)
+
+	// the cancel was requested after its worker died, so nobody will act
+	// on it
+	cancelling := newTestJob(t, db, "cancelling", nil)
+	cancelling.SetConfiguration(config)
+	claimed, err = cancelling.Claim("dead_worker", -time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	_, err = cancelling.UpdateState(StateCancelRequested)
+	assert.NoError(t, err)
+
+	// claimed by workers that predate leases, one of them long enough ago
+	// that it must be stuck
+	for jobId, createdAt := range map[string]time.Time{
+		"legacy_stuck":   time.Now().Add(-2 * LegacyStuckJobThreshold),
+		"legacy_running": time.Now(),
+	} {
+		_, _, err = db.InsertWith(map[string]interface{}{
+			"type":       Job,
+			"state":      StateBeingProcessed,
+			"worker_id":  "legacy_worker",
+			"created_at": createdAt.UTC().Format(time.RFC3339),
+		}, jobId)
+		assert.NoError(t, err)
+	}
+
+	// the view doesn't exist yet, so this installs it first
+	reaperConfig := ReaperConfig{GracePeriod: time.Minute, RetryPolicy: DefaultRetryPolicy()}
+	assert.NoError(t, ReapStuckJobs(syncGw.DBURL(), reaperConfig))
+	assert.NotEqual(t, nil, syncGw.DesignDoc(DesignDocName))
+
+	stored := syncGw.Doc("stuck")
+	assert.Equal(t, StateReadyToProcess, stored["state"])
+	assert.Equal(t, nil, stored["worker_id"])
+	assert.Equal(t, AttemptOutcomeLeaseExpired, stored["attempt_history"].([]interface{})[0].(map[string]interface{})["outcome"])
+
+	stored = syncGw.Doc("cancelling")
+	assert.Equal(t, StateCancelled, stored["state"])
+	assert.Equal(t, nil, stored["worker_id"])
+	assert.Equal(t, AttemptOutcomeLeaseExpired, stored["attempt_history"].([]interface{})[0].(map[string]interface{})["outcome"])
+
+	// a single run is enough to reset a legacy job
+	stored = syncGw.Doc("legacy_stuck")
+	assert.Equal(t, StateReadyToProcess, stored["state"])
+	assert.Equal(t, nil, stored["worker_id"])
+	assert.Equal(t, StateBeingProcessed, syncGw.Doc("legacy_running")["state"])
+
+	numJobs, err := numJobsReadyOrBeingProcessed(syncGw.DBURL())
+	assert.NoError(t, err)
+	assert.Equal(t, 3.0, numJobs)
+
+}
+
+func TestRetryBudget(t *testing.T) {
+
+	syncGw := fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+
+	db, err := GetDbConnection(syncGw.DBURL())
+	assert.NoError(t, err)
+	config := configuration{Database: db}
+
+	_, _, err = db.InsertWith(map[string]interface{}{
+		"type":  Job,
+		"state": StateReadyToProcess,
+	}, "job1")
+	assert.NoError(t, err)
+
+	retryPolicy := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Hour}
+	crash := AttemptResult{Err: fmt.Errorf("out of GPU memory"), Retryable: true, ExitStatus: 137}
+
+	// first attempt fails and the job backs off
+	jobDoc, err := NewJobDocument("job1", config)
+	assert.NoError(t, err)
+	claimed, err := jobDoc.Claim("worker1", DefaultLeaseDuration)
+	assert.True(t, claimed)
+	updated, err := jobDoc.CompleteAttempt("worker1", crash, retryPolicy)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+	assert.Equal(t, StateReadyToProcess, jobDoc.State)
+	assert.Equal(t, 1, jobDoc.Attempts)
+	assert.Equal(t, 137, *jobDoc.AttemptHistory[0].ExitStatus)
+	assert.Equal(t, "out of GPU memory", jobDoc.AttemptHistory[0].ErrorMessage)
+
+	// nobody can claim it until the backoff is over
+	claimed, err = jobDoc.Claim("worker2", DefaultLeaseDuration)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+
+	// pretend the backoff has passed, then the reaper releases it
+	jobDoc.NotBefore = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	_, err = db.Edit(jobDoc)
+	assert.NoError(t, err)
+	assert.NoError(t, releaseDueRetries([]JobDocument{*jobDoc}))
+	assert.Equal(t, nil, syncGw.Doc("job1")["not_before"])
+
+	// second attempt fails too, which uses up the budget
+	claimed, err = jobDoc.Claim("worker2", DefaultLeaseDuration)
+	assert.True(t, claimed)
+	updated, err = jobDoc.CompleteAttempt("worker2", crash, retryPolicy)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+	assert.Equal(t, StateProcessingAbandoned, jobDoc.State)
+	assert.Equal(t, 2, len(jobDoc.AttemptHistory))
+	assert.Equal(t, "worker2", jobDoc.AttemptHistory[1].WorkerId)
+	assert.Contains(t, jobDoc.ErrorMessage, "Gave up after 2 attempts")
+
+}
+
+// intermediateExecutor writes an intermediate result, then fails, and
+// records whether an earlier attempt's intermediate result was there
+type intermediateExecutor struct {
+	sawStale *bool
+}
+
+func (e intermediateExecutor) Execute(ctx context.Context, req StyleTransferRequest) ([]byte, error) {
+	ext := filepath.Ext(req.OutputFilePath)
+	base := strings.TrimSuffix(req.OutputFilePath, ext)
+	if _, _, ok := newestIntermediateResult(req.OutputFilePath); ok {
+		*e.sawStale = true
+	}
+	if err := ioutil.WriteFile(base+"_100"+ext, []byte("partial"), 0644); err != nil {
+		return nil, err
+	}
+	return []byte("out of memory"), fmt.Errorf("exit status 3")
+}
+
+func TestFailedAttemptsRemoveTempFiles(t *testing.T) {
+
+	syncGw := fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+
+	db, err := GetDbConnection(syncGw.DBURL())
+	assert.NoError(t, err)
+	dir, err := ioutil.TempDir("", "deepstyle_job")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sawStale := false
+	config := configuration{
+		Database:    db,
+		TempDir:     dir,
+		Executor:    intermediateExecutor{sawStale: &sawStale},
+		WorkerId:    "worker1",
+		RetryPolicy: RetryPolicy{MaxAttempts: 3},
+	}
+	jobDoc := newTestJob(t, db, "job1", nil)
+
+	// an attempt that died here left an intermediate result behind
+	stale := NewDeepStyleJob(jobDoc, config).outputFilePath(jobDoc.RequestedParameters().WithDefaults())
+	stale = strings.TrimSuffix(stale, filepath.Ext(stale)) + "_900" + filepath.Ext(stale)
+	assert.NoError(t, ioutil.WriteFile(stale, []byte("stale"), 0644))
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		assert.NoError(t, jobDoc.RefreshFromDB())
+		assert.Error(t, executeDeepStyleJob(config, jobDoc))
+		assert.False(t, sawStale, "attempt %v", attempt)
+		files, err := ioutil.ReadDir(dir)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(files), "attempt %v", attempt)
+	}
 
 }
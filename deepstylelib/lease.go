@@ -0,0 +1,131 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a claim on a job lasts without being renewed.  The worker
+	// renews it several times per lease while the job runs.
+	DefaultLeaseDuration = 5 * time.Minute
+
+	// How long past lease expiry the reaper waits before requeueing a job,
+	// to allow for clock skew and slow heartbeats.
+	DefaultLeaseGracePeriod = 5 * time.Minute
+)
+
+// LeaseExpiry returns when the current claim on the job expires.  Jobs
+// claimed by older workers have no lease, in which case ok is false.
+func (doc JobDocument) LeaseExpiry() (expiry time.Time, ok bool) {
+	if doc.LeaseExpiresAt == "" {
+		return time.Time{}, false
+	}
+	expiry, err := time.Parse(time.RFC3339, doc.LeaseExpiresAt)
+	if err != nil {
+		log.Printf("Job %v has invalid lease_expires_at: %v", doc.Id, doc.LeaseExpiresAt)
+		return time.Time{}, false
+	}
+	return expiry, true
+}
+
+// RenewLease extends the lease held by workerId.  If the job is no longer
+// being processed by workerId (eg it was reaped and claimed by someone else)
+// it returns false and leaves the doc alone.
+func (doc *JobDocument) RenewLease(workerId string, leaseDuration time.Duration) (renewed bool, err error) {
+
+	isHeldByWorker := func() bool {
+		return doc.State == StateBeingProcessed && doc.WorkerId == workerId
+	}
+
+	leaseUpdater := func() {
+		doc.LeaseExpiresAt = leaseExpiresAt(leaseDuration)
+	}
+
+	return doc.editIf(isHeldByWorker, leaseUpdater)
+
+}
+
+// ReleaseExpiredLease takes the job away from its worker if it is still
+// being processed and its lease expired more than gracePeriod ago.  The job
+// goes back to READY_TO_PROCESS, or to PROCESSING_ABANDONED if it has used up
+// its retry budget.  The update is conditional on the revision it checked,
+// so a heartbeat that lands in the meantime wins and the job is left alone.
+func (doc *JobDocument) ReleaseExpiredLease(gracePeriod time.Duration, retryPolicy RetryPolicy) (released bool, err error) {
+
+	isExpired := func() bool {
+		if doc.State != StateBeingProcessed {
+			return false
+		}
+		expiry, ok := doc.LeaseExpiry()
+		return ok && !time.Now().Before(expiry.Add(gracePeriod))
+	}
+
+	releaseUpdater := func() {
+		log.Printf("Lease on job %v held by %v expired at %v", doc.Id, doc.WorkerId, doc.LeaseExpiresAt)
+		leaseErr := fmt.Errorf("Worker %v stopped renewing its lease, which expired at %v", doc.WorkerId, doc.LeaseExpiresAt)
+		doc.finishAttempt(AttemptOutcomeLeaseExpired, leaseErr, noExitStatus)
+		doc.retryOrAbandon(retryPolicy)
+	}
+
+	return doc.editIf(isExpired, releaseUpdater)
+
+}
+
+func (doc *JobDocument) clearClaim() {
+	doc.WorkerId = ""
+	doc.ClaimedAt = ""
+	doc.LeaseExpiresAt = ""
+}
+
+// startLeaseHeartbeat renews the lease on the job every third of the lease
+// duration until the returned stop func is called (which is safe to call
+// more than once).  If the job stops being ours, because it was cancelled,
+// deleted or reaped, onLost is called.  It works on its own copy of the doc
+// so it never races with updates made by the job itself.
+func startLeaseHeartbeat(jobDoc JobDocument, workerId string, leaseDuration time.Duration, onLost func()) (stop func()) {
+
+	stopChan := make(chan struct{})
+	doneChan := make(chan struct{})
+
+	go func() {
+		defer close(doneChan)
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-time.After(leaseDuration / 3):
+			}
+			renewed, err := jobDoc.RenewLease(workerId, leaseDuration)
+			if err != nil && isNotFound(err) {
+				log.Printf("Job %v was deleted, stopping heartbeat", jobDoc.Id)
+				onLost()
+				return
+			}
+			if err != nil {
+				log.Printf("Error renewing lease on job %v: %v", jobDoc.Id, err)
+				continue
+			}
+			if !renewed {
+				log.Printf("Job %v is %v and no longer held by %v, stopping heartbeat", jobDoc.Id, jobDoc.State, workerId)
+				onLost()
+				return
+			}
+		}
+	}()
+
+	var stopOnce sync.Once
+	return func() {
+		stopOnce.Do(func() {
+			close(stopChan)
+			<-doneChan
+		})
+	}
+
+}
+
+func leaseExpiresAt(leaseDuration time.Duration) string {
+	return time.Now().Add(leaseDuration).UTC().Format(time.RFC3339)
+}
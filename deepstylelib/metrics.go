@@ -0,0 +1,262 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics sinks
+const (
+	MetricsSinkNone       = "none"
+	MetricsSinkCloudWatch = "cloudwatch" // pushed every flush interval
+	MetricsSinkPrometheus = "prometheus" // scraped from /metrics
+)
+
+// How often sinks that push are flushed by workers
+const DefaultMetricsFlushInterval = 60 * time.Second
+
+// Metric names, in Prometheus style.  The CloudWatch sink maps them to its
+// own names, see cloudWatchMetricNames.
+const (
+	MetricQueueJobs                  = "deepstyle_queue_jobs"                     // gauge, by state
+	MetricQueueJobsReadyOrProcessing = "deepstyle_queue_jobs_ready_or_processing" // gauge, ready or being processed
+	MetricJobDuration                = "deepstyle_job_duration_seconds"           // histogram, by outcome
+	MetricJobFailures                = "deepstyle_job_failures_total"             // counter, by reason
+	MetricAttachmentBytes            = "deepstyle_attachment_bytes_total"         // counter, by direction
+	MetricFeedLag                    = "deepstyle_feed_lag_sequences"             // gauge
+	MetricOldestJobAge               = "deepstyle_oldest_job_age_seconds"         // gauge, of the oldest ready job
+	MetricBacklogSeconds             = "deepstyle_backlog_gpu_seconds"            // gauge, estimated work left in the queue
+	MetricRecommendedWorkers         = "deepstyle_recommended_workers"            // gauge, to get through the backlog in time
+	MetricQueueMessages              = "deepstyle_queue_messages_total"           // counter, by outcome
+)
+
+// Failure reasons, the reason label of MetricJobFailures
+const (
+	FailureReasonInvalidParameters = "invalid_parameters"
+	FailureReasonDownload          = "download"
+	FailureReasonExecutorExit      = "executor_exit" // the executor process exited non-zero
+	FailureReasonExecutor          = "executor"      // any other executor error
+	FailureReasonTimeout           = "timeout"
+	FailureReasonUpload            = "upload"
+)
+
+// Outcomes of a job attempt, the outcome label of MetricJobDuration
+const (
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+	OutcomeTimedOut  = "timed_out"
+	OutcomeCancelled = "cancelled"
+	OutcomeAbandoned = "abandoned" // failed, with no attempts left
+)
+
+// Labels are the dimensions of a metric
+type Labels map[string]string
+
+// MetricsSink is where workers and the queue publisher send their metrics.
+// Implementations must be safe to use from several goroutines.
+type MetricsSink interface {
+	SetGauge(name string, labels Labels, value float64)
+	AddCounter(name string, labels Labels, delta float64)
+	Observe(name string, labels Labels, value float64) // histograms
+	Flush() error                                      // push anything buffered, if the sink pushes
+}
+
+type metricKind string
+
+const (
+	gaugeMetric     metricKind = "gauge"
+	counterMetric   metricKind = "counter"
+	histogramMetric metricKind = "histogram"
+)
+
+type metricDefinition struct {
+	kind    metricKind
+	help    string
+	buckets []float64 // histograms only
+}
+
+var metricDefinitions = map[string]metricDefinition{
+	MetricQueueJobs: {
+		kind: gaugeMetric,
+		help: "Jobs waiting to be processed or being processed, by state",
+	},
+	MetricQueueJobsReadyOrProcessing: {
+		kind: gaugeMetric,
+		help: "Jobs ready to process or being processed",
+	},
+	MetricJobDuration: {
+		kind:    histogramMetric,
+		help:    "How long jobs took from claim to result, by outcome",
+		buckets: []float64{10, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200},
+	},
+	MetricJobFailures: {
+		kind: counterMetric,
+		help: "Failed job attempts, by reason",
+	},
+	MetricAttachmentBytes: {
+		kind: counterMetric,
+		help: "Bytes of attachments downloaded and uploaded by workers",
+	},
+	MetricFeedLag: {
+		kind: gaugeMetric,
+		help: "How many sequences the changes feed follower is behind the database",
+	},
+	MetricOldestJobAge: {
+		kind: gaugeMetric,
+		help: "How long the oldest job ready to process has been waiting since it was created",
+	},
+	MetricBacklogSeconds: {
+		kind: gaugeMetric,
+		help: "Estimated GPU seconds needed to finish every queued and running job, from their parameters and how long recent jobs took",
+	},
+	MetricRecommendedWorkers: {
+		kind: gaugeMetric,
+		help: "How many workers would finish the backlog within the target drain time",
+	},
+	MetricQueueMessages: {
+		kind: counterMetric,
+		help: "Job messages from the message queue, by whether they were acked, redelivered or dead-lettered",
+	},
+}
+
+// MetricsConfig configures all the metrics sinks.  Sinks ignore fields they
+// don't need.
+type MetricsConfig struct {
+	PrometheusAddr string // eg :9102, where /metrics is served
+	CloudWatch     CloudWatchConfig
+}
+
+// NewMetricsSink builds the named sink.  "none" returns nil, which
+// configuration and ChangesFeedFollower treat as not collecting metrics.
+func NewMetricsSink(name string, config MetricsConfig) (MetricsSink, error) {
+	switch name {
+	case MetricsSinkNone, "":
+		return nil, nil
+	case MetricsSinkCloudWatch:
+		return NewCloudWatchSink(config.CloudWatch), nil
+	case MetricsSinkPrometheus:
+		sink := NewPrometheusSink()
+		if config.PrometheusAddr != "" {
+			if err := sink.ListenAndServe(config.PrometheusAddr); err != nil {
+				return nil, err
+			}
+		}
+		return sink, nil
+	default:
+		return nil, fmt.Errorf("Unknown metrics sink: %v.  Valid sinks: %v", name, []string{MetricsSinkNone, MetricsSinkCloudWatch, MetricsSinkPrometheus})
+	}
+}
+
+// nopMetrics is used when no sink is configured
+type nopMetrics struct{}
+
+func (nopMetrics) SetGauge(name string, labels Labels, value float64)   {}
+func (nopMetrics) AddCounter(name string, labels Labels, delta float64) {}
+func (nopMetrics) Observe(name string, labels Labels, value float64)    {}
+func (nopMetrics) Flush() error                                         { return nil }
+
+func (config configuration) metrics() MetricsSink {
+	if config.Metrics == nil {
+		return nopMetrics{}
+	}
+	return config.Metrics
+}
+
+// StartFlushing flushes the sink every interval until the returned func is
+// called, for sinks that push
+func StartFlushing(sink MetricsSink, interval time.Duration) (stop func()) {
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := sink.Flush(); err != nil {
+					log.Printf("Error flushing metrics: %v", err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+
+}
+
+// attemptOutcome is the outcome of an attempt that failed for reason, or
+// succeeded if there's no reason, given the state it left the job in
+func attemptOutcome(reason string, state string) string {
+	switch {
+	case reason == "":
+		return OutcomeSucceeded
+	case reason == FailureReasonTimeout:
+		return OutcomeTimedOut
+	case state == StateProcessingAbandoned:
+		return OutcomeAbandoned
+	}
+	return OutcomeFailed
+}
+
+// recordAttemptMetrics records how long an attempt took and, if it failed,
+// why
+func recordAttemptMetrics(sink MetricsSink, duration time.Duration, outcome, reason string) {
+	sink.Observe(MetricJobDuration, Labels{"outcome": outcome}, duration.Seconds())
+	if reason != "" {
+		sink.AddCounter(MetricJobFailures, Labels{"reason": reason}, 1)
+	}
+}
+
+// downloadError is an error downloading the attachments of a job
+type downloadError struct {
+	error
+}
+
+// failureReason classifies the error a job attempt failed with
+func failureReason(err error) string {
+	switch err.(type) {
+	case *TimeoutError:
+		return FailureReasonTimeout
+	case *exec.ExitError:
+		return FailureReasonExecutorExit
+	case downloadError:
+		return FailureReasonDownload
+	}
+	return FailureReasonExecutor
+}
+
+// labelsKey is a canonical form of the labels, sorted by name
+func labelsKey(labels Labels) string {
+	names := []string{}
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := []string{}
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%v=%v", name, strconv.Quote(labels[name])))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// sequenceNumber returns the numeric part of a changes feed sequence.
+// Sync Gateway sequences can be compound, eg "12:34", where the last part
+// is the sequence itself.  CouchDB's are opaque, eg "12-g1AAAA...", but
+// start with the number of updates.
+func sequenceNumber(sequence string) (number uint64, ok bool) {
+	sequence = strings.SplitN(sequence, "-", 2)[0]
+	parts := strings.Split(sequence, ":")
+	number, err := strconv.ParseUint(parts[len(parts)-1], 10, 64)
+	return number, err == nil
+}
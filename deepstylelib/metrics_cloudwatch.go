@@ -0,0 +1,277 @@
+package deepstylelib
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+const (
+	DefaultCloudWatchNamespace = "DeepStyleQueue"
+	DefaultCloudWatchRegion    = "us-east-1"
+	DefaultCloudWatchTimeout   = 30 * time.Second
+
+	// PutMetricData takes at most this many metrics per call
+	cloudWatchMaxMetricsPerRequest = 20
+)
+
+// CloudWatchConfig says where the CloudWatch sink sends metrics
+type CloudWatchConfig struct {
+	Region     string
+	Namespace  string
+	Endpoint   string            // Overrides the regional endpoint, eg for a local CloudWatch in tests
+	Dimensions map[string]string // Added to every metric, eg Database and WorkerPool, so several deployments can share an account
+}
+
+func DefaultCloudWatchConfig() CloudWatchConfig {
+	return CloudWatchConfig{
+		Region:    DefaultCloudWatchRegion,
+		Namespace: DefaultCloudWatchNamespace,
+	}
+}
+
+// cloudWatchMetricNames are the CloudWatch names of the metrics.  The total
+// keeps the name the auto-scale alarms already watch.
+var cloudWatchMetricNames = map[string]string{
+	MetricQueueJobs:                  "NumJobsByState",
+	MetricQueueJobsReadyOrProcessing: "NumJobsReadyOrBeingProcessed",
+	MetricJobDuration:                "JobDuration",
+	MetricJobFailures:                "JobFailures",
+	MetricAttachmentBytes:            "AttachmentBytes",
+	MetricFeedLag:                    "FeedLag",
+	MetricOldestJobAge:               "OldestJobAge",
+	MetricBacklogSeconds:             "BacklogGpuSeconds",
+	MetricRecommendedWorkers:         "RecommendedWorkers",
+	MetricQueueMessages:              "QueueMessages",
+}
+
+var cloudWatchUnits = map[string]string{
+	MetricQueueJobs:                  cloudwatch.StandardUnitCount,
+	MetricQueueJobsReadyOrProcessing: cloudwatch.StandardUnitCount,
+	MetricJobDuration:                cloudwatch.StandardUnitSeconds,
+	MetricJobFailures:                cloudwatch.StandardUnitCount,
+	MetricAttachmentBytes:            cloudwatch.StandardUnitBytes,
+	MetricFeedLag:                    cloudwatch.StandardUnitCount,
+	MetricOldestJobAge:               cloudwatch.StandardUnitSeconds,
+	MetricBacklogSeconds:             cloudwatch.StandardUnitSeconds,
+	MetricRecommendedWorkers:         cloudwatch.StandardUnitCount,
+	MetricQueueMessages:              cloudwatch.StandardUnitCount,
+}
+
+// CloudWatchSink buffers metrics and sends them to CloudWatch on Flush.
+// Gauges send their latest value, counters what was added since the last
+// flush, and histograms a statistic set of what was observed.
+type CloudWatchSink struct {
+	config CloudWatchConfig
+	mutex  sync.Mutex
+	series map[string]*cloudWatchSeries // by name and labels key
+
+	putMetricData func(input *cloudwatch.PutMetricDataInput) error
+}
+
+type cloudWatchSeries struct {
+	name   string
+	labels Labels
+	value  float64 // gauges and counters
+	stats  *cloudwatch.StatisticSet
+}
+
+// NewCloudWatchSink creates the CloudWatch client, and its session, once
+// for the life of the sink.  AWS keys are taken from environment variables
+// or ~/.aws/.
+func NewCloudWatchSink(config CloudWatchConfig) *CloudWatchSink {
+
+	defaults := DefaultCloudWatchConfig()
+	if config.Region == "" {
+		config.Region = defaults.Region
+	}
+	if config.Namespace == "" {
+		config.Namespace = defaults.Namespace
+	}
+
+	// a client of its own, so nothing done to http.DefaultClient applies
+	awsConfig := &aws.Config{
+		Region:     aws.String(config.Region),
+		HTTPClient: &http.Client{Timeout: DefaultCloudWatchTimeout},
+	}
+	if config.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(config.Endpoint)
+	}
+	svc := cloudwatch.New(session.New(), awsConfig)
+
+	return &CloudWatchSink{
+		config: config,
+		series: map[string]*cloudWatchSeries{},
+		putMetricData: func(input *cloudwatch.PutMetricDataInput) error {
+			_, err := svc.PutMetricData(input)
+			return err
+		},
+	}
+}
+
+// seriesFor returns the series, creating it if needed.  Caller must hold
+// the lock.
+func (c *CloudWatchSink) seriesFor(name string, labels Labels) *cloudWatchSeries {
+	key := name + "{" + labelsKey(labels) + "}"
+	series, ok := c.series[key]
+	if !ok {
+		series = &cloudWatchSeries{name: name, labels: labels}
+		c.series[key] = series
+	}
+	return series
+}
+
+func (c *CloudWatchSink) SetGauge(name string, labels Labels, value float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.seriesFor(name, labels).value = value
+}
+
+func (c *CloudWatchSink) AddCounter(name string, labels Labels, delta float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.seriesFor(name, labels).value += delta
+}
+
+func (c *CloudWatchSink) Observe(name string, labels Labels, value float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	series := c.seriesFor(name, labels)
+	if series.stats == nil {
+		series.stats = &cloudwatch.StatisticSet{
+			Maximum:     aws.Float64(value),
+			Minimum:     aws.Float64(value),
+			SampleCount: aws.Float64(0),
+			Sum:         aws.Float64(0),
+		}
+	}
+	if value > *series.stats.Maximum {
+		series.stats.Maximum = aws.Float64(value)
+	}
+	if value < *series.stats.Minimum {
+		series.stats.Minimum = aws.Float64(value)
+	}
+	series.stats.SampleCount = aws.Float64(*series.stats.SampleCount + 1)
+	series.stats.Sum = aws.Float64(*series.stats.Sum + value)
+}
+
+// Flush sends everything buffered since the last flush, as few
+// PutMetricData calls as possible.  Gauges are sent on every flush,
+// counters and histograms only when something was recorded.
+func (c *CloudWatchSink) Flush() error {
+
+	metricData := c.drain()
+	if len(metricData) == 0 {
+		return nil
+	}
+
+	log.Printf("Sending %v metrics to CloudWatch namespace %v in %v", len(metricData), c.config.Namespace, c.config.Region)
+	for start := 0; start < len(metricData); start += cloudWatchMaxMetricsPerRequest {
+		end := start + cloudWatchMaxMetricsPerRequest
+		if end > len(metricData) {
+			end = len(metricData)
+		}
+		input := &cloudwatch.PutMetricDataInput{
+			MetricData: metricData[start:end],
+			Namespace:  aws.String(c.config.Namespace),
+		}
+		if err := c.putMetricData(input); err != nil {
+			return err
+		}
+	}
+	return nil
+
+}
+
+// drain turns the buffered series into metric data, and resets counters and
+// histograms
+func (c *CloudWatchSink) drain() []*cloudwatch.MetricDatum {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	keys := []string{}
+	for key := range c.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	timestamp := time.Now()
+	metricData := []*cloudwatch.MetricDatum{}
+	for _, key := range keys {
+		series := c.series[key]
+		datum := &cloudwatch.MetricDatum{
+			MetricName: aws.String(cloudWatchMetricName(series.name)),
+			Timestamp:  aws.Time(timestamp),
+			Dimensions: c.dimensions(series.labels),
+		}
+		if unit, ok := cloudWatchUnits[series.name]; ok {
+			datum.Unit = aws.String(unit)
+		}
+
+		switch metricDefinitions[series.name].kind {
+		case histogramMetric:
+			if series.stats == nil {
+				continue
+			}
+			datum.StatisticValues = series.stats
+			series.stats = nil
+		case counterMetric:
+			if series.value == 0 {
+				continue
+			}
+			datum.Value = aws.Float64(series.value)
+			series.value = 0
+		default:
+			datum.Value = aws.Float64(series.value)
+		}
+		metricData = append(metricData, datum)
+	}
+	return metricData
+
+}
+
+// cloudWatchMetricName looks up the CloudWatch name of the metric, falling
+// back to a CamelCase version of it
+func cloudWatchMetricName(name string) string {
+	if cloudWatchName, ok := cloudWatchMetricNames[name]; ok {
+		return cloudWatchName
+	}
+	words := strings.Split(name, "_")
+	for i, word := range words {
+		words[i] = strings.Title(word)
+	}
+	return strings.Join(words, "")
+}
+
+// dimensions are the configured dimensions plus the labels of the metric,
+// with the label names in CamelCase
+func (c *CloudWatchSink) dimensions(labels Labels) []*cloudwatch.Dimension {
+	values := map[string]string{}
+	for name, value := range c.config.Dimensions {
+		values[name] = value
+	}
+	for name, value := range labels {
+		values[strings.Title(name)] = value
+	}
+	names := []string{}
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	dimensions := []*cloudwatch.Dimension{}
+	for _, name := range names {
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String(name),
+			Value: aws.String(values[name]),
+		})
+	}
+	return dimensions
+}
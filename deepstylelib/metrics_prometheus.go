@@ -0,0 +1,194 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// PrometheusSink keeps metrics in memory and serves them in the Prometheus
+// text format.  It's an http.Handler, or call ListenAndServe to serve it on
+// /metrics.
+type PrometheusSink struct {
+	mutex  sync.Mutex
+	series map[string]map[string]*prometheusSeries // by name, then labels key
+}
+
+type prometheusSeries struct {
+	labels Labels
+	value  float64  // gauges and counters
+	counts []uint64 // histograms, per bucket (not cumulative)
+	sum    float64  // histograms
+	count  uint64   // histograms
+}
+
+func NewPrometheusSink() *PrometheusSink {
+	return &PrometheusSink{
+		series: map[string]map[string]*prometheusSeries{},
+	}
+}
+
+// seriesFor returns the series, creating it if needed.  Caller must hold
+// the lock.
+func (p *PrometheusSink) seriesFor(name string, labels Labels) *prometheusSeries {
+	byLabels, ok := p.series[name]
+	if !ok {
+		byLabels = map[string]*prometheusSeries{}
+		p.series[name] = byLabels
+	}
+	key := labelsKey(labels)
+	series, ok := byLabels[key]
+	if !ok {
+		series = &prometheusSeries{labels: labels}
+		if definition := metricDefinitions[name]; definition.kind == histogramMetric {
+			series.counts = make([]uint64, len(definition.buckets))
+		}
+		byLabels[key] = series
+	}
+	return series
+}
+
+func (p *PrometheusSink) SetGauge(name string, labels Labels, value float64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.seriesFor(name, labels).value = value
+}
+
+func (p *PrometheusSink) AddCounter(name string, labels Labels, delta float64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.seriesFor(name, labels).value += delta
+}
+
+func (p *PrometheusSink) Observe(name string, labels Labels, value float64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	series := p.seriesFor(name, labels)
+	for i, bucket := range metricDefinitions[name].buckets {
+		if value <= bucket {
+			series.counts[i] += 1
+			break
+		}
+	}
+	series.sum += value
+	series.count += 1
+}
+
+// Flush does nothing, Prometheus scrapes
+func (p *PrometheusSink) Flush() error {
+	return nil
+}
+
+func (p *PrometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p.WriteTo(w)
+}
+
+// ListenAndServe serves /metrics on addr in the background
+func (p *PrometheusSink) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", p)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("Metrics server on %v stopped: %v", addr, err)
+		}
+	}()
+	log.Printf("Serving Prometheus metrics on %v/metrics", listener.Addr())
+	return nil
+}
+
+// WriteTo writes every metric in the Prometheus text format
+func (p *PrometheusSink) WriteTo(w io.Writer) (n int64, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	names := []string{}
+	for name := range p.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	counter := &countingWriter{w: w}
+	for _, name := range names {
+		definition := metricDefinitions[name]
+		kind := definition.kind
+		if kind == "" {
+			kind = "untyped"
+		}
+		fmt.Fprintf(counter, "# HELP %v %v\n", name, definition.help)
+		fmt.Fprintf(counter, "# TYPE %v %v\n", name, kind)
+
+		keys := []string{}
+		for key := range p.series[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			series := p.series[name][key]
+			if kind != histogramMetric {
+				fmt.Fprintf(counter, "%v%v %v\n", name, formatLabels(key), formatValue(series.value))
+				continue
+			}
+			cumulative := uint64(0)
+			for i, bucket := range definition.buckets {
+				cumulative += series.counts[i]
+				fmt.Fprintf(counter, "%v_bucket%v %v\n", name, formatLabels(key, "le="+strconv.Quote(formatValue(bucket))), cumulative)
+			}
+			fmt.Fprintf(counter, "%v_bucket%v %v\n", name, formatLabels(key, `le="+Inf"`), series.count)
+			fmt.Fprintf(counter, "%v_sum%v %v\n", name, formatLabels(key), formatValue(series.sum))
+			fmt.Fprintf(counter, "%v_count%v %v\n", name, formatLabels(key), series.count)
+		}
+	}
+	return counter.n, counter.err
+
+}
+
+// formatLabels renders a labels key, plus any extra labels, as {a="b",...}
+func formatLabels(key string, extra ...string) string {
+	pairs := extra
+	if key != "" {
+		pairs = append([]string{key}, extra...)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	labels := ""
+	for i, pair := range pairs {
+		if i > 0 {
+			labels += ","
+		}
+		labels += pair
+	}
+	return "{" + labels + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
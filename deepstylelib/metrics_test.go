@@ -0,0 +1,347 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tleyden/deepstyle/deepstylelib/fakesyncgw"
+)
+
+// scrape returns the metrics the sink serves, one line per sample
+func scrape(t *testing.T, sink *PrometheusSink) []string {
+	recorder := httptest.NewRecorder()
+	sink.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, recorder.Code)
+	assert.True(t, strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain"))
+	return strings.Split(recorder.Body.String(), "\n")
+}
+
+// sample returns the value of the sample whose line starts with prefix
+func sample(lines []string, prefix string) string {
+	for _, line := range lines {
+		if strings.HasPrefix(line, prefix+" ") {
+			return strings.TrimPrefix(line, prefix+" ")
+		}
+	}
+	return ""
+}
+
+func TestPrometheusSink(t *testing.T) {
+
+	sink := NewPrometheusSink()
+	sink.SetGauge(MetricQueueJobs, Labels{"state": StateReadyToProcess}, 3)
+	sink.SetGauge(MetricQueueJobs, Labels{"state": StateReadyToProcess}, 5)
+	sink.SetGauge(MetricFeedLag, nil, 12)
+	sink.AddCounter(MetricJobFailures, Labels{"reason": FailureReasonTimeout}, 1)
+	sink.AddCounter(MetricJobFailures, Labels{"reason": FailureReasonTimeout}, 1)
+	sink.Observe(MetricJobDuration, Labels{"outcome": OutcomeSucceeded}, 45)
+	sink.Observe(MetricJobDuration, Labels{"outcome": OutcomeSucceeded}, 500)
+	assert.NoError(t, sink.Flush())
+
+	lines := scrape(t, sink)
+	assert.Contains(t, lines, "# TYPE deepstyle_queue_jobs gauge")
+	assert.Contains(t, lines, "# TYPE deepstyle_job_duration_seconds histogram")
+	assert.Equal(t, "5", sample(lines, `deepstyle_queue_jobs{state="READY_TO_PROCESS"}`))
+	assert.Equal(t, "12", sample(lines, `deepstyle_feed_lag_sequences`))
+	assert.Equal(t, "2", sample(lines, `deepstyle_job_failures_total{reason="timeout"}`))
+	assert.Equal(t, "0", sample(lines, `deepstyle_job_duration_seconds_bucket{outcome="succeeded",le="30"}`))
+	assert.Equal(t, "1", sample(lines, `deepstyle_job_duration_seconds_bucket{outcome="succeeded",le="60"}`))
+	assert.Equal(t, "2", sample(lines, `deepstyle_job_duration_seconds_bucket{outcome="succeeded",le="600"}`))
+	assert.Equal(t, "2", sample(lines, `deepstyle_job_duration_seconds_bucket{outcome="succeeded",le="+Inf"}`))
+	assert.Equal(t, "545", sample(lines, `deepstyle_job_duration_seconds_sum{outcome="succeeded"}`))
+	assert.Equal(t, "2", sample(lines, `deepstyle_job_duration_seconds_count{outcome="succeeded"}`))
+
+}
+
+func TestJobMetrics(t *testing.T) {
+
+	syncGw := fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+
+	db, err := GetDbConnection(syncGw.DBURL())
+	assert.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "deepstyle_metrics")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sink := NewPrometheusSink()
+	config := configuration{
+		Database:      db,
+		TempDir:       dir,
+		Executor:      FakeExecutor{},
+		WorkerId:      "worker1",
+		LeaseDuration: time.Minute,
+		RetryPolicy:   DefaultRetryPolicy(),
+		Metrics:       sink,
+	}
+
+	assert.NoError(t, executeDeepStyleJob(config, newTestJob(t, db, "job1", nil)))
+	assert.Error(t, executeDeepStyleJob(config, newTestJob(t, db, "job2", &JobParameters{Iterations: -1})))
+
+	lines := scrape(t, sink)
+	assert.Equal(t, "1", sample(lines, `deepstyle_job_duration_seconds_count{outcome="succeeded"}`))
+	assert.Equal(t, "1", sample(lines, `deepstyle_job_duration_seconds_count{outcome="failed"}`))
+	assert.Equal(t, "1", sample(lines, `deepstyle_job_failures_total{reason="invalid_parameters"}`))
+	assert.NotEqual(t, "", sample(lines, `deepstyle_attachment_bytes_total{direction="download"}`))
+	assert.NotEqual(t, "", sample(lines, `deepstyle_attachment_bytes_total{direction="upload"}`))
+
+	// a failure that uses up the last attempt abandons the job
+	config.Executor = CommandExecutor{Command: "false"}
+	config.RetryPolicy.MaxAttempts = 1
+	assert.Error(t, executeDeepStyleJob(config, newTestJob(t, db, "job3", nil)))
+	job3 := JobDocument{}
+	assert.NoError(t, db.Retrieve("job3", &job3))
+	assert.Equal(t, StateProcessingAbandoned, job3.State)
+
+	lines = scrape(t, sink)
+	assert.Equal(t, "1", sample(lines, `deepstyle_job_duration_seconds_count{outcome="abandoned"}`))
+	assert.Equal(t, "1", sample(lines, `deepstyle_job_duration_seconds_count{outcome="failed"}`))
+	assert.Equal(t, "1", sample(lines, `deepstyle_job_failures_total{reason="executor_exit"}`))
+
+}
+
+// fakeCloudWatch is a local CloudWatch endpoint that records the metrics
+// in each PutMetricData call, by name and then dimensions (Name=Value,...)
+type fakeCloudWatch struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []url.Values
+}
+
+func newFakeCloudWatch() *fakeCloudWatch {
+	fake := &fakeCloudWatch{}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		fake.mutex.Lock()
+		fake.requests = append(fake.requests, r.PostForm)
+		fake.mutex.Unlock()
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprint(w, `<PutMetricDataResponse xmlns="http://monitoring.amazonaws.com/doc/2010-08-01/"><ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></PutMetricDataResponse>`)
+	}))
+	return fake
+}
+
+// metrics returns the values sent in every request, keyed by
+// name/dimension values, and the namespace of each request
+func (fake *fakeCloudWatch) metrics(t *testing.T) (values map[string]string, namespaces []string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	values = map[string]string{}
+	for _, form := range fake.requests {
+		assert.Equal(t, "PutMetricData", form.Get("Action"))
+		namespaces = append(namespaces, form.Get("Namespace"))
+		for i := 1; form.Get(fmt.Sprintf("MetricData.member.%d.MetricName", i)) != ""; i++ {
+			prefix := fmt.Sprintf("MetricData.member.%d.", i)
+			key := form.Get(prefix + "MetricName")
+			for j := 1; form.Get(fmt.Sprintf("%vDimensions.member.%d.Name", prefix, j)) != ""; j++ {
+				key += fmt.Sprintf("/%v=%v", form.Get(fmt.Sprintf("%vDimensions.member.%d.Name", prefix, j)), form.Get(fmt.Sprintf("%vDimensions.member.%d.Value", prefix, j)))
+			}
+			value := form.Get(prefix + "Value")
+			if value == "" {
+				value = form.Get(prefix+"StatisticValues.SampleCount") + " samples, sum " + form.Get(prefix+"StatisticValues.Sum")
+			}
+			values[key] = value
+		}
+	}
+	return values, namespaces
+}
+
+func TestPublishQueueMetrics(t *testing.T) {
+
+	syncGw := fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+	syncGw.DefineView(DesignDocName, ViewName, unprocessedJobsView)
+
+	db, err := GetDbConnection(syncGw.DBURL())
+	assert.NoError(t, err)
+	now := time.Now().UTC()
+	jobs := []map[string]interface{}{
+		{"state": StateReadyToProcess, "created_at": now.Add(-time.Hour).Format(time.RFC3339)},
+		{"state": StateReadyToProcess, "created_at": now.Add(-time.Minute).Format(time.RFC3339)},
+		{"state": StateBeingProcessed, "created_at": now.Add(-2 * time.Hour).Format(time.RFC3339), "claimed_at": now.Add(-100 * time.Second).Format(time.RFC3339)},
+		{"state": StateProcessingSuccessful},
+	}
+	for i, job := range jobs {
+		job["type"] = Job
+		_, _, err = db.InsertWith(job, fmt.Sprintf("job%v", i))
+		assert.NoError(t, err)
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	cloudWatch := newFakeCloudWatch()
+	defer cloudWatch.Close()
+
+	sink := NewCloudWatchSink(CloudWatchConfig{
+		Region:     "eu-west-1",
+		Namespace:  "DeepStyleTest",
+		Endpoint:   cloudWatch.URL,
+		Dimensions: map[string]string{"Database": "deepstyle", "WorkerPool": "gpu"},
+	})
+	assert.NoError(t, PublishQueueMetrics(syncGw.DBURL(), DefaultQueueMetricsConfig(), sink))
+
+	values, namespaces := cloudWatch.metrics(t)
+	assert.Equal(t, []string{"DeepStyleTest"}, namespaces)
+	dimensions := "/Database=deepstyle/WorkerPool=gpu"
+	byState := func(state string) string {
+		return "NumJobsByState/Database=deepstyle/State=" + state + "/WorkerPool=gpu"
+	}
+	assert.Equal(t, "3", values["NumJobsReadyOrBeingProcessed"+dimensions])
+	assert.Equal(t, "2", values[byState(StateReadyToProcess)])
+	assert.Equal(t, "1", values[byState(StateBeingProcessed)])
+	assert.Equal(t, "0", values[byState(StateNotReadyToProcess)])
+	oldest, _ := strconv.ParseFloat(values["OldestJobAge"+dimensions], 64)
+	assert.True(t, oldest >= 3600 && oldest < 3660)
+	backlog, _ := strconv.ParseFloat(values["BacklogGpuSeconds"+dimensions], 64)
+	assert.True(t, backlog > 2*DefaultEstimatedJobSeconds && backlog <= 3*DefaultEstimatedJobSeconds-100)
+	assert.Equal(t, "1", values["RecommendedWorkers"+dimensions])
+
+	// counters and histograms are only sent when something was recorded, and
+	// big flushes are split into several calls
+	sink.AddCounter(MetricJobFailures, Labels{"reason": FailureReasonDownload}, 1)
+	sink.Observe(MetricJobDuration, Labels{"outcome": OutcomeFailed}, 2)
+	sink.Observe(MetricJobDuration, Labels{"outcome": OutcomeFailed}, 4)
+	for i := 0; i < 20; i++ {
+		sink.SetGauge("deepstyle_test_gauge", Labels{"index": strconv.Itoa(i)}, float64(i))
+	}
+	assert.NoError(t, sink.Flush())
+	values, namespaces = cloudWatch.metrics(t)
+	assert.Equal(t, 3, len(namespaces))
+	assert.Equal(t, "1", values["JobFailures/Database=deepstyle/Reason=download/WorkerPool=gpu"])
+	assert.Equal(t, "2 samples, sum 6", values["JobDuration/Database=deepstyle/Outcome=failed/WorkerPool=gpu"])
+	assert.Equal(t, "19", values["DeepstyleTestGauge/Database=deepstyle/Index=19/WorkerPool=gpu"])
+
+	assert.NoError(t, sink.Flush())
+	_, namespaces = cloudWatch.metrics(t)
+	assert.Equal(t, 5, len(namespaces))
+
+}
+
+// unprocessedJobsView is the Go equivalent of the javascript view installed
+// by the DesignDocManager
+func unprocessedJobsView(doc map[string]interface{}, emit func(key, value interface{})) {
+	switch doc["state"] {
+	case StateNotReadyToProcess, StateReadyToProcess, StateBeingProcessed, StateCancelRequested:
+		if doc["type"] == Job {
+			emit(doc["state"], map[string]interface{}{
+				"state":                doc["state"],
+				"created_at":           doc["created_at"],
+				"claimed_at":           doc["claimed_at"],
+				"parameters":           doc["parameters"],
+				"effective_parameters": doc["effective_parameters"],
+				"progress":             doc["progress"],
+			})
+		}
+	}
+}
+
+func TestBacklogEstimate(t *testing.T) {
+
+	syncGw := fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+	syncGw.DefineView(DesignDocName, ViewName, unprocessedJobsView)
+
+	db, err := GetDbConnection(syncGw.DBURL())
+	assert.NoError(t, err)
+	dir, err := ioutil.TempDir("", "deepstyle_metrics")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// finished jobs are recorded in the duration stats of their backend
+	config := configuration{
+		Database:      db,
+		TempDir:       dir,
+		Executor:      FakeExecutor{},
+		ExecutorName:  ExecutorFake,
+		WorkerId:      "worker1",
+		LeaseDuration: time.Minute,
+		RetryPolicy:   DefaultRetryPolicy(),
+	}
+	assert.NoError(t, executeDeepStyleJob(config, newTestJob(t, db, "done", nil)))
+	store := DurationStatsStore{Database: db, DocId: DefaultDurationStatsDocId}
+	durationStats, err := store.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, durationStats[ExecutorFake].Jobs)
+
+	// the average rolls towards newer jobs
+	assert.NoError(t, store.Record(ExecutorNeuralStyle, 1, 100*time.Second))
+	assert.NoError(t, store.Record(ExecutorNeuralStyle, 2, 400*time.Second))
+	durationStats, err = store.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, durationStats[ExecutorNeuralStyle].Jobs)
+	assert.InDelta(t, 110, durationStats[ExecutorNeuralStyle].SecondsPerUnit, 0.001)
+
+	assert.Equal(t, 1.0, jobWorkUnits(JobParameters{}))
+	assert.Equal(t, 8.0, jobWorkUnits(JobParameters{Iterations: 2000, ImageSize: 1024}))
+
+	// queued jobs are estimated from their parameters, running jobs from
+	// their progress
+	now := time.Now().UTC()
+	jobs := map[string]map[string]interface{}{
+		"small":   {"state": StateReadyToProcess, "parameters": JobParameters{Iterations: 500, ImageSize: 256}},
+		"big":     {"state": StateReadyToProcess, "parameters": JobParameters{Iterations: 2000, ImageSize: 1024}},
+		"running": {"state": StateBeingProcessed, "claimed_at": now.Format(time.RFC3339), "progress": JobProgress{Iteration: 750, TotalIterations: 1000}},
+	}
+	for jobId, job := range jobs {
+		job["type"] = Job
+		_, _, err = db.InsertWith(job, jobId)
+		assert.NoError(t, err)
+	}
+
+	queueConfig := QueueMetricsConfig{Executor: ExecutorNeuralStyle, TargetDrainTime: 5 * time.Minute}
+	stats, err := getQueueStats(db, now, queueConfig)
+	assert.NoError(t, err)
+	assert.InDelta(t, 110, stats.SecondsPerUnit, 0.001)
+	assert.InDelta(t, 110*(0.125+8+0.25), stats.BacklogSeconds, 0.001)
+	assert.Equal(t, 3, stats.RecommendedWorkers)
+
+	queueConfig.MaxWorkers = 2
+	stats, err = getQueueStats(db, now, queueConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.RecommendedWorkers)
+
+	// a backend with nothing recorded falls back to the default estimate
+	stats, err = getQueueStats(db, now, QueueMetricsConfig{Executor: ExecutorCommand, TargetDrainTime: time.Hour})
+	assert.NoError(t, err)
+	assert.InDelta(t, DefaultEstimatedJobSeconds*(0.125+8+0.25), stats.BacklogSeconds, 0.001)
+	assert.Equal(t, 2, stats.RecommendedWorkers)
+
+	assert.Equal(t, 0, recommendedWorkers(0, 0, queueConfig))
+	assert.Equal(t, 1, recommendedWorkers(1, 4, queueConfig))
+
+}
+
+func TestFailureReason(t *testing.T) {
+
+	assert.Equal(t, FailureReasonTimeout, failureReason(&TimeoutError{}))
+	assert.Equal(t, FailureReasonDownload, failureReason(downloadError{fmt.Errorf("404")}))
+	assert.Equal(t, FailureReasonExecutor, failureReason(fmt.Errorf("out of memory")))
+
+	err := exec.Command("sh", "-c", "exit 3").Run()
+	assert.Equal(t, FailureReasonExecutorExit, failureReason(err))
+
+}
+
+func TestSequenceNumber(t *testing.T) {
+
+	for sequence, expected := range map[string]uint64{"42": 42, "12:34": 34, "1:2:56": 56, "17-g1AAAAFTeJzLYWBg": 17} {
+		number, ok := sequenceNumber(sequence)
+		assert.True(t, ok)
+		assert.Equal(t, expected, number)
+	}
+	_, ok := sequenceNumber("now")
+	assert.False(t, ok)
+
+}
@@ -0,0 +1,235 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+
+	"github.com/tleyden/go-couch"
+)
+
+// The attachment the source image was kept in before it was source_image
+const LegacySourceImageAttachment = "photo"
+
+// A Migration upgrades job docs written by older versions of deepstyle.
+// Migrations must be safe to run again, eg after being interrupted.
+type Migration struct {
+	Name        string
+	Description string
+	Needed      func(doc map[string]interface{}) bool
+	Apply       func(store JobStore, doc map[string]interface{}) error
+}
+
+// Migrations are run on every job doc, in this order
+var Migrations = []Migration{
+	{
+		Name:        "rename_photo_attachment",
+		Description: "Rename the legacy photo attachment to source_image",
+		Needed:      hasLegacySourceImage,
+		Apply:       renameLegacySourceImage,
+	},
+}
+
+// MigrationReport is what a migration run did, or would do with DryRun
+type MigrationReport struct {
+	DesignDocsInstalled []string
+	JobsChecked         int
+	JobsMigrated        map[string]int // Migration name -> number of jobs
+	JobsFailed          int
+	DocsUnreadable      int // Docs that couldn't be retrieved, so weren't checked
+}
+
+// Migrate brings the design docs and job docs in the database up to date
+func Migrate(dbUrl string, dryRun bool) (MigrationReport, error) {
+
+	store, err := OpenJobStore(dbUrl)
+	if err != nil {
+		return MigrationReport{}, fmt.Errorf("Error connecting to db: %v.  Err: %v", dbUrl, err)
+	}
+	return MigrateStore(store, dryRun)
+
+}
+
+// MigrateStore installs or updates the store's design docs, then runs the
+// Migrations on every job doc.  With dryRun nothing is changed, the report
+// says what would have been.  A doc that can't be read or a job that fails
+// to migrate is logged and counted, and doesn't stop the others.
+func MigrateStore(store JobStore, dryRun bool) (MigrationReport, error) {
+
+	report := MigrationReport{
+		DesignDocsInstalled: []string{},
+		JobsMigrated:        map[string]int{},
+	}
+
+	if manager, ok := designDocManagerFor(store); ok {
+		var installed []string
+		var err error
+		if dryRun {
+			installed, err = manager.OutOfDateDesignDocs()
+		} else {
+			installed, err = manager.EnsureDesignDocs()
+		}
+		report.DesignDocsInstalled = installed
+		if err != nil {
+			return report, err
+		}
+	}
+
+	docIds, err := allDocIds(store)
+	if err != nil {
+		return report, err
+	}
+
+	for _, docId := range docIds {
+
+		doc := map[string]interface{}{}
+		if err := store.Retrieve(docId, &doc); err != nil {
+			log.Printf("Error retrieving %v, skipping: %v", docId, err)
+			report.DocsUnreadable += 1
+			continue
+		}
+		if doc["type"] != Job {
+			continue
+		}
+		report.JobsChecked += 1
+
+		for _, migration := range Migrations {
+			migrated, err := runMigration(store, migration, docId, doc, dryRun)
+			if err != nil {
+				log.Printf("Error running %v on %v: %v", migration.Name, docId, err)
+				report.JobsFailed += 1
+				break
+			}
+			if migrated {
+				log.Printf("Migrated %v: %v", docId, migration.Description)
+				report.JobsMigrated[migration.Name] += 1
+			}
+		}
+
+	}
+
+	return report, nil
+
+}
+
+// runMigration applies the migration if the job needs it, retrying against
+// the latest revision if a worker updates the job at the same time
+func runMigration(store JobStore, migration Migration, docId string, doc map[string]interface{}, dryRun bool) (migrated bool, err error) {
+
+	numRetries := 10
+	for i := 0; i < numRetries; i++ {
+
+		if !migration.Needed(doc) {
+			return migrated, nil
+		}
+		if dryRun {
+			return true, nil
+		}
+
+		err := migration.Apply(store, doc)
+		if err == nil {
+			migrated = true
+		} else if !isConflict(err) {
+			return migrated, err
+		}
+
+		// see what the job looks like now, to check it worked
+		for key := range doc {
+			delete(doc, key)
+		}
+		if err := store.Retrieve(docId, &doc); err != nil {
+			return migrated, err
+		}
+		if migrated && !migration.Needed(doc) {
+			return migrated, nil
+		}
+
+	}
+
+	return migrated, fmt.Errorf("Unable to run %v on %v after %v retries", migration.Name, docId, numRetries)
+
+}
+
+// allDocIds reads the whole changes feed, to find every doc in the store
+func allDocIds(store JobStore) ([]string, error) {
+
+	docIds := []string{}
+	var decodeErr error
+
+	handler := func(reader io.Reader) interface{} {
+		changes := couch.Changes{}
+		decoder := json.NewDecoder(reader)
+		decoder.UseNumber()
+		if err := decoder.Decode(&changes); err != nil {
+			decodeErr = err
+			return nil
+		}
+		if len(changes.Results) == 0 {
+			return nil
+		}
+		for _, change := range changes.Results {
+			if !change.Deleted {
+				docIds = append(docIds, change.Id)
+			}
+		}
+		return changes.LastSequence
+	}
+
+	store.Changes(handler, map[string]interface{}{"since": "0"})
+	return docIds, decodeErr
+
+}
+
+func hasLegacySourceImage(doc map[string]interface{}) bool {
+	attachments, _ := doc["_attachments"].(map[string]interface{})
+	_, ok := attachments[LegacySourceImageAttachment]
+	return ok
+}
+
+// renameLegacySourceImage copies the photo attachment to source_image, if
+// that isn't there yet, then drops photo from the doc
+func renameLegacySourceImage(store JobStore, doc map[string]interface{}) error {
+
+	docId, _ := doc["_id"].(string)
+	rev, _ := doc["_rev"].(string)
+	attachments := doc["_attachments"].(map[string]interface{})
+
+	if _, ok := attachments[SourceImageAttachment]; !ok {
+
+		reader, err := store.RetrieveAttachment(docId, LegacySourceImageAttachment)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		stub, _ := attachments[LegacySourceImageAttachment].(map[string]interface{})
+		contentType, _ := stub["content_type"].(string)
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		if err := store.PutAttachment(docId, rev, SourceImageAttachment, contentType, bytes.NewReader(content), int64(len(content))); err != nil {
+			return err
+		}
+
+		// the put made a new revision, drop photo on top of that one
+		updated := map[string]interface{}{}
+		if err := store.Retrieve(docId, &updated); err != nil {
+			return err
+		}
+		doc = updated
+		attachments = doc["_attachments"].(map[string]interface{})
+
+	}
+
+	// attachments left out of _attachments are removed
+	delete(attachments, LegacySourceImageAttachment)
+	_, err := store.Edit(doc)
+	return err
+
+}
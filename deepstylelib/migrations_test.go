@@ -0,0 +1,64 @@
+package deepstylelib
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tleyden/deepstyle/deepstylelib/fakesyncgw"
+)
+
+func TestMigrate(t *testing.T) {
+
+	syncGw := fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+	syncGw.DefineView(DesignDocName, ViewName, unprocessedJobsView)
+
+	db, err := GetDbConnection(syncGw.DBURL())
+	assert.NoError(t, err)
+
+	// a job from before source_image, one that's current, and not a job
+	_, rev, err := db.InsertWith(map[string]interface{}{"type": Job, "state": StateProcessingSuccessful}, "legacy")
+	assert.NoError(t, err)
+	assert.NoError(t, db.PutAttachment("legacy", rev, LegacySourceImageAttachment, "image/jpeg", strings.NewReader("jpeg"), 4))
+	newTestJob(t, db, "current", nil)
+	_, _, err = db.InsertWith(map[string]interface{}{"type": "other"}, "other")
+	assert.NoError(t, err)
+
+	// a dry run only reports, and a doc it can't read is counted apart from
+	// jobs that fail to migrate
+	syncGw.FailRequests("GET", "other", 500, 1)
+	report, err := Migrate(syncGw.DBURL(), true)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.JobsChecked)
+	assert.Equal(t, map[string]int{"rename_photo_attachment": 1}, report.JobsMigrated)
+	assert.Equal(t, 0, report.JobsFailed)
+	assert.Equal(t, 1, report.DocsUnreadable)
+	assert.Equal(t, []string{DesignDocName}, report.DesignDocsInstalled)
+	assert.Equal(t, []byte("jpeg"), syncGw.Attachment("legacy", LegacySourceImageAttachment))
+	assert.Equal(t, map[string]interface{}(nil), syncGw.DesignDoc(DesignDocName))
+
+	report, err = Migrate(syncGw.DBURL(), false)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"rename_photo_attachment": 1}, report.JobsMigrated)
+	assert.Equal(t, 0, report.JobsFailed)
+	assert.Equal(t, 0, report.DocsUnreadable)
+	assert.Equal(t, []string{DesignDocName}, report.DesignDocsInstalled)
+
+	assert.Equal(t, []byte("jpeg"), syncGw.Attachment("legacy", SourceImageAttachment))
+	assert.Equal(t, []byte(nil), syncGw.Attachment("legacy", LegacySourceImageAttachment))
+	legacy := syncGw.Doc("legacy")
+	assert.Equal(t, StateProcessingSuccessful, legacy["state"])
+	stub := legacy["_attachments"].(map[string]interface{})[SourceImageAttachment].(map[string]interface{})
+	assert.Equal(t, "image/jpeg", stub["content_type"])
+
+	// running it again changes nothing
+	report, err = Migrate(syncGw.DBURL(), false)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{}, report.JobsMigrated)
+	assert.Equal(t, []string{}, report.DesignDocsInstalled)
+	report, err = Migrate(syncGw.DBURL(), true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, report.DesignDocsInstalled)
+
+}
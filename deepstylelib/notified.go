@@ -0,0 +1,130 @@
+package deepstylelib
+
+import (
+	"log"
+	"time"
+)
+
+// How long a worker has to send a notification it claimed before another
+// worker may take it over (eg because the first one died mid-send)
+const NotificationClaimTimeout = 5 * time.Minute
+
+// NotifiedState records the last state of a job that its owner was told
+// about over one notification channel.  While a worker is sending the
+// notification, NotifiedAt is empty and SendingBy / SendingAt say who
+// claimed it and when.
+type NotifiedState struct {
+	State      string `json:"state"`
+	Attempt    int    `json:"attempt,omitempty"`
+	Percent    int    `json:"percent,omitempty"` // progress notifications only
+	NotifiedAt string `json:"notified_at,omitempty"`
+	SendingBy  string `json:"sending_by,omitempty"`
+	SendingAt  string `json:"sending_at,omitempty"`
+}
+
+// notifiedStateFor identifies the state transition a notification about
+// the job would be for.  The attempt is included so a job that fails again
+// after a retry gets notified again.
+func notifiedStateFor(jobDoc JobDocument) NotifiedState {
+	notified := NotifiedState{
+		State:   jobDoc.State,
+		Attempt: jobDoc.Attempts,
+	}
+	if jobDoc.State == StateBeingProcessed && jobDoc.Progress != nil {
+		notified.Percent = jobDoc.Progress.Percent
+	}
+	return notified
+}
+
+func (n NotifiedState) sameTransition(other NotifiedState) bool {
+	return n.State == other.State && n.Attempt == other.Attempt && n.Percent == other.Percent
+}
+
+// notificationClaim is held by a worker between claiming a notification
+// and recording the outcome
+type notificationClaim struct {
+	channel    string
+	workerId   string
+	transition NotifiedState
+	previous   *NotifiedState
+}
+
+// claimNotification records that workerId is about to notify the owner
+// about the job's current state over channel.  Returns false if there is
+// nothing to notify about, or it has already been sent or is being sent by
+// someone else.
+func (doc *JobDocument) claimNotification(channel, workerId string, notifyProgress bool) (notification Notification, claim notificationClaim, claimed bool, err error) {
+
+	isUnnotified := func() bool {
+		var ok bool
+		notification, ok = newNotification(*doc, notifyProgress)
+		if !ok {
+			return false
+		}
+		notified, exists := doc.Notified[channel]
+		if !exists || !notified.sameTransition(notifiedStateFor(*doc)) {
+			return true
+		}
+		if notified.NotifiedAt != "" {
+			return false
+		}
+		sendingAt, err := time.Parse(time.RFC3339, notified.SendingAt)
+		return err != nil || time.Since(sendingAt) > NotificationClaimTimeout
+	}
+
+	claimUpdater := func() {
+		claim = notificationClaim{
+			channel:    channel,
+			workerId:   workerId,
+			transition: notifiedStateFor(*doc),
+		}
+		if previous, exists := doc.Notified[channel]; exists {
+			claim.previous = &previous
+		}
+		sending := claim.transition
+		sending.SendingBy = workerId
+		sending.SendingAt = time.Now().UTC().Format(time.RFC3339)
+		if doc.Notified == nil {
+			doc.Notified = map[string]NotifiedState{}
+		}
+		doc.Notified[channel] = sending
+	}
+
+	claimed, err = doc.editIf(isUnnotified, claimUpdater)
+	return notification, claim, claimed, err
+
+}
+
+// finishNotification records the outcome of a claimed notification.  If it
+// was sent, it's marked notified so it's never sent again.  Otherwise the
+// claim is dropped so it can be retried.
+func (doc *JobDocument) finishNotification(claim notificationClaim, sent bool) (updated bool, err error) {
+
+	isClaimed := func() bool {
+		notified, exists := doc.Notified[claim.channel]
+		return exists &&
+			notified.sameTransition(claim.transition) &&
+			notified.NotifiedAt == "" &&
+			notified.SendingBy == claim.workerId
+	}
+
+	outcomeUpdater := func() {
+		switch {
+		case sent:
+			notified := claim.transition
+			notified.NotifiedAt = time.Now().UTC().Format(time.RFC3339)
+			doc.Notified[claim.channel] = notified
+		case claim.previous != nil:
+			doc.Notified[claim.channel] = *claim.previous
+		default:
+			delete(doc.Notified, claim.channel)
+		}
+	}
+
+	updated, err = doc.editIf(isClaimed, outcomeUpdater)
+	if err == nil && !updated {
+		log.Printf("Claim on %v notification for %v was taken over before it finished", claim.channel, doc.Id)
+	}
+	return updated, err
+
+}
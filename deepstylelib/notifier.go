@@ -0,0 +1,220 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notifier backends
+const (
+	NotifierUniqush = "uniqush" // push notifications via Uniqush (APNS or GCM)
+	NotifierWebhook = "webhook" // POST the notification as json to a url
+	NotifierSMTP    = "smtp"    // email the owner
+	NotifierLog     = "log"     // just log it
+)
+
+// Device types an owner can register in owner_device_type
+const (
+	DeviceTypeIOS     = "ios" // the default
+	DeviceTypeAndroid = "android"
+)
+
+// How long a notifier may take to deliver a notification
+const DefaultNotifierTimeout = 30 * time.Second
+
+// Notification is what notifiers are told about a job whose owner should
+// hear about it
+type Notification struct {
+	JobId    string       `json:"job_id"`
+	Revision string       `json:"revision"`
+	State    string       `json:"state"`
+	Message  string       `json:"message"`
+	Progress *JobProgress `json:"progress,omitempty"`
+
+	Owner            string `json:"owner"`
+	OwnerDeviceToken string `json:"-"`
+	OwnerDeviceType  string `json:"-"`
+	OwnerEmail       string `json:"-"`
+}
+
+// Notifier delivers notifications to job owners over one channel.  Owners
+// who can't be reached over the channel (eg no email address) are skipped
+// without an error.
+type Notifier interface {
+	Name() string
+	Notify(notification Notification) error
+}
+
+// NotifierConfig is the configuration for all notifier backends.  Backends
+// ignore the fields they don't need.
+type NotifierConfig struct {
+	Timeout time.Duration // 0 means DefaultNotifierTimeout
+
+	// Uniqush
+	UniqushURL     string
+	UniqushService string // defaults to "deepstyle"
+
+	// Webhook
+	WebhookURL string
+
+	// SMTP
+	SMTPAddr     string // host:port
+	SMTPUsername string // PLAIN auth, if set
+	SMTPPassword string
+	SMTPFrom     string
+}
+
+func (config NotifierConfig) httpClient() *http.Client {
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultNotifierTimeout
+	}
+	return &http.Client{Timeout: timeout}
+}
+
+// NotifierFactory builds a Notifier from its configuration
+type NotifierFactory func(config NotifierConfig) (Notifier, error)
+
+var (
+	notifierRegistryMutex sync.RWMutex
+	notifierRegistry      = map[string]NotifierFactory{}
+)
+
+// RegisterNotifier makes a notifier backend available by name.  Registering
+// the same name twice replaces the earlier factory.
+func RegisterNotifier(name string, factory NotifierFactory) {
+	notifierRegistryMutex.Lock()
+	defer notifierRegistryMutex.Unlock()
+	notifierRegistry[name] = factory
+}
+
+// NewNotifier builds the notifier backend registered under name
+func NewNotifier(name string, config NotifierConfig) (Notifier, error) {
+
+	notifierRegistryMutex.RLock()
+	factory, ok := notifierRegistry[name]
+	notifierRegistryMutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown notifier: %v.  Valid notifiers: %v", name, NotifierNames())
+	}
+	return factory(config)
+
+}
+
+// NewNotifiers builds a notifier that fans out to each of the named backends
+func NewNotifiers(names []string, config NotifierConfig) (Notifier, error) {
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No notifiers given.  Valid notifiers: %v", NotifierNames())
+	}
+
+	notifiers := MultiNotifier{}
+	for _, name := range names {
+		notifier, err := NewNotifier(name, config)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	return notifiers, nil
+
+}
+
+// NotifierNames returns the names of all registered notifier backends
+func NotifierNames() []string {
+
+	notifierRegistryMutex.RLock()
+	defer notifierRegistryMutex.RUnlock()
+
+	names := []string{}
+	for name := range notifierRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+
+}
+
+// MultiNotifier sends every notification to all of its notifiers.  One
+// failing doesn't stop the others from being tried.
+type MultiNotifier []Notifier
+
+func (m MultiNotifier) Name() string {
+	names := []string{}
+	for _, notifier := range m {
+		names = append(names, notifier.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+func (m MultiNotifier) Notify(notification Notification) error {
+
+	errs := []string{}
+	for _, notifier := range m {
+		if err := notifier.Notify(notification); err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", notifier.Name(), err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Notifiers failed: %v", strings.Join(errs, "; "))
+	}
+	return nil
+
+}
+
+// notifierChannels splits a MultiNotifier into the notifiers it fans out
+// to, so each one can be tracked separately
+func notifierChannels(notifier Notifier) []Notifier {
+	multi, ok := notifier.(MultiNotifier)
+	if !ok {
+		return []Notifier{notifier}
+	}
+	channels := []Notifier{}
+	for _, channel := range multi {
+		channels = append(channels, notifierChannels(channel)...)
+	}
+	return channels
+}
+
+// newNotification returns the notification the owner of the job should get
+// about its current state, if any
+func newNotification(jobDoc JobDocument, notifyProgress bool) (notification Notification, ok bool) {
+
+	message := ""
+	switch jobDoc.State {
+	case StateProcessingSuccessful:
+		message = "Your DeepStyle work of art is ready!"
+	case StateProcessingFailed:
+		message = "Oops, something went wrong making your DeepStyle work of art!"
+	case StateProcessingAbandoned:
+		message = "Sorry, we tried several times but couldn't make your DeepStyle work of art."
+	case StateProcessingTimedOut:
+		message = "Your DeepStyle work of art took too long, here's how far we got!"
+	case StateBeingProcessed:
+		if !notifyProgress || jobDoc.Progress == nil {
+			return Notification{}, false
+		}
+		message = fmt.Sprintf("Your DeepStyle work of art is %v%% done", jobDoc.Progress.Percent)
+	default:
+		// Job isn't finished, don't send any notification
+		return Notification{}, false
+	}
+
+	return Notification{
+		JobId:            jobDoc.Id,
+		Revision:         jobDoc.Revision,
+		State:            jobDoc.State,
+		Message:          message,
+		Progress:         jobDoc.Progress,
+		Owner:            jobDoc.Owner,
+		OwnerDeviceToken: jobDoc.OwnerDeviceToken,
+		OwnerDeviceType:  jobDoc.OwnerDeviceType,
+		OwnerEmail:       jobDoc.OwnerEmail,
+	}, true
+
+}
@@ -0,0 +1,24 @@
+package deepstylelib
+
+import "log"
+
+func init() {
+	RegisterNotifier(NotifierLog, NewLogNotifier)
+}
+
+// LogNotifier only logs notifications, for running without any way to reach
+// job owners
+type LogNotifier struct{}
+
+func NewLogNotifier(config NotifierConfig) (Notifier, error) {
+	return LogNotifier{}, nil
+}
+
+func (n LogNotifier) Name() string {
+	return NotifierLog
+}
+
+func (n LogNotifier) Notify(notification Notification) error {
+	log.Printf("Notification for %v about %v@%v (%v): %v", notification.Owner, notification.JobId, notification.Revision, notification.State, notification.Message)
+	return nil
+}
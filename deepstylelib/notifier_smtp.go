@@ -0,0 +1,113 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+func init() {
+	RegisterNotifier(NotifierSMTP, NewSMTPNotifier)
+}
+
+// SMTPNotifier emails the owner at owner_email.  It uses STARTTLS when the
+// server offers it, and PLAIN auth if a username is configured.
+type SMTPNotifier struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+	timeout  time.Duration
+}
+
+func NewSMTPNotifier(config NotifierConfig) (Notifier, error) {
+	if config.SMTPAddr == "" || config.SMTPFrom == "" {
+		return nil, fmt.Errorf("The smtp notifier needs an smtp server address and a from address")
+	}
+	if _, _, err := net.SplitHostPort(config.SMTPAddr); err != nil {
+		return nil, fmt.Errorf("Invalid smtp server address %v: %v", config.SMTPAddr, err)
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultNotifierTimeout
+	}
+	return SMTPNotifier{
+		Addr:     config.SMTPAddr,
+		Username: config.SMTPUsername,
+		Password: config.SMTPPassword,
+		From:     config.SMTPFrom,
+		timeout:  timeout,
+	}, nil
+}
+
+func (n SMTPNotifier) Name() string {
+	return NotifierSMTP
+}
+
+func (n SMTPNotifier) Notify(notification Notification) error {
+
+	if notification.OwnerEmail == "" {
+		log.Printf("No email address for %v, skipping email for %v", notification.Owner, notification.JobId)
+		return nil
+	}
+
+	// net/smtp.SendMail has no timeout, so dial ourselves
+	conn, err := net.DialTimeout("tcp", n.Addr, n.timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(n.timeout))
+	host, _, _ := net.SplitHostPort(n.Addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if n.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", n.Username, n.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(n.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(notification.OwnerEmail); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(n.message(notification)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+
+}
+
+func (n SMTPNotifier) message(notification Notification) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %v\r\n", n.From)
+	fmt.Fprintf(&buf, "To: %v\r\n", notification.OwnerEmail)
+	fmt.Fprintf(&buf, "Subject: %v\r\n", notification.Message)
+	fmt.Fprintf(&buf, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&buf, "\r\n")
+	fmt.Fprintf(&buf, "%v\r\n\r\nJob: %v\r\nState: %v\r\n", notification.Message, notification.JobId, notification.State)
+	return buf.Bytes()
+}
@@ -0,0 +1,289 @@
+package deepstylelib
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testNotification() Notification {
+	notification, _ := newNotification(JobDocument{
+		TypedDocument:    TypedDocument{Document: Document{Id: "job1", Revision: "3-abc"}},
+		State:            StateProcessingSuccessful,
+		Owner:            "alice",
+		OwnerDeviceToken: "token1",
+		OwnerEmail:       "alice@example.com",
+	}, false)
+	return notification
+}
+
+// recordingServer is a stand-in for Uniqush or a webhook receiver
+type recordingServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []recordedRequest
+}
+
+type recordedRequest struct {
+	path string
+	form url.Values
+	body string
+}
+
+func newRecordingServer(status int) *recordingServer {
+	s := &recordingServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := recordedRequest{path: r.URL.Path}
+		if r.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+			r.ParseForm()
+			request.form = r.PostForm
+		} else {
+			body := new(strings.Builder)
+			bufio.NewReader(r.Body).WriteTo(body)
+			request.body = body.String()
+		}
+		s.mutex.Lock()
+		s.requests = append(s.requests, request)
+		s.mutex.Unlock()
+		w.WriteHeader(status)
+	}))
+	return s
+}
+
+func (s *recordingServer) recorded() []recordedRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]recordedRequest{}, s.requests...)
+}
+
+func TestUniqushNotifier(t *testing.T) {
+
+	server := newRecordingServer(http.StatusOK)
+	defer server.Close()
+
+	notifier, err := NewNotifier(NotifierUniqush, NotifierConfig{UniqushURL: server.URL + "/"})
+	assert.NoError(t, err)
+
+	// iOS by default
+	assert.NoError(t, notifier.Notify(testNotification()))
+
+	android := testNotification()
+	android.OwnerDeviceType = DeviceTypeAndroid
+	assert.NoError(t, notifier.Notify(android))
+
+	// owners without a device are skipped
+	noDevice := testNotification()
+	noDevice.OwnerDeviceToken = ""
+	assert.NoError(t, notifier.Notify(noDevice))
+
+	requests := server.recorded()
+	assert.Equal(t, 4, len(requests))
+
+	assert.Equal(t, "/subscribe", requests[0].path)
+	assert.Equal(t, "deepstyle", requests[0].form.Get("service"))
+	assert.Equal(t, "alice", requests[0].form.Get("subscriber"))
+	assert.Equal(t, "apns", requests[0].form.Get("pushservicetype"))
+	assert.Equal(t, "token1", requests[0].form.Get("devtoken"))
+
+	assert.Equal(t, "/push", requests[1].path)
+	assert.Equal(t, "Your DeepStyle work of art is ready!", requests[1].form.Get("msg"))
+
+	assert.Equal(t, "gcm", requests[2].form.Get("pushservicetype"))
+	assert.Equal(t, "token1", requests[2].form.Get("regid"))
+
+	unknown := testNotification()
+	unknown.OwnerDeviceType = "blackberry"
+	assert.Error(t, notifier.Notify(unknown))
+
+	_, err = NewNotifier(NotifierUniqush, NotifierConfig{})
+	assert.Error(t, err)
+
+}
+
+func TestWebhookNotifier(t *testing.T) {
+
+	server := newRecordingServer(http.StatusNoContent)
+	defer server.Close()
+
+	notifier, err := NewNotifier(NotifierWebhook, NotifierConfig{WebhookURL: server.URL + "/hook"})
+	assert.NoError(t, err)
+	assert.NoError(t, notifier.Notify(testNotification()))
+
+	requests := server.recorded()
+	assert.Equal(t, 1, len(requests))
+	assert.Equal(t, "/hook", requests[0].path)
+
+	body := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal([]byte(requests[0].body), &body))
+	assert.Equal(t, "job1", body["job_id"])
+	assert.Equal(t, "3-abc", body["revision"])
+	assert.Equal(t, StateProcessingSuccessful, body["state"])
+	assert.Equal(t, "alice", body["owner"])
+	assert.NotContains(t, requests[0].body, "token1")
+	assert.NotContains(t, requests[0].body, "alice@example.com")
+
+	failing := newRecordingServer(http.StatusInternalServerError)
+	defer failing.Close()
+	notifier, err = NewNotifier(NotifierWebhook, NotifierConfig{WebhookURL: failing.URL})
+	assert.NoError(t, err)
+	assert.Error(t, notifier.Notify(testNotification()))
+
+}
+
+// fakeSMTPServer accepts one connection at a time and records the messages
+// it is sent.  It offers no extensions, so no STARTTLS or auth.
+type fakeSMTPServer struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	messages []fakeSMTPMessage
+}
+
+type fakeSMTPMessage struct {
+	from, to, data string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := &fakeSMTPServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%v\r\n", line) }
+
+	message := fakeSMTPMessage{}
+	reply("220 localhost fake smtp")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch command {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "MAIL":
+			message.from = strings.TrimSpace(line[len("MAIL FROM:"):])
+			reply("250 ok")
+		case "RCPT":
+			message.to = strings.TrimSpace(line[len("RCPT TO:"):])
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			data := new(strings.Builder)
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(dataLine)
+			}
+			message.data = data.String()
+			s.mutex.Lock()
+			s.messages = append(s.messages, message)
+			s.mutex.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+
+}
+
+func (s *fakeSMTPServer) received() []fakeSMTPMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]fakeSMTPMessage{}, s.messages...)
+}
+
+func TestSMTPNotifier(t *testing.T) {
+
+	server := newFakeSMTPServer(t)
+	defer server.listener.Close()
+
+	notifier, err := NewNotifier(NotifierSMTP, NotifierConfig{
+		SMTPAddr: server.listener.Addr().String(),
+		SMTPFrom: "deepstyle@example.com",
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, notifier.Notify(testNotification()))
+
+	// owners without an email address are skipped
+	noEmail := testNotification()
+	noEmail.OwnerEmail = ""
+	assert.NoError(t, notifier.Notify(noEmail))
+
+	messages := server.received()
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, "<deepstyle@example.com>", messages[0].from)
+	assert.Equal(t, "<alice@example.com>", messages[0].to)
+	assert.Contains(t, messages[0].data, "Subject: Your DeepStyle work of art is ready!\r\n")
+	assert.Contains(t, messages[0].data, "Job: job1\r\n")
+
+	_, err = NewNotifier(NotifierSMTP, NotifierConfig{SMTPAddr: "no-port", SMTPFrom: "deepstyle@example.com"})
+	assert.Error(t, err)
+
+}
+
+func TestNewNotifiers(t *testing.T) {
+
+	failing := newRecordingServer(http.StatusInternalServerError)
+	defer failing.Close()
+	uniqush := newRecordingServer(http.StatusOK)
+	defer uniqush.Close()
+
+	notifier, err := NewNotifiers(
+		[]string{NotifierWebhook, NotifierUniqush, NotifierLog},
+		NotifierConfig{WebhookURL: failing.URL, UniqushURL: uniqush.URL},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "webhook,uniqush,log", notifier.Name())
+
+	// the failing webhook doesn't stop the push notification
+	err = notifier.Notify(testNotification())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "webhook")
+	assert.Equal(t, 2, len(uniqush.recorded()))
+
+	_, err = NewNotifiers([]string{NotifierLog, "carrier_pigeon"}, NotifierConfig{})
+	assert.Error(t, err)
+	_, err = NewNotifiers(nil, NotifierConfig{})
+	assert.Error(t, err)
+
+	// unfinished jobs don't get notifications, unless progress is wanted
+	jobDoc := JobDocument{State: StateBeingProcessed, Progress: &JobProgress{Percent: 40}}
+	_, ok := newNotification(jobDoc, false)
+	assert.False(t, ok)
+	notification, ok := newNotification(jobDoc, true)
+	assert.True(t, ok)
+	assert.Equal(t, "Your DeepStyle work of art is 40% done", notification.Message)
+
+}
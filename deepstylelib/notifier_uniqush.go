@@ -0,0 +1,92 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func init() {
+	RegisterNotifier(NotifierUniqush, NewUniqushNotifier)
+}
+
+// UniqushNotifier sends push notifications through a Uniqush push server,
+// over APNS for iOS devices and GCM for Android ones.  The owner is
+// subscribed to the service before each push, which Uniqush treats as a
+// no-op if they already are.
+type UniqushNotifier struct {
+	URL     string
+	Service string
+	client  *http.Client
+}
+
+func NewUniqushNotifier(config NotifierConfig) (Notifier, error) {
+	if config.UniqushURL == "" {
+		return nil, fmt.Errorf("The uniqush notifier needs a Uniqush url")
+	}
+	service := config.UniqushService
+	if service == "" {
+		service = "deepstyle"
+	}
+	return UniqushNotifier{
+		URL:     strings.TrimSuffix(config.UniqushURL, "/"),
+		Service: service,
+		client:  config.httpClient(),
+	}, nil
+}
+
+func (n UniqushNotifier) Name() string {
+	return NotifierUniqush
+}
+
+func (n UniqushNotifier) Notify(notification Notification) error {
+
+	if notification.OwnerDeviceToken == "" {
+		log.Printf("No device token for %v, skipping push notification for %v", notification.Owner, notification.JobId)
+		return nil
+	}
+
+	subscription := url.Values{
+		"service":    {n.Service},
+		"subscriber": {notification.Owner},
+	}
+	switch notification.OwnerDeviceType {
+	case DeviceTypeAndroid:
+		subscription.Set("pushservicetype", "gcm")
+		subscription.Set("regid", notification.OwnerDeviceToken)
+	case DeviceTypeIOS, "":
+		subscription.Set("pushservicetype", "apns")
+		subscription.Set("devtoken", notification.OwnerDeviceToken)
+	default:
+		return fmt.Errorf("Unknown device type: %v", notification.OwnerDeviceType)
+	}
+	if err := n.post("subscribe", subscription); err != nil {
+		return err
+	}
+
+	return n.post("push", url.Values{
+		"service":    {n.Service},
+		"subscriber": {notification.Owner},
+		"msg":        {notification.Message},
+	})
+
+}
+
+func (n UniqushNotifier) post(endpoint string, values url.Values) error {
+
+	resp, err := n.client.PostForm(fmt.Sprintf("%v/%v", n.URL, endpoint), values)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Uniqush %v failed.  Status: %v.  Body: %s", endpoint, resp.StatusCode, body)
+	}
+	return nil
+
+}
@@ -0,0 +1,55 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+func init() {
+	RegisterNotifier(NotifierWebhook, NewWebhookNotifier)
+}
+
+// WebhookNotifier POSTs each notification as json to a url.  The device
+// token and email address of the owner aren't included.
+type WebhookNotifier struct {
+	URL    string
+	client *http.Client
+}
+
+func NewWebhookNotifier(config NotifierConfig) (Notifier, error) {
+	if config.WebhookURL == "" {
+		return nil, fmt.Errorf("The webhook notifier needs a webhook url")
+	}
+	return WebhookNotifier{
+		URL:    config.WebhookURL,
+		client: config.httpClient(),
+	}, nil
+}
+
+func (n WebhookNotifier) Name() string {
+	return NotifierWebhook
+}
+
+func (n WebhookNotifier) Notify(notification Notification) error {
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook failed.  Status: %v.  Body: %s", resp.StatusCode, respBody)
+	}
+	return nil
+
+}
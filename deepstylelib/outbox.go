@@ -0,0 +1,306 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultEventOutboxDir        = "event_outbox"
+	DefaultEventDeliveryInterval = 10 * time.Second
+)
+
+// Headers on every webhook delivery
+const (
+	WebhookEventHeader     = "X-DeepStyle-Event"
+	WebhookTimestampHeader = "X-DeepStyle-Timestamp"
+	WebhookSignatureHeader = "X-DeepStyle-Signature"
+)
+
+// DefaultEventRetryPolicy retries failed deliveries for about a day before
+// giving up on them
+func DefaultEventRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    30,
+		InitialBackoff: 10 * time.Second,
+		MaxBackoff:     1 * time.Hour,
+	}
+}
+
+// WebhookSubscription is a url that gets every job event, signed with the
+// secret
+type WebhookSubscription struct {
+	URL    string
+	Secret string
+}
+
+// EventOutbox delivers job events to the webhook subscriptions.  Events are
+// written to a directory before anything is sent, one file per event and
+// subscription, and a file is only removed once the subscriber accepts it,
+// so deliveries survive restarts.  Deliveries that keep failing are retried
+// with backoff, then moved to the failed/ subdirectory.  Each worker needs
+// its own directory.
+type EventOutbox struct {
+	Dir           string
+	Subscriptions []WebhookSubscription
+	RetryPolicy   RetryPolicy
+	Interval      time.Duration // How often to look for due deliveries
+
+	client   *http.Client
+	delivery sync.Mutex    // one delivery pass at a time
+	kick     chan struct{} // wakes up the delivery loop after a Publish
+}
+
+// outboxEntry is the file written for each pending delivery.  The secret
+// isn't stored, it's looked up by url when delivering.
+type outboxEntry struct {
+	Event         JobEvent `json:"event"`
+	URL           string   `json:"url"`
+	Attempts      int      `json:"attempts"`
+	NextAttemptAt string   `json:"next_attempt_at"`
+	LastError     string   `json:"last_error,omitempty"`
+}
+
+func NewEventOutbox(dir string, subscriptions []WebhookSubscription) (*EventOutbox, error) {
+
+	for _, subscription := range subscriptions {
+		if subscription.URL == "" || subscription.Secret == "" {
+			return nil, fmt.Errorf("Webhook subscriptions need a url and a secret to sign with")
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "failed"), 0700); err != nil {
+		return nil, err
+	}
+
+	return &EventOutbox{
+		Dir:           dir,
+		Subscriptions: subscriptions,
+		RetryPolicy:   DefaultEventRetryPolicy(),
+		Interval:      DefaultEventDeliveryInterval,
+		client:        &http.Client{Timeout: DefaultNotifierTimeout},
+		kick:          make(chan struct{}, 1),
+	}, nil
+
+}
+
+// Publish queues the event for every subscription
+func (o *EventOutbox) Publish(event JobEvent) error {
+
+	now := time.Now().UTC()
+	for _, subscription := range o.Subscriptions {
+		entry := outboxEntry{
+			Event:         event,
+			URL:           subscription.URL,
+			NextAttemptAt: now.Format(time.RFC3339Nano),
+		}
+		urlHash := sha256.Sum256([]byte(subscription.URL))
+		name := fmt.Sprintf("%020d-%v-%x.json", now.UnixNano(), event.Id, urlHash[:4])
+		if err := o.writeEntry(filepath.Join(o.Dir, name), entry); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case o.kick <- struct{}{}:
+	default:
+	}
+	return nil
+
+}
+
+// writeEntry replaces the file atomically, so a crash never leaves half an
+// entry behind
+func (o *EventOutbox) writeEntry(path string, entry outboxEntry) error {
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tempPath := path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, entryBytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+// Start delivers pending events in the background until the returned func
+// is called
+func (o *EventOutbox) Start() (stop func()) {
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(o.Interval)
+		defer ticker.Stop()
+		for {
+			if err := o.Deliver(); err != nil {
+				log.Printf("Error delivering events from %v: %v", o.Dir, err)
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			case <-o.kick:
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+
+}
+
+// Deliver makes one pass over the outbox, oldest first, sending every
+// delivery that is due
+func (o *EventOutbox) Deliver() error {
+
+	o.delivery.Lock()
+	defer o.delivery.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(o.Dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		if err := o.deliverEntry(path); err != nil {
+			log.Printf("Error delivering %v: %v", path, err)
+		}
+	}
+	return nil
+
+}
+
+func (o *EventOutbox) deliverEntry(path string) error {
+
+	entryBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	entry := outboxEntry{}
+	if err := json.Unmarshal(entryBytes, &entry); err != nil {
+		return o.moveToFailed(path, fmt.Errorf("Invalid outbox entry: %v", err))
+	}
+
+	nextAttemptAt, err := time.Parse(time.RFC3339Nano, entry.NextAttemptAt)
+	if err == nil && time.Now().Before(nextAttemptAt) {
+		return nil
+	}
+
+	subscription, ok := o.subscription(entry.URL)
+	if !ok {
+		log.Printf("No subscription for %v any more, dropping event %v", entry.URL, entry.Event.Id)
+		return os.Remove(path)
+	}
+
+	sendErr := o.send(subscription, entry.Event)
+	if sendErr == nil {
+		return os.Remove(path)
+	}
+
+	entry.Attempts += 1
+	entry.LastError = sendErr.Error()
+	if o.RetryPolicy.IsExhausted(entry.Attempts) {
+		if err := o.writeEntry(path, entry); err != nil {
+			return err
+		}
+		return o.moveToFailed(path, sendErr)
+	}
+	backoff := o.RetryPolicy.Backoff(entry.Attempts)
+	entry.NextAttemptAt = time.Now().Add(backoff).UTC().Format(time.RFC3339Nano)
+	log.Printf("Delivering event %v to %v failed: %v.  Retrying in %v", entry.Event.Id, entry.URL, sendErr, backoff)
+	return o.writeEntry(path, entry)
+
+}
+
+func (o *EventOutbox) moveToFailed(path string, reason error) error {
+	log.Printf("Giving up on delivering %v: %v", path, reason)
+	return os.Rename(path, filepath.Join(o.Dir, "failed", filepath.Base(path)))
+}
+
+func (o *EventOutbox) subscription(url string) (WebhookSubscription, bool) {
+	for _, subscription := range o.Subscriptions {
+		if subscription.URL == url {
+			return subscription, true
+		}
+	}
+	return WebhookSubscription{}, false
+}
+
+// send POSTs the event, signed with the subscription's secret
+func (o *EventOutbox) send(subscription WebhookSubscription, event JobEvent) error {
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequest("POST", subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, event.Id)
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(subscription.Secret, timestamp, body))
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected status %v.  Body: %s", resp.StatusCode, respBody)
+	}
+	return nil
+
+}
+
+// SignWebhook returns the signature header for a webhook body: sha256= and
+// the hex HMAC-SHA256 of "<timestamp>.<body>" keyed with the secret
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks the signature of a webhook delivery, and that it was
+// signed within tolerance of now, for receivers written in Go
+func VerifyWebhook(secret string, header http.Header, body []byte, tolerance time.Duration) error {
+
+	timestamp, err := strconv.ParseInt(header.Get(WebhookTimestampHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid %v header: %v", WebhookTimestampHeader, err)
+	}
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > tolerance || age < -tolerance {
+		return fmt.Errorf("Webhook timestamp %v is too far from now", timestamp)
+	}
+
+	expected := SignWebhook(secret, timestamp, body)
+	signature := strings.TrimSpace(header.Get(WebhookSignatureHeader))
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return fmt.Errorf("Webhook signature doesn't match")
+	}
+	return nil
+
+}
@@ -0,0 +1,200 @@
+package deepstylelib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tleyden/deepstyle/deepstylelib/fakesyncgw"
+)
+
+// eventReceiver is a webhook subscriber that checks signatures, failing
+// the first failures deliveries
+type eventReceiver struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	events   []JobEvent
+	failures int
+}
+
+func newEventReceiver(t *testing.T, secret string, failures int) *eventReceiver {
+	receiver := &eventReceiver{failures: failures}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := VerifyWebhook(secret, r.Header, body, time.Minute); err != nil {
+			t.Errorf("Bad delivery: %v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		receiver.mutex.Lock()
+		defer receiver.mutex.Unlock()
+		if receiver.failures > 0 {
+			receiver.failures -= 1
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		event := JobEvent{}
+		assert.NoError(t, json.Unmarshal(body, &event))
+		assert.Equal(t, event.Id, r.Header.Get(WebhookEventHeader))
+		receiver.events = append(receiver.events, event)
+	}))
+	return receiver
+}
+
+func (r *eventReceiver) received() []JobEvent {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]JobEvent{}, r.events...)
+}
+
+func pendingDeliveries(t *testing.T, dir string) int {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.NoError(t, err)
+	return len(paths)
+}
+
+func TestEventOutbox(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "deepstyle_outbox")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	receiver := newEventReceiver(t, "secret1", 2)
+	defer receiver.Close()
+	subscriptions := []WebhookSubscription{{URL: receiver.URL, Secret: "secret1"}}
+
+	outbox, err := NewEventOutbox(dir, subscriptions)
+	assert.NoError(t, err)
+	outbox.RetryPolicy = RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond}
+
+	event := JobEvent{Id: "event1", JobId: "job1", OldState: StateBeingProcessed, NewState: StateProcessingSuccessful}
+	assert.NoError(t, outbox.Publish(event))
+	assert.Equal(t, 1, pendingDeliveries(t, dir))
+
+	// the first delivery fails, and is still there after a restart
+	assert.NoError(t, outbox.Deliver())
+	assert.Equal(t, 1, pendingDeliveries(t, dir))
+	outbox, err = NewEventOutbox(dir, subscriptions)
+	assert.NoError(t, err)
+	outbox.RetryPolicy = RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for pendingDeliveries(t, dir) > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		assert.NoError(t, outbox.Deliver())
+	}
+	received := receiver.received()
+	assert.Equal(t, 1, len(received))
+	assert.Equal(t, "event1", received[0].Id)
+	assert.Equal(t, StateProcessingSuccessful, received[0].NewState)
+
+	// a subscriber that never accepts ends up in failed/
+	down := newEventReceiver(t, "secret1", 1000)
+	defer down.Close()
+	outbox, err = NewEventOutbox(dir, []WebhookSubscription{{URL: down.URL, Secret: "secret1"}})
+	assert.NoError(t, err)
+	outbox.RetryPolicy = RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}
+	assert.NoError(t, outbox.Publish(event))
+	for i := 0; i < 5; i++ {
+		time.Sleep(5 * time.Millisecond)
+		assert.NoError(t, outbox.Deliver())
+	}
+	assert.Equal(t, 0, pendingDeliveries(t, dir))
+	failed, err := filepath.Glob(filepath.Join(dir, "failed", "*.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(failed))
+
+	_, err = NewEventOutbox(dir, []WebhookSubscription{{URL: down.URL}})
+	assert.Error(t, err)
+
+}
+
+func TestVerifyWebhook(t *testing.T) {
+
+	body := []byte(`{"id": "event1"}`)
+	now := time.Now().Unix()
+	header := http.Header{}
+	header.Set(WebhookTimestampHeader, strconv.FormatInt(now, 10))
+	header.Set(WebhookSignatureHeader, SignWebhook("secret1", now, body))
+	assert.NoError(t, VerifyWebhook("secret1", header, body, time.Minute))
+
+	assert.Error(t, VerifyWebhook("secret2", header, body, time.Minute))
+	assert.Error(t, VerifyWebhook("secret1", header, []byte(`{"id": "event2"}`), time.Minute))
+
+	old := now - 3600
+	header.Set(WebhookTimestampHeader, strconv.FormatInt(old, 10))
+	header.Set(WebhookSignatureHeader, SignWebhook("secret1", old, body))
+	assert.Error(t, VerifyWebhook("secret1", header, body, time.Minute))
+
+}
+
+func TestJobTransitionEvents(t *testing.T) {
+
+	syncGw := fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+
+	db, err := GetDbConnection(syncGw.DBURL())
+	assert.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "deepstyle_outbox")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	receiver := newEventReceiver(t, "secret1", 0)
+	defer receiver.Close()
+	outbox, err := NewEventOutbox(dir, []WebhookSubscription{{URL: receiver.URL, Secret: "secret1"}})
+	assert.NoError(t, err)
+
+	config := configuration{
+		Database:      db,
+		TempDir:       dir,
+		Executor:      FakeExecutor{},
+		WorkerId:      "worker1",
+		LeaseDuration: time.Minute,
+		RetryPolicy:   DefaultRetryPolicy(),
+		Events:        outbox,
+	}
+
+	jobDoc := newTestJob(t, db, "job1", nil)
+	assert.NoError(t, executeDeepStyleJob(config, jobDoc))
+	assert.NoError(t, outbox.Deliver())
+
+	received := receiver.received()
+	assert.Equal(t, 2, len(received))
+	assert.Equal(t, []string{StateReadyToProcess, StateBeingProcessed}, []string{received[0].OldState, received[0].NewState})
+	assert.Equal(t, "worker1", received[0].WorkerId)
+	assert.Equal(t, 1, received[0].Attempt)
+	assert.Equal(t, "", received[0].ResultURL)
+	assert.Equal(t, []string{StateBeingProcessed, StateProcessingSuccessful}, []string{received[1].OldState, received[1].NewState})
+	assert.Equal(t, syncGw.DBURL()+"/job1/"+ResultImageAttachment, received[1].ResultURL)
+	assert.NotEqual(t, received[0].Id, received[1].Id)
+
+	// the reaper's transitions are sent too
+	_, _, err = db.InsertWith(map[string]interface{}{"type": Job, "state": StateReadyToProcess}, "job2")
+	assert.NoError(t, err)
+	stuck, err := NewJobDocument("job2", configuration{Database: db})
+	assert.NoError(t, err)
+	claimed, err := stuck.Claim("worker2", -time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	stuck, err = NewJobDocument("job2", configuration{Database: db})
+	assert.NoError(t, err)
+
+	reaperConfig := ReaperConfig{GracePeriod: time.Minute, RetryPolicy: DefaultRetryPolicy(), Events: outbox}
+	assert.NoError(t, reapStuckJobs([]JobDocument{*stuck}, reaperConfig))
+	assert.NoError(t, outbox.Deliver())
+
+	received = receiver.received()
+	assert.Equal(t, 3, len(received))
+	assert.Equal(t, "job2", received[2].JobId)
+	assert.Equal(t, []string{StateBeingProcessed, StateReadyToProcess}, []string{received[2].OldState, received[2].NewState})
+
+}
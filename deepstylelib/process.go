@@ -0,0 +1,51 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"os/exec"
+)
+
+// runCommand runs cmd and returns its combined stdout and stderr.  If ctx is
+// done before the command exits, the whole process group is killed and
+// ctx.Err() is returned, so callers can tell a cancelled job from a failed
+// one.  If progress isn't nil, the output is scanned for iteration lines as
+// it is written.
+func runCommand(ctx context.Context, cmd *exec.Cmd, progress ProgressFunc) (stdOutAndErr []byte, err error) {
+
+	var output bytes.Buffer
+	var writer io.Writer = &output
+	if progress != nil {
+		writer = io.MultiWriter(&output, &progressWriter{progress: progress})
+	}
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			log.Printf("Killing %v (pid %v): %v", cmd.Path, cmd.Process.Pid, ctx.Err())
+			if err := killProcessGroup(cmd); err != nil {
+				log.Printf("Error killing %v: %v", cmd.Path, err)
+			}
+		case <-exited:
+		}
+	}()
+
+	err = cmd.Wait()
+	close(exited)
+
+	if err != nil && ctx.Err() != nil {
+		return output.Bytes(), ctx.Err()
+	}
+	return output.Bytes(), err
+
+}
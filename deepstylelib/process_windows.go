@@ -0,0 +1,11 @@
+package deepstylelib
+
+import "os/exec"
+
+// Windows has no process groups, so only the command itself is killed
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
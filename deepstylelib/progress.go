@@ -0,0 +1,162 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"log"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often a running job's progress is saved on the job doc
+const DefaultProgressInterval = 15 * time.Second
+
+// ProgressFunc is called by an executor each time the style transfer
+// completes an iteration
+type ProgressFunc func(iteration, totalIterations int)
+
+// JobProgress is how far a running job has got
+type JobProgress struct {
+	Iteration       int    `json:"iteration"`
+	TotalIterations int    `json:"total_iterations"`
+	Percent         int    `json:"percent"`
+	UpdatedAt       string `json:"updated_at"`
+}
+
+func newJobProgress(iteration, totalIterations int) JobProgress {
+	percent := 0
+	if totalIterations > 0 {
+		percent = iteration * 100 / totalIterations
+	}
+	return JobProgress{
+		Iteration:       iteration,
+		TotalIterations: totalIterations,
+		Percent:         percent,
+		UpdatedAt:       time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// UpdateProgress saves the progress of the job, if it's still being
+// processed by workerId.
+func (doc *JobDocument) UpdateProgress(workerId string, progress JobProgress) (updated bool, err error) {
+
+	isHeldByWorker := func() bool {
+		return doc.State == StateBeingProcessed && doc.WorkerId == workerId
+	}
+
+	progressUpdater := func() {
+		doc.Progress = &progress
+	}
+
+	return doc.editIf(isHeldByWorker, progressUpdater)
+
+}
+
+// neural-style prints eg "Iteration 150 / 1000" every -print_iter iterations
+var iterationRegexp = regexp.MustCompile(`Iteration (\d+) / (\d+)`)
+
+// progressWriter scans executor output for iteration lines and reports
+// them to progress.  Partial lines are held until the rest arrives.
+type progressWriter struct {
+	progress ProgressFunc
+	partial  []byte
+}
+
+func (w *progressWriter) Write(p []byte) (n int, err error) {
+
+	w.partial = append(w.partial, p...)
+	for {
+		newline := bytes.IndexByte(w.partial, '\n')
+		if newline < 0 {
+			break
+		}
+		w.scanLine(w.partial[:newline])
+		w.partial = w.partial[newline+1:]
+	}
+	return len(p), nil
+
+}
+
+func (w *progressWriter) scanLine(line []byte) {
+	match := iterationRegexp.FindSubmatch(line)
+	if match == nil {
+		return
+	}
+	iteration, err := strconv.Atoi(string(match[1]))
+	if err != nil {
+		return
+	}
+	totalIterations, err := strconv.Atoi(string(match[2]))
+	if err != nil {
+		return
+	}
+	w.progress(iteration, totalIterations)
+}
+
+// startProgressReporter returns a ProgressFunc for the executor, which only
+// records the latest progress, and saves it on the job doc at most once per
+// interval so a fast printing executor doesn't flood the database.  Saving
+// happens on its own copy of the doc, like the lease heartbeat.  The
+// returned stop func is safe to call more than once.
+func startProgressReporter(jobDoc JobDocument, workerId string, interval time.Duration) (report ProgressFunc, stop func()) {
+
+	if interval <= 0 {
+		return nil, func() {}
+	}
+
+	var (
+		mutex    sync.Mutex
+		latest   *JobProgress
+		reported *JobProgress
+	)
+
+	report = func(iteration, totalIterations int) {
+		progress := newJobProgress(iteration, totalIterations)
+		mutex.Lock()
+		latest = &progress
+		mutex.Unlock()
+	}
+
+	stopChan := make(chan struct{})
+	doneChan := make(chan struct{})
+
+	go func() {
+		defer close(doneChan)
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-time.After(interval):
+			}
+
+			mutex.Lock()
+			progress := latest
+			mutex.Unlock()
+			if progress == nil || progress == reported {
+				continue
+			}
+
+			updated, err := jobDoc.UpdateProgress(workerId, *progress)
+			if err != nil {
+				log.Printf("Error saving progress of job %v: %v", jobDoc.Id, err)
+				continue
+			}
+			if !updated {
+				// no longer ours, the heartbeat deals with that
+				return
+			}
+			reported = progress
+		}
+	}()
+
+	var stopOnce sync.Once
+	stop = func() {
+		stopOnce.Do(func() {
+			close(stopChan)
+			<-doneChan
+		})
+	}
+	return report, stop
+
+}
@@ -0,0 +1,352 @@
+package deepstylelib
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultQueuePollInterval     = 5 * time.Second
+	DefaultImageDownloadTimeout  = 2 * time.Minute
+	DefaultMaxMessageDeliveries  = 5
+	DefaultMessageRedeliveryWait = 10 * time.Second
+)
+
+// Outcomes of a queue message, the outcome label of MetricQueueMessages
+const (
+	MessageOutcomeAcked        = "acked"
+	MessageOutcomeRedelivered  = "redelivered"
+	MessageOutcomeDeadLettered = "dead_lettered"
+)
+
+// JobMessage is a job published to a message queue.  The images are urls,
+// or keys of blobs under the QueueJobSource's BlobURL.
+type JobMessage struct {
+	JobId       string         `json:"job_id,omitempty"` // The job doc id, defaults to one made from the message id
+	Owner       string         `json:"owner,omitempty"`
+	SourceImage string         `json:"source_image"`
+	StyleImage  string         `json:"style_image"`
+	Parameters  *JobParameters `json:"parameters,omitempty"`
+}
+
+// DefaultDeliveryPolicy redelivers a message that couldn't be run, eg
+// because an image couldn't be downloaded, a few times over a couple of
+// minutes before dead-lettering it
+func DefaultDeliveryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    DefaultMaxMessageDeliveries,
+		InitialBackoff: DefaultMessageRedeliveryWait,
+		MaxBackoff:     DefaultMessageRedeliveryWait * 8,
+	}
+}
+
+// QueueJobSource runs jobs published to a message queue by other services.
+// Each message becomes an ordinary job in Database, so it's run through
+// the same pipeline as jobs from the app, with the same retries, events
+// and metrics, and the result ends up as its result_image attachment.  The
+// message is only acked once the job has succeeded.  A job that fails for
+// good is dead-lettered, and a message that can't be turned into a job is
+// redelivered until DeliveryPolicy gives up on it.
+//
+// Jobs are idempotent: a redelivered message picks up the job it already
+// created, and just waits for it if another worker is running it.
+type QueueJobSource struct {
+	Queue            MessageQueue
+	Database         JobStore
+	Executor         Executor      // Runs the style transfer for each job
+	ExecutorName     string        // Which backend Executor is, for duration stats
+	WorkerId         string        // Recorded on jobs claimed by this worker
+	LeaseDuration    time.Duration // How long a claim lasts between heartbeats
+	RetryPolicy      RetryPolicy   // How often to retry failing jobs
+	DeliveryPolicy   RetryPolicy   // How often to redeliver messages that couldn't be run
+	ProgressInterval time.Duration // How often running jobs save progress, 0 to never
+	SnapshotInterval time.Duration // How often timelapse jobs upload a snapshot
+	PollInterval     time.Duration // How long to wait for messages, and on jobs running elsewhere
+	BlobURL          string        // Where images given by key are downloaded from
+	TempDir          string        // Where images are downloaded to
+	Events           *EventOutbox  // Webhooks for job state transitions, may be nil
+	Metrics          MetricsSink   // Job and message metrics, may be nil
+}
+
+func NewQueueJobSource(queue MessageQueue, syncGatewayUrl string) (*QueueJobSource, error) {
+
+	db, err := OpenJobStore(syncGatewayUrl)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to db: %v.  Err: %v", syncGatewayUrl, err)
+	}
+
+	executor, err := NewExecutor(ExecutorNeuralStyle, ExecutorConfig{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &QueueJobSource{
+		Queue:            queue,
+		Database:         db,
+		Executor:         executor,
+		ExecutorName:     ExecutorNeuralStyle,
+		WorkerId:         DefaultWorkerId(),
+		LeaseDuration:    DefaultLeaseDuration,
+		RetryPolicy:      DefaultRetryPolicy(),
+		DeliveryPolicy:   DefaultDeliveryPolicy(),
+		ProgressInterval: DefaultProgressInterval,
+		SnapshotInterval: DefaultSnapshotInterval,
+		PollInterval:     DefaultQueuePollInterval,
+		TempDir:          os.TempDir(),
+	}, nil
+
+}
+
+// Follow runs jobs from the queue one at a time, forever
+func (s *QueueJobSource) Follow() {
+
+	if s.Events != nil {
+		stopDelivery := s.Events.Start()
+		defer stopDelivery()
+	}
+
+	for {
+		received, err := s.ProcessNext(s.PollInterval)
+		if err != nil {
+			log.Printf("Error processing message from queue: %v", err)
+			if !received {
+				// eg the broker is down, don't spin
+				<-time.After(s.PollInterval)
+			}
+		}
+	}
+
+}
+
+// ProcessNext waits up to wait for a message and runs its job, returning
+// false if there wasn't one.  Errors are from the queue, failed jobs are
+// dealt with by nacking their messages.
+func (s *QueueJobSource) ProcessNext(wait time.Duration) (received bool, err error) {
+
+	message, err := s.Queue.Receive(wait)
+	if err != nil || message == nil {
+		return false, err
+	}
+	log.Printf("Received message %v, delivery #%v", message.Id, message.Deliveries)
+
+	// a message that failed was nacked straight away, so the delivery
+	// policy's backoff is waited out by whoever gets it next
+	if !message.NackedAt.IsZero() {
+		retryAt := message.NackedAt.Add(s.DeliveryPolicy.Backoff(message.Deliveries - 1))
+		if wait := time.Until(retryAt); wait > 0 {
+			log.Printf("Message %v failed recently, not retrying until %v", message.Id, retryAt)
+			<-time.After(wait)
+		}
+	}
+
+	jobMessage := JobMessage{}
+	if err := json.Unmarshal(message.Body, &jobMessage); err != nil {
+		return true, s.deadLetter(message, fmt.Errorf("Invalid job message: %v", err))
+	}
+	if jobMessage.SourceImage == "" || jobMessage.StyleImage == "" {
+		return true, s.deadLetter(message, fmt.Errorf("Job message needs a source_image and a style_image"))
+	}
+
+	jobDoc, err := s.submit(message, jobMessage)
+	if err != nil {
+		return true, s.redeliver(message, err)
+	}
+
+	if err := s.run(jobDoc); err != nil {
+		if isNotFound(err) {
+			log.Printf("Job %v was deleted, dropping message %v", jobDoc.Id, message.Id)
+			return true, s.ack(message)
+		}
+		return true, s.redeliver(message, err)
+	}
+
+	switch {
+	case jobDoc.IsProcessingSuccessful():
+		log.Printf("Job %v succeeded, acking message %v", jobDoc.Id, message.Id)
+		return true, s.ack(message)
+	case jobDoc.State == StateCancelled:
+		log.Printf("Job %v was cancelled, dropping message %v", jobDoc.Id, message.Id)
+		return true, s.ack(message)
+	default:
+		return true, s.deadLetter(message, fmt.Errorf("Job %v is %v: %v", jobDoc.Id, jobDoc.State, jobDoc.ErrorMessage))
+	}
+
+}
+
+// submit adds the job to the database the way the app does: doc first,
+// then the images, then marks it ready.  If the message was delivered
+// before, the job it created is returned instead, finishing it off if
+// it's still missing images.
+func (s *QueueJobSource) submit(message *QueueMessage, jobMessage JobMessage) (*JobDocument, error) {
+
+	jobId := jobMessage.JobId
+	if jobId == "" {
+		jobId = "queue_" + message.Id
+	}
+
+	jobDoc, err := NewJobDocument(jobId, s.config())
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	if err != nil {
+		body := map[string]interface{}{
+			"type":       Job,
+			"state":      StateNotReadyToProcess,
+			"created_at": time.Now().UTC().Format(time.RFC3339),
+		}
+		if jobMessage.Owner != "" {
+			body["owner"] = jobMessage.Owner
+		}
+		if jobMessage.Parameters != nil {
+			body["parameters"] = jobMessage.Parameters
+		}
+		// another worker may have got a copy of the message, eg after a
+		// nack whose ack failed
+		if _, _, err := s.Database.InsertWith(body, jobId); err != nil && !isConflict(err) {
+			return nil, err
+		}
+		if jobDoc, err = NewJobDocument(jobId, s.config()); err != nil {
+			return nil, err
+		}
+	}
+	if jobDoc.State != StateNotReadyToProcess {
+		log.Printf("Message %v is job %v, which is already %v", message.Id, jobId, jobDoc.State)
+		return jobDoc, nil
+	}
+
+	images := map[string]string{
+		SourceImageAttachment: jobMessage.SourceImage,
+		StyleImageAttachment:  jobMessage.StyleImage,
+	}
+	for attachmentName, image := range images {
+		imagePath := filepath.Join(s.TempDir, fmt.Sprintf("%v_%v_download", jobId, attachmentName))
+		err := s.download(image, imagePath)
+		if err == nil {
+			err = jobDoc.AddAttachment(attachmentName, imagePath)
+		}
+		os.Remove(imagePath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to attach %v: %v", image, err)
+		}
+	}
+
+	if _, err := jobDoc.UpdateState(StateReadyToProcess); err != nil {
+		return nil, err
+	}
+	log.Printf("Message %v is job %v", message.Id, jobId)
+	return jobDoc, nil
+
+}
+
+// download fetches an image, given as a url or a blob key
+func (s *QueueJobSource) download(image, destFilename string) error {
+
+	imageUrl := image
+	if !strings.Contains(image, "://") {
+		if s.BlobURL == "" {
+			return fmt.Errorf("No blob url to download %v from", image)
+		}
+		segments := strings.Split(strings.TrimPrefix(image, "/"), "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		imageUrl = strings.TrimSuffix(s.BlobURL, "/") + "/" + strings.Join(segments, "/")
+	}
+
+	client := &http.Client{Timeout: DefaultImageDownloadTimeout}
+	resp, err := client.Get(imageUrl)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status code in response: %v", resp.StatusCode)
+	}
+
+	written, err := writeToFile(resp.Body, destFilename)
+	s.config().metrics().AddCounter(MetricAttachmentBytes, Labels{"direction": "download"}, float64(written))
+	return err
+
+}
+
+// run executes the job until it's finished, waiting out the backoff
+// between attempts.  A job claimed by another worker is left to it, and
+// waited for.
+func (s *QueueJobSource) run(jobDoc *JobDocument) error {
+
+	for {
+
+		switch {
+		case jobDoc.IsFinished() || jobDoc.State == StateCancelled:
+			return nil
+		case jobDoc.IsCancelRequested() && jobDoc.WorkerId == "":
+			if _, err := jobDoc.MarkCancelled(s.WorkerId); err != nil {
+				return err
+			}
+		case jobDoc.IsReadyToProcess():
+			if until, backingOff := jobDoc.IsBackingOff(); backingOff {
+				log.Printf("Retrying job %v at %v", jobDoc.Id, until)
+				<-time.After(time.Until(until))
+			} else if err := executeDeepStyleJob(s.config(), *jobDoc); err != nil {
+				log.Printf("Job %v failed: %v", jobDoc.Id, err)
+			}
+		default:
+			<-time.After(s.PollInterval)
+		}
+
+		if err := jobDoc.RefreshFromDB(); err != nil {
+			return err
+		}
+
+	}
+
+}
+
+func (s *QueueJobSource) ack(message *QueueMessage) error {
+	s.config().metrics().AddCounter(MetricQueueMessages, Labels{"outcome": MessageOutcomeAcked}, 1)
+	return s.Queue.Ack(message)
+}
+
+// redeliver nacks the message, or dead-letters it if it's been delivered
+// too often.  The backoff is waited out when it's received again.
+func (s *QueueJobSource) redeliver(message *QueueMessage, reason error) error {
+
+	if s.DeliveryPolicy.IsExhausted(message.Deliveries) {
+		return s.deadLetter(message, reason)
+	}
+
+	log.Printf("Message %v failed, redelivering it: %v", message.Id, reason)
+
+	s.config().metrics().AddCounter(MetricQueueMessages, Labels{"outcome": MessageOutcomeRedelivered}, 1)
+	return s.Queue.Nack(message, reason, false)
+
+}
+
+func (s *QueueJobSource) deadLetter(message *QueueMessage, reason error) error {
+	log.Printf("Dead-lettering message %v: %v", message.Id, reason)
+	s.config().metrics().AddCounter(MetricQueueMessages, Labels{"outcome": MessageOutcomeDeadLettered}, 1)
+	return s.Queue.Nack(message, reason, true)
+}
+
+func (s *QueueJobSource) config() configuration {
+	return configuration{
+		Database:         s.Database,
+		TempDir:          s.TempDir,
+		Executor:         s.Executor,
+		ExecutorName:     s.ExecutorName,
+		WorkerId:         s.WorkerId,
+		LeaseDuration:    s.LeaseDuration,
+		RetryPolicy:      s.RetryPolicy,
+		ProgressInterval: s.ProgressInterval,
+		SnapshotInterval: s.SnapshotInterval,
+		Events:           s.Events,
+		Metrics:          s.Metrics,
+	}
+}
@@ -0,0 +1,193 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tleyden/deepstyle/deepstylelib/fakeredis"
+	"github.com/tleyden/deepstyle/deepstylelib/fakesyncgw"
+)
+
+// newTestQueueJobSource returns a source reading the jobs stream on the
+// fake redis, running jobs on the fake Sync Gateway with executor
+func newTestQueueJobSource(t *testing.T, syncGw *fakesyncgw.Server, redis *fakeredis.Server, executor Executor, dir string) *QueueJobSource {
+	source, err := NewQueueJobSource(NewRedisStreamQueue(redis.Addr, "jobs", "workers", "worker1"), syncGw.DBURL())
+	assert.NoError(t, err)
+	source.Executor = executor
+	source.TempDir = dir
+	source.PollInterval = 10 * time.Millisecond
+	source.RetryPolicy = RetryPolicy{MaxAttempts: 1}
+	source.DeliveryPolicy = RetryPolicy{MaxAttempts: 2, InitialBackoff: 10 * time.Millisecond}
+	return source
+}
+
+// newTestImageServer serves solid png images at any path under /images
+func newTestImageServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/images/") {
+			http.NotFound(w, r)
+			return
+		}
+		image := bytes.Buffer{}
+		assert.NoError(t, png.Encode(&image, solidImage(4, 4, color.RGBA{R: 200, A: 0xff})))
+		w.Write(image.Bytes())
+	}))
+}
+
+// processQueue runs jobs until the queue is empty
+func processQueue(t *testing.T, source *QueueJobSource) {
+	for {
+		received, err := source.ProcessNext(10 * time.Millisecond)
+		assert.NoError(t, err)
+		if !received {
+			return
+		}
+	}
+}
+
+func TestQueueJobSource(t *testing.T) {
+
+	syncGw := fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+	redis := fakeredis.NewServer()
+	defer redis.Close()
+	images := newTestImageServer(t)
+	defer images.Close()
+
+	dir, err := ioutil.TempDir("", "deepstyle_queue")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	source := newTestQueueJobSource(t, syncGw, redis, FakeExecutor{}, dir)
+	defer source.Queue.Close()
+	source.BlobURL = images.URL + "/images"
+
+	// one image by key and one by url, one job with no job id, and three
+	// messages that can't be run
+	redis.Add("jobs", map[string]string{redisJobField: fmt.Sprintf(`{"job_id": "cat", "owner": "alice", "source_image": "uploads/cat.png", "style_image": "%v/images/starry_night.png", "parameters": {"output_format": "png"}}`, images.URL)})
+	anonymousId := redis.Add("jobs", map[string]string{redisJobField: `{"source_image": "dog.png", "style_image": "starry_night.png"}`})
+	redis.Add("jobs", map[string]string{redisJobField: `{"job_id": "fox"`})
+	redis.Add("jobs", map[string]string{redisJobField: `{"job_id": "fox", "source_image": "fox.png"}`})
+	redis.Add("jobs", map[string]string{redisJobField: fmt.Sprintf(`{"job_id": "owl", "source_image": "%v/missing.png", "style_image": "starry_night.png"}`, images.URL)})
+
+	processQueue(t, source)
+
+	for _, jobId := range []string{"cat", "queue_" + anonymousId} {
+		assert.Equal(t, StateProcessingSuccessful, syncGw.Doc(jobId)["state"])
+		assert.NotEqual(t, 0, len(syncGw.Attachment(jobId, ResultImageAttachment)))
+	}
+	assert.Equal(t, "alice", syncGw.Doc("cat")["owner"])
+	assert.Equal(t, []string{}, redis.Pending("jobs", "workers"))
+
+	// the missing image was tried twice before giving up
+	dead := redis.Entries("jobs:dead")
+	assert.Equal(t, 3, len(dead))
+	assert.True(t, strings.Contains(dead[0].Fields[redisErrorField], "Invalid job message"))
+	assert.True(t, strings.Contains(dead[1].Fields[redisErrorField], "style_image"))
+	assert.True(t, strings.Contains(dead[2].Fields[redisErrorField], "404"))
+	assert.Equal(t, "2", dead[2].Fields[redisDeliveriesField])
+	assert.Equal(t, StateNotReadyToProcess, syncGw.Doc("owl")["state"])
+
+	// a message delivered again after its job succeeded is just acked
+	redis.Add("jobs", map[string]string{redisJobField: `{"job_id": "cat", "source_image": "cat.png", "style_image": "starry_night.png"}`})
+	processQueue(t, source)
+	assert.Equal(t, float64(1), syncGw.Doc("cat")["attempts"])
+	assert.Equal(t, []string{}, redis.Pending("jobs", "workers"))
+	assert.Equal(t, 3, len(redis.Entries("jobs:dead")))
+
+}
+
+func TestQueueJobSourceFailedJobs(t *testing.T) {
+
+	syncGw := fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+	redis := fakeredis.NewServer()
+	defer redis.Close()
+	images := newTestImageServer(t)
+	defer images.Close()
+
+	dir, err := ioutil.TempDir("", "deepstyle_queue")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	executor, err := NewExecutor(ExecutorCommand, ExecutorConfig{Command: "sh", Args: []string{"-c", "echo out of memory; exit 3"}})
+	assert.NoError(t, err)
+	source := newTestQueueJobSource(t, syncGw, redis, executor, dir)
+	defer source.Queue.Close()
+	source.BlobURL = images.URL + "/images"
+
+	redis.Add("jobs", map[string]string{redisJobField: `{"job_id": "cat", "source_image": "cat.png", "style_image": "starry_night.png"}`})
+	processQueue(t, source)
+
+	// the job has the log, the dead letter says why
+	cat := syncGw.Doc("cat")
+	assert.Equal(t, StateProcessingAbandoned, cat["state"])
+	assert.True(t, strings.Contains(cat["std_out_and_err"].(string), "out of memory"))
+	dead := redis.Entries("jobs:dead")
+	assert.Equal(t, 1, len(dead))
+	assert.True(t, strings.Contains(dead[0].Fields[redisErrorField], StateProcessingAbandoned))
+	assert.Equal(t, []string{}, redis.Pending("jobs", "workers"))
+
+}
+
+// unreachableStore is a store that can't be reached once its jobs have been
+// submitted, failing with an error that has the doc's url in it
+type unreachableStore struct {
+	JobStore
+}
+
+func (s unreachableStore) Retrieve(id string, doc interface{}) error {
+	jobDoc := JobDocument{}
+	if err := s.JobStore.Retrieve(id, &jobDoc); err != nil {
+		return err
+	}
+	if jobDoc.State != StateNotReadyToProcess {
+		return fmt.Errorf(`Get "http://localhost:4984/deepstyle/%v": dial tcp 127.0.0.1:4984: connect: connection refused`, id)
+	}
+	return s.JobStore.Retrieve(id, doc)
+}
+
+func TestQueueJobSourceUnreachableStore(t *testing.T) {
+
+	syncGw := fakesyncgw.NewServer("deepstyle")
+	defer syncGw.Close()
+	redis := fakeredis.NewServer()
+	defer redis.Close()
+	images := newTestImageServer(t)
+	defer images.Close()
+
+	dir, err := ioutil.TempDir("", "deepstyle_queue")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	source := newTestQueueJobSource(t, syncGw, redis, FakeExecutor{}, dir)
+	defer source.Queue.Close()
+	source.BlobURL = images.URL + "/images"
+	source.Database = unreachableStore{source.Database}
+
+	// the 404 in the id doesn't make the failure look like a deleted job,
+	// so the message is redelivered and then dead-lettered, not acked
+	redis.Add("jobs", map[string]string{redisJobField: `{"job_id": "queue_1697571234404-0", "source_image": "cat.png", "style_image": "starry_night.png"}`})
+	processQueue(t, source)
+
+	dead := redis.Entries("jobs:dead")
+	if assert.Equal(t, 1, len(dead)) {
+		assert.True(t, strings.Contains(dead[0].Fields[redisErrorField], "connection refused"))
+		assert.Equal(t, "2", dead[0].Fields[redisDeliveriesField])
+	}
+	assert.Equal(t, []string{}, redis.Pending("jobs", "workers"))
+
+	assert.False(t, isNotFound(fmt.Errorf(`Get "http://localhost:4984/deepstyle/queue_1697571234404-0": EOF`)))
+	assert.True(t, isNotFound(newStatusError(http.StatusNotFound, "Unable to retrieve queue_1697571234404-0")))
+
+}
@@ -0,0 +1,473 @@
+package deepstylelib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRedisTimeout   = 10 * time.Second
+	DefaultRedisClaimIdle = 2 * DefaultLeaseDuration
+)
+
+// Fields of the stream entries a RedisStreamQueue reads and writes.  Other
+// services only need to XADD a job field.
+const (
+	redisJobField        = "job"        // the message body, a JobMessage
+	redisMessageIdField  = "message_id" // the id of the original entry, on redeliveries and dead letters
+	redisDeliveriesField = "deliveries" // how many times the message was delivered before
+	redisNackedAtField   = "nacked_at"  // when the message was nacked, on redeliveries
+	redisErrorField      = "error"      // why the message was dead-lettered
+)
+
+// RedisStreamQueue is a MessageQueue on a Redis stream, read by a consumer
+// group (created if needed) so each message goes to one worker.  Entries
+// are acked with XACK.  A nacked message is added to the end of the
+// stream again, or to the dead letter stream, before the original is
+// acked.  Entries a worker received but never acked, eg because it died,
+// are delivered to it again when it reconnects, so each worker in the
+// group needs a stable consumer name.  A worker that never comes back has
+// its entries claimed with XAUTOCLAIM by the others once they've been
+// pending for ClaimIdle; since that's longer than the job lease, a job
+// still running there is just waited for.
+type RedisStreamQueue struct {
+	Addr             string        // host:port
+	Password         string        // For AUTH, if set
+	Stream           string        // The stream jobs are published to
+	Group            string        // The consumer group the workers share
+	Consumer         string        // This worker's name in the group
+	DeadLetterStream string        // Where messages that can't be run go
+	Timeout          time.Duration // For connecting and each command, on top of how long reads block
+	ClaimIdle        time.Duration // How long other consumers' entries stay pending before this one takes them over
+
+	mutex        sync.Mutex
+	conn         net.Conn
+	reader       *bufio.Reader
+	recovering   bool   // still redelivering entries left pending by the last connection
+	pendingAfter string // the last pending entry redelivered
+	claimCursor  string // where the next XAUTOCLAIM carries on from
+}
+
+// redisError is an error reply from the server, eg "BUSYGROUP Consumer
+// Group name already exists"
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// streamEntry is an entry read from a stream.  The fields are nil if the
+// entry was deleted while it was pending.
+type streamEntry struct {
+	id     string
+	fields map[string]string
+}
+
+func NewRedisStreamQueue(addr, stream, group, consumer string) *RedisStreamQueue {
+	return &RedisStreamQueue{
+		Addr:             addr,
+		Stream:           stream,
+		Group:            group,
+		Consumer:         consumer,
+		DeadLetterStream: stream + ":dead",
+		Timeout:          DefaultRedisTimeout,
+		ClaimIdle:        DefaultRedisClaimIdle,
+	}
+}
+
+// Receive reads the next entry for this consumer, starting with any left
+// pending by a previous connection, then any abandoned by other consumers
+func (q *RedisStreamQueue) Receive(wait time.Duration) (*QueueMessage, error) {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if err := q.connect(); err != nil {
+		return nil, err
+	}
+
+	for q.recovering {
+		reply, err := q.do(0, "XREADGROUP", "GROUP", q.Group, q.Consumer, "COUNT", "1", "STREAMS", q.Stream, q.pendingAfter)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := streamEntries(reply)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			q.recovering = false
+			break
+		}
+		entry := entries[0]
+		q.pendingAfter = entry.id
+		if entry.fields == nil {
+			if _, err := q.do(0, "XACK", q.Stream, q.Group, entry.id); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// it was delivered at least once already, to the connection that
+		// left it pending
+		message := entry.message()
+		message.Deliveries += 1
+		return message, nil
+	}
+
+	if message, err := q.claimAbandoned(); err != nil || message != nil {
+		return message, err
+	}
+
+	args := []string{"XREADGROUP", "GROUP", q.Group, q.Consumer, "COUNT", "1"}
+	if wait > 0 {
+		args = append(args, "BLOCK", strconv.FormatInt(int64(wait/time.Millisecond)+1, 10))
+	}
+	args = append(args, "STREAMS", q.Stream, ">")
+	reply, err := q.do(wait, args...)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := streamEntries(reply)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return entries[0].message(), nil
+
+}
+
+// claimAbandoned takes over the next entry another consumer has left
+// pending for ClaimIdle, returning nil if there isn't one.  Each call
+// carries on scanning the pending entries where the last one stopped.
+func (q *RedisStreamQueue) claimAbandoned() (*QueueMessage, error) {
+
+	minIdle := strconv.FormatInt(int64(q.claimIdle()/time.Millisecond), 10)
+	reply, err := q.do(0, "XAUTOCLAIM", q.Stream, q.Group, q.Consumer, minIdle, q.claimCursor, "COUNT", "1")
+	if err != nil {
+		return nil, err
+	}
+	cursor, entries, err := claimedEntries(reply)
+	if err != nil {
+		return nil, err
+	}
+	q.claimCursor = cursor
+
+	for _, entry := range entries {
+		if entry.fields == nil {
+			if _, err := q.do(0, "XACK", q.Stream, q.Group, entry.id); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// the consumer that abandoned it had it delivered too
+		message := entry.message()
+		message.Deliveries += 1
+		return message, nil
+	}
+	return nil, nil
+
+}
+
+func (q *RedisStreamQueue) Ack(message *QueueMessage) error {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if err := q.connect(); err != nil {
+		return err
+	}
+	_, err := q.do(0, "XACK", q.Stream, q.Group, message.receipt)
+	return err
+
+}
+
+// Nack adds the message to the end of the stream, or to the dead letter
+// stream, then acks the original.  If the ack fails the message is
+// delivered twice, so jobs must be idempotent, which QueueJobSource's are.
+func (q *RedisStreamQueue) Nack(message *QueueMessage, reason error, deadLetter bool) error {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if err := q.connect(); err != nil {
+		return err
+	}
+
+	stream := q.Stream
+	args := []string{
+		redisJobField, string(message.Body),
+		redisMessageIdField, message.Id,
+		redisDeliveriesField, strconv.Itoa(message.Deliveries),
+	}
+	if deadLetter {
+		stream = q.DeadLetterStream
+		if reason != nil {
+			args = append(args, redisErrorField, reason.Error())
+		}
+	} else {
+		args = append(args, redisNackedAtField, time.Now().UTC().Format(time.RFC3339Nano))
+	}
+	if _, err := q.do(0, append([]string{"XADD", stream, "*"}, args...)...); err != nil {
+		return err
+	}
+	_, err := q.do(0, "XACK", q.Stream, q.Group, message.receipt)
+	return err
+
+}
+
+func (q *RedisStreamQueue) Close() error {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.conn == nil {
+		return nil
+	}
+	err := q.conn.Close()
+	q.conn = nil
+	return err
+
+}
+
+// connect connects if not connected, and makes sure the consumer group
+// exists.  A new group starts at the beginning of the stream, so jobs
+// published before the first worker started aren't missed.
+func (q *RedisStreamQueue) connect() error {
+
+	if q.conn != nil {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("tcp", q.Addr, q.timeout())
+	if err != nil {
+		return fmt.Errorf("Unable to connect to redis at %v: %v", q.Addr, err)
+	}
+	q.conn = conn
+	q.reader = bufio.NewReader(conn)
+
+	if q.Password != "" {
+		if _, err := q.do(0, "AUTH", q.Password); err != nil {
+			q.disconnect()
+			return err
+		}
+	}
+	_, err = q.do(0, "XGROUP", "CREATE", q.Stream, q.Group, "0", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		q.disconnect()
+		return fmt.Errorf("Unable to create consumer group %v on %v: %v", q.Group, q.Stream, err)
+	}
+
+	q.recovering = true
+	q.pendingAfter = "0"
+	q.claimCursor = "0-0"
+	return nil
+
+}
+
+func (q *RedisStreamQueue) disconnect() {
+	if q.conn != nil {
+		q.conn.Close()
+		q.conn = nil
+	}
+}
+
+func (q *RedisStreamQueue) claimIdle() time.Duration {
+	if q.ClaimIdle <= 0 {
+		return DefaultRedisClaimIdle
+	}
+	return q.ClaimIdle
+}
+
+func (q *RedisStreamQueue) timeout() time.Duration {
+	if q.Timeout <= 0 {
+		return DefaultRedisTimeout
+	}
+	return q.Timeout
+}
+
+// do sends a command and reads the reply, waiting up to block on top of the
+// timeout.  Error replies are returned as a redisError, and anything else
+// that goes wrong drops the connection, to be reconnected next time.
+func (q *RedisStreamQueue) do(block time.Duration, args ...string) (interface{}, error) {
+
+	q.conn.SetDeadline(time.Now().Add(block + q.timeout()))
+
+	if err := writeRedisCommand(q.conn, args); err != nil {
+		q.disconnect()
+		return nil, err
+	}
+	reply, err := readRedisReply(q.reader)
+	if err != nil {
+		q.disconnect()
+		return nil, err
+	}
+	if replyErr, ok := reply.(redisError); ok {
+		return nil, replyErr
+	}
+	return reply, nil
+
+}
+
+// writeRedisCommand writes the command as a RESP array of bulk strings
+func writeRedisCommand(writer io.Writer, args []string) error {
+	command := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		command = append(command, fmt.Sprintf("$%d\r\n%v\r\n", len(arg), arg)...)
+	}
+	_, err := writer.Write(command)
+	return err
+}
+
+// readRedisReply reads a RESP reply: a string for simple and bulk strings,
+// int64, redisError, []interface{} for arrays, or nil
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("Invalid reply from redis: %q", line)
+	}
+	value := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return value, nil
+	case '-':
+		return redisError(value), nil
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(value)
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		bulk := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, bulk); err != nil {
+			return nil, err
+		}
+		return string(bulk[:length]), nil
+	case '*':
+		length, err := strconv.Atoi(value)
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, length)
+		for i := range items {
+			if items[i], err = readRedisReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("Invalid reply from redis: %q", line)
+	}
+
+}
+
+// streamEntries returns the entries of the first stream in an XREADGROUP
+// reply, which is nil if there weren't any
+func streamEntries(reply interface{}) ([]streamEntry, error) {
+
+	invalid := fmt.Errorf("Unexpected XREADGROUP reply: %v", reply)
+
+	if reply == nil {
+		return nil, nil
+	}
+	streams, ok := reply.([]interface{})
+	if !ok || len(streams) == 0 {
+		return nil, invalid
+	}
+	stream, ok := streams[0].([]interface{})
+	if !ok || len(stream) != 2 {
+		return nil, invalid
+	}
+	items, ok := stream[1].([]interface{})
+	if !ok {
+		return nil, invalid
+	}
+	return parseStreamEntries(items, invalid)
+
+}
+
+// claimedEntries returns the cursor and the entries of an XAUTOCLAIM reply.
+// Entries deleted while pending are left out: Redis 7 drops them itself,
+// and 6.2 returns them with no fields, which is left to the caller to ack.
+func claimedEntries(reply interface{}) (cursor string, entries []streamEntry, err error) {
+
+	invalid := fmt.Errorf("Unexpected XAUTOCLAIM reply: %v", reply)
+
+	items, ok := reply.([]interface{})
+	if !ok || len(items) < 2 {
+		return "", nil, invalid
+	}
+	if cursor, ok = items[0].(string); !ok {
+		return "", nil, invalid
+	}
+	claimed, ok := items[1].([]interface{})
+	if !ok {
+		return "", nil, invalid
+	}
+	entries, err = parseStreamEntries(claimed, invalid)
+	return cursor, entries, err
+
+}
+
+// parseStreamEntries parses entries as XREADGROUP and XAUTOCLAIM return
+// them, each its id then its fields and values, returning invalid if they
+// aren't
+func parseStreamEntries(items []interface{}, invalid error) ([]streamEntry, error) {
+
+	entries := []streamEntry{}
+	for _, item := range items {
+		pair, ok := item.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, invalid
+		}
+		entry := streamEntry{}
+		if entry.id, ok = pair[0].(string); !ok {
+			return nil, invalid
+		}
+		if pair[1] != nil {
+			fieldValues, ok := pair[1].([]interface{})
+			if !ok || len(fieldValues)%2 != 0 {
+				return nil, invalid
+			}
+			entry.fields = map[string]string{}
+			for i := 0; i < len(fieldValues); i += 2 {
+				field, _ := fieldValues[i].(string)
+				value, _ := fieldValues[i+1].(string)
+				entry.fields[field] = value
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+
+}
+
+// message turns a stream entry into a message.  Redeliveries carry the id
+// of the original entry, how often it's been delivered before, and when it
+// was nacked.
+func (entry streamEntry) message() *QueueMessage {
+
+	message := &QueueMessage{
+		Id:      entry.id,
+		Body:    []byte(entry.fields[redisJobField]),
+		receipt: entry.id,
+	}
+	if id := entry.fields[redisMessageIdField]; id != "" {
+		message.Id = id
+	}
+	deliveries, _ := strconv.Atoi(entry.fields[redisDeliveriesField])
+	message.Deliveries = deliveries + 1
+	message.NackedAt, _ = time.Parse(time.RFC3339Nano, entry.fields[redisNackedAtField])
+	return message
+
+}
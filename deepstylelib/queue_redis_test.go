@@ -0,0 +1,110 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tleyden/deepstyle/deepstylelib/fakeredis"
+)
+
+func TestRedisStreamQueue(t *testing.T) {
+
+	redis := fakeredis.NewServer()
+	defer redis.Close()
+
+	// published before any worker started
+	firstId := redis.Add("jobs", map[string]string{redisJobField: "first"})
+
+	queue := NewRedisStreamQueue(redis.Addr, "jobs", "workers", "worker1")
+	defer queue.Close()
+
+	message, err := queue.Receive(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, firstId, message.Id)
+	assert.Equal(t, "first", string(message.Body))
+	assert.Equal(t, 1, message.Deliveries)
+	assert.Equal(t, []string{firstId}, redis.Pending("jobs", "workers"))
+	assert.NoError(t, queue.Ack(message))
+	assert.Equal(t, []string{}, redis.Pending("jobs", "workers"))
+
+	// nothing left
+	message, err = queue.Receive(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, message == nil)
+
+	// a nacked message comes back with the same id, then is dead-lettered
+	secondId := redis.Add("jobs", map[string]string{redisJobField: "second"})
+	message, err = queue.Receive(time.Second)
+	assert.NoError(t, err)
+	assert.NoError(t, queue.Nack(message, fmt.Errorf("Unable to download"), false))
+	message, err = queue.Receive(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, secondId, message.Id)
+	assert.Equal(t, "second", string(message.Body))
+	assert.Equal(t, 2, message.Deliveries)
+	assert.True(t, time.Since(message.NackedAt) < time.Second)
+	assert.NoError(t, queue.Nack(message, fmt.Errorf("Unable to download"), true))
+	assert.Equal(t, []string{}, redis.Pending("jobs", "workers"))
+
+	dead := redis.Entries("jobs:dead")
+	assert.Equal(t, 1, len(dead))
+	assert.Equal(t, map[string]string{
+		redisJobField:        "second",
+		redisMessageIdField:  secondId,
+		redisDeliveriesField: "2",
+		redisErrorField:      "Unable to download",
+	}, dead[0].Fields)
+
+	// a message left pending when the connection dropped goes back to the
+	// same consumer, and to no one else
+	thirdId := redis.Add("jobs", map[string]string{redisJobField: "third"})
+	message, err = queue.Receive(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, thirdId, message.Id)
+	redis.DropConnections()
+
+	otherQueue := NewRedisStreamQueue(redis.Addr, "jobs", "workers", "worker2")
+	defer otherQueue.Close()
+	message, err = otherQueue.Receive(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, message == nil)
+
+	// the first call notices the connection is gone
+	message, err = queue.Receive(time.Second)
+	if err != nil {
+		message, err = queue.Receive(time.Second)
+	}
+	assert.NoError(t, err)
+	if assert.NotNil(t, message) {
+		assert.Equal(t, thirdId, message.Id)
+		assert.Equal(t, 2, message.Deliveries)
+		assert.NoError(t, queue.Ack(message))
+	}
+	assert.Equal(t, []string{}, redis.Pending("jobs", "workers"))
+
+	// a message left pending by a consumer that never comes back is
+	// claimed by another once it's been idle long enough
+	fourthId := redis.Add("jobs", map[string]string{redisJobField: "fourth"})
+	message, err = queue.Receive(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, fourthId, message.Id)
+	queue.Close()
+
+	otherQueue.ClaimIdle = 50 * time.Millisecond
+	message, err = otherQueue.Receive(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, message == nil)
+	<-time.After(otherQueue.ClaimIdle)
+	message, err = otherQueue.Receive(10 * time.Millisecond)
+	assert.NoError(t, err)
+	if assert.NotNil(t, message) {
+		assert.Equal(t, fourthId, message.Id)
+		assert.Equal(t, "fourth", string(message.Body))
+		assert.Equal(t, 2, message.Deliveries)
+		assert.NoError(t, otherQueue.Ack(message))
+	}
+	assert.Equal(t, []string{}, redis.Pending("jobs", "workers"))
+
+}
@@ -0,0 +1,142 @@
+package deepstylelib
+
+import (
+	"log"
+	"math"
+	"time"
+)
+
+// How long a job with the default parameters is assumed to take on the GPU,
+// until workers have recorded how long jobs actually take
+const DefaultEstimatedJobSeconds = 600.0
+
+// How soon the recommended number of workers should get through the backlog
+const DefaultTargetDrainTime = 30 * time.Minute
+
+// QueueMetricsConfig configures how the metrics publisher estimates the
+// backlog and how many workers it needs
+type QueueMetricsConfig struct {
+	Executor        string        // Backend the workers run, whose duration stats are used
+	TargetDrainTime time.Duration // How soon the recommended workers should finish the backlog
+	MaxWorkers      int           // Upper limit on the recommended workers, 0 for none
+}
+
+func DefaultQueueMetricsConfig() QueueMetricsConfig {
+	return QueueMetricsConfig{
+		Executor:        ExecutorNeuralStyle,
+		TargetDrainTime: DefaultTargetDrainTime,
+	}
+}
+
+// QueueStats describe the jobs that haven't been processed yet
+type QueueStats struct {
+	NumJobs            float64            // every unprocessed job
+	ByState            map[string]float64 // the number of jobs in each state
+	OldestJobAge       time.Duration      // how long the oldest job ready to process has waited
+	SecondsPerUnit     float64            // how long a job with the default parameters takes
+	BacklogSeconds     float64            // estimated GPU seconds to finish the ready and running jobs
+	RecommendedWorkers int                // workers needed to finish the backlog in the target drain time
+}
+
+// getQueueStats counts the unprocessed jobs by state, and looks at the
+// ready and running jobs to see how old they are and how much work is left
+// in them
+func getQueueStats(store JobStore, now time.Time, config QueueMetricsConfig) (stats QueueStats, err error) {
+
+	stats.ByState = map[string]float64{}
+
+	rows, err := store.JobsInStates(StateNotReadyToProcess, StateReadyToProcess, StateBeingProcessed)
+	if err != nil {
+		return stats, err
+	}
+
+	// How long jobs have been taking on this backend
+	stats.SecondsPerUnit = DefaultEstimatedJobSeconds
+	durationStats, err := DurationStatsStore{Database: store, DocId: DefaultDurationStatsDocId}.Load()
+	if err != nil {
+		log.Printf("Error loading duration stats, using the default estimate: %v", err)
+	} else if backendStats, ok := durationStats[config.Executor]; ok && backendStats.Jobs > 0 {
+		stats.SecondsPerUnit = backendStats.SecondsPerUnit
+	}
+
+	activeJobs := 0
+	for _, row := range rows {
+		stats.ByState[row.State] += 1
+		if row.State != StateReadyToProcess && row.State != StateBeingProcessed {
+			continue
+		}
+		activeJobs += 1
+
+		jobDoc := row.Job
+		jobDoc.State = row.State
+		stats.BacklogSeconds += estimatedSecondsLeft(jobDoc, stats.SecondsPerUnit, now)
+		if age, ok := jobAge(jobDoc, now); ok && jobDoc.IsReadyToProcess() && age > stats.OldestJobAge {
+			stats.OldestJobAge = age
+		}
+	}
+
+	stats.NumJobs = float64(len(rows))
+	stats.RecommendedWorkers = recommendedWorkers(stats.BacklogSeconds, activeJobs, config)
+	return stats, nil
+
+}
+
+// estimatedSecondsLeft is how much longer the job is expected to take.
+// Running jobs have done some of their work already: as much as their
+// progress says, or else as long as they've been running.
+func estimatedSecondsLeft(jobDoc JobDocument, secondsPerUnit float64, now time.Time) float64 {
+
+	params := jobDoc.RequestedParameters()
+	if jobDoc.EffectiveParameters != nil {
+		params = *jobDoc.EffectiveParameters
+	}
+	estimate := jobWorkUnits(params) * secondsPerUnit
+	if jobDoc.State != StateBeingProcessed {
+		return estimate
+	}
+
+	if progress := jobDoc.Progress; progress != nil && progress.TotalIterations > 0 {
+		done := float64(progress.Iteration) / float64(progress.TotalIterations)
+		return math.Max(estimate*(1-done), 0)
+	}
+	claimedAt, err := time.Parse(time.RFC3339, jobDoc.ClaimedAt)
+	if err != nil {
+		return estimate
+	}
+	return math.Max(estimate-now.Sub(claimedAt).Seconds(), 0)
+
+}
+
+// recommendedWorkers is how many workers would finish the backlog within
+// the target drain time.  There's no point in more workers than jobs, and
+// any job at all needs one.
+func recommendedWorkers(backlogSeconds float64, activeJobs int, config QueueMetricsConfig) int {
+
+	if activeJobs == 0 {
+		return 0
+	}
+	workers := activeJobs
+	if config.TargetDrainTime > 0 {
+		workers = int(math.Ceil(backlogSeconds / config.TargetDrainTime.Seconds()))
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > activeJobs {
+		workers = activeJobs
+	}
+	if config.MaxWorkers > 0 && workers > config.MaxWorkers {
+		workers = config.MaxWorkers
+	}
+	return workers
+
+}
+
+// jobAge is how long ago the job was created, if it has a valid created_at
+func jobAge(jobDoc JobDocument, now time.Time) (time.Duration, bool) {
+	createdAt, err := time.Parse(time.RFC3339, jobDoc.CreatedAt)
+	if err != nil {
+		return 0, false
+	}
+	return now.Sub(createdAt), true
+}
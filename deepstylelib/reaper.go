@@ -0,0 +1,205 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Jobs claimed by workers that predate leases have no lease_expires_at, so
+// for those we fall back to requeueing them once they were claimed (or, if
+// that wasn't recorded, created) this long ago.
+const LegacyStuckJobThreshold = 60 * time.Minute
+
+// ReaperConfig controls when the reaper gives up on a worker, and what
+// happens to its job afterwards.
+type ReaperConfig struct {
+	GracePeriod time.Duration // How long past lease expiry to wait
+	RetryPolicy RetryPolicy   // Decides between requeueing and abandoning
+	Events      *EventOutbox  // Webhooks for the transitions it makes, may be nil
+}
+
+func DefaultReaperConfig() ReaperConfig {
+	return ReaperConfig{
+		GracePeriod: DefaultLeaseGracePeriod,
+		RetryPolicy: DefaultRetryPolicy(),
+	}
+}
+
+// ReapStuckJobs requeues every job whose worker has stopped renewing its
+// lease for longer than the grace period (or abandons it if it's out of
+// attempts), cancels jobs whose worker died before it could act on a
+// cancel request, and releases failed jobs whose retry backoff has passed.
+func ReapStuckJobs(syncGwAdminUrl string, reaperConfig ReaperConfig) error {
+
+	db, err := OpenJobStore(syncGwAdminUrl)
+	if err != nil {
+		return fmt.Errorf("Error connecting to db: %v.  Err: %v", syncGwAdminUrl, err)
+	}
+	return ReapStuckJobsIn(db, reaperConfig)
+
+}
+
+// ReapStuckJobsIn is ReapStuckJobs for any job store
+func ReapStuckJobsIn(store JobStore, reaperConfig ReaperConfig) error {
+
+	jobs, err := getJobDocsBeingProcessed(store)
+	if err != nil {
+		log.Printf("Error getting jobs being processed: %v", err)
+		return err
+	}
+
+	if err := reapStuckJobs(jobs, reaperConfig); err != nil {
+		return err
+	}
+
+	cancelRequestedJobs, err := getJobDocsInState(store, StateCancelRequested)
+	if err != nil {
+		log.Printf("Error getting jobs with a cancel request: %v", err)
+		return err
+	}
+	reapCancelRequestedJobs(cancelRequestedJobs, reaperConfig)
+
+	readyJobs, err := getJobDocsInState(store, StateReadyToProcess)
+	if err != nil {
+		log.Printf("Error getting jobs ready to process: %v", err)
+		return err
+	}
+
+	return releaseDueRetries(readyJobs)
+
+}
+
+func reapStuckJobs(jobs []JobDocument, reaperConfig ReaperConfig) error {
+
+	gracePeriod := reaperConfig.GracePeriod
+
+	for _, job := range jobs {
+
+		job.config.Events = reaperConfig.Events
+
+		expiry, hasLease := job.LeaseExpiry()
+		if !hasLease {
+			resetStuckLegacyJob(job)
+			continue
+		}
+
+		if time.Now().Before(expiry.Add(gracePeriod)) {
+			log.Printf("Job %v is being processed by %v, lease expires at %v", job.Id, job.WorkerId, expiry)
+			continue
+		}
+
+		released, err := job.ReleaseExpiredLease(gracePeriod, reaperConfig.RetryPolicy)
+		if err != nil {
+			log.Printf("Unable to release lease for job: %v.  Error: %v", job.Id, err)
+			continue
+		}
+		if !released {
+			log.Printf("Job %v was renewed or finished before it could be reaped", job.Id)
+		}
+
+	}
+
+	return nil
+}
+
+// reapCancelRequestedJobs cancels the jobs whose worker stopped renewing
+// its lease before it cancelled them.  Jobs nobody holds are left to the
+// changes feed followers, which cancel them as soon as they see them.
+func reapCancelRequestedJobs(jobs []JobDocument, reaperConfig ReaperConfig) {
+
+	for _, job := range jobs {
+
+		job.config.Events = reaperConfig.Events
+
+		expiry, hasLease := job.LeaseExpiry()
+		if job.WorkerId == "" || !hasLease {
+			continue
+		}
+		if time.Now().Before(expiry.Add(reaperConfig.GracePeriod)) {
+			log.Printf("Job %v is being cancelled by %v, lease expires at %v", job.Id, job.WorkerId, expiry)
+			continue
+		}
+
+		cancelled, err := job.CancelExpiredLease(reaperConfig.GracePeriod)
+		if err != nil {
+			log.Printf("Unable to cancel job: %v.  Error: %v", job.Id, err)
+			continue
+		}
+		if !cancelled {
+			log.Printf("Job %v was renewed or cancelled before it could be reaped", job.Id)
+		}
+
+	}
+
+}
+
+// releaseDueRetries touches failed jobs whose backoff is over, so that they
+// show up on the changes feed again.
+func releaseDueRetries(jobs []JobDocument) error {
+
+	for _, job := range jobs {
+
+		if job.NotBefore == "" {
+			continue
+		}
+		if until, backingOff := job.IsBackingOff(); backingOff {
+			log.Printf("Job %v is backing off until %v", job.Id, until)
+			continue
+		}
+
+		if _, err := job.ReleaseDueRetry(); err != nil {
+			log.Printf("Unable to release job %v for retry.  Error: %v", job.Id, err)
+		}
+
+	}
+	return nil
+
+}
+
+// resetStuckLegacyJob requeues a job claimed without a lease once it has
+// been processing for longer than LegacyStuckJobThreshold, going by when the
+// doc says it was claimed or created.
+func resetStuckLegacyJob(job JobDocument) {
+
+	isStuck := func() bool {
+		if job.State != StateBeingProcessed {
+			return false
+		}
+		if _, hasLease := job.LeaseExpiry(); hasLease {
+			return false
+		}
+		since, ok := job.legacyProcessingSince()
+		if !ok {
+			log.Printf("Job %v is being processed without a lease and has no claimed_at or created_at, leaving it alone", job.Id)
+			return false
+		}
+		if duration := time.Since(since); duration < LegacyStuckJobThreshold {
+			log.Printf("Job %v has been processing for %v minutes", job.Id, duration.Minutes())
+			return false
+		}
+		return true
+	}
+
+	resetUpdater := func() {
+		log.Printf("Job %v has been stuck for over %v.  Resetting state to %v", job.Id, LegacyStuckJobThreshold, StateReadyToProcess)
+		job.State = StateReadyToProcess
+		job.clearClaim()
+	}
+
+	if _, err := job.editIf(isStuck, resetUpdater); err != nil {
+		log.Printf("Unable to update job state for job: %v.  Error: %v", job.Id, err)
+	}
+
+}
+
+// legacyProcessingSince is the job's claimed_at, or its created_at for jobs
+// claimed by workers that didn't record when.
+func (doc JobDocument) legacyProcessingSince() (time.Time, bool) {
+	for _, timestamp := range []string{doc.ClaimedAt, doc.CreatedAt} {
+		if parsed, err := time.Parse(time.RFC3339, timestamp); err == nil {
+			return parsed, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,230 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"time"
+)
+
+const (
+	DefaultMaxAttempts     = 3
+	DefaultRetryBackoff    = 1 * time.Minute
+	DefaultMaxRetryBackoff = 30 * time.Minute
+)
+
+// Attempt outcomes, in addition to the job states an attempt can end in
+const (
+	AttemptOutcomeLeaseExpired = "LEASE_EXPIRED" // worker died or hung
+)
+
+// Exit status recorded when there was no process exit status, eg the
+// attachments couldn't be downloaded.
+const noExitStatus = -1
+
+// RetryPolicy decides how often a failing job is retried, and how long to
+// wait between attempts.
+type RetryPolicy struct {
+	MaxAttempts    int           // 0 means retry forever
+	InitialBackoff time.Duration // Wait before the second attempt
+	MaxBackoff     time.Duration // The backoff doubles each attempt up to this
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    DefaultMaxAttempts,
+		InitialBackoff: DefaultRetryBackoff,
+		MaxBackoff:     DefaultMaxRetryBackoff,
+	}
+}
+
+// IsExhausted returns true if a job that has made this many attempts
+// shouldn't be retried again.
+func (p RetryPolicy) IsExhausted(attempts int) bool {
+	return p.MaxAttempts > 0 && attempts >= p.MaxAttempts
+}
+
+// Backoff returns how long to wait after the given number of attempts
+func (p RetryPolicy) Backoff(attempts int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	return backoff
+}
+
+// JobAttempt is the history entry for one claim of a job by a worker
+type JobAttempt struct {
+	Attempt      int    `json:"attempt"`
+	WorkerId     string `json:"worker_id"`
+	StartedAt    string `json:"started_at"`
+	FinishedAt   string `json:"finished_at,omitempty"`
+	Outcome      string `json:"outcome,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+	ExitStatus   *int   `json:"exit_status,omitempty"`
+}
+
+// AttemptResult is what a worker reports back at the end of an attempt
+type AttemptResult struct {
+	Err          error  // nil if the attempt succeeded
+	Retryable    bool   // false for errors that will never go away, eg bad parameters
+	ExitStatus   int    // exit status of the executor process, if any
+	StdOutAndErr string // executor output
+}
+
+// IsBackingOff returns true if the job failed recently and shouldn't be
+// retried until the returned time.
+func (doc JobDocument) IsBackingOff() (until time.Time, backingOff bool) {
+	if doc.NotBefore == "" {
+		return time.Time{}, false
+	}
+	until, err := time.Parse(time.RFC3339, doc.NotBefore)
+	if err != nil {
+		log.Printf("Job %v has invalid not_before: %v", doc.Id, doc.NotBefore)
+		return time.Time{}, false
+	}
+	return until, time.Now().Before(until)
+}
+
+// CompleteAttempt records the result of the attempt held by workerId.  A
+// successful attempt finishes the job.  A failed one is either retried
+// later, abandoned if it has run out of attempts, or failed outright if the
+// error isn't retryable.  A timed out one is PROCESSING_TIMED_OUT if a
+// partial result was kept, otherwise failed.  Returns false if the job is no longer held by
+// workerId, eg because its lease expired and it was reaped.
+func (doc *JobDocument) CompleteAttempt(workerId string, result AttemptResult, retryPolicy RetryPolicy) (updated bool, err error) {
+
+	isHeldByWorker := func() bool {
+		return doc.State == StateBeingProcessed && doc.WorkerId == workerId
+	}
+
+	completeUpdater := func() {
+
+		if result.StdOutAndErr != "" {
+			doc.StdOutAndErr = result.StdOutAndErr
+		}
+
+		timeoutErr, timedOut := result.Err.(*TimeoutError)
+
+		switch {
+		case result.Err == nil:
+			doc.finishAttempt(StateProcessingSuccessful, nil, result.ExitStatus)
+			doc.State = StateProcessingSuccessful
+		case timedOut:
+			// it would only time out again, so never retry
+			doc.finishAttempt(AttemptOutcomeTimedOut, result.Err, result.ExitStatus)
+			doc.ErrorMessage = result.Err.Error()
+			doc.Timeout = &JobTimeout{
+				LimitSeconds:           int(timeoutErr.Limit.Seconds()),
+				PartialResultIteration: timeoutErr.PartialResultIteration,
+			}
+			doc.State = StateProcessingFailed
+			if timeoutErr.PartialResultIteration > 0 {
+				doc.State = StateProcessingTimedOut
+			}
+		case !result.Retryable:
+			doc.finishAttempt(StateProcessingFailed, result.Err, result.ExitStatus)
+			doc.ErrorMessage = result.Err.Error()
+			doc.State = StateProcessingFailed
+		default:
+			doc.finishAttempt(StateProcessingFailed, result.Err, result.ExitStatus)
+			doc.ErrorMessage = result.Err.Error()
+			doc.retryOrAbandon(retryPolicy)
+		}
+
+	}
+
+	return doc.editIf(isHeldByWorker, completeUpdater)
+
+}
+
+// ReleaseDueRetry clears not_before once the backoff has passed.  The edit
+// puts the job back on the changes feed, so workers see it again.
+func (doc *JobDocument) ReleaseDueRetry() (released bool, err error) {
+
+	isDue := func() bool {
+		_, backingOff := doc.IsBackingOff()
+		return doc.IsReadyToProcess() && doc.NotBefore != "" && !backingOff
+	}
+
+	releaseUpdater := func() {
+		log.Printf("Backoff for job %v is over, releasing it for retry", doc.Id)
+		doc.NotBefore = ""
+	}
+
+	return doc.editIf(isDue, releaseUpdater)
+
+}
+
+// startAttempt adds a new entry to the attempt history
+func (doc *JobDocument) startAttempt(workerId string) {
+	doc.Attempts += 1
+	doc.AttemptHistory = append(doc.AttemptHistory, JobAttempt{
+		Attempt:   doc.Attempts,
+		WorkerId:  workerId,
+		StartedAt: time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// finishAttempt fills in the outcome of the latest attempt
+func (doc *JobDocument) finishAttempt(outcome string, attemptErr error, exitStatus int) {
+
+	if len(doc.AttemptHistory) == 0 {
+		// claimed by a worker that predates attempt tracking
+		doc.startAttempt(doc.WorkerId)
+	}
+
+	attempt := &doc.AttemptHistory[len(doc.AttemptHistory)-1]
+	attempt.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	attempt.Outcome = outcome
+	if attemptErr != nil {
+		attempt.ErrorMessage = attemptErr.Error()
+	}
+	if exitStatus != noExitStatus {
+		attempt.ExitStatus = &exitStatus
+	}
+
+}
+
+// retryOrAbandon puts a job whose attempt failed back in the queue after a
+// backoff, or abandons it if it has run out of attempts.
+func (doc *JobDocument) retryOrAbandon(retryPolicy RetryPolicy) {
+
+	doc.clearClaim()
+
+	if retryPolicy.IsExhausted(doc.Attempts) {
+		log.Printf("Job %v failed %v times, abandoning it", doc.Id, doc.Attempts)
+		doc.State = StateProcessingAbandoned
+		doc.NotBefore = ""
+		doc.ErrorMessage = fmt.Sprintf("Gave up after %v attempts.  Last error: %v", doc.Attempts, doc.lastAttemptError())
+		return
+	}
+
+	backoff := retryPolicy.Backoff(doc.Attempts)
+	log.Printf("Job %v failed attempt %v, retrying in %v", doc.Id, doc.Attempts, backoff)
+	doc.State = StateReadyToProcess
+	doc.NotBefore = time.Now().Add(backoff).UTC().Format(time.RFC3339)
+
+}
+
+func (doc JobDocument) lastAttemptError() string {
+	if len(doc.AttemptHistory) == 0 {
+		return doc.ErrorMessage
+	}
+	return doc.AttemptHistory[len(doc.AttemptHistory)-1].ErrorMessage
+}
+
+// exitStatus returns the exit status of the process that caused err, 0 if
+// err is nil, or noExitStatus if the error didn't come from a process.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return noExitStatus
+}
@@ -0,0 +1,102 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/tleyden/go-couch"
+)
+
+// JobStore is where jobs are kept: their documents and revisions, their
+// attachments, a feed of changes to them, and queries by state.
+// SyncGatewayStore keeps them in Sync Gateway, FileStore in a local
+// directory so a single box can run without a Couchbase stack.
+//
+// Updates are MVCC: a doc must carry the _rev it was read at, and saving
+// on top of a stale revision fails with an error that isConflict
+// recognizes.
+type JobStore interface {
+
+	// Retrieve reads the current revision of the doc into doc
+	Retrieve(id string, doc interface{}) error
+
+	// InsertWith creates the doc with the given id
+	InsertWith(doc interface{}, id string) (newId, newRev string, err error)
+
+	// Edit saves doc, which must have its _id and _rev, as a new revision
+	Edit(doc interface{}) (newRev string, err error)
+
+	// EditRetry applies retryUpdater and saves the doc, refreshing it and
+	// trying again on failure, until retryDoneMetric says there is nothing
+	// left to do.  Returns true if it saved the doc.
+	EditRetry(doc interface{}, retryUpdater func(), retryDoneMetric func() bool, retryRefresh func() error) (updated bool, err error)
+
+	// RetrieveAttachment reads an attachment of the current revision
+	RetrieveAttachment(docId, name string) (io.Reader, error)
+
+	// PutAttachment adds or replaces an attachment, on top of the given
+	// revision of the doc
+	PutAttachment(docId, rev, name, contentType string, content io.Reader, size int64) error
+
+	// AttachmentURL is where the attachment can be downloaded from, without
+	// any credentials the worker connects with
+	AttachmentURL(docId, name string) string
+
+	// Changes calls handler with each batch of changes, in the JSON form of
+	// the CouchDB changes feed, for as long as handler returns the since
+	// value to continue from
+	Changes(handler couch.ChangeHandler, options map[string]interface{})
+
+	// LastSequence is the sequence of the most recent change
+	LastSequence() (string, error)
+
+	// RetrieveLocal reads a local doc (one that is neither replicated nor
+	// on the changes feed), returning false if it doesn't exist yet
+	RetrieveLocal(id string, doc interface{}) (found bool, err error)
+
+	// SaveLocal saves a local doc, on top of the _rev it was read at if any
+	SaveLocal(id string, doc interface{}) error
+
+	// JobsInStates lists the jobs in any of the given states, which must be
+	// unprocessed states (NOT_READY_TO_PROCESS, READY_TO_PROCESS,
+	// BEING_PROCESSED or CANCEL_REQUESTED) for stores that only index those
+	JobsInStates(states ...string) ([]JobRow, error)
+}
+
+// JobRow is a job found by JobsInStates.  Job has at least the fields the
+// queue stats need (state, created_at, claimed_at, parameters,
+// effective_parameters and progress), which the view emits as its value so
+// they don't have to be retrieved job by job.
+type JobRow struct {
+	Id    string
+	State string
+	Job   JobDocument
+}
+
+// editRetry is EditRetry for stores that only have Edit, with the same
+// behaviour as go-couch
+func editRetry(edit func(doc interface{}) (string, error), doc interface{}, retryUpdater func(), retryDoneMetric func() bool, retryRefresh func() error) (updated bool, err error) {
+
+	for i := 1; i <= 10; i++ {
+
+		if retryDoneMetric() {
+			return false, nil
+		}
+		retryUpdater()
+
+		_, err := edit(doc)
+		if err == nil {
+			return true, nil
+		}
+		if !isConflict(err) {
+			return false, err
+		}
+		if err := retryRefresh(); err != nil {
+			return false, err
+		}
+
+	}
+
+	return false, fmt.Errorf("Tried to update doc 10 times, giving up")
+
+}
@@ -0,0 +1,361 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// CouchDBStore keeps jobs in an Apache CouchDB 2.x or 3.x database, eg the
+// one a PouchDB client syncs with.  It differs from Sync Gateway in a few
+// ways:
+//
+//   - sequences are opaque strings, to be passed back verbatim
+//   - views are plain javascript (see DesignDocs), and are brought up to
+//     date when queried (stale=false isn't accepted)
+//   - docs may not contain special members it doesn't know, or a null
+//     _attachments or empty _rev
+//   - replication can leave a doc with conflicting revisions.  They're
+//     resolved before the doc is next edited: the revision furthest along
+//     in the job lifecycle is kept and the others are deleted, so a job
+//     that finished on one node isn't run again because of another.
+//
+// Attachments, _local docs and the changes feed work as they do against
+// Sync Gateway.
+type CouchDBStore struct {
+	SyncGatewayStore
+}
+
+func (s CouchDBStore) Retrieve(id string, doc interface{}) error {
+
+	body, err := s.retrieveBody(id, url.Values{})
+	if err != nil {
+		return err
+	}
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bodyBytes, doc)
+
+}
+
+// retrieveBody reads the doc with the given query params, eg a rev
+func (s CouchDBStore) retrieveBody(id string, params url.Values) (map[string]interface{}, error) {
+
+	docUrl := s.docUrl(id)
+	if len(params) > 0 {
+		docUrl += "?" + params.Encode()
+	}
+	req, err := http.NewRequest("GET", docUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, newStatusError(resp.StatusCode, "Unable to retrieve %v.  Unexpected status code in response: %v", id, resp.StatusCode)
+	}
+
+	body := map[string]interface{}{}
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	err = decoder.Decode(&body)
+	return body, err
+
+}
+
+// resolveConflicts settles any replication conflicts on the doc.  If one of
+// the losing revisions is further along in the job lifecycle than the
+// winner, it's saved on top of the winner, attachments and all.  Then the
+// losing revisions are deleted.
+func (s CouchDBStore) resolveConflicts(id string) error {
+
+	winner, err := s.retrieveBody(id, url.Values{"conflicts": {"true"}})
+	if err != nil {
+		return err
+	}
+	conflicts, _ := winner["_conflicts"].([]interface{})
+	if len(conflicts) == 0 {
+		return nil
+	}
+	delete(winner, "_conflicts")
+
+	best := winner
+	losers := []string{}
+	for _, conflict := range conflicts {
+		rev, _ := conflict.(string)
+		loser, err := s.retrieveBody(id, url.Values{"rev": {rev}, "attachments": {"true"}})
+		if err != nil {
+			return err
+		}
+		losers = append(losers, rev)
+		if isFurtherAlong(loser, best) {
+			best = loser
+		}
+	}
+
+	if best["_rev"] != winner["_rev"] {
+		log.Printf("Doc %v has conflicting revision %v further along than %v, keeping it", id, best["_rev"], winner["_rev"])
+		best["_rev"] = winner["_rev"]
+		if _, err := s.putDoc(id, best); err != nil {
+			return err
+		}
+	}
+	s.deleteLosingRevisions(id, losers)
+	return nil
+
+}
+
+// isFurtherAlong returns true if the job in body is further along its
+// lifecycle than the one in than: in a later state, with any finished state
+// the furthest, or in the same state after more attempts.  Docs that aren't
+// jobs are never further along.
+func isFurtherAlong(body, than map[string]interface{}) bool {
+
+	rank := func(body map[string]interface{}) (stateRank int, attempts int64) {
+		state, _ := body["state"].(string)
+		switch {
+		case body["type"] != Job:
+			return 0, 0
+		case JobDocument{State: state}.IsFinished() || state == StateCancelled:
+			stateRank = 5
+		case state == StateCancelRequested:
+			stateRank = 4
+		case state == StateBeingProcessed:
+			stateRank = 3
+		case state == StateReadyToProcess:
+			stateRank = 2
+		case state == StateNotReadyToProcess:
+			stateRank = 1
+		}
+		if number, ok := body["attempts"].(json.Number); ok {
+			attempts, _ = number.Int64()
+		}
+		return stateRank, attempts
+	}
+
+	stateRank, attempts := rank(body)
+	thanStateRank, thanAttempts := rank(than)
+	if stateRank != thanStateRank {
+		return stateRank > thanStateRank
+	}
+	return attempts > thanAttempts
+
+}
+
+// deleteLosingRevisions removes the revisions that lost a replication
+// conflict.  Failing to is only logged, the next edit tries again.
+func (s CouchDBStore) deleteLosingRevisions(id string, revisions []string) {
+
+	for _, rev := range revisions {
+		log.Printf("Doc %v has conflicting revision %v, deleting it", id, rev)
+		req, err := http.NewRequest("DELETE", s.docUrl(id)+"?"+url.Values{"rev": {rev}}.Encode(), nil)
+		if err != nil {
+			log.Printf("Unable to delete conflicting revision %v of %v: %v", rev, id, err)
+			continue
+		}
+		resp, err := doRequest(req)
+		if err != nil {
+			log.Printf("Unable to delete conflicting revision %v of %v: %v", rev, id, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			log.Printf("Unable to delete conflicting revision %v of %v.  Unexpected status code in response: %v", rev, id, resp.StatusCode)
+		}
+	}
+
+}
+
+func (s CouchDBStore) InsertWith(doc interface{}, id string) (newId, newRev string, err error) {
+	body, err := couchDBDocBody(doc)
+	if err != nil {
+		return "", "", err
+	}
+	newRev, err = s.putDoc(id, body)
+	return id, newRev, err
+}
+
+// Edit resolves any replication conflicts on the doc first.  If that saves
+// a losing revision on top of the one the doc was read at, the edit fails
+// with a conflict, so the caller re-reads it and applies its update to that.
+func (s CouchDBStore) Edit(doc interface{}) (newRev string, err error) {
+	body, err := couchDBDocBody(doc)
+	if err != nil {
+		return "", err
+	}
+	id, _ := body["_id"].(string)
+	if err := s.resolveConflicts(id); err != nil {
+		return "", err
+	}
+	return s.putDoc(id, body)
+}
+
+func (s CouchDBStore) EditRetry(doc interface{}, retryUpdater func(), retryDoneMetric func() bool, retryRefresh func() error) (updated bool, err error) {
+	return editRetry(s.Edit, doc, retryUpdater, retryDoneMetric, retryRefresh)
+}
+
+// putDoc saves the body as the next revision of the doc.  A stale _rev
+// fails with a 409 statusError.
+func (s CouchDBStore) putDoc(id string, body map[string]interface{}) (newRev string, err error) {
+
+	docBytes, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("PUT", s.docUrl(id), bytes.NewReader(docBytes))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := doRequest(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		reason, _ := readCouchDBError(resp.Body)
+		return "", newStatusError(resp.StatusCode, "Unable to save %v.  Unexpected status code in response: %v %v", id, resp.StatusCode, reason)
+	}
+
+	saved := struct {
+		Rev string `json:"rev"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&saved)
+	return saved.Rev, err
+
+}
+
+// LastSequence returns the update_seq of the database, which is an opaque
+// string on CouchDB 2.x and later
+func (s CouchDBStore) LastSequence() (string, error) {
+
+	req, err := http.NewRequest("GET", s.DBURL(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := doRequest(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("Unable to get database info.  Unexpected status code in response: %v", resp.StatusCode)
+	}
+
+	dbInfo := struct {
+		UpdateSequence interface{} `json:"update_seq"`
+	}{}
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&dbInfo); err != nil {
+		return "", err
+	}
+	return sequenceString(dbInfo.UpdateSequence), nil
+
+}
+
+// JobsInStates queries the unprocessed_jobs view, installing or updating
+// it first if this process hasn't yet, or it's missing.  CouchDB builds the
+// view as part of the query, so there's no stale=false.
+func (s CouchDBStore) JobsInStates(states ...string) ([]JobRow, error) {
+
+	jobs := []JobRow{}
+
+	var viewResults unprocessedJobsResults
+	err := NewDesignDocManager(s.DBURL(), FlavorCouchDB).queryView(func() error {
+		var err error
+		viewResults, err = s.queryView()
+		return err
+	})
+	if err != nil {
+		return jobs, err
+	}
+
+	wanted := map[string]bool{}
+	for _, state := range states {
+		wanted[state] = true
+	}
+	for _, row := range viewResults.Rows {
+		if wanted[row.Key] {
+			jobs = append(jobs, JobRow{Id: row.Id, State: row.Key, Job: row.Value})
+		}
+	}
+	return jobs, nil
+
+}
+
+// unprocessedJobsResults is the result of querying the unprocessed_jobs view
+type unprocessedJobsResults struct {
+	Rows []struct {
+		Id    string      `json:"id"`
+		Key   string      `json:"key"`
+		Value JobDocument `json:"value"`
+	} `json:"rows"`
+}
+
+func (s CouchDBStore) queryView() (viewResults unprocessedJobsResults, err error) {
+
+	viewUrl := fmt.Sprintf("%v/_design/%v/_view/%v", s.DBURL(), DesignDocName, ViewName)
+	req, err := http.NewRequest("GET", viewUrl, nil)
+	if err != nil {
+		return viewResults, err
+	}
+	resp, err := doRequest(req)
+	if err != nil {
+		return viewResults, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return viewResults, newStatusError(resp.StatusCode, "Unable to query view %v.  Unexpected status code in response: %v", ViewName, resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&viewResults)
+	return viewResults, err
+
+}
+
+func (s CouchDBStore) docUrl(id string) string {
+	return fmt.Sprintf("%v/%v", s.DBURL(), url.PathEscape(id))
+}
+
+// couchDBDocBody turns a doc into its JSON fields, leaving out what CouchDB
+// would reject: a null _attachments (JobDocument has one until the first
+// attachment is added) and an empty _rev
+func couchDBDocBody(doc interface{}) (map[string]interface{}, error) {
+	body, err := toDocBody(doc)
+	if err != nil {
+		return nil, err
+	}
+	if attachments, ok := body["_attachments"]; ok && attachments == nil {
+		delete(body, "_attachments")
+	}
+	if rev, ok := body["_rev"]; ok && rev == "" {
+		delete(body, "_rev")
+	}
+	return body, nil
+}
+
+// readCouchDBError returns the reason from a CouchDB error response
+func readCouchDBError(body io.Reader) (string, error) {
+	couchError := struct {
+		Error  string `json:"error"`
+		Reason string `json:"reason"`
+	}{}
+	if err := json.NewDecoder(body).Decode(&couchError); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v: %v", couchError.Error, couchError.Reason), nil
+}
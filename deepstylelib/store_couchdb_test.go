@@ -0,0 +1,140 @@
+package deepstylelib
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tleyden/deepstyle/deepstylelib/fakesyncgw"
+)
+
+func TestCouchDBStore(t *testing.T) {
+
+	couchDB := fakesyncgw.NewCouchDBServer("deepstyle")
+	defer couchDB.Close()
+	couchDB.DefineView(DesignDocName, ViewName, unprocessedJobsView)
+
+	dir, err := ioutil.TempDir("", "deepstyle_couchdb")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	follower := newTestFollower(t, couchDB, FakeExecutor{}, dir)
+	follower.Database = CouchDBStore{SyncGatewayStore: follower.Database.(SyncGatewayStore)}
+	go follower.Follow()
+
+	newTestJob(t, follower.Database, "job1", nil)
+	waitForState(t, couchDB, "job1", StateProcessingSuccessful)
+	assert.NotEqual(t, 0, len(couchDB.Attachment("job1", ResultImageAttachment)))
+
+	// sequences are opaque strings, checkpointed as they are
+	lastSequence, err := follower.Database.LastSequence()
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(lastSequence, "-"))
+	waitForCheckpoint(t, follower.Checkpoint, lastSequence)
+
+	// the view is installed in CouchDB's javascript, and queried without
+	// stale=false
+	newTestJob(t, follower.Database, "job2", nil)
+	waitForState(t, couchDB, "job2", StateProcessingSuccessful)
+	_, _, err = follower.Database.InsertWith(map[string]interface{}{"type": Job, "state": StateNotReadyToProcess}, "job3")
+	assert.NoError(t, err)
+	stats, err := getQueueStats(follower.Database, time.Now(), DefaultQueueMetricsConfig())
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), stats.NumJobs)
+	views := couchDB.DesignDoc(DesignDocName)["views"].(map[string]interface{})
+	viewMap := views[ViewName].(map[string]interface{})["map"].(string)
+	assert.True(t, strings.HasPrefix(viewMap, "function (doc) {"))
+	assert.False(t, strings.Contains(viewMap, "meta"))
+
+}
+
+func TestCouchDBStoreConflicts(t *testing.T) {
+
+	couchDB := fakesyncgw.NewCouchDBServer("deepstyle")
+	defer couchDB.Close()
+
+	db, err := GetDbConnection(couchDB.DBURL())
+	assert.NoError(t, err)
+	store := CouchDBStore{SyncGatewayStore: db}
+
+	// a JobDocument with no attachments or rev yet is still accepted
+	newJob := JobDocument{State: StateReadyToProcess}
+	newJob.Type = Job
+	_, _, err = store.InsertWith(newJob, "job1")
+	assert.NoError(t, err)
+	couchDB.AddConflict("job1", map[string]interface{}{"type": Job, "state": StateNotReadyToProcess})
+	assert.Equal(t, 1, len(couchDB.Conflicts("job1")))
+
+	// reading the doc gets the winner and leaves the loser alone
+	jobDoc := JobDocument{}
+	assert.NoError(t, store.Retrieve("job1", &jobDoc))
+	assert.Equal(t, StateReadyToProcess, jobDoc.State)
+	assert.Equal(t, 1, len(couchDB.Conflicts("job1")))
+
+	// editing it deletes the loser, which is behind the winner
+	jobDoc.State = StateBeingProcessed
+	_, err = store.Edit(jobDoc)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(couchDB.Conflicts("job1")))
+
+	// a loser that got further, eg finished on another node, is kept, and
+	// an edit of the old winner has to start over from it
+	assert.NoError(t, store.Retrieve("job1", &jobDoc))
+	couchDB.AddConflict("job1", map[string]interface{}{"type": Job, "state": StateProcessingSuccessful, "attempts": 1})
+	jobDoc.LeaseExpiresAt = "2030-01-01T00:00:00Z"
+	_, err = store.Edit(jobDoc)
+	assert.True(t, isConflict(err))
+	assert.Equal(t, 0, len(couchDB.Conflicts("job1")))
+	assert.NoError(t, store.Retrieve("job1", &jobDoc))
+	assert.Equal(t, StateProcessingSuccessful, jobDoc.State)
+	assert.Equal(t, 1, jobDoc.Attempts)
+
+	// an update on top of the old revision is a conflict
+	jobDoc.OwnerEmail = "owner@example.com"
+	_, err = store.Edit(jobDoc)
+	assert.NoError(t, err)
+	jobDoc.OwnerEmail = ""
+	_, err = store.Edit(jobDoc)
+	assert.True(t, isConflict(err))
+
+	err = store.Retrieve("missing", &jobDoc)
+	assert.True(t, isNotFound(err))
+
+}
+
+func TestCouchDBStoreEnsuresDesignDocsOnce(t *testing.T) {
+
+	couchDB := fakesyncgw.NewCouchDBServer("deepstyle")
+	defer couchDB.Close()
+	couchDB.DefineView(DesignDocName, ViewName, unprocessedJobsView)
+
+	db, err := GetDbConnection(couchDB.DBURL())
+	assert.NoError(t, err)
+	store := CouchDBStore{SyncGatewayStore: db}
+	_, _, err = store.InsertWith(map[string]interface{}{"type": Job, "state": StateReadyToProcess}, "job1")
+	assert.NoError(t, err)
+
+	rows, err := store.JobsInStates(StateReadyToProcess)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(rows))
+
+	// later queries don't look at the design doc again
+	designDocPath := "_design/" + DesignDocName
+	couchDB.FailRequests("GET", designDocPath, 500, 1)
+	rows, err = store.JobsInStates(StateReadyToProcess)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(rows))
+
+	_, err = NewDesignDocManager(couchDB.DBURL(), FlavorCouchDB).EnsureDesignDocs()
+	assert.Error(t, err)
+
+	// unless the view has gone missing, when it's installed again
+	couchDB.FailRequests("GET", designDocPath+"/_view/"+ViewName, 404, 1)
+	rows, err = store.JobsInStates(StateReadyToProcess)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(rows))
+
+}
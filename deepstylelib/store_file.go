@@ -0,0 +1,808 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tleyden/go-couch"
+)
+
+// How long a longpoll on the FileStore changes feed waits for a change
+// before returning an empty batch
+const fileStoreLongpollTimeout = time.Minute
+
+// FileStore keeps jobs in a local directory, for running on a single box
+// without Sync Gateway.  Only one process may use the directory at a time.
+//
+//	docs/<id>.json             the current revision of each doc
+//	attachments/<id>/<name>    the attachments of each doc
+//	staged/<id>/<name>         attachments being added, until the index has them
+//	local/<id>.json            local docs, eg checkpoints
+//	index.json                 revisions, sequences, states and attachment
+//	                           metadata of every doc
+//
+// Revisions and the changes feed work like CouchDB, except that only the
+// current revision of a doc is kept, and deleted docs are dropped without a
+// tombstone.  Docs are written (and removed) before the index, so after a
+// crash a doc can be ahead of the index, and OpenFileStore catches the
+// index up.
+type FileStore struct {
+	Dir string
+
+	// Where AttachmentURL points, eg the job API of deepstyle serve.  If
+	// it's empty attachments have no url.
+	AttachmentBaseURL string
+
+	mutex   sync.Mutex
+	index   fileStoreIndex
+	changed chan struct{} // closed and replaced on every change
+	closed  chan struct{}
+	once    sync.Once
+}
+
+type fileStoreIndex struct {
+	LastSequence int64                      `json:"last_seq"`
+	Docs         map[string]*fileStoreEntry `json:"docs"`
+}
+
+type fileStoreEntry struct {
+	Revision    string                         `json:"rev"`
+	Sequence    int64                          `json:"seq"`
+	Type        string                         `json:"type,omitempty"`
+	State       string                         `json:"state,omitempty"`
+	Attachments map[string]fileStoreAttachment `json:"attachments,omitempty"`
+}
+
+// fileStoreAttachment is also the attachment stub in the doc
+type fileStoreAttachment struct {
+	ContentType string `json:"content_type"`
+	Digest      string `json:"digest"` // md5, as CouchDB does
+	Length      int64  `json:"length"`
+	RevPos      int    `json:"revpos"`
+	Stub        bool   `json:"stub"`
+}
+
+// fileStoreChange is a row of the changes feed, as CouchDB sends it
+type fileStoreChange struct {
+	Sequence int64               `json:"seq"`
+	Id       string              `json:"id"`
+	Changes  []map[string]string `json:"changes"`
+}
+
+// OpenFileStore opens the store in dir, creating it if needed
+func OpenFileStore(dir string) (*FileStore, error) {
+
+	for _, subdir := range []string{"docs", "attachments", "staged", "local"} {
+		if err := os.MkdirAll(filepath.Join(dir, subdir), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &FileStore{
+		Dir:     dir,
+		index:   fileStoreIndex{Docs: map[string]*fileStoreEntry{}},
+		changed: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+
+	indexBytes, err := ioutil.ReadFile(s.indexPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(indexBytes, &s.index); err != nil {
+			return nil, fmt.Errorf("Invalid index %v: %v", s.indexPath(), err)
+		}
+	}
+	if s.index.Docs == nil {
+		s.index.Docs = map[string]*fileStoreEntry{}
+	}
+
+	if err := s.recoverDocs(); err != nil {
+		return nil, err
+	}
+	if err := s.recoverAttachments(); err != nil {
+		return nil, err
+	}
+	return s, nil
+
+}
+
+// recoverDocs catches the index up with docs that were written or deleted
+// just before a crash.  Written ones get new sequences so they're on the
+// changes feed.
+func (s *FileStore) recoverDocs() error {
+
+	docFiles, err := filepath.Glob(filepath.Join(s.Dir, "docs", "*.json"))
+	if err != nil {
+		return err
+	}
+
+	recovered := false
+	onDisk := map[string]bool{}
+	for _, docFile := range docFiles {
+
+		docBytes, err := ioutil.ReadFile(docFile)
+		if err != nil {
+			return err
+		}
+		doc := struct {
+			Id          string                         `json:"_id"`
+			Revision    string                         `json:"_rev"`
+			Type        string                         `json:"type"`
+			State       string                         `json:"state"`
+			Attachments map[string]fileStoreAttachment `json:"_attachments"`
+		}{}
+		if err := json.Unmarshal(docBytes, &doc); err != nil {
+			return fmt.Errorf("Invalid doc %v: %v", docFile, err)
+		}
+		onDisk[doc.Id] = true
+
+		if entry, ok := s.index.Docs[doc.Id]; ok && entry.Revision == doc.Revision {
+			continue
+		}
+		log.Printf("Recovering %v at revision %v, which the index is missing", doc.Id, doc.Revision)
+		s.index.LastSequence += 1
+		s.index.Docs[doc.Id] = &fileStoreEntry{
+			Revision:    doc.Revision,
+			Sequence:    s.index.LastSequence,
+			Type:        doc.Type,
+			State:       doc.State,
+			Attachments: doc.Attachments,
+		}
+		recovered = true
+	}
+
+	for id := range s.index.Docs {
+		if onDisk[id] {
+			continue
+		}
+		log.Printf("Recovering deletion of %v", id)
+		if err := os.RemoveAll(s.attachmentDir(id)); err != nil {
+			return err
+		}
+		delete(s.index.Docs, id)
+		recovered = true
+	}
+
+	if !recovered {
+		return nil
+	}
+	return s.saveIndex()
+
+}
+
+// recoverAttachments moves staged attachments that made it into the index
+// into place, and removes the ones that didn't
+func (s *FileStore) recoverAttachments() error {
+
+	stagedFiles, err := filepath.Glob(filepath.Join(s.Dir, "staged", "*", "*"))
+	if err != nil {
+		return err
+	}
+
+	for _, stagedFile := range stagedFiles {
+
+		docId, err := url.PathUnescape(filepath.Base(filepath.Dir(stagedFile)))
+		if err != nil {
+			return err
+		}
+		name, err := url.PathUnescape(filepath.Base(stagedFile))
+		if err != nil {
+			return err
+		}
+
+		attachment, ok := fileStoreAttachment{}, false
+		if entry, found := s.index.Docs[docId]; found {
+			attachment, ok = entry.Attachments[name]
+		}
+		if ok {
+			digest, err := fileDigest(stagedFile)
+			if err != nil {
+				return err
+			}
+			ok = digest == attachment.Digest
+		}
+
+		if !ok {
+			if err := os.Remove(stagedFile); err != nil {
+				return err
+			}
+			continue
+		}
+		log.Printf("Recovering attachment %v of %v", name, docId)
+		if err := os.MkdirAll(filepath.Dir(s.attachmentPath(docId, name)), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(stagedFile, s.attachmentPath(docId, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+
+}
+
+// fileDigest is the md5 of the file, as it's kept in attachment stubs
+func fileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := md5.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return "md5-" + base64.StdEncoding.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Close stops any changes feeds
+func (s *FileStore) Close() {
+	s.once.Do(func() { close(s.closed) })
+}
+
+func (s *FileStore) Retrieve(id string, doc interface{}) error {
+
+	s.mutex.Lock()
+	_, ok := s.index.Docs[id]
+	s.mutex.Unlock()
+	if !ok {
+		return newStatusError(http.StatusNotFound, "404 not_found: %v", id)
+	}
+
+	docBytes, err := ioutil.ReadFile(s.docPath(id))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(docBytes, doc)
+
+}
+
+func (s *FileStore) InsertWith(doc interface{}, id string) (newId, newRev string, err error) {
+
+	body, err := toDocBody(doc)
+	if err != nil {
+		return "", "", err
+	}
+	rev, _ := body["_rev"].(string)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	newRev, err = s.save(id, body, rev, nil)
+	return id, newRev, err
+
+}
+
+func (s *FileStore) Edit(doc interface{}) (newRev string, err error) {
+
+	body, err := toDocBody(doc)
+	if err != nil {
+		return "", err
+	}
+	id, _ := body["_id"].(string)
+	rev, _ := body["_rev"].(string)
+	if rev == "" {
+		return "", fmt.Errorf("Can't edit %v without a _rev", id)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.save(id, body, rev, nil)
+
+}
+
+func (s *FileStore) EditRetry(doc interface{}, retryUpdater func(), retryDoneMetric func() bool, retryRefresh func() error) (updated bool, err error) {
+	return editRetry(s.Edit, doc, retryUpdater, retryDoneMetric, retryRefresh)
+}
+
+// save writes body as the next revision of the doc, if rev is its current
+// revision ("" for a new doc).  The _attachments of body are ignored, the
+// doc gets stubs for attachments, or for the ones in the index if that's
+// nil.  Caller must hold the lock.
+func (s *FileStore) save(id string, body map[string]interface{}, rev string, attachments map[string]fileStoreAttachment) (newRev string, err error) {
+
+	if !validDocId(id) {
+		return "", fmt.Errorf("Invalid doc id: %q", id)
+	}
+
+	entry, exists := s.index.Docs[id]
+	currentRev := ""
+	if exists {
+		currentRev = entry.Revision
+	}
+	if rev != currentRev {
+		return "", newStatusError(http.StatusConflict, "409 conflict: %v is at revision %q, not %q", id, currentRev, rev)
+	}
+	if !exists {
+		entry = &fileStoreEntry{}
+	}
+	if attachments == nil {
+		attachments = entry.Attachments
+	}
+
+	delete(body, "_id")
+	delete(body, "_rev")
+	delete(body, "_attachments")
+	newRev, err = nextRevision(currentRev, body)
+	if err != nil {
+		return "", err
+	}
+
+	body["_id"] = id
+	body["_rev"] = newRev
+	if len(attachments) > 0 {
+		body["_attachments"] = attachments
+	}
+	docBytes, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileAtomically(s.docPath(id), docBytes); err != nil {
+		return "", err
+	}
+
+	// the index follows the doc, on disk once saveIndex succeeds or else
+	// when the store is next opened
+	entry.Revision = newRev
+	entry.Attachments = attachments
+	entry.Type, _ = body["type"].(string)
+	entry.State, _ = body["state"].(string)
+	s.index.LastSequence += 1
+	entry.Sequence = s.index.LastSequence
+	s.index.Docs[id] = entry
+	if err := s.saveIndex(); err != nil {
+		return "", err
+	}
+
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return newRev, nil
+
+}
+
+// Delete removes the doc and its attachments, if rev is its current
+// revision
+func (s *FileStore) Delete(id, rev string) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.index.Docs[id]
+	if !ok {
+		return newStatusError(http.StatusNotFound, "404 not_found: %v", id)
+	}
+	if entry.Revision != rev {
+		return newStatusError(http.StatusConflict, "409 conflict: %v is at revision %q, not %q", id, entry.Revision, rev)
+	}
+
+	if err := os.Remove(s.docPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(s.index.Docs, id)
+	if err := s.saveIndex(); err != nil {
+		return err
+	}
+	return os.RemoveAll(s.attachmentDir(id))
+
+}
+
+// RetrieveAttachment reads the whole attachment, so there's no file left
+// open for the caller to close
+func (s *FileStore) RetrieveAttachment(docId, name string) (io.Reader, error) {
+
+	s.mutex.Lock()
+	entry, ok := s.index.Docs[docId]
+	if ok {
+		_, ok = entry.Attachments[name]
+	}
+	s.mutex.Unlock()
+	if !ok {
+		return nil, newStatusError(http.StatusNotFound, "404 not_found: %v/%v", docId, name)
+	}
+
+	content, err := ioutil.ReadFile(s.attachmentPath(docId, name))
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(content), nil
+
+}
+
+// PutAttachment copies the content to a temp file first, so that a slow
+// upload doesn't hold up everything else.  If rev is still the current
+// revision it's staged, the doc and index are saved with its stub, and only
+// then is it moved into place.
+func (s *FileStore) PutAttachment(docId, rev, name, contentType string, content io.Reader, size int64) error {
+
+	if name == "" || strings.HasPrefix(name, "_") {
+		return fmt.Errorf("Invalid attachment name: %q", name)
+	}
+
+	for _, path := range []string{s.attachmentPath(docId, name), s.stagedAttachmentPath(docId, name)} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(s.stagedAttachmentPath(docId, name)), ".upload")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+
+	hasher := md5.New()
+	length, err := io.Copy(io.MultiWriter(tmpFile, hasher), content)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if size >= 0 && length != size {
+		return fmt.Errorf("Attachment %v of %v is %v bytes, expected %v", name, docId, length, size)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.index.Docs[docId]
+	if !ok {
+		return newStatusError(http.StatusNotFound, "404 not_found: %v", docId)
+	}
+	if entry.Revision != rev {
+		return newStatusError(http.StatusConflict, "409 conflict: %v is at revision %q, not %q", docId, entry.Revision, rev)
+	}
+
+	body := map[string]interface{}{}
+	docBytes, err := ioutil.ReadFile(s.docPath(docId))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(docBytes, &body); err != nil {
+		return err
+	}
+
+	attachments := map[string]fileStoreAttachment{}
+	for existingName, attachment := range entry.Attachments {
+		attachments[existingName] = attachment
+	}
+	attachments[name] = fileStoreAttachment{
+		ContentType: contentType,
+		Digest:      "md5-" + base64.StdEncoding.EncodeToString(hasher.Sum(nil)),
+		Length:      length,
+		RevPos:      revisionGeneration(rev) + 1,
+		Stub:        true,
+	}
+
+	// if saving fails, or we die before the last rename, OpenFileStore
+	// moves the staged file into place if the doc made it to disk, and
+	// removes it if not
+	stagedPath := s.stagedAttachmentPath(docId, name)
+	if err := os.Rename(tmpPath, stagedPath); err != nil {
+		return err
+	}
+	if _, err := s.save(docId, body, rev, attachments); err != nil {
+		return err
+	}
+	return os.Rename(stagedPath, s.attachmentPath(docId, name))
+
+}
+
+func (s *FileStore) AttachmentURL(docId, name string) string {
+	if s.AttachmentBaseURL == "" {
+		return ""
+	}
+	return fmt.Sprintf("%v/%v/%v", strings.TrimSuffix(s.AttachmentBaseURL, "/"), url.PathEscape(docId), url.PathEscape(name))
+}
+
+func (s *FileStore) LastSequence() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return strconv.FormatInt(s.index.LastSequence, 10), nil
+}
+
+// Changes sends handler the changes since options["since"], like the
+// CouchDB changes feed: each doc once, at its latest sequence.  With
+// feed=longpoll it waits for a change when there are none, and it carries
+// on from whatever since the handler returns until the handler returns nil
+// or the store is closed.
+func (s *FileStore) Changes(handler couch.ChangeHandler, options map[string]interface{}) {
+
+	since, err := parseFileStoreSequence(options["since"])
+	if err != nil {
+		log.Printf("Invalid since %v, starting from 0: %v", options["since"], err)
+	}
+	longpoll := options["feed"] == "longpoll"
+
+	for {
+
+		results, lastSequence, changed := s.changesSince(since)
+		if len(results) == 0 && longpoll {
+			select {
+			case <-changed:
+				continue
+			case <-time.After(fileStoreLongpollTimeout):
+			case <-s.closed:
+				return
+			}
+		}
+
+		select {
+		case <-s.closed:
+			return
+		default:
+		}
+
+		changesBytes, err := json.Marshal(map[string]interface{}{
+			"results":  results,
+			"last_seq": lastSequence,
+		})
+		if err != nil {
+			log.Printf("Error encoding changes: %v", err)
+			return
+		}
+
+		next := handler(bytes.NewReader(changesBytes))
+		if next == nil {
+			return
+		}
+		since, err = parseFileStoreSequence(next)
+		if err != nil {
+			log.Printf("Invalid since %v from changes handler: %v", next, err)
+			return
+		}
+
+	}
+
+}
+
+// changesSince returns the changes after since in sequence order, the
+// sequence they go up to, and a channel that's closed on the next change
+func (s *FileStore) changesSince(since int64) (results []fileStoreChange, lastSequence int64, changed chan struct{}) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	results = []fileStoreChange{}
+	for id, entry := range s.index.Docs {
+		if entry.Sequence <= since {
+			continue
+		}
+		results = append(results, fileStoreChange{
+			Sequence: entry.Sequence,
+			Id:       id,
+			Changes:  []map[string]string{{"rev": entry.Revision}},
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Sequence < results[j].Sequence
+	})
+
+	lastSequence = since
+	if len(results) > 0 {
+		lastSequence = results[len(results)-1].Sequence
+	}
+	return results, lastSequence, s.changed
+
+}
+
+func (s *FileStore) RetrieveLocal(id string, doc interface{}) (found bool, err error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	docBytes, err := ioutil.ReadFile(s.localDocPath(id))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(docBytes, doc)
+
+}
+
+// SaveLocal saves the doc if its _rev is the current one.  Local doc
+// revisions are 0-1, 0-2 and so on, as in CouchDB.
+func (s *FileStore) SaveLocal(id string, doc interface{}) error {
+
+	if !validDocId(id) {
+		return fmt.Errorf("Invalid doc id: %q", id)
+	}
+	body, err := toDocBody(doc)
+	if err != nil {
+		return err
+	}
+	rev, _ := body["_rev"].(string)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	current := map[string]interface{}{}
+	docBytes, err := ioutil.ReadFile(s.localDocPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(docBytes, &current); err != nil {
+			return err
+		}
+	}
+	currentRev, _ := current["_rev"].(string)
+	if rev != currentRev {
+		return newStatusError(http.StatusConflict, "409 conflict: _local/%v is at revision %q, not %q", id, currentRev, rev)
+	}
+
+	body["_id"] = "_local/" + id
+	localRevision, _ := strconv.Atoi(strings.TrimPrefix(currentRev, "0-"))
+	body["_rev"] = fmt.Sprintf("0-%v", localRevision+1)
+	docBytes, err = json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(s.localDocPath(id), docBytes)
+
+}
+
+// JobsInStates finds the jobs in the index, in the order they last changed,
+// and reads them from disk
+func (s *FileStore) JobsInStates(states ...string) ([]JobRow, error) {
+
+	wanted := map[string]bool{}
+	for _, state := range states {
+		wanted[state] = true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ids := []string{}
+	for id, entry := range s.index.Docs {
+		if entry.Type == Job && wanted[entry.State] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return s.index.Docs[ids[i]].Sequence < s.index.Docs[ids[j]].Sequence
+	})
+
+	jobs := []JobRow{}
+	for _, id := range ids {
+		jobDoc := JobDocument{}
+		docBytes, err := ioutil.ReadFile(s.docPath(id))
+		if err != nil {
+			return jobs, err
+		}
+		if err := json.Unmarshal(docBytes, &jobDoc); err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, JobRow{Id: id, State: s.index.Docs[id].State, Job: jobDoc})
+	}
+	return jobs, nil
+
+}
+
+// saveIndex writes the index.  Caller must hold the lock.
+func (s *FileStore) saveIndex() error {
+	indexBytes, err := json.Marshal(s.index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(s.indexPath(), indexBytes)
+}
+
+func (s *FileStore) indexPath() string {
+	return filepath.Join(s.Dir, "index.json")
+}
+
+func (s *FileStore) docPath(id string) string {
+	return filepath.Join(s.Dir, "docs", url.PathEscape(id)+".json")
+}
+
+func (s *FileStore) localDocPath(id string) string {
+	return filepath.Join(s.Dir, "local", url.PathEscape(id)+".json")
+}
+
+func (s *FileStore) attachmentDir(docId string) string {
+	return filepath.Join(s.Dir, "attachments", url.PathEscape(docId))
+}
+
+func (s *FileStore) attachmentPath(docId, name string) string {
+	return filepath.Join(s.attachmentDir(docId), url.PathEscape(name))
+}
+
+func (s *FileStore) stagedAttachmentPath(docId, name string) string {
+	return filepath.Join(s.Dir, "staged", url.PathEscape(docId), url.PathEscape(name))
+}
+
+// validDocId rules out ids that CouchDB reserves, and ones that would
+// escape the store's directories
+func validDocId(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.HasPrefix(id, "_")
+}
+
+// toDocBody turns a doc into its JSON fields
+func toDocBody(doc interface{}) (map[string]interface{}, error) {
+	docBytes, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	body := map[string]interface{}{}
+	err = json.Unmarshal(docBytes, &body)
+	return body, err
+}
+
+// nextRevision is the revision after rev for the body: the generation goes
+// up by one, followed by a digest of the body and the previous revision
+func nextRevision(rev string, body map[string]interface{}) (string, error) {
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	digest := md5.Sum(append([]byte(rev), bodyBytes...))
+	return fmt.Sprintf("%v-%v", revisionGeneration(rev)+1, hex.EncodeToString(digest[:])), nil
+}
+
+// revisionGeneration is the number before the dash in a revision, 0 for no
+// revision
+func revisionGeneration(rev string) int {
+	generation, _ := strconv.Atoi(strings.SplitN(rev, "-", 2)[0])
+	return generation
+}
+
+func parseFileStoreSequence(since interface{}) (int64, error) {
+	sinceString := sequenceString(since)
+	if sinceString == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(sinceString, 10, 64)
+}
+
+// writeFileAtomically writes the file to a temp file in the same directory
+// and renames it into place, so a crash never leaves it half written
+func writeFileAtomically(path string, data []byte) error {
+
+	dir, name := filepath.Split(path)
+	tmpFile, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+
+}
@@ -0,0 +1,425 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFileStore(t *testing.T) (*FileStore, func()) {
+	dir, err := ioutil.TempDir("", "deepstyle_store")
+	assert.NoError(t, err)
+	store, err := OpenFileStore(dir)
+	assert.NoError(t, err)
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFileStoreRevisions(t *testing.T) {
+
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	_, rev1, err := store.InsertWith(map[string]interface{}{"type": Job, "state": StateNotReadyToProcess}, "job1")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(rev1, "1-"))
+
+	// the id is taken
+	_, _, err = store.InsertWith(map[string]interface{}{"type": Job}, "job1")
+	assert.True(t, isConflict(err))
+
+	jobDoc := JobDocument{}
+	assert.NoError(t, store.Retrieve("job1", &jobDoc))
+	assert.Equal(t, "job1", jobDoc.Id)
+	assert.Equal(t, rev1, jobDoc.Revision)
+
+	jobDoc.State = StateReadyToProcess
+	rev2, err := store.Edit(jobDoc)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(rev2, "2-"))
+
+	// an update on top of the old revision loses
+	jobDoc.State = StateBeingProcessed
+	_, err = store.Edit(jobDoc)
+	assert.True(t, isConflict(err))
+
+	err = store.Retrieve("missing", &jobDoc)
+	assert.True(t, isNotFound(err))
+
+	// everything is still there after reopening
+	reopened, err := OpenFileStore(store.Dir)
+	assert.NoError(t, err)
+	reread := JobDocument{}
+	assert.NoError(t, reopened.Retrieve("job1", &reread))
+	assert.Equal(t, rev2, reread.Revision)
+	assert.Equal(t, StateReadyToProcess, reread.State)
+	lastSequence, err := reopened.LastSequence()
+	assert.NoError(t, err)
+	assert.Equal(t, "2", lastSequence)
+
+	jobs, err := reopened.JobsInStates(StateReadyToProcess, StateBeingProcessed)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(jobs))
+	assert.Equal(t, JobRow{Id: "job1", State: StateReadyToProcess, Job: reread}, jobs[0])
+
+}
+
+func TestFileStoreAttachments(t *testing.T) {
+
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	// uploads are verified against the digest the store records
+	jobDoc := newTestJob(t, store, "job1", nil)
+	stub := jobDoc.Attachments[SourceImageAttachment].(map[string]interface{})
+	assert.True(t, strings.HasPrefix(stub["digest"].(string), "md5-"))
+	assert.Equal(t, "image/png", stub["content_type"])
+
+	reader, err := store.RetrieveAttachment("job1", SourceImageAttachment)
+	assert.NoError(t, err)
+	_, _, err = image.Decode(reader)
+	assert.NoError(t, err)
+
+	// saving the doc keeps its attachments, whatever _attachments says
+	jobDoc.Attachments = nil
+	_, err = jobDoc.UpdateState(StateBeingProcessed)
+	assert.NoError(t, err)
+	assert.NoError(t, jobDoc.RefreshFromDB())
+	assert.Equal(t, 2, len(jobDoc.Attachments))
+
+	err = store.PutAttachment("job1", "1-stale", ResultImageAttachment, "image/png", strings.NewReader("png"), 3)
+	assert.True(t, isConflict(err))
+
+	_, err = store.RetrieveAttachment("job1", ResultImageAttachment)
+	assert.True(t, isNotFound(err))
+
+	store.AttachmentBaseURL = "http://localhost:8080/jobs"
+	assert.Equal(t, "http://localhost:8080/jobs/job1/result_image", store.AttachmentURL("job1", ResultImageAttachment))
+
+}
+
+func TestFileStoreRecovery(t *testing.T) {
+
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	_, rev1, err := store.InsertWith(map[string]interface{}{"type": Job, "state": StateReadyToProcess}, "job1")
+	assert.NoError(t, err)
+
+	// die during PutAttachment, after the doc was written but before the
+	// index was, and with a staged attachment that never made it in
+	assert.NoError(t, os.MkdirAll(filepath.Dir(store.stagedAttachmentPath("job1", ResultImageAttachment)), 0755))
+	assert.NoError(t, ioutil.WriteFile(store.stagedAttachmentPath("job1", ResultImageAttachment), []byte("png"), 0644))
+	assert.NoError(t, ioutil.WriteFile(store.stagedAttachmentPath("job1", "orphan"), []byte("orphan"), 0644))
+	digest, err := fileDigest(store.stagedAttachmentPath("job1", ResultImageAttachment))
+	assert.NoError(t, err)
+	docBytes, err := json.Marshal(map[string]interface{}{
+		"_id":   "job1",
+		"_rev":  "2-crashed",
+		"type":  Job,
+		"state": StateBeingProcessed,
+		"_attachments": map[string]interface{}{
+			ResultImageAttachment: fileStoreAttachment{ContentType: "image/png", Digest: digest, Length: 3, RevPos: 2, Stub: true},
+		},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, writeFileAtomically(store.docPath("job1"), docBytes))
+
+	reopened, err := OpenFileStore(store.Dir)
+	assert.NoError(t, err)
+	defer reopened.Close()
+
+	// the index caught up with the doc, so it can be edited again, and the
+	// change is on the feed
+	jobDoc := JobDocument{}
+	assert.NoError(t, reopened.Retrieve("job1", &jobDoc))
+	assert.Equal(t, "2-crashed", jobDoc.Revision)
+	_, err = reopened.Edit(map[string]interface{}{"_id": "job1", "_rev": rev1, "type": Job})
+	assert.True(t, isConflict(err))
+	_, err = reopened.Edit(jobDoc)
+	assert.NoError(t, err)
+	lastSequence, err := reopened.LastSequence()
+	assert.NoError(t, err)
+	assert.Equal(t, "3", lastSequence)
+
+	reader, err := reopened.RetrieveAttachment("job1", ResultImageAttachment)
+	assert.NoError(t, err)
+	content, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "png", string(content))
+
+	_, err = os.Stat(reopened.stagedAttachmentPath("job1", "orphan"))
+	assert.True(t, os.IsNotExist(err))
+
+}
+
+func TestFileStoreDelete(t *testing.T) {
+
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	_, rev1, err := store.InsertWith(map[string]interface{}{"type": Job, "state": StateReadyToProcess}, "job1")
+	assert.NoError(t, err)
+	assert.NoError(t, store.PutAttachment("job1", rev1, ResultImageAttachment, "image/png", strings.NewReader("png"), 3))
+	jobDoc := JobDocument{}
+	assert.NoError(t, store.Retrieve("job1", &jobDoc))
+
+	assert.True(t, isConflict(store.Delete("job1", rev1)))
+	assert.NoError(t, store.Delete("job1", jobDoc.Revision))
+	assert.True(t, isNotFound(store.Retrieve("job1", &JobDocument{})))
+	assert.True(t, isNotFound(store.Delete("job1", jobDoc.Revision)))
+	_, err = os.Stat(store.attachmentDir("job1"))
+	assert.True(t, os.IsNotExist(err))
+
+	// die during Delete, after the doc was removed but before the index was
+	_, _, err = store.InsertWith(map[string]interface{}{"type": Job, "state": StateReadyToProcess}, "job2")
+	assert.NoError(t, err)
+	assert.NoError(t, os.Remove(store.docPath("job2")))
+
+	reopened, err := OpenFileStore(store.Dir)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	rows, err := reopened.JobsInStates(StateReadyToProcess)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(rows))
+
+}
+
+func TestFileStoreChanges(t *testing.T) {
+
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	for _, id := range []string{"doc1", "doc2"} {
+		_, _, err := store.InsertWith(map[string]interface{}{"type": "other"}, id)
+		assert.NoError(t, err)
+	}
+	doc := map[string]interface{}{}
+	assert.NoError(t, store.Retrieve("doc1", &doc))
+	_, err := store.Edit(doc)
+	assert.NoError(t, err)
+
+	// each doc once, at its latest sequence
+	batches := make(chan map[string]interface{}, 10)
+	handler := func(reader io.Reader) interface{} {
+		changes := map[string]interface{}{}
+		assert.NoError(t, json.NewDecoder(reader).Decode(&changes))
+		batches <- changes
+		return changes["last_seq"]
+	}
+	go store.Changes(handler, map[string]interface{}{"since": "0", "feed": "longpoll"})
+
+	batch := <-batches
+	results := batch["results"].([]interface{})
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, "doc2", results[0].(map[string]interface{})["id"])
+	assert.Equal(t, "doc1", results[1].(map[string]interface{})["id"])
+	assert.Equal(t, float64(3), batch["last_seq"])
+
+	// the longpoll wakes up for the next change
+	_, _, err = store.InsertWith(map[string]interface{}{"type": "other"}, "doc3")
+	assert.NoError(t, err)
+	select {
+	case batch = <-batches:
+		results = batch["results"].([]interface{})
+		assert.Equal(t, 1, len(results))
+		assert.Equal(t, "doc3", results[0].(map[string]interface{})["id"])
+	case <-time.After(5 * time.Second):
+		t.Errorf("Changes feed never sent doc3")
+	}
+
+}
+
+func TestFileStoreLocalDocs(t *testing.T) {
+
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	checkpoint := SyncGwCheckpointStore{Database: store, DocId: DefaultCheckpointDocId}
+	since, err := checkpoint.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "", since)
+	assert.NoError(t, checkpoint.Save("5"))
+	assert.NoError(t, checkpoint.Save("7"))
+	since, err = checkpoint.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "7", since)
+
+	// a stale _rev is a conflict
+	err = store.SaveLocal(DefaultCheckpointDocId, checkpointDocument{Revision: "0-1", LastSequence: "6"})
+	assert.True(t, isConflict(err))
+
+	// local docs aren't on the changes feed
+	lastSequence, err := store.LastSequence()
+	assert.NoError(t, err)
+	assert.Equal(t, "0", lastSequence)
+
+}
+
+// TestJobAPI runs a job the way deepstyle serve does: submitted over the
+// API, processed by a follower on the file store, and fetched back
+func TestJobAPI(t *testing.T) {
+
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	server := httptest.NewServer(JobAPI{Store: store})
+	defer server.Close()
+	store.AttachmentBaseURL = server.URL + "/jobs"
+
+	follower := ChangesFeedFollower{
+		Database:      store,
+		ProcessJobs:   true,
+		StartingSince: "0",
+		Checkpoint:    FileCheckpointStore{Path: filepath.Join(store.Dir, DefaultCheckpointFile)},
+		Executor:      FakeExecutor{},
+		WorkerId:      "worker1",
+		LeaseDuration: time.Minute,
+		RetryPolicy:   DefaultRetryPolicy(),
+	}
+	followed := make(chan struct{})
+	go func() {
+		follower.Follow()
+		close(followed)
+	}()
+
+	body, contentType := newJobUpload(t)
+	resp, err := http.Post(server.URL+"/jobs", contentType, body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	created := map[string]string{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	resp.Body.Close()
+	jobId := created["id"]
+
+	jobDoc := map[string]interface{}{}
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) && jobDoc["state"] != StateProcessingSuccessful {
+		time.Sleep(10 * time.Millisecond)
+		jobDoc = map[string]interface{}{}
+		resp, err = http.Get(server.URL + "/jobs/" + jobId)
+		assert.NoError(t, err)
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&jobDoc))
+		resp.Body.Close()
+	}
+	assert.Equal(t, StateProcessingSuccessful, jobDoc["state"])
+
+	resp, err = http.Get(server.URL + "/jobs/" + jobId + "/" + ResultImageAttachment)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+	_, _, err = image.Decode(resp.Body)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	resp, err = http.Get(server.URL + "/jobs/missing")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// a finished job can't be cancelled
+	resp, err = http.Post(server.URL+"/jobs/"+jobId+"/cancel", "", nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.NoError(t, store.Retrieve(jobId, &jobDoc))
+	assert.Equal(t, StateProcessingSuccessful, jobDoc["state"])
+
+	// closing the store stops the follower
+	store.Close()
+	select {
+	case <-followed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Follower didn't stop when the store was closed")
+	}
+
+}
+
+// newJobUpload returns the body of a job API POST with a source and style
+// image, and its content type
+func newJobUpload(t *testing.T) (io.Reader, string) {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	assert.NoError(t, form.WriteField("parameters", `{"output_format": "png"}`))
+	for _, attachmentName := range []string{SourceImageAttachment, StyleImageAttachment} {
+		part, err := form.CreateFormFile(attachmentName, attachmentName+".png")
+		assert.NoError(t, err)
+		assert.NoError(t, png.Encode(part, solidImage(4, 4, color.RGBA{R: 200, A: 0xff})))
+	}
+	assert.NoError(t, form.Close())
+	return body, form.FormDataContentType()
+}
+
+// failingAttachmentStore is a store whose attachment uploads fail
+type failingAttachmentStore struct {
+	JobStore
+}
+
+func (s failingAttachmentStore) PutAttachment(docId, rev, name, contentType string, content io.Reader, size int64) error {
+	return fmt.Errorf("Disk full")
+}
+
+func TestJobAPIFailedUpload(t *testing.T) {
+
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	server := httptest.NewServer(JobAPI{Store: failingAttachmentStore{store}})
+	defer server.Close()
+
+	body, contentType := newJobUpload(t)
+	resp, err := http.Post(server.URL+"/jobs", contentType, body)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	// the half-created job isn't left waiting for its images
+	jobs, err := store.JobsInStates(StateNotReadyToProcess, StateProcessingFailed)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(jobs)) {
+		assert.Equal(t, StateProcessingFailed, jobs[0].State)
+		assert.True(t, strings.Contains(jobs[0].Job.ErrorMessage, "Disk full"))
+	}
+
+}
+
+func TestJobAPIToken(t *testing.T) {
+
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	server := httptest.NewServer(JobAPI{Store: store, Token: "secret"})
+	defer server.Close()
+
+	for _, authorization := range []string{"", "secret", "Bearer wrong", "Bearer secret"} {
+		req, err := http.NewRequest("GET", server.URL+"/jobs/missing", nil)
+		assert.NoError(t, err)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		if authorization == "Bearer secret" {
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		} else {
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		}
+	}
+
+}
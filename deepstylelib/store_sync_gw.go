@@ -0,0 +1,141 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/tleyden/go-couch"
+)
+
+// SyncGatewayStore keeps jobs in a Sync Gateway database (backed by
+// Couchbase Server or walrus).  Documents and the changes feed go through
+// go-couch; attachments, _local docs and the unprocessed_jobs view are
+// requests deepstylelib makes itself, with the configured connection.
+type SyncGatewayStore struct {
+	couch.Database
+}
+
+func (s SyncGatewayStore) EditRetry(doc interface{}, retryUpdater func(), retryDoneMetric func() bool, retryRefresh func() error) (updated bool, err error) {
+	return s.Database.EditRetry(doc, retryUpdater, retryDoneMetric, retryRefresh)
+}
+
+// PutAttachment streams the attachment to Sync Gateway.  A stale revision
+// fails with a 409 statusError.
+func (s SyncGatewayStore) PutAttachment(docId, rev, name, contentType string, content io.Reader, size int64) error {
+
+	attachmentUrl := fmt.Sprintf("%v/%v/%v?%v",
+		s.DBURL(),
+		url.PathEscape(docId),
+		url.PathEscape(name),
+		url.Values{"rev": {rev}}.Encode(),
+	)
+	req, err := http.NewRequest("PUT", attachmentUrl, content)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := doRequest(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return newStatusError(resp.StatusCode, "Unable to upload attachment: %v to %v. Unexpected status code in response: %v", name, docId, resp.StatusCode)
+	}
+	return nil
+
+}
+
+func (s SyncGatewayStore) AttachmentURL(docId, name string) string {
+	dbUrl, err := url.Parse(s.DBURL())
+	if err != nil {
+		return ""
+	}
+	dbUrl.User = nil
+	return fmt.Sprintf("%v/%v/%v", dbUrl, url.PathEscape(docId), name)
+}
+
+func (s SyncGatewayStore) RetrieveLocal(id string, doc interface{}) (found bool, err error) {
+
+	req, err := http.NewRequest("GET", s.localDocUrl(id), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := doRequest(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return false, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return false, fmt.Errorf("Unable to retrieve _local/%v.  Unexpected status code in response: %v", id, resp.StatusCode)
+	}
+
+	return true, json.NewDecoder(resp.Body).Decode(doc)
+
+}
+
+func (s SyncGatewayStore) SaveLocal(id string, doc interface{}) error {
+
+	docBytes, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", s.localDocUrl(id), bytes.NewReader(docBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := doRequest(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return newStatusError(resp.StatusCode, "Unable to save _local/%v.  Unexpected status code in response: %v", id, resp.StatusCode)
+	}
+	return nil
+
+}
+
+func (s SyncGatewayStore) localDocUrl(id string) string {
+	return fmt.Sprintf("%v/_local/%v", s.DBURL(), id)
+}
+
+// JobsInStates queries the unprocessed_jobs view, installing it first if
+// it's missing, so only the unprocessed states and CANCEL_REQUESTED can be
+// found
+func (s SyncGatewayStore) JobsInStates(states ...string) ([]JobRow, error) {
+
+	jobs := []JobRow{}
+
+	viewResults, err := getJobsReadyOrBeingProcessed(s)
+	if err != nil {
+		return jobs, err
+	}
+
+	wanted := map[string]bool{}
+	for _, state := range states {
+		wanted[state] = true
+	}
+
+	for _, row := range viewResults.Rows {
+		if wanted[row.Key] {
+			jobs = append(jobs, JobRow{Id: row.Id, State: row.Key, Job: row.Value})
+		}
+	}
+	return jobs, nil
+
+}
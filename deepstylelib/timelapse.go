@@ -0,0 +1,214 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	TimelapseGifAttachment = "timelapse_gif"
+
+	// Snapshots are uploaded as snapshot_00100, snapshot_00200, ..
+	SnapshotAttachmentPrefix = "snapshot_"
+
+	// How often a timelapse job uploads its newest snapshot
+	DefaultSnapshotInterval = 30 * time.Second
+
+	// Stop uploading snapshots after this many, to keep the doc a sane size
+	MaxSnapshots = 50
+)
+
+// Frame delays in the timelapse gif, in 100ths of a second
+const (
+	timelapseFrameDelay = 20
+	timelapseFinalDelay = 300
+)
+
+func snapshotAttachmentName(iteration int) string {
+	return fmt.Sprintf("%v%05d", SnapshotAttachmentPrefix, iteration)
+}
+
+// snapshotUploader watches for the intermediate results an executor writes
+// next to the output file, and uploads the newest one as an attachment at
+// most once per interval.  It keeps the local paths of the snapshots it
+// uploaded, in order, to build the timelapse from.  Uploads happen on its
+// own copy of the doc, like the lease heartbeat.
+type snapshotUploader struct {
+	jobDoc         JobDocument
+	outputFilePath string
+	interval       time.Duration
+
+	mutex         sync.Mutex
+	uploaded      []string
+	lastIteration int
+
+	stopChan chan struct{}
+	doneChan chan struct{}
+	stopOnce sync.Once
+}
+
+func startSnapshotUploader(jobDoc JobDocument, outputFilePath string, interval time.Duration) *snapshotUploader {
+
+	if interval <= 0 {
+		interval = DefaultSnapshotInterval
+	}
+
+	u := &snapshotUploader{
+		jobDoc:         jobDoc,
+		outputFilePath: outputFilePath,
+		interval:       interval,
+		stopChan:       make(chan struct{}),
+		doneChan:       make(chan struct{}),
+	}
+
+	go func() {
+		defer close(u.doneChan)
+		for {
+			select {
+			case <-u.stopChan:
+				return
+			case <-time.After(u.interval):
+			}
+			u.uploadNewest()
+		}
+	}()
+
+	return u
+
+}
+
+// stop waits for any upload in progress, and returns the local paths of
+// the snapshots that were uploaded.  Safe to call more than once.
+func (u *snapshotUploader) stop() (uploaded []string) {
+	u.stopOnce.Do(func() {
+		close(u.stopChan)
+		<-u.doneChan
+	})
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return append([]string{}, u.uploaded...)
+}
+
+func (u *snapshotUploader) uploadNewest() {
+
+	u.mutex.Lock()
+	lastIteration, numUploaded := u.lastIteration, len(u.uploaded)
+	u.mutex.Unlock()
+
+	if numUploaded >= MaxSnapshots {
+		return
+	}
+
+	snapshotPath, iteration, ok := newestIntermediateResult(u.outputFilePath)
+	if !ok || iteration <= lastIteration {
+		return
+	}
+
+	// the executor may still be writing it, try again next time
+	if _, err := decodeImageFile(snapshotPath); err != nil {
+		return
+	}
+
+	if err := u.jobDoc.AddAttachment(snapshotAttachmentName(iteration), snapshotPath); err != nil {
+		log.Printf("Unable to upload snapshot %v of job %v: %v", iteration, u.jobDoc.Id, err)
+		return
+	}
+
+	u.mutex.Lock()
+	u.uploaded = append(u.uploaded, snapshotPath)
+	u.lastIteration = iteration
+	u.mutex.Unlock()
+
+}
+
+// buildTimelapseGif writes an animated gif of the frames, in order, to
+// gifPath.  Every frame is scaled to the size of the last one, which is
+// the final result, and held a little longer.
+func buildTimelapseGif(framePaths []string, gifPath string) error {
+
+	if len(framePaths) == 0 {
+		return fmt.Errorf("No frames for timelapse")
+	}
+
+	frames := []image.Image{}
+	for _, framePath := range framePaths {
+		frame, err := decodeImageFile(framePath)
+		if err != nil {
+			return err
+		}
+		frames = append(frames, frame)
+	}
+
+	bounds := frames[len(frames)-1].Bounds()
+	bounds = bounds.Sub(bounds.Min)
+
+	animation := &gif.GIF{}
+	for i, frame := range frames {
+		paletted := image.NewPaletted(bounds, palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, bounds, scaleImage(frame, bounds), image.Point{})
+		delay := timelapseFrameDelay
+		if i == len(frames)-1 {
+			delay = timelapseFinalDelay
+		}
+		animation.Image = append(animation.Image, paletted)
+		animation.Delay = append(animation.Delay, delay)
+	}
+
+	f, err := os.Create(gifPath)
+	if err != nil {
+		return err
+	}
+	if err := gif.EncodeAll(f, animation); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+
+}
+
+// attachTimelapse builds the timelapse from the snapshots and the final
+// result and attaches it to the job.  A job without a timelapse is still a
+// success, so errors are only logged.
+func (d DeepStyleJob) attachTimelapse(jobDoc *JobDocument, snapshotPaths []string, outputFilePath string) {
+
+	gifPath := d.timelapseFilePath()
+	framePaths := append(snapshotPaths, outputFilePath)
+
+	if err := buildTimelapseGif(framePaths, gifPath); err != nil {
+		log.Printf("Unable to build timelapse for job %v: %v", jobDoc.Id, err)
+		return
+	}
+	if err := jobDoc.AddAttachment(TimelapseGifAttachment, gifPath); err != nil {
+		log.Printf("Unable to attach timelapse to job %v: %v", jobDoc.Id, err)
+	}
+
+}
+
+// scaleImage does a nearest neighbour resize of img to bounds, unless it
+// is already that size
+func scaleImage(img image.Image, bounds image.Rectangle) image.Image {
+
+	imgBounds := img.Bounds()
+	if imgBounds.Dx() == bounds.Dx() && imgBounds.Dy() == bounds.Dy() {
+		return img
+	}
+
+	scaled := image.NewRGBA(bounds)
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			scaled.Set(x, y, img.At(
+				imgBounds.Min.X+x*imgBounds.Dx()/bounds.Dx(),
+				imgBounds.Min.Y+y*imgBounds.Dy()/bounds.Dy(),
+			))
+		}
+	}
+	return scaled
+
+}
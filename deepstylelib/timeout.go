@@ -0,0 +1,95 @@
+package deepstylelib
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Attempt outcome for a job that ran past its time limit
+const AttemptOutcomeTimedOut = "TIMED_OUT"
+
+// Longest time limit a job can ask for
+const MaxJobTimeout = 24 * time.Hour
+
+// TimeoutError is returned by an executor when the job ran past its time
+// limit and was killed.
+type TimeoutError struct {
+	Limit                  time.Duration // the limit that was hit
+	PartialResultIteration int           // iteration of the partial result uploaded, 0 if none
+}
+
+func (e *TimeoutError) Error() string {
+	if e.PartialResultIteration > 0 {
+		return fmt.Sprintf("Timed out after %v, kept partial result from iteration %v", e.Limit, e.PartialResultIteration)
+	}
+	return fmt.Sprintf("Timed out after %v with no partial result", e.Limit)
+}
+
+// JobTimeout is stored on a job that timed out
+type JobTimeout struct {
+	LimitSeconds           int `json:"limit_seconds"`
+	PartialResultIteration int `json:"partial_result_iteration,omitempty"`
+}
+
+// timeoutExecutor enforces the backend wide time limit from ExecutorConfig
+type timeoutExecutor struct {
+	Executor
+	timeout time.Duration
+}
+
+func (e timeoutExecutor) Execute(ctx context.Context, req StyleTransferRequest) (stdOutAndErr []byte, err error) {
+	return executeWithTimeout(ctx, e.Executor, req, e.timeout)
+}
+
+// executeWithTimeout runs the executor with a deadline of timeout, and turns
+// hitting that deadline into a *TimeoutError.  A done parent ctx is passed
+// through as is, so cancellation isn't mistaken for a timeout.
+func executeWithTimeout(ctx context.Context, executor Executor, req StyleTransferRequest, timeout time.Duration) (stdOutAndErr []byte, err error) {
+
+	if timeout <= 0 {
+		return executor.Execute(ctx, req)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stdOutAndErr, err = executor.Execute(timeoutCtx, req)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return stdOutAndErr, &TimeoutError{Limit: timeout}
+	}
+	return stdOutAndErr, err
+
+}
+
+// newestIntermediateResult finds the latest intermediate image written next
+// to outputFilePath.  neural-style saves one every -save_iter iterations,
+// named like the output with the iteration appended, eg result_200.jpg for
+// result.jpg, and other executors are expected to follow the same scheme.
+func newestIntermediateResult(outputFilePath string) (path string, iteration int, ok bool) {
+
+	ext := filepath.Ext(outputFilePath)
+	prefix := strings.TrimSuffix(outputFilePath, ext) + "_"
+
+	matches, err := filepath.Glob(prefix + "*" + ext)
+	if err != nil {
+		return "", 0, false
+	}
+
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(match, prefix), ext)
+		matchIteration, err := strconv.Atoi(suffix)
+		if err != nil || matchIteration <= 0 {
+			continue
+		}
+		if matchIteration > iteration {
+			path, iteration = match, matchIteration
+		}
+	}
+
+	return path, iteration, iteration > 0
+
+}
@@ -1,7 +1,10 @@
 package deepstylelib
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
@@ -10,7 +13,9 @@ import (
 	"github.com/tleyden/go-couch"
 )
 
-func GetDbConnection(syncGatewayUrl string) (db couch.Database, err error) {
+// GetDbConnection connects to the Sync Gateway database at the url, with the
+// configured credentials
+func GetDbConnection(syncGatewayUrl string) (db SyncGatewayStore, err error) {
 
 	// if it has a trailing slash, remove it
 	rawUrl := strings.TrimSuffix(syncGatewayUrl, "/")
@@ -18,22 +23,95 @@ func GetDbConnection(syncGatewayUrl string) (db couch.Database, err error) {
 	// url validation
 	url, err := url.Parse(rawUrl)
 	if err != nil {
-		return couch.Database{}, err
+		return SyncGatewayStore{}, err
 	}
 
-	return couch.Connect(url.String())
+	// add any configured credentials
+	authenticateUrl(url)
 
+	database, err := couch.Connect(url.String())
+	return SyncGatewayStore{Database: database}, err
+
+}
+
+// OpenJobStore connects to the database at the url as the configured
+// flavor: Sync Gateway, or Apache CouchDB
+func OpenJobStore(dbUrl string) (JobStore, error) {
+
+	db, err := GetDbConnection(dbUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	connectionMutex.RLock()
+	flavor := connectionConfig.Flavor
+	connectionMutex.RUnlock()
+
+	if flavor == FlavorCouchDB {
+		return CouchDBStore{SyncGatewayStore: db}, nil
+	}
+	return db, nil
+
+}
+
+// DefaultWorkerId identifies this process as hostname:pid
+func DefaultWorkerId() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%v:%v", hostname, os.Getpid())
 }
 
-func writeToFile(reader io.Reader, destFilename string) error {
+// statusError is an error response from the database.  Errors are told
+// apart by its status code, never by their text, which can contain doc ids
+// and urls with anything in them.
+type statusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *statusError) Error() string {
+	return e.Message
+}
+
+func newStatusError(statusCode int, format string, args ...interface{}) error {
+	return &statusError{StatusCode: statusCode, Message: fmt.Sprintf(format, args...)}
+}
+
+// statusCode returns the status code of an error response from the
+// database, whether from a JobStore or go-couch, or 0 if err isn't one, eg
+// because the database couldn't be reached
+func statusCode(err error) int {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
+	}
+	var couchErr *couch.HttpError
+	if errors.As(err, &couchErr) {
+		return couchErr.Status
+	}
+	return 0
+}
+
+// isNotFound returns true if err is a 404, eg the doc was deleted
+func isNotFound(err error) bool {
+	return statusCode(err) == http.StatusNotFound
+}
+
+// isConflict returns true if err is a 409 document update conflict
+func isConflict(err error) bool {
+	return statusCode(err) == http.StatusConflict
+}
+
+func writeToFile(reader io.Reader, destFilename string) (written int64, err error) {
 
 	destFile, err := os.Create(destFilename)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer destFile.Close()
-	_, err = io.Copy(destFile, reader)
-	return err
+	return io.Copy(destFile, reader)
 
 }
 
@@ -52,6 +130,24 @@ func hasGPU() bool {
 	return true
 }
 
+// numGPUs returns how many GPUs nvidia-smi can see, or 0 if there are none
+func numGPUs() int {
+
+	output, err := exec.Command("nvidia-smi", "-L").Output()
+	if err != nil {
+		return 0
+	}
+
+	numGPUs := 0
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "GPU ") {
+			numGPUs += 1
+		}
+	}
+	return numGPUs
+
+}
+
 func torchInstalled() bool {
 
 	cmd := exec.Command("th", "--help")
@@ -67,22 +163,3 @@ func torchInstalled() bool {
 	return true
 
 }
-
-func cp(dst, src string) error {
-	s, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	// no need to check errors on read only file, we already got everything
-	// we need from the filesystem, so nothing can go wrong now.
-	defer s.Close()
-	d, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	if _, err := io.Copy(d, s); err != nil {
-		d.Close()
-		return err
-	}
-	return d.Close()
-}
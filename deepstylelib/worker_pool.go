@@ -0,0 +1,272 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/couchbaselabs/logg"
+	"github.com/tleyden/go-couch"
+)
+
+const (
+	DefaultNumNotificationWorkers = 4
+
+	// How many dispatched-but-unstarted items each pool will hold before
+	// the changes feed blocks waiting for a free worker.
+	DefaultWorkQueueSize = 1000
+)
+
+// Pool names, used to track which docs are in flight in each pool
+const (
+	jobPool          = "job"
+	notificationPool = "notification"
+)
+
+// followerPool hands changes off from the feed goroutine to a pool of job
+// workers and a separate pool of notification workers.
+type followerPool struct {
+	follower      ChangesFeedFollower
+	jobs          chan poolWork
+	notifications chan poolWork
+	tracker       *sequenceTracker
+
+	inFlightMutex sync.Mutex
+	inFlight      map[string]bool // "pool:docid" for docs queued or running
+}
+
+type poolWork struct {
+	jobDoc   JobDocument
+	sequence *trackedSequence
+}
+
+func newFollowerPool(follower ChangesFeedFollower) *followerPool {
+	return &followerPool{
+		follower:      follower,
+		jobs:          make(chan poolWork, DefaultWorkQueueSize),
+		notifications: make(chan poolWork, DefaultWorkQueueSize),
+		tracker:       newSequenceTracker(follower.Checkpoint),
+		inFlight:      map[string]bool{},
+	}
+}
+
+func (p *followerPool) start() {
+
+	numJobWorkers := p.follower.NumJobWorkers
+	numGPUs := numGPUs()
+	if numJobWorkers <= 0 {
+		numJobWorkers = numGPUs
+	}
+	if numJobWorkers <= 0 {
+		numJobWorkers = 1
+	}
+
+	numNotificationWorkers := p.follower.NumNotificationWorkers
+	if numNotificationWorkers <= 0 {
+		numNotificationWorkers = DefaultNumNotificationWorkers
+	}
+
+	if p.follower.ProcessJobs {
+		log.Printf("Starting %v job workers (%v GPUs)", numJobWorkers, numGPUs)
+		for i := 0; i < numJobWorkers; i++ {
+			// spread the workers across the GPUs
+			gpuIndex := 0
+			if numGPUs > 0 {
+				gpuIndex = i % numGPUs
+			}
+			go p.jobWorker(gpuIndex)
+		}
+	}
+
+	if p.follower.SendNotifications {
+		log.Printf("Starting %v notification workers", numNotificationWorkers)
+		for i := 0; i < numNotificationWorkers; i++ {
+			go p.notificationWorker()
+		}
+	}
+
+}
+
+// dispatchChanges queues the work for each change and returns without
+// waiting for it to run.  The checkpoint is advanced by the tracker as the
+// work finishes.
+func (p *followerPool) dispatchChanges(changes couch.Changes) {
+
+	for _, change := range changes.Results {
+		sequence := p.tracker.add(sequenceString(change.Sequence))
+		if err := p.dispatchChange(change, sequence); err != nil {
+			errMsg := fmt.Errorf("Error %v processing change %v", err, change)
+			logg.LogError(errMsg)
+			p.tracker.done(sequence)
+		}
+	}
+
+	// nothing to do for the batch's last_seq itself, but it can only be
+	// checkpointed once everything before it is done.
+	if lastSequence := sequenceString(changes.LastSequence); lastSequence != "" {
+		p.tracker.done(p.tracker.add(lastSequence))
+	}
+
+}
+
+func (p *followerPool) dispatchChange(change couch.Change, sequence *trackedSequence) error {
+
+	if change.Deleted {
+		p.follower.cancelDeletedJob(change.Id)
+		p.tracker.done(sequence)
+		return nil
+	}
+
+	jobDoc, err := p.follower.retrieveJobDoc(change)
+	if err != nil {
+		return err
+	}
+	if jobDoc == nil {
+		p.tracker.done(sequence)
+		return nil
+	}
+
+	// cancellation is quick, so handle it right here on the feed goroutine
+	if jobDoc.IsCancelRequested() {
+		if err := p.follower.cancelJob(*jobDoc); err != nil {
+			return err
+		}
+		p.tracker.done(sequence)
+		return nil
+	}
+
+	work := poolWork{
+		jobDoc:   *jobDoc,
+		sequence: sequence,
+	}
+
+	switch {
+	case p.follower.ProcessJobs && jobDoc.IsReadyToProcess():
+		if !p.markInFlight(jobPool, jobDoc.Id) {
+			log.Printf("Job %v is already queued or running, skipping", jobDoc.Id)
+			p.tracker.done(sequence)
+			return nil
+		}
+		p.jobs <- work
+	case p.follower.SendNotifications && p.follower.shouldNotify(*jobDoc):
+		if !p.markInFlight(notificationPool, jobDoc.Id) {
+			p.tracker.done(sequence)
+			return nil
+		}
+		p.notifications <- work
+	default:
+		p.tracker.done(sequence)
+	}
+
+	return nil
+
+}
+
+func (p *followerPool) jobWorker(gpuIndex int) {
+
+	for work := range p.jobs {
+
+		// the job may have been picked up elsewhere while it was queued
+		jobDoc := work.jobDoc
+		jobDoc.SetConfiguration(configuration{Database: p.follower.Database})
+		if err := jobDoc.RefreshFromDB(); err != nil {
+			logg.LogError(fmt.Errorf("Error %v refreshing job %v", err, jobDoc.Id))
+		} else if jobDoc.IsReadyToProcess() {
+			if err := p.follower.processJob(jobDoc, gpuIndex); err != nil {
+				logg.LogError(fmt.Errorf("Error %v processing job %v", err, jobDoc.Id))
+			}
+		}
+
+		p.clearInFlight(jobPool, jobDoc.Id)
+		p.tracker.done(work.sequence)
+	}
+
+}
+
+func (p *followerPool) notificationWorker() {
+
+	for work := range p.notifications {
+
+		if err := p.follower.sendNotifications(work.jobDoc); err != nil {
+			logg.LogError(fmt.Errorf("Error %v sending notification for %v", err, work.jobDoc.Id))
+		}
+
+		p.clearInFlight(notificationPool, work.jobDoc.Id)
+		p.tracker.done(work.sequence)
+	}
+
+}
+
+// markInFlight returns false if the doc is already queued or running in
+// the given pool.
+func (p *followerPool) markInFlight(pool, docId string) bool {
+	p.inFlightMutex.Lock()
+	defer p.inFlightMutex.Unlock()
+	key := pool + ":" + docId
+	if p.inFlight[key] {
+		return false
+	}
+	p.inFlight[key] = true
+	return true
+}
+
+func (p *followerPool) clearInFlight(pool, docId string) {
+	p.inFlightMutex.Lock()
+	defer p.inFlightMutex.Unlock()
+	delete(p.inFlight, pool+":"+docId)
+}
+
+// sequenceTracker keeps the changes feed sequences that have been
+// dispatched, in feed order, and checkpoints the latest one for which it and
+// everything before it is done.  Sequences are never compared, only ordered
+// by arrival, so compound Sync Gateway sequences work fine.
+type sequenceTracker struct {
+	mutex      sync.Mutex
+	pending    []*trackedSequence
+	checkpoint CheckpointStore
+}
+
+type trackedSequence struct {
+	sequence string
+	done     bool
+}
+
+func newSequenceTracker(checkpoint CheckpointStore) *sequenceTracker {
+	return &sequenceTracker{
+		checkpoint: checkpoint,
+	}
+}
+
+func (t *sequenceTracker) add(sequence string) *trackedSequence {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	trackedSeq := &trackedSequence{sequence: sequence}
+	t.pending = append(t.pending, trackedSeq)
+	return trackedSeq
+}
+
+func (t *sequenceTracker) done(trackedSeq *trackedSequence) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	trackedSeq.done = true
+
+	// pop everything that's done from the front of the line
+	lastDone := ""
+	for len(t.pending) > 0 && t.pending[0].done {
+		if t.pending[0].sequence != "" {
+			lastDone = t.pending[0].sequence
+		}
+		t.pending = t.pending[1:]
+	}
+
+	if lastDone == "" || t.checkpoint == nil {
+		return
+	}
+	if err := t.checkpoint.Save(lastDone); err != nil {
+		errMsg := fmt.Errorf("Error %v saving checkpoint %v", err, lastDone)
+		logg.LogError(errMsg)
+	}
+
+}